@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	chi "gopkg.in/chi.v3"
+	"within.website/ln"
+)
+
+const (
+	defaultSignedURLTTL = time.Hour
+	maxSignedURLTTL     = 7 * 24 * time.Hour
+)
+
+// validAPIToken checks the bearer token of r against the configured API tokens.
+func (s *site) validAPIToken(r *http.Request) bool {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return false
+	}
+	tok := []byte(strings.TrimPrefix(h, "Bearer "))
+
+	for _, t := range s.cfg.APITokens {
+		if t == "" {
+			continue
+		}
+
+		if subtle.ConstantTimeCompare(tok, []byte(t)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isAuthed lets requests through that have either a valid session or a valid
+// API token. Requests with a bad API token are rejected outright, everything
+// else falls back to isLoggedIn.
+func (s *site) isAuthed(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			if !s.validAPIToken(r) {
+				http.Error(w, "invalid api token", http.StatusUnauthorized)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		s.isLoggedIn(next).ServeHTTP(w, r)
+	})
+}
+
+// isSignedOrAuthed lets requests through that carry a valid signature for the
+// image in the URL, falling back to isAuthed.
+func (s *site) isSignedOrAuthed(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("sig") == "" {
+			s.isAuthed(next).ServeHTTP(w, r)
+			return
+		}
+
+		exp, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid signature", http.StatusForbidden)
+			return
+		}
+
+		if time.Now().Unix() > exp {
+			http.Error(w, "signature expired", http.StatusForbidden)
+			return
+		}
+
+		id := chi.URLParam(r, "id")
+		if !s.keys.Verify(imageSignatureMessage(id, exp), q.Get("sig")) {
+			ln.Log(r.Context(), ln.Action("rejecting bad image signature"), ln.F{"image_id": id})
+			http.Error(w, "invalid signature", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func imageSignatureMessage(id string, expires int64) []byte {
+	return []byte("img:" + id + ":" + strconv.FormatInt(expires, 10))
+}
+
+// signedImageURL returns a path for the raw image data of id that is valid
+// without a session until expires.
+func (s *site) signedImageURL(id string, expires time.Time) string {
+	exp := expires.Unix()
+
+	v := url.Values{}
+	v.Set("expires", strconv.FormatInt(exp, 10))
+	v.Set("sig", s.keys.Sign(imageSignatureMessage(id, exp)))
+
+	return "/images/id/" + id + "/img?" + v.Encode()
+}
+
+func (s *site) signImage(w http.ResponseWriter, r *http.Request) {
+	i, ok := s.visible(r, chi.URLParam(r, "id"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	var err error
+	ttl := defaultSignedURLTTL
+	if t := r.URL.Query().Get("ttl"); t != "" {
+		ttl, err = time.ParseDuration(t)
+		if err != nil || ttl <= 0 || ttl > maxSignedURLTTL {
+			http.Error(w, "ttl must be a duration between 0 and "+maxSignedURLTTL.String(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	expires := time.Now().Add(ttl)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		URL     string    `json:"url"`
+		Expires time.Time `json:"expires"`
+	}{
+		URL:     s.signedImageURL(i.ID, expires),
+		Expires: expires,
+	})
+}
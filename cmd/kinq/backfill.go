@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"time"
+
+	"github.com/Xe/kinq/internal/backfill"
+	"github.com/Xe/kinq/internal/database"
+	"github.com/Xe/kinq/internal/discord"
+	"github.com/Xe/kinq/internal/ingest"
+	"github.com/bwmarrin/discordgo"
+	"within.website/ln"
+)
+
+// backfillMessage queues the URLs in an old message, unless it was seen
+// before.
+func (s *site) backfillMessage(ctx context.Context, m *discordgo.Message) error {
+	seen, err := s.q.HasMessage(m.ID)
+	if err != nil {
+		return err
+	}
+	if seen {
+		return nil
+	}
+
+	s.enqueueMessage(ctx, m, true)
+	return nil
+}
+
+func (s *site) newBackfiller() *backfill.Backfiller {
+	return backfill.New(s.dg, s.cursors, s.backfillMessage)
+}
+
+// parseSince accepts a date or a full RFC 3339 time.
+func parseSince(since string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", since); err == nil {
+		return t, nil
+	}
+
+	return time.Parse(time.RFC3339, since)
+}
+
+// backfillCommand queues everything posted in monitored channels since a
+// date, or since the last message kinq saw there. The queued jobs are worked
+// on the next time kinq serves.
+func backfillCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("backfill", flag.ExitOnError)
+	channel := fs.String("channel", "", "channel to backfill, defaults to every monitored channel")
+	since := fs.String("since", "", "date (2006-01-02) or time to start at, defaults to the last message seen")
+	fs.Parse(args)
+
+	cfg, db, err := setup()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	dg, err := discordgo.New("Bot " + cfg.DiscordKey)
+	if err != nil {
+		return err
+	}
+
+	s := &site{
+		cfg:      cfg,
+		db:       db,
+		dg:       dg,
+		cursors:  database.NewStormCursors(db),
+		channels: database.NewStormChannels(db),
+		q:        ingest.New(db, nil, ingest.Config{}),
+	}
+
+	channels := []string{*channel}
+	if *channel == "" {
+		s.seedChannels(ctx)
+
+		channels, err = s.monitoredChannels()
+		if err != nil {
+			return err
+		}
+	}
+
+	var after string
+	if *since != "" {
+		t, err := parseSince(*since)
+		if err != nil {
+			return err
+		}
+		after = discord.SnowflakeAt(t)
+	}
+
+	b := s.newBackfiller()
+	for _, id := range channels {
+		start := after
+		if start == "" {
+			start, err = s.cursors.Get(id)
+			if err != nil {
+				return err
+			}
+			if start == "" {
+				return errors.New("backfill: channel " + id + " has never been read, give --since")
+			}
+		}
+
+		n, err := b.Channel(ctx, id, start)
+		if err != nil {
+			return err
+		}
+
+		ln.Log(ctx, ln.Action("backfilled channel"), ln.F{"channel_id": id, "messages": n})
+	}
+
+	return nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/Xe/kinq/internal/backup"
+	"github.com/Xe/kinq/internal/events"
+	"github.com/caarlos0/env"
+	bolt "go.etcd.io/bbolt"
+	"within.website/ln"
+)
+
+// startBackups snapshots the database to BACKUP_DIR on a schedule, if it is
+// set. A BACKUP_INTERVAL of zero leaves only snapshots made from the admin
+// page.
+func (s *site) startBackups(ctx context.Context) {
+	if s.cfg.BackupDir == "" {
+		return
+	}
+
+	s.backups = backup.New(s.db.Bolt, backup.Config{
+		Dir:       s.cfg.BackupDir,
+		Interval:  s.cfg.BackupInterval,
+		Keep:      s.cfg.BackupKeep,
+		FullEvery: s.cfg.BackupFullEvery,
+		Ignore:    []string{logBucket},
+	})
+
+	if s.cfg.BackupInterval <= 0 {
+		return
+	}
+
+	go s.backups.Run(ctx, func(snap *backup.Snapshot, err error) {
+		s.backupDone(ctx, snap, err)
+	})
+
+	ln.Log(ctx, ln.Action("scheduled backups"), ln.F{"dir": s.cfg.BackupDir, "interval": s.cfg.BackupInterval})
+}
+
+// backupDone logs and publishes how a snapshot went. A nil snapshot without
+// an error means nothing changed since the last one.
+func (s *site) backupDone(ctx context.Context, snap *backup.Snapshot, err error) {
+	switch {
+	case err != nil:
+		ln.Error(ctx, err, ln.Action("snapshotting database"))
+		s.events.Publish(ctx, events.Event{
+			Kind:    events.BackupFailed,
+			Summary: fmt.Sprintf("couldn't back up the database: %v", err),
+			Fields:  map[string]string{"error": err.Error()},
+		})
+	case snap == nil:
+		ln.Log(ctx, ln.Action("database unchanged, not snapshotting"))
+	default:
+		ln.Log(ctx, snap, ln.Action("snapshotted database"))
+		s.events.Publish(ctx, events.Event{
+			Kind:    events.BackupDone,
+			Summary: fmt.Sprintf("backed up the database to %s (%d bytes)", snap.Name, snap.Size),
+			Fields: map[string]string{
+				"name":   snap.Name,
+				"size":   strconv.FormatInt(snap.Size, 10),
+				"sha256": snap.SHA256,
+			},
+		})
+	}
+}
+
+func (s *site) listBackups(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		Subtitle  string
+		Enabled   bool
+		Dir       string
+		Keep      int
+		FullEvery int
+		Snapshots []backup.Snapshot
+	}{
+		Subtitle:  "backups",
+		Enabled:   s.backups != nil,
+		Dir:       s.cfg.BackupDir,
+		Keep:      s.cfg.BackupKeep,
+		FullEvery: s.cfg.BackupFullEvery,
+	}
+
+	if s.backups != nil {
+		snaps, err := s.backups.List()
+		if err != nil {
+			ln.Error(r.Context(), err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data.Snapshots = snaps
+	}
+
+	s.renderTemplatePage("backups.html", &data).ServeHTTP(w, r)
+}
+
+func (s *site) snapshotNow(w http.ResponseWriter, r *http.Request) {
+	if s.backups == nil {
+		http.Error(w, "set BACKUP_DIR to make snapshots", http.StatusNotFound)
+		return
+	}
+
+	snap, err := s.backups.Snapshot(r.Context())
+	s.backupDone(r.Context(), snap, err)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/backups", http.StatusSeeOther)
+}
+
+// restoreCommand checks a snapshot and puts it in place of the database.
+// Without a snapshot it lists the ones in BACKUP_DIR.
+func restoreCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	check := fs.Bool("check", false, "only verify the snapshot, don't restore it")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s restore [flags] [snapshot]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	var cfg config
+	err := env.Parse(&cfg)
+	if err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 {
+		if cfg.BackupDir == "" {
+			fs.Usage()
+			return errors.New("restore: give a snapshot or set BACKUP_DIR to list them")
+		}
+
+		snaps, err := backup.List(cfg.BackupDir)
+		if err != nil {
+			return err
+		}
+		for _, snap := range snaps {
+			fmt.Printf("%s\t%d bytes\ttx %d\t%s\n", snap.Path, snap.Size, snap.TxID, snap.SHA256)
+		}
+		return nil
+	}
+
+	snapshot := fs.Arg(0)
+	if *check {
+		err = backup.Verify(snapshot)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s is intact\n", snapshot)
+		return nil
+	}
+
+	previous, err := backup.Restore(snapshot, cfg.DBPath)
+	if err != nil {
+		return err
+	}
+
+	ln.Log(ctx, ln.Action("restored database"), ln.F{"snapshot": snapshot, "db_path": cfg.DBPath, "previous": previous})
+	fmt.Printf("restored %s, the old database is at %s\n", snapshot, previous)
+	return nil
+}
+
+// downloadBackup sends a copy of the database. It holds every guild's images
+// and the sessions of every user, so only admins may download it.
+func (s *site) downloadBackup(w http.ResponseWriter, r *http.Request) {
+	var size int64
+	err := s.db.Bolt.View(func(tx *bolt.Tx) error {
+		size = tx.Size()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", `attachment; filename="kinq.db"`)
+		w.Header().Set("Content-Length", strconv.Itoa(int(size)))
+		_, err := tx.WriteTo(w)
+		return err
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sd, _ := currentSession(r.Context())
+	by := sd.UserID
+
+	s.events.Publish(r.Context(), events.Event{
+		Kind:    events.BackupDone,
+		Summary: fmt.Sprintf("%s downloaded a backup of %d bytes", by, size),
+		Fields:  map[string]string{"size": strconv.FormatInt(size, 10), "by": by},
+	})
+}
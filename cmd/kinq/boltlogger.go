@@ -11,6 +11,9 @@ import (
 	"within.website/ln"
 )
 
+// logBucket is the bucket the server logs to.
+const logBucket = "ln"
+
 type boltLogger struct {
 	db         *bbolt.DB
 	g          sandflake.Generator
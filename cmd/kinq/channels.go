@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Xe/kinq/internal/database"
+	"github.com/Xe/kinq/internal/discord"
+	"github.com/asdine/storm/v2"
+	chi "gopkg.in/chi.v3"
+	"within.website/ln"
+)
+
+// monitored returns true if every message in a channel is archived.
+func (s *site) monitored(channelID string) bool {
+	c, err := s.channels.One(channelID)
+	if err != nil {
+		ln.Error(context.Background(), err, ln.F{"channel_id": channelID})
+		return false
+	}
+
+	return c != nil && c.Monitored
+}
+
+// monitoredChannels returns the IDs of every monitored channel.
+func (s *site) monitoredChannels() ([]string, error) {
+	cs, err := s.channels.Monitored()
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, c := range cs {
+		ids = append(ids, c.ChannelID)
+	}
+
+	return ids, nil
+}
+
+// seedChannels adds the channels in DISCORD_MONITOR_CHANNELS when no
+// channel has a config yet, so existing deployments keep working. After
+// that, channels are managed in the admin UI and the variable is ignored,
+// so channels removed there stay removed.
+func (s *site) seedChannels(ctx context.Context) {
+	existing, err := s.channels.List()
+	if err != nil {
+		ln.Error(ctx, err, ln.Action("listing channel configs"))
+		return
+	}
+	if len(existing) > 0 {
+		return
+	}
+
+	for _, id := range s.cfg.DiscordMonitorChannels {
+		c := &database.ChannelConfig{
+			ChannelID: id,
+			Monitored: true,
+			UpdatedBy: "DISCORD_MONITOR_CHANNELS",
+		}
+		if ch, err := s.channel(id); err == nil {
+			c.GuildID = ch.GuildID
+			c.Name = ch.Name
+		}
+
+		err := s.channels.Put(c)
+		if err != nil {
+			ln.Error(ctx, err, c, ln.Action("seeding channel config"))
+			continue
+		}
+
+		ln.Log(ctx, c, ln.Action("seeded channel config"))
+	}
+}
+
+// catchUpChannel reads what was posted in a channel that was just
+// monitored since kinq last read it. A channel kinq never read starts from
+// now; its older history needs kinq backfill.
+func (s *site) catchUpChannel(ctx context.Context, id string) {
+	f := ln.F{"channel_id": id}
+
+	after, err := s.cursors.Get(id)
+	if err != nil {
+		ln.Error(ctx, err, f, ln.Action("getting channel cursor"))
+		return
+	}
+
+	if after == "" {
+		err = s.cursors.Advance(id, discord.SnowflakeAt(time.Now()))
+		if err != nil {
+			ln.Error(ctx, err, f, ln.Action("starting channel cursor"))
+		}
+		return
+	}
+
+	s.newBackfiller().CatchUp(ctx, []string{id})
+}
+
+// splitList splits a form field on commas and whitespace.
+func splitList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n' || r == '\r' || r == '\t'
+	})
+}
+
+func (s *site) listChannels(w http.ResponseWriter, r *http.Request) {
+	cs, err := s.channels.List()
+	if err != nil {
+		ln.Error(r.Context(), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Subtitle string
+		Channels []database.ChannelConfig
+	}{
+		Subtitle: "channels",
+		Channels: cs,
+	}
+
+	s.renderTemplatePage("channels.html", &data).ServeHTTP(w, r)
+}
+
+// putChannel creates or replaces the config of a channel.
+func (s *site) putChannel(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSpace(r.FormValue("channel_id"))
+	if id == "" {
+		http.Error(w, "channel_id is required", http.StatusBadRequest)
+		return
+	}
+
+	ch, err := s.channel(id)
+	if err != nil {
+		ln.Error(r.Context(), err, ln.F{"channel_id": id})
+		http.Error(w, "can't find that channel: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !contains(s.cfg.guilds(), ch.GuildID) {
+		http.Error(w, "that channel isn't in a guild this archive is for", http.StatusBadRequest)
+		return
+	}
+
+	c := &database.ChannelConfig{
+		ChannelID:   id,
+		GuildID:     ch.GuildID,
+		Name:        ch.Name,
+		Monitored:   r.FormValue("monitored") != "",
+		DefaultTags: splitList(r.FormValue("default_tags")),
+		Blocklist:   splitList(r.FormValue("blocklist")),
+	}
+	if sd, ok := currentSession(r.Context()); ok {
+		c.UpdatedBy = sd.UserID
+	}
+
+	prev, err := s.channels.One(id)
+	if err != nil {
+		ln.Error(r.Context(), err, c)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = s.channels.Put(c)
+	if err != nil {
+		ln.Error(r.Context(), err, c)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ln.Log(r.Context(), c, ln.Action("updated channel config"))
+
+	if c.Monitored && (prev == nil || !prev.Monitored) {
+		go s.catchUpChannel(context.Background(), id)
+	}
+
+	http.Redirect(w, r, "/admin/channels", http.StatusSeeOther)
+}
+
+func (s *site) deleteChannel(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	err := s.channels.Delete(id)
+	if err == storm.ErrNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		ln.Error(r.Context(), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ln.Log(r.Context(), ln.Action("deleted channel config"), ln.F{"channel_id": id})
+
+	http.Redirect(w, r, "/admin/channels", http.StatusSeeOther)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/Xe/kinq/internal/database"
+	"github.com/Xe/kinq/internal/ksecretbox"
+	"github.com/Xe/kinq/internal/linkscraper"
+	"github.com/asdine/storm/v2"
+	"github.com/caarlos0/env"
+	bolt "go.etcd.io/bbolt"
+	"within.website/ln"
+)
+
+type command struct {
+	help string
+	run  func(ctx context.Context, args []string) error
+}
+
+var commands = map[string]command{
+	"keygen": {
+		help: "print a new key for SECRET_BOX_KEY",
+		run:  keygen,
+	},
+	"encrypt-images": {
+		help: "encrypt stored images, re-sealing ones sealed with old keys",
+		run:  encryptImages,
+	},
+	"backfill": {
+		help: "queue images from channel history, run with the server stopped",
+		run:  backfillCommand,
+	},
+	"export": {
+		help: "write images and their metadata to a tar or zip file",
+		run:  exportCommand,
+	},
+	"import": {
+		help: "archive images from a directory, zip or tarball, run with the server stopped",
+		run:  importCommand,
+	},
+	"fsck": {
+		help: "check stored images against their hashes, run with the server stopped",
+		run:  fsckCommand,
+	},
+	"restore": {
+		help: "verify a backup snapshot and swap it in, run with the server stopped",
+		run:  restoreCommand,
+	},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [command] [flags]\n\nWithout a command, kinq serves the site and runs the bot.\n\ncommands:\n", os.Args[0])
+
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].help)
+	}
+}
+
+// runCommand runs the subcommand name, returning false if there is no such
+// command.
+func runCommand(ctx context.Context, name string, args []string) (bool, error) {
+	cmd, ok := commands[name]
+	if !ok {
+		return false, nil
+	}
+
+	return true, cmd.run(ctx, args)
+}
+
+// errDatabaseLocked is returned when another process, usually the server,
+// has the database open.
+var errDatabaseLocked = errors.New("database locked, is kinq running?")
+
+// setup loads the config and opens the database for commands that need them.
+func setup() (config, *storm.DB, error) {
+	var cfg config
+	err := env.Parse(&cfg)
+	if err != nil {
+		return cfg, nil, err
+	}
+
+	db, err := storm.Open(cfg.DBPath, storm.BoltOptions(0600, &bolt.Options{Timeout: time.Second}))
+	if err == bolt.ErrTimeout {
+		return cfg, nil, errDatabaseLocked
+	}
+	if err != nil {
+		return cfg, nil, err
+	}
+
+	return cfg, db, nil
+}
+
+// offlineImages opens the image archive for commands. Nothing is scraped,
+// so commands work without network access.
+func offlineImages(cfg config, db *storm.DB) (database.Images, error) {
+	keys, err := ksecretbox.ParseKeys(cfg.SecretBoxKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return database.NewStormImages(db, &linkscraper.Rules{},
+		database.WithKeys(keys.Derive(database.ImageKeyPurpose), cfg.EncryptImages),
+	), nil
+}
+
+// keygen prints a new key. To rotate keys, put the new key at the front of
+// SECRET_BOX_KEY and keep the old ones after it until nothing uses them.
+func keygen(ctx context.Context, args []string) error {
+	key, err := ksecretbox.GenerateKey()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(ksecretbox.ShowKey(key))
+	return nil
+}
+
+func encryptImages(ctx context.Context, args []string) error {
+	cfg, db, err := setup()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	keys, err := ksecretbox.ParseKeys(cfg.SecretBoxKey)
+	if err != nil {
+		return err
+	}
+
+	n, err := database.EncryptImages(ctx, db, keys.Derive(database.ImageKeyPurpose))
+	ln.Log(ctx, ln.Action("encrypted images"), ln.F{"count": n})
+	return err
+}
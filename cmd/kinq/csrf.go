@@ -0,0 +1,74 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+
+	"within.website/ln"
+)
+
+// csrfField is the form field and query parameter forms send their CSRF
+// token in. Scripts can send it in the X-CSRF-Token header instead.
+const csrfField = "csrf"
+
+func csrfMessage(sessionID string) []byte {
+	return []byte("csrf:" + sessionID)
+}
+
+// csrfToken returns the token requests changing something with the session
+// of r must carry, or nothing if r has no session.
+func (s *site) csrfToken(r *http.Request) string {
+	sd, ok := currentSession(r.Context())
+	if !ok {
+		return ""
+	}
+
+	return s.keys.Sign(csrfMessage(sd.ID))
+}
+
+// checkCSRF rejects requests that could change something and were sent with
+// a session cookie but without the session's CSRF token, so other sites
+// can't post forms as a logged in user. Requests with an API token don't
+// need one: browsers don't add that header on their own.
+func (s *site) checkCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.Header.Get("Authorization") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		sd, ok := currentSession(r.Context())
+		if ok && s.keys.Verify(csrfMessage(sd.ID), requestCSRFToken(r)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ln.Log(r.Context(), ln.Action("rejecting request without csrf token"), ln.F{"path": r.URL.Path})
+		http.Error(w, "missing or invalid csrf token, reload the page and try again", http.StatusForbidden)
+	})
+}
+
+// requestCSRFToken finds the CSRF token of r. Multipart bodies aren't read,
+// their handlers limit how much of them is read; forms with files send the
+// token in the URL instead.
+func requestCSRFToken(r *http.Request) string {
+	if tok := r.Header.Get("X-CSRF-Token"); tok != "" {
+		return tok
+	}
+
+	if tok := r.URL.Query().Get(csrfField); tok != "" {
+		return tok
+	}
+
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct == "application/x-www-form-urlencoded" {
+		return r.PostFormValue(csrfField)
+	}
+
+	return ""
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/Xe/kinq/internal/ksecretbox"
+)
+
+func TestCheckCSRF(t *testing.T) {
+	s := &site{keys: ksecretbox.Keyring{new([32]byte)}}
+	h := s.checkCSRF(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	withSession := func(r *http.Request, id string) *http.Request {
+		return r.WithContext(context.WithValue(r.Context(), sessionDataKey, sessionData{ID: id}))
+	}
+	token := s.csrfToken(withSession(httptest.NewRequest("GET", "/", nil), "s1"))
+	other := s.csrfToken(withSession(httptest.NewRequest("GET", "/", nil), "s2"))
+
+	form := func(tok string) *http.Request {
+		r := httptest.NewRequest("POST", "/admin/rules", strings.NewReader(url.Values{csrfField: {tok}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return r
+	}
+
+	cases := []struct {
+		name string
+		r    *http.Request
+		want int
+	}{
+		{"get", withSession(httptest.NewRequest("GET", "/admin/rules", nil), "s1"), http.StatusOK},
+		{"form", withSession(form(token), "s1"), http.StatusOK},
+		{"no token", withSession(form(""), "s1"), http.StatusForbidden},
+		{"token of another session", withSession(form(other), "s1"), http.StatusForbidden},
+		{"no session", form(token), http.StatusForbidden},
+		{"query", withSession(httptest.NewRequest("POST", "/images/upload?csrf="+url.QueryEscape(token), nil), "s1"), http.StatusOK},
+		{"header", func() *http.Request {
+			r := withSession(httptest.NewRequest("POST", "/api/images", nil), "s1")
+			r.Header.Set("X-CSRF-Token", token)
+			return r
+		}(), http.StatusOK},
+		{"api token", func() *http.Request {
+			r := httptest.NewRequest("POST", "/api/images", nil)
+			r.Header.Set("Authorization", "Bearer hunter2")
+			return r
+		}(), http.StatusOK},
+	}
+
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, cs.r)
+			if w.Code != cs.want {
+				t.Fatalf("wanted status %d, got: %d", cs.want, w.Code)
+			}
+		})
+	}
+}
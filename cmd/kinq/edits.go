@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+
+	"github.com/bwmarrin/discordgo"
+	"within.website/ln"
+)
+
+// Policies for DISCORD_DELETE_POLICY.
+const (
+	// deletePolicyRecord only marks the origins of a deleted message.
+	deletePolicyRecord = "record"
+	// deletePolicyDelete also deletes images that were only attached to
+	// messages that are now gone, see Origins.Abandoned.
+	deletePolicyDelete = "delete"
+)
+
+// messageUpdate archives links that were added to a message by editing it.
+func (s *site) messageUpdate(ds *discordgo.Session, mu *discordgo.MessageUpdate) {
+	ctx := context.Background()
+
+	// updates without content are embeds being filled in
+	if mu.Content == "" {
+		return
+	}
+
+	if !s.monitored(mu.ChannelID) {
+		// messages archived by reaction are followed too
+		seen, err := s.q.HasMessage(mu.ID)
+		if err != nil || !seen {
+			return
+		}
+	}
+
+	m := mu.Message
+	if m.Author == nil {
+		full, err := s.dg.ChannelMessage(mu.ChannelID, mu.ID)
+		if err != nil {
+			ln.Error(ctx, err, ln.Action("getting edited message"), ln.F{"message_id": mu.ID})
+			return
+		}
+		m = full
+	}
+
+	s.enqueueMessage(ctx, m, false)
+}
+
+func (s *site) messageDelete(ds *discordgo.Session, md *discordgo.MessageDelete) {
+	s.messageDeleted(context.Background(), md.ID)
+}
+
+func (s *site) messageDeleteBulk(ds *discordgo.Session, mdb *discordgo.MessageDeleteBulk) {
+	ctx := context.Background()
+
+	for _, id := range mdb.Messages {
+		s.messageDeleted(ctx, id)
+	}
+}
+
+// messageDeleted applies the delete policy to the images archived from a
+// message that was deleted.
+func (s *site) messageDeleted(ctx context.Context, messageID string) {
+	f := ln.F{"message_id": messageID, "policy": s.cfg.DiscordDeletePolicy}
+
+	origins, err := s.origins.MarkDeleted(messageID)
+	if err != nil {
+		ln.Error(ctx, err, f, ln.Action("recording deleted message"))
+		return
+	}
+	if len(origins) == 0 {
+		return
+	}
+
+	ln.Log(ctx, f, ln.Action("recorded deleted message"), ln.F{"images": len(origins)})
+
+	if s.cfg.DiscordDeletePolicy != deletePolicyDelete {
+		return
+	}
+
+	abandoned, err := s.origins.Abandoned(origins)
+	if err != nil {
+		ln.Error(ctx, err, f, ln.Action("finding images of deleted message"))
+		return
+	}
+
+	for _, id := range abandoned {
+		err = s.i.Delete(id)
+		if err != nil {
+			ln.Error(ctx, err, f, ln.Action("deleting image of deleted message"), ln.F{"image_id": id})
+			continue
+		}
+
+		ln.Log(ctx, f, ln.Action("deleted image of deleted message"), ln.F{"image_id": id})
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Xe/kinq/internal/bulk"
+	"github.com/Xe/kinq/internal/database"
+	"within.website/ln"
+)
+
+// exportFilter builds the filter of an export from a tag query and dates
+// as parseSince accepts them.
+func exportFilter(tags, after, before string) (database.Filter, error) {
+	f := database.Filter{Tags: strings.Fields(tags)}
+
+	var err error
+	if after != "" {
+		f.After, err = parseSince(after)
+		if err != nil {
+			return f, err
+		}
+	}
+	if before != "" {
+		f.Before, err = parseSince(before)
+		if err != nil {
+			return f, err
+		}
+	}
+
+	return f, nil
+}
+
+// exportFormat guesses the archive format from a file name.
+func exportFormat(name string) string {
+	if strings.HasSuffix(strings.ToLower(name), ".zip") {
+		return "zip"
+	}
+
+	return "tar"
+}
+
+// export writes every image matching f to w as a tar or zip archive, each
+// image named by its hash with a JSON sidecar kinq import can read back.
+// It returns the number of images written.
+func (s *site) export(ctx context.Context, w io.Writer, format string, f database.Filter) (int, error) {
+	bw, err := bulk.NewWriter(w, format)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	err = s.i.Each(f, func(i *database.Image) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		origins, err := s.origins.ForImage(i.ID)
+		if err != nil {
+			return err
+		}
+
+		sc := bulk.NewSidecar(i, originsIn(origins, f.Guilds))
+		if f.Guilds != nil {
+			sc.Guilds = intersect(sc.Guilds, f.Guilds)
+		}
+
+		meta, err := json.MarshalIndent(sc, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		name := bulk.FileName(i)
+		err = bw.Add(name, i.Added, i.Data)
+		if err != nil {
+			return err
+		}
+		err = bw.Add(name+".json", i.Added, meta)
+		if err != nil {
+			return err
+		}
+
+		n++
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+
+	return n, bw.Close()
+}
+
+// originsIn returns the origins posted in guilds, or all of them if guilds
+// is nil.
+func originsIn(origins []database.Origin, guilds []string) []database.Origin {
+	if guilds == nil {
+		return origins
+	}
+
+	var result []database.Origin
+	for _, o := range origins {
+		if contains(guilds, o.GuildID) {
+			result = append(result, o)
+		}
+	}
+
+	return result
+}
+
+func intersect(a, b []string) []string {
+	var result []string
+	for _, s := range a {
+		if contains(b, s) {
+			result = append(result, s)
+		}
+	}
+
+	return result
+}
+
+// exportCommand writes images to an archive file, or to standard output
+// when the file is -.
+func exportCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "", "tar or zip, defaults to zip for .zip files and tar otherwise")
+	tags := fs.String("tags", "", "only export images with any of these tags")
+	after := fs.String("after", "", "only export images added at or after this date (2006-01-02) or time")
+	before := fs.String("before", "", "only export images added before this date (2006-01-02) or time")
+	guild := fs.String("guild", "", "only export images posted in this guild")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s export [flags] <file.tar, file.zip or ->\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("export: give one file to write to")
+	}
+	out := fs.Arg(0)
+
+	f, err := exportFilter(*tags, *after, *before)
+	if err != nil {
+		return err
+	}
+	if *guild != "" {
+		f.Guilds = []string{*guild}
+	}
+
+	if *format == "" {
+		*format = exportFormat(out)
+	}
+
+	cfg, db, err := setup()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	i, err := offlineImages(cfg, db)
+	if err != nil {
+		return err
+	}
+
+	s := &site{cfg: cfg, db: db, i: i, origins: database.NewStormOrigins(db)}
+
+	var w io.Writer = os.Stdout
+	if out != "-" {
+		fout, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+		defer fout.Close()
+		w = fout
+	}
+
+	n, err := s.export(ctx, w, *format, f)
+	ln.Log(ctx, ln.Action("exported images"), ln.F{"count": n, "file": out})
+	return err
+}
+
+// exportImages streams an archive of the images matching the tags, after
+// and before query parameters.
+func (s *site) exportImages(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	f, err := exportFilter(q.Get("tags"), q.Get("after"), q.Get("before"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	format := q.Get("format")
+	switch format {
+	case "":
+		format = "tar"
+	case "tar", "zip":
+	default:
+		http.Error(w, "format must be tar or zip", http.StatusBadRequest)
+		return
+	}
+
+	contentType := "application/x-tar"
+	if format == "zip" {
+		contentType = "application/zip"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="kinq-export-%s.%s"`, time.Now().Format("2006-01-02"), format))
+
+	// the status is sent with the first file, so errors after that can only
+	// be logged and show up as a truncated archive
+	n, err := s.export(r.Context(), w, format, f)
+	if err != nil {
+		ln.Error(r.Context(), err, ln.Action("exporting images"), ln.F{"count": n})
+		return
+	}
+
+	ln.Log(r.Context(), ln.Action("exported images"), ln.F{"count": n})
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Xe/kinq/internal/bulk"
+	"github.com/Xe/kinq/internal/database"
+	"github.com/Xe/kinq/internal/linkscraper"
+	"github.com/asdine/storm/v2"
+)
+
+func testSite(t *testing.T, name string) *site {
+	db, err := storm.Open(filepath.Join(t.TempDir(), name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return &site{
+		cfg:     config{FetchMaxBytes: 1 << 20},
+		db:      db,
+		i:       database.NewStormImages(db, &linkscraper.Rules{}),
+		origins: database.NewStormOrigins(db),
+	}
+}
+
+func testPNG(t *testing.T, n int) []byte {
+	img := image.NewGray(image.Rect(0, 0, 8, 8))
+	img.SetGray(0, 0, color.Gray{Y: uint8(n)})
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	from := testSite(t, "from.db")
+
+	type seed struct {
+		source   string
+		fetched  bool
+		tags     []string
+		guilds   []string
+		added    time.Time
+		original bool
+	}
+	seeds := []seed{
+		{source: "https://example.com/a.png", tags: []string{"a", "b"}, guilds: []string{"g1", "g2"}, original: true},
+		{guilds: []string{"g1"}},
+		{source: "https://example.com/c.png", fetched: true, tags: []string{"c"}, guilds: []string{"g2"}, added: time.Date(2019, 4, 1, 12, 0, 0, 0, time.UTC)},
+	}
+
+	var want []database.Image
+	for n, sd := range seeds {
+		img, err := from.i.InsertBytes(testPNG(t, n), "image/png", sd.source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sd.fetched {
+			if err := from.i.SetUploaded(img.ID, false); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !sd.added.IsZero() {
+			if err := from.i.SetAdded(img.ID, sd.added); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, g := range sd.guilds {
+			if err := from.fileImage(img, sd.tags, g); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if sd.original {
+			_, err := from.origins.Add(database.Origin{ImageID: img.ID, GuildID: "g1", ChannelID: "c1", MessageID: "m1", Posted: time.Now()})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		img, err = from.i.One(img.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, *img)
+	}
+
+	archive := filepath.Join(t.TempDir(), "export.tar")
+	f, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := from.export(ctx, f, "tar", database.Filter{})
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(seeds) {
+		t.Fatalf("exported %d images, want %d", n, len(seeds))
+	}
+
+	to := testSite(t, "to.db")
+	c, err := bulk.Scan(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	im := &importer{s: to, c: c, guildID: "default"}
+	if err := im.walk(ctx, archive); err != nil {
+		t.Fatal(err)
+	}
+	if im.imported != len(seeds) || im.failed != 0 {
+		t.Fatalf("imported %d, failed %d, want %d imported", im.imported, im.failed, len(seeds))
+	}
+
+	for _, w := range want {
+		got, err := to.i.ByHash(w.Blake2Hash)
+		if err != nil {
+			t.Fatalf("image %s wasn't imported: %v", w.ID, err)
+		}
+
+		// upload URLs are made from the new ID
+		wantURL := w.URL
+		if w.SourceURL() == "" {
+			wantURL = "upload:" + got.ID
+		}
+		sort.Strings(w.Tags)
+		sort.Strings(got.Tags)
+
+		if got.URL != wantURL || got.Uploaded != w.Uploaded || !got.Added.Equal(w.Added) ||
+			!reflect.DeepEqual(got.Tags, w.Tags) || !reflect.DeepEqual(got.Guilds, w.Guilds) ||
+			got.Mime != w.Mime || got.Size != w.Size || !bytes.Equal(got.Data, w.Data) {
+			t.Errorf("image %s came back as\n%+v\nwant\n%+v", w.ID, got, w)
+		}
+
+		wantOrigins, err := from.origins.ForImage(w.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotOrigins, err := to.origins.ForImage(got.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(gotOrigins) != len(wantOrigins) {
+			t.Errorf("image %s has %d origins, want %d", w.ID, len(gotOrigins), len(wantOrigins))
+		}
+	}
+
+	// a second import skips everything
+	im = &importer{s: to, c: c, guildID: "default"}
+	if err := im.walk(ctx, archive); err != nil {
+		t.Fatal(err)
+	}
+	if im.skipped != len(seeds) {
+		t.Errorf("second import skipped %d, want %d", im.skipped, len(seeds))
+	}
+}
+
+func TestRestoreTags(t *testing.T) {
+	s := testSite(t, "restore.db")
+
+	img, err := s.i.InsertBytes(testPNG(t, 1), "image/png", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// room to grow, so appending to the sidecar's tags would write into it
+	sidecarTags := make([]string, 1, 4)
+	sidecarTags[0] = "sidecar"
+	md := bulk.Metadata{
+		Tags: sidecarTags,
+		Kinq: &bulk.Sidecar{Guilds: []string{"g1", "g2"}, Uploaded: true},
+	}
+
+	im := &importer{s: s, guildID: "g0", tags: []string{"extra"}}
+	if err := im.restore(img, md); err != nil {
+		t.Fatal(err)
+	}
+
+	if extra := sidecarTags[:2][1]; extra != "" {
+		t.Errorf("restore wrote %q into the sidecar's tags", extra)
+	}
+
+	stored, err := s.i.One(img.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(stored.Tags)
+	if !reflect.DeepEqual(stored.Tags, []string{"extra", "sidecar"}) {
+		t.Errorf("tags = %v, want [extra sidecar]", stored.Tags)
+	}
+	if !reflect.DeepEqual(stored.Guilds, []string{"g1", "g2"}) {
+		t.Errorf("guilds = %v, want [g1 g2]", stored.Guilds)
+	}
+}
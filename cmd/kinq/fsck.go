@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Xe/kinq/internal/database"
+	"github.com/Xe/kinq/internal/events"
+	"github.com/Xe/kinq/internal/ksecretbox"
+	"github.com/asdine/storm/v2"
+	"within.website/ln"
+	"within.website/ln/opname"
+)
+
+// scrubber runs fsck in the background, one scrub at a time.
+type scrubber struct {
+	db     *storm.DB
+	cfg    database.FsckConfig
+	events *events.Bus
+
+	lock    sync.Mutex
+	running bool
+}
+
+// startScrub checks stored images every SCRUB_INTERVAL, if it isn't zero.
+// Admins can start a scrub either way.
+func (s *site) startScrub(ctx context.Context) {
+	f, err := newFetcher(s.cfg)
+	if err != nil {
+		ln.Error(ctx, err, ln.Action("making fetcher for scrubs"))
+		return
+	}
+
+	s.scrubs = &scrubber{
+		db:     s.db,
+		events: s.events,
+		cfg: database.FsckConfig{
+			Keys:    s.keys.Derive(database.ImageKeyPurpose),
+			Encrypt: s.cfg.EncryptImages,
+			Repair:  s.cfg.ScrubRepair,
+			Fetcher: f,
+		},
+	}
+
+	if s.cfg.ScrubInterval <= 0 {
+		return
+	}
+
+	go func() {
+		ctx := opname.With(ctx, "scrub")
+
+		t := time.NewTicker(s.cfg.ScrubInterval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				s.scrubs.run(ctx, s.cfg.ScrubRepair)
+			}
+		}
+	}()
+
+	ln.Log(ctx, ln.Action("scheduled scrubs"), ln.F{"interval": s.cfg.ScrubInterval, "repair": s.cfg.ScrubRepair})
+}
+
+// run checks every stored image unless a scrub is already running, and
+// keeps the report.
+func (sc *scrubber) run(ctx context.Context, repair bool) {
+	sc.lock.Lock()
+	if sc.running {
+		sc.lock.Unlock()
+		return
+	}
+	sc.running = true
+	sc.lock.Unlock()
+
+	defer func() {
+		sc.lock.Lock()
+		sc.running = false
+		sc.lock.Unlock()
+	}()
+
+	cfg := sc.cfg
+	cfg.Repair = repair
+
+	r, err := database.Fsck(ctx, sc.db, cfg)
+	if err != nil {
+		ln.Error(ctx, err, ln.Action("scrubbing images"))
+		return
+	}
+
+	err = database.SaveFsckReport(sc.db, r)
+	if err != nil {
+		ln.Error(ctx, err, r, ln.Action("saving scrub report"))
+	}
+
+	ln.Log(ctx, r, ln.Action("scrubbed images"))
+
+	if n := r.Unrepaired(); n > 0 {
+		sc.events.Publish(ctx, events.Event{
+			Kind:    events.FsckProblems,
+			Summary: fmt.Sprintf("a scrub of %d images found %d problems, see /admin/fsck", r.Images, n),
+			Fields: map[string]string{
+				"images":   strconv.Itoa(r.Images),
+				"problems": strconv.Itoa(n),
+			},
+		})
+	}
+}
+
+func (sc *scrubber) isRunning() bool {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	return sc.running
+}
+
+func (s *site) fsckReport(w http.ResponseWriter, r *http.Request) {
+	report, err := database.LastFsckReport(s.db)
+	if err != nil {
+		ln.Error(r.Context(), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Subtitle string
+		Report   *database.FsckReport
+		Running  bool
+		Interval time.Duration
+	}{
+		Subtitle: "fsck",
+		Report:   report,
+		Running:  s.scrubs != nil && s.scrubs.isRunning(),
+		Interval: s.cfg.ScrubInterval,
+	}
+
+	s.renderTemplatePage("fsck.html", &data).ServeHTTP(w, r)
+}
+
+// scrubNow starts a scrub in the background. Checking every image takes a
+// while, so the report shows up on /admin/fsck when it is done.
+func (s *site) scrubNow(w http.ResponseWriter, r *http.Request) {
+	if s.scrubs == nil {
+		http.Error(w, "scrubs aren't set up, see the logs", http.StatusServiceUnavailable)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	repair := r.PostForm.Get("repair") != ""
+	sd, _ := currentSession(r.Context())
+	ctx := ln.WithF(opname.With(context.Background(), "scrub"), ln.F{"started_by": sd.UserID})
+	go s.scrubs.run(ctx, repair)
+
+	http.Redirect(w, r, "/admin/fsck", http.StatusSeeOther)
+}
+
+// fsckCommand checks every stored image and prints what is wrong. It fails
+// if any problem is left, so it can be used from scripts.
+func fsckCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "fetch broken images again from their url and rebuild the hash index")
+	fs.Parse(args)
+
+	cfg, db, err := setup()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	keys, err := ksecretbox.ParseKeys(cfg.SecretBoxKey)
+	if err != nil {
+		return err
+	}
+
+	f, err := newFetcher(cfg)
+	if err != nil {
+		return err
+	}
+
+	r, err := database.Fsck(ctx, db, database.FsckConfig{
+		Keys:    keys.Derive(database.ImageKeyPurpose),
+		Encrypt: cfg.EncryptImages,
+		Repair:  *repair,
+		Fetcher: f,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = database.SaveFsckReport(db, r)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, fi := range r.Findings {
+		status := "problem"
+		if fi.Repaired {
+			status = "repaired"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", status, fi.Problem, fi.ImageID, fi.URL, fi.Detail)
+	}
+	tw.Flush()
+
+	fmt.Printf("checked %d images (%d bytes) in %s, %d findings, %d unrepaired\n",
+		r.Images, r.Bytes, r.Finished.Sub(r.Started).Round(time.Millisecond), len(r.Findings), r.Unrepaired())
+
+	if n := r.Unrepaired(); n > 0 {
+		return fmt.Errorf("fsck: %d problems left", n)
+	}
+
+	return nil
+}
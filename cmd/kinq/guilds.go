@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/Xe/kinq/internal/database"
+	"github.com/bwmarrin/discordgo"
+	"within.website/ln"
+)
+
+// guilds returns every guild kinq archives. DISCORD_MUST_GUILD comes first,
+// so it is the guild images archived before multi-guild support belong to.
+func (c config) guilds() []string {
+	var result []string
+	for _, g := range append([]string{c.DiscordMustGuild}, c.DiscordGuilds...) {
+		if g != "" && !contains(result, g) {
+			result = append(result, g)
+		}
+	}
+
+	return result
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// guildOf returns the guild a channel is in if kinq archives that guild.
+func (s *site) guildOf(channelID string) (string, bool) {
+	ch, err := s.channel(channelID)
+	if err != nil || !contains(s.cfg.guilds(), ch.GuildID) {
+		return "", false
+	}
+
+	return ch.GuildID, true
+}
+
+// discordUnknownMember is the error code Discord answers with when a user
+// isn't in a guild.
+const discordUnknownMember = 10007
+
+// notMember returns true if err from GuildMember means the user definitely
+// isn't in the guild, as opposed to Discord not answering.
+func notMember(err error) bool {
+	rerr, ok := err.(*discordgo.RESTError)
+	if !ok {
+		return false
+	}
+
+	if rerr.Message != nil && rerr.Message.Code == discordUnknownMember {
+		return true
+	}
+
+	return rerr.Response != nil && rerr.Response.StatusCode == http.StatusNotFound
+}
+
+// memberGuilds returns the archived guilds userID is still a member of. If
+// Discord couldn't say for some guild, because it is down or rate limiting,
+// the guilds it confirmed are returned with the error.
+func (s *site) memberGuilds(userID string) ([]string, error) {
+	var result []string
+	var failed error
+	for _, g := range s.cfg.guilds() {
+		_, err := s.dg.GuildMember(g, userID)
+		switch {
+		case err == nil:
+			result = append(result, g)
+		case notMember(err):
+		default:
+			failed = err
+		}
+	}
+
+	return result, failed
+}
+
+func (s *site) isAdminUser(userID string) bool {
+	return contains(s.cfg.AdminUsers, userID)
+}
+
+// visibleGuilds returns the guilds whose images the request may see, for
+// the guilds argument of database.Images. Admins and API tokens get nil,
+// meaning every guild.
+func visibleGuilds(ctx context.Context) []string {
+	guilds, ok := ctx.Value(sessionGuildsKey).([]string)
+	if !ok {
+		return nil
+	}
+
+	return guilds
+}
+
+// visible loads an image if the request may see it.
+func (s *site) visible(r *http.Request, id string) (*database.Image, bool) {
+	i, err := s.i.One(id)
+	if err != nil {
+		ln.Error(r.Context(), err, ln.F{"image_id": id})
+		return nil, false
+	}
+
+	if !i.VisibleTo(visibleGuilds(r.Context())) {
+		return nil, false
+	}
+
+	return i, true
+}
+
+// visibleOrigins drops the origins in guilds the request can't see.
+func visibleOrigins(ctx context.Context, origins []database.Origin) []database.Origin {
+	guilds := visibleGuilds(ctx)
+	if guilds == nil {
+		return origins
+	}
+
+	var result []database.Origin
+	for _, o := range origins {
+		if contains(guilds, o.GuildID) {
+			result = append(result, o)
+		}
+	}
+
+	return result
+}
@@ -20,7 +20,12 @@ func (s *site) renderTemplatePage(templateFname string, data interface{}) http.H
 		ctx := opname.With(r.Context(), "renderTemplatePage")
 		defer logTemplateTime(ctx, templateFname, time.Now())
 
-		t, err := template.ParseFiles("templates/base.html", "templates/"+templateFname)
+		funcs := template.FuncMap{
+			// csrf is the token POST forms have to send, see checkCSRF
+			"csrf": func() string { return s.csrfToken(r) },
+		}
+
+		t, err := template.New("base.html").Funcs(funcs).ParseFiles("templates/base.html", "templates/"+templateFname)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			ln.Error(ctx, err, ln.F{"action": "renderTemplatePage", "page": templateFname})
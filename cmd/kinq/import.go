@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/Xe/kinq/internal/bulk"
+	"github.com/Xe/kinq/internal/database"
+	"within.website/ln"
+)
+
+// importCommand archives every image in a directory, zip file or tarball,
+// with tags and source URLs from sidecar files. Sidecars from kinq export
+// also bring back when images were added, their guilds and their origins.
+// Files that are already stored are skipped by hash, so an interrupted
+// import can be run again to pick up where it stopped. Files whose source
+// already has other data archived from it are reported as conflicts and left
+// out.
+func importCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	guild := fs.String("guild", "", "guild to file the images under, defaults to the first archived guild")
+	tags := fs.String("tags", "", "tags to add to every image")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s import [flags] <directory, .zip or .tar(.gz)>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("import: give one directory or archive to import")
+	}
+	path := fs.Arg(0)
+
+	cfg, db, err := setup()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	guildID := *guild
+	if guildID == "" {
+		if len(cfg.guilds()) == 0 {
+			return errors.New("import: set DISCORD_MUST_GUILD, DISCORD_GUILDS or --guild")
+		}
+		guildID = cfg.guilds()[0]
+	}
+
+	i, err := offlineImages(cfg, db)
+	if err != nil {
+		return err
+	}
+
+	c, err := bulk.Scan(path)
+	if err != nil {
+		return err
+	}
+
+	s := &site{cfg: cfg, db: db, i: i, origins: database.NewStormOrigins(db)}
+	im := &importer{
+		s:       s,
+		c:       c,
+		guildID: guildID,
+		tags:    splitList(*tags),
+	}
+
+	err = im.walk(ctx, path)
+
+	ln.Log(ctx, ln.Action("imported images"), ln.F{
+		"path":       path,
+		"files":      len(c.Files),
+		"imported":   im.imported,
+		"skipped":    im.skipped,
+		"conflicted": im.conflicted,
+		"failed":     im.failed,
+	})
+	fmt.Fprintf(os.Stderr, "%d imported, %d already stored, %d conflicting sources, %d failed\n", im.imported, im.skipped, im.conflicted, im.failed)
+
+	return err
+}
+
+type importer struct {
+	s       *site
+	c       *bulk.Collection
+	guildID string
+	tags    []string
+
+	done, imported, skipped, conflicted, failed int
+}
+
+// walk imports every file in path.
+func (im *importer) walk(ctx context.Context, path string) error {
+	return bulk.Walk(path, func(name string, size int64, r io.Reader) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if bulk.IsSidecar(name) {
+			return nil
+		}
+
+		im.file(ctx, name, size, r)
+		return nil
+	})
+}
+
+// progress prints how an import of one file went.
+func (im *importer) progress(name, status string) {
+	fmt.Fprintf(os.Stderr, "[%d/%d] %s: %s\n", im.done, len(im.c.Files), name, status)
+}
+
+func (im *importer) file(ctx context.Context, name string, size int64, r io.Reader) {
+	im.done++
+	f := ln.F{"import_file": name}
+
+	if size > im.s.cfg.FetchMaxBytes {
+		im.failed++
+		im.progress(name, fmt.Sprintf("bigger than %d bytes", im.s.cfg.FetchMaxBytes))
+		return
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(r, im.s.cfg.FetchMaxBytes))
+	if err != nil {
+		im.failed++
+		ln.Error(ctx, err, f)
+		im.progress(name, err.Error())
+		return
+	}
+
+	if existing, err := im.s.i.ByHash(database.Hash(data)); err == nil {
+		im.skipped++
+		im.progress(name, "already stored as "+existing.ID)
+		return
+	}
+
+	md, err := im.c.Metadata(name)
+	if err != nil {
+		ln.Error(ctx, err, f, ln.Action("reading sidecar"))
+	}
+
+	// kinq exports keep the URL images were fetched from even if it isn't
+	// http, upload URLs are made again from the new ID
+	source := md.Source
+	if md.Kinq != nil && md.Kinq.URL != "" && !strings.HasPrefix(md.Kinq.URL, "upload:") {
+		source = md.Kinq.URL
+	}
+
+	if source != "" {
+		if existing, err := im.s.i.ByURL(source); err == nil {
+			im.conflicted++
+			im.progress(name, "other data is already stored from its source as "+existing.ID)
+			return
+		}
+	}
+
+	img, err := im.s.i.InsertBytes(data, "", source)
+	if err != nil {
+		im.failed++
+		ln.Error(ctx, err, f, ln.Action("importing file"))
+		im.progress(name, err.Error())
+		return
+	}
+
+	err = im.restore(img, md)
+	if err != nil {
+		im.failed++
+		ln.Error(ctx, err, f, img, ln.Action("restoring imported image metadata"))
+		im.progress(name, err.Error())
+		return
+	}
+
+	im.imported++
+	ln.Log(ctx, f, img, ln.Action("imported image"))
+	im.progress(name, "imported as "+img.ID)
+}
+
+// restore adds the tags and guilds of an imported image, and for kinq
+// exports whether it was uploaded, its original added time and its origins.
+func (im *importer) restore(img *database.Image, md bulk.Metadata) error {
+	guilds := []string{im.guildID}
+	if md.Kinq != nil && len(md.Kinq.Guilds) > 0 {
+		guilds = md.Kinq.Guilds
+	}
+
+	tags := append(append([]string(nil), md.Tags...), im.tags...)
+	if len(tags) > 0 {
+		err := im.s.i.AddTags(img.ID, tags)
+		if err != nil {
+			return err
+		}
+		img.Tags = append(img.Tags, tags...)
+	}
+
+	for _, g := range guilds {
+		err := im.s.i.AddGuild(img.ID, g)
+		if err != nil {
+			return err
+		}
+	}
+
+	if md.Kinq == nil {
+		return nil
+	}
+
+	if !md.Kinq.Uploaded {
+		err := im.s.i.SetUploaded(img.ID, false)
+		if err != nil {
+			return err
+		}
+		img.Uploaded = false
+	}
+
+	if !md.Kinq.Added.IsZero() {
+		err := im.s.i.SetAdded(img.ID, md.Kinq.Added)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, o := range md.Kinq.DatabaseOrigins(img.ID) {
+		_, err := im.s.origins.Add(o)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
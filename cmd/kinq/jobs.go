@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Xe/kinq/internal/database"
+	"github.com/Xe/kinq/internal/ingest"
+	"github.com/asdine/storm/v2"
+	"github.com/bwmarrin/discordgo"
+	chi "gopkg.in/chi.v3"
+	"within.website/ln"
+)
+
+const (
+	emojiQueued = "⏳"
+	emojiSaved  = "💾"
+	emojiFailed = "❌"
+)
+
+// messageURLs returns every link and attachment in m that could be an image.
+func messageURLs(m *discordgo.Message) []string {
+	var urls []string
+
+	for _, word := range strings.Fields(m.Content) {
+		if !strings.HasPrefix(word, "http") {
+			continue
+		}
+
+		urls = append(urls, word)
+	}
+
+	for _, att := range m.Attachments {
+		urls = append(urls, att.URL)
+	}
+
+	return urls
+}
+
+// without returns the strings in list that aren't in remove.
+func without(list, remove []string) []string {
+	var result []string
+	for _, s := range list {
+		found := false
+		for _, r := range remove {
+			if s == r {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			result = append(result, s)
+		}
+	}
+
+	return result
+}
+
+// channel looks up a channel in the state cache, falling back to the API.
+func (s *site) channel(id string) (*discordgo.Channel, error) {
+	if ch, err := s.dg.State.Channel(id); err == nil {
+		return ch, nil
+	}
+
+	return s.dg.Channel(id)
+}
+
+// enqueueMessage queues every URL in m for archival that wasn't queued for
+// it before. Unless quiet is set, the message gets reactions showing how
+// archiving went.
+func (s *site) enqueueMessage(ctx context.Context, m *discordgo.Message, quiet bool) {
+	urls := messageURLs(m)
+	if len(urls) == 0 {
+		return
+	}
+
+	done, err := s.q.URLs(m.ID)
+	if err != nil {
+		ln.Error(ctx, err, ln.Action("finding queued urls"), ln.F{"message_id": m.ID})
+		return
+	}
+	urls = without(urls, done)
+
+	cc, err := s.channels.One(m.ChannelID)
+	if err != nil {
+		ln.Error(ctx, err, ln.Action("getting channel config"), ln.F{"channel_id": m.ChannelID})
+		return
+	}
+	if cc == nil {
+		cc = &database.ChannelConfig{ChannelID: m.ChannelID}
+	}
+
+	var allowed []string
+	for _, u := range urls {
+		if cc.Blocked(u) {
+			ln.Log(ctx, cc, ln.Action("not archiving blocked url"), ln.F{"url": u})
+			continue
+		}
+		allowed = append(allowed, u)
+	}
+	urls = allowed
+	if len(urls) == 0 {
+		return
+	}
+
+	msg := ingest.Job{
+		ChannelID: m.ChannelID,
+		MessageID: m.ID,
+		Content:   m.Content,
+		Tags:      cc.DefaultTags,
+		Quiet:     quiet,
+	}
+	if m.Author != nil {
+		msg.AuthorID = m.Author.ID
+		msg.Author = m.Author.Username
+	}
+	if posted, err := m.Timestamp.Parse(); err == nil {
+		msg.Posted = posted
+	}
+	if ch, err := s.channel(m.ChannelID); err == nil {
+		msg.GuildID = ch.GuildID
+		msg.ChannelName = ch.Name
+	} else {
+		ln.Error(ctx, err, ln.Action("looking up channel"), ln.F{"channel_id": m.ChannelID})
+	}
+
+	queued := false
+
+	for _, u := range urls {
+		j := msg
+		j.URL = u
+
+		jj, err := s.q.Enqueue(j)
+		if err != nil {
+			ln.Error(ctx, err, j, ln.Action("queueing url from message"))
+			continue
+		}
+
+		ln.Log(ctx, jj, ln.Action("queued url from message"))
+		queued = true
+	}
+
+	if queued && !quiet {
+		s.dg.MessageReactionAdd(m.ChannelID, m.ID, emojiQueued)
+	}
+}
+
+// ingestDone tags and files archived images under the guild of their job,
+// records where they were posted and reacts to the message a finished job
+// came from.
+func (s *site) ingestDone(j ingest.Job, img *database.Image, err error) {
+	if err != nil {
+		s.publishIngestFailed(j, err)
+	} else {
+		s.addChannelTags(j, img)
+
+		if j.GuildID != "" {
+			if gerr := s.i.AddGuild(img.ID, j.GuildID); gerr != nil {
+				ln.Error(context.Background(), gerr, j, ln.Action("adding image guild"))
+			}
+		}
+	}
+
+	if j.MessageID == "" {
+		return
+	}
+
+	if err == nil {
+		o, oerr := s.origins.Add(database.Origin{
+			ImageID:     img.ID,
+			GuildID:     j.GuildID,
+			ChannelID:   j.ChannelID,
+			ChannelName: j.ChannelName,
+			MessageID:   j.MessageID,
+			AuthorID:    j.AuthorID,
+			Author:      j.Author,
+			Content:     j.Content,
+			Posted:      j.Posted,
+		})
+		if oerr != nil {
+			ln.Error(context.Background(), oerr, j, ln.Action("recording image origin"))
+		} else {
+			ln.Log(context.Background(), o, ln.Action("recorded image origin"))
+		}
+	}
+
+	if j.Quiet {
+		return
+	}
+
+	if err != nil {
+		s.dg.MessageReactionAdd(j.ChannelID, j.MessageID, emojiFailed)
+	} else {
+		s.dg.MessageReactionAdd(j.ChannelID, j.MessageID, emojiSaved)
+	}
+
+	n, perr := s.q.Pending(j.MessageID)
+	if perr == nil && n == 0 {
+		s.dg.MessageReactionRemove(j.ChannelID, j.MessageID, emojiQueued, "@me")
+	}
+}
+
+// addChannelTags adds the default tags of the channel a job came from and the
+// tags of its tag rules that match. Rules only match on what scrapers said
+// about the job's URL, but don't default a namespace the image or the
+// channel defaults already have a tag in.
+func (s *site) addChannelTags(j ingest.Job, img *database.Image) {
+	ctx := context.Background()
+
+	rules, err := s.tagRules.ForChannel(j.ChannelID)
+	if err != nil {
+		ln.Error(ctx, err, j, ln.Action("getting tag rules"))
+	}
+
+	tags := append([]string{}, j.Tags...)
+	have := append(append([]string{}, img.Tags...), j.Tags...)
+	tags = append(tags, database.RuleTags(rules, j.URL, img.Scraped, have)...)
+	if len(tags) == 0 {
+		return
+	}
+
+	err = s.i.AddTags(img.ID, tags)
+	if err != nil {
+		ln.Error(ctx, err, j, ln.Action("adding channel tags"))
+		return
+	}
+
+	ln.Log(ctx, j, ln.Action("added channel tags"), ln.F{"tags": tags})
+}
+
+func (s *site) listJobs(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+
+	jobs, err := s.q.List(ingest.Status(r.URL.Query().Get("status")), visibleGuilds(r.Context()), limit)
+	if err != nil {
+		ln.Error(r.Context(), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jobs)
+}
+
+func (s *site) oneJob(w http.ResponseWriter, r *http.Request) {
+	j, err := s.q.One(chi.URLParam(r, "id"))
+	if err != nil {
+		ln.Error(r.Context(), err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	// jobs of other guilds look like jobs that don't exist
+	if guilds := visibleGuilds(r.Context()); guilds != nil && !contains(guilds, j.GuildID) {
+		http.Error(w, storm.ErrNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(j)
+}
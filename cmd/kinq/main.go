@@ -1,25 +1,32 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"os"
 	"strconv"
-	"strings"
 	"time"
 
+	"github.com/Xe/kinq/internal/backup"
 	"github.com/Xe/kinq/internal/database"
 	"github.com/Xe/kinq/internal/discord"
+	"github.com/Xe/kinq/internal/events"
+	"github.com/Xe/kinq/internal/ingest"
 	"github.com/Xe/kinq/internal/ksecretbox"
 	"github.com/Xe/kinq/internal/linkscraper"
+	"github.com/Xe/kinq/internal/media"
+	"github.com/Xe/kinq/internal/slash"
+	"github.com/Xe/kinq/internal/webhook"
 	"github.com/asdine/storm/v2"
 	"github.com/bwmarrin/discordgo"
 	"github.com/caarlos0/env"
 	"github.com/celrenheit/sandflake"
 	_ "github.com/joho/godotenv/autoload"
 	"github.com/kr/session"
-	bolt "go.etcd.io/bbolt"
 	"golang.org/x/oauth2"
 	chi "gopkg.in/chi.v3"
 	"gopkg.in/chi.v3/middleware"
@@ -32,11 +39,60 @@ type config struct {
 	SecretBoxKey              string   `env:"SECRET_BOX_KEY,required"`
 	DBPath                    string   `env:"DB_PATH,required"`
 	DiscordKey                string   `env:"DISCORD_KEY,required"`
-	DiscordMonitorChannels    []string `env:"DISCORD_MONITOR_CHANNELS,required"`
-	DiscordMustGuild          string   `env:"DISCORD_MUST_GUILD,required"`
+	DiscordMonitorChannels    []string `env:"DISCORD_MONITOR_CHANNELS"`
+	DiscordMustGuild          string   `env:"DISCORD_MUST_GUILD"`
+	DiscordGuilds             []string `env:"DISCORD_GUILDS"`
 	DiscordOAuth2ClientID     string   `env:"DISCORD_OAUTH2_CLIENT_ID,required"`
 	DiscordOAuth2ClientSecret string   `env:"DISCORD_OAUTH2_CLIENT_SECRET,required"`
 	DiscordOAuth2RedirectURL  string   `env:"DISCORD_OAUTH2_REDIRECT_URL,required"`
+	APITokens                 []string `env:"API_TOKENS"`
+
+	DiscordTagRoles    []string `env:"DISCORD_TAG_ROLES"`
+	DiscordDeleteRoles []string `env:"DISCORD_DELETE_ROLES"`
+	SiteURL            string   `env:"SITE_URL"`
+
+	DiscordArchiveEmoji string `env:"DISCORD_ARCHIVE_EMOJI" envDefault:"💾"`
+	DiscordTagEmoji     string `env:"DISCORD_TAG_EMOJI" envDefault:"🏷️"`
+	DiscordDeleteEmoji  string `env:"DISCORD_DELETE_EMOJI" envDefault:"❌"`
+
+	DiscordDeletePolicy string `env:"DISCORD_DELETE_POLICY" envDefault:"record"`
+
+	DiscordLogChannel string        `env:"DISCORD_LOG_CHANNEL"`
+	NotifyInterval    time.Duration `env:"NOTIFY_INTERVAL" envDefault:"1m"`
+	NotifyMaxLines    int           `env:"NOTIFY_MAX_LINES" envDefault:"10"`
+
+	WebhookMaxAttempts int           `env:"WEBHOOK_MAX_ATTEMPTS" envDefault:"8"`
+	WebhookBackoff     time.Duration `env:"WEBHOOK_BACKOFF" envDefault:"30s"`
+	WebhookTimeout     time.Duration `env:"WEBHOOK_TIMEOUT" envDefault:"10s"`
+	WebhookRetention   time.Duration `env:"WEBHOOK_RETENTION" envDefault:"720h"`
+
+	BackupDir       string        `env:"BACKUP_DIR"`
+	BackupInterval  time.Duration `env:"BACKUP_INTERVAL" envDefault:"6h"`
+	BackupKeep      int           `env:"BACKUP_KEEP" envDefault:"14"`
+	BackupFullEvery int           `env:"BACKUP_FULL_EVERY" envDefault:"4"`
+
+	ScrubInterval time.Duration `env:"SCRUB_INTERVAL" envDefault:"24h"`
+	ScrubRepair   bool          `env:"SCRUB_REPAIR"`
+
+	SessionMaxAge      time.Duration `env:"SESSION_MAX_AGE" envDefault:"720h"`
+	SessionIdleTimeout time.Duration `env:"SESSION_IDLE_TIMEOUT" envDefault:"72h"`
+	AdminUsers         []string      `env:"ADMIN_USERS"`
+	EncryptImages      bool          `env:"ENCRYPT_IMAGES"`
+	StripEXIF          bool          `env:"STRIP_EXIF"`
+
+	IngestWorkers      int           `env:"INGEST_WORKERS" envDefault:"4"`
+	IngestHostInterval time.Duration `env:"INGEST_HOST_INTERVAL" envDefault:"1s"`
+	IngestMaxAttempts  int           `env:"INGEST_MAX_ATTEMPTS" envDefault:"5"`
+	IngestBackoff      time.Duration `env:"INGEST_BACKOFF" envDefault:"30s"`
+	IngestRetention    time.Duration `env:"INGEST_RETENTION" envDefault:"720h"`
+
+	FetchMaxBytes       int64         `env:"FETCH_MAX_BYTES" envDefault:"52428800"`
+	FetchConnectTimeout time.Duration `env:"FETCH_CONNECT_TIMEOUT" envDefault:"10s"`
+	FetchTimeout        time.Duration `env:"FETCH_TIMEOUT" envDefault:"1m"`
+	FetchMaxRedirects   int           `env:"FETCH_MAX_REDIRECTS" envDefault:"5"`
+	FetchAllowNets      []string      `env:"FETCH_ALLOW_NETS"`
+
+	DuplicateDistance int `env:"DUPLICATE_DISTANCE" envDefault:"10"`
 
 	E621APIKey       string `env:"E621_API_KEY,required"`
 	DerpibooruAPIKey string `env:"DERPIBOORU_API_KEY,required"`
@@ -63,22 +119,74 @@ func requestIDMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// newFetcher makes the Fetcher images are downloaded with.
+func newFetcher(cfg config) (*database.Fetcher, error) {
+	allow, err := database.ParseCIDRs(cfg.FetchAllowNets)
+	if err != nil {
+		return nil, err
+	}
+
+	return database.NewFetcher(database.FetchConfig{
+		MaxBytes:       cfg.FetchMaxBytes,
+		ConnectTimeout: cfg.FetchConnectTimeout,
+		Timeout:        cfg.FetchTimeout,
+		MaxRedirects:   cfg.FetchMaxRedirects,
+		Allow:          allow,
+		UserAgent:      genUserAgent(),
+	}), nil
+}
+
 func main() {
 	ctx := context.Background()
+
+	if len(os.Args) > 1 {
+		ok, err := runCommand(ctx, os.Args[1], os.Args[2:])
+		if !ok {
+			usage()
+			os.Exit(2)
+		}
+		if err != nil {
+			ln.FatalErr(ctx, err, ln.F{"command": os.Args[1]})
+		}
+		return
+	}
+
 	var cfg config
 	err := env.Parse(&cfg)
 	if err != nil {
 		ln.FatalErr(ctx, err)
 	}
 
+	switch cfg.DiscordDeletePolicy {
+	case deletePolicyRecord, deletePolicyDelete:
+	default:
+		ln.FatalErr(ctx, errors.New("DISCORD_DELETE_POLICY must be record or delete"))
+	}
+
+	if len(cfg.guilds()) == 0 {
+		ln.FatalErr(ctx, errors.New("set DISCORD_MUST_GUILD or DISCORD_GUILDS"))
+	}
+
+	if cfg.NotifyInterval <= 0 {
+		ln.FatalErr(ctx, errors.New("NOTIFY_INTERVAL must be more than zero"))
+	}
+
 	db, err := storm.Open(cfg.DBPath)
 	if err != nil {
 		ln.FatalErr(ctx, err)
 	}
 
-	bl := BoltLogger(db.Bolt, "ln", ln.NewTextFormatter())
+	bl := BoltLogger(db.Bolt, logBucket, ln.NewTextFormatter())
 	ln.AddFilter(bl)
 
+	n, err := database.AssignGuilds(ctx, db, cfg.guilds()[0])
+	if err != nil {
+		ln.FatalErr(ctx, err, ln.Action("assigning image guilds"))
+	}
+	if n > 0 {
+		ln.Log(ctx, ln.Action("assigned guilds to older images"), ln.F{"count": n})
+	}
+
 	dg, err := discordgo.New("Bot " + cfg.DiscordKey)
 	if err != nil {
 		ln.FatalErr(ctx, err)
@@ -89,17 +197,31 @@ func main() {
 		linkscraper.NewDerpiCDNScraper(cfg.DerpibooruAPIKey),
 	}
 
-	i := database.NewStormImages(db, rs)
+	keys, err := ksecretbox.ParseKeys(cfg.SecretBoxKey)
+	if err != nil {
+		ln.FatalErr(ctx, err)
+	}
 
-	skey, err := ksecretbox.ParseKey(cfg.SecretBoxKey)
+	f, err := newFetcher(cfg)
 	if err != nil {
 		ln.FatalErr(ctx, err)
 	}
 
+	bus := events.NewBus()
+
+	i := database.NewStormImages(db, rs,
+		database.WithKeys(keys.Derive(database.ImageKeyPurpose), cfg.EncryptImages),
+		database.WithFetcher(f),
+		database.WithEvents(bus),
+		database.WithDuplicateDistance(cfg.DuplicateDistance),
+	)
+
 	scfg := &session.Config{
 		Name:     "kinq",
+		Path:     "/",
+		MaxAge:   cfg.SessionMaxAge,
 		HTTPOnly: true,
-		Keys:     []*[32]byte{skey},
+		Keys:     keys,
 	}
 
 	oa2cfg := &oauth2.Config{
@@ -111,21 +233,79 @@ func main() {
 	}
 
 	s := &site{
-		cfg:    cfg,
-		oa2cfg: oa2cfg,
-		scfg:   scfg,
-		db:     db,
-		dg:     dg,
-		i:      i,
+		cfg:      cfg,
+		oa2cfg:   oa2cfg,
+		scfg:     scfg,
+		db:       db,
+		dg:       dg,
+		i:        i,
+		shares:   database.NewStormShares(db),
+		sessions: database.NewStormSessions(db),
+		origins:  database.NewStormOrigins(db),
+		cursors:  database.NewStormCursors(db),
+		channels: database.NewStormChannels(db),
+		tagRules: database.NewStormTagRules(db),
+		events:   bus,
+		keys:     keys,
 	}
+	s.guildsOf = s.memberGuilds
+
+	s.startNotifier(ctx)
+	s.startSessionPrune(ctx)
+	s.startBackups(ctx)
+	s.startScrub(ctx)
+
+	s.hooks = webhook.New(db, webhook.Config{
+		MaxAttempts: cfg.WebhookMaxAttempts,
+		Backoff:     cfg.WebhookBackoff,
+		Timeout:     cfg.WebhookTimeout,
+		Retention:   cfg.WebhookRetention,
+		Control:     f.DialControl,
+	})
+	err = bus.Subscribe(ctx, "webhooks", s.hooks.Publish)
+	if err != nil {
+		ln.FatalErr(ctx, err)
+	}
+	go s.hooks.Run(ctx)
+
+	s.q = ingest.New(db, i, ingest.Config{
+		Workers:      cfg.IngestWorkers,
+		HostInterval: cfg.IngestHostInterval,
+		MaxAttempts:  cfg.IngestMaxAttempts,
+		Backoff:      cfg.IngestBackoff,
+		Retention:    cfg.IngestRetention,
+	})
+	s.q.OnDone = s.ingestDone
+	go s.q.Run(ctx)
+
+	s.slash = s.newSlashHandler()
 
 	dg.AddHandler(s.messageCreate)
+	dg.AddHandler(s.messageUpdate)
+	dg.AddHandler(s.messageDelete)
+	dg.AddHandler(s.messageDeleteBulk)
+	dg.AddHandler(s.ready)
+	dg.AddHandler(s.interactionCreate)
+	dg.AddHandler(s.messageReactionAdd)
+	dg.AddHandler(s.tagReply)
 
 	err = dg.Open()
 	if err != nil {
 		ln.FatalErr(ctx, err)
 	}
 
+	s.seedChannels(ctx)
+
+	go func() {
+		channels, err := s.monitoredChannels()
+		if err != nil {
+			ln.Error(ctx, err, ln.Action("listing monitored channels"))
+			return
+		}
+
+		s.newBackfiller().CatchUp(ctx, channels)
+	}()
+
 	r := chi.NewRouter()
 
 	r.Use(requestIDMiddleware)
@@ -136,17 +316,64 @@ func main() {
 	r.Get("/info", info)
 	r.Get("/login", s.login)
 	r.Get("/login/redirect", s.redirect)
-	r.Get("/images/id/{id}/img", s.image)
-	r.Get("/images/id/{id}/json", s.imageJSON)
+	r.Post("/logout", s.logout)
+	r.Get("/s/{id}", s.viewShare)
+	r.Get("/s/{id}/img/{image}", s.shareImage)
 
 	r.Route("/images", func(r chi.Router) {
-		r.Use(s.isLoggedIn)
+		r.With(s.isSignedOrAuthed).Get("/id/{id}/img", s.image)
+		r.With(s.isAuthed).Get("/id/{id}/json", s.imageJSON)
+
+		r.Group(func(r chi.Router) {
+			r.Use(s.isLoggedIn)
+			r.Use(s.checkCSRF)
+
+			r.Get("/", s.renderTemplatePage("index.html", nil).ServeHTTP)
+			r.Get("/recent", s.recent)
+			r.Get("/upload", s.uploadForm)
+			r.Post("/upload", s.upload)
+			r.Get("/id/{id}", s.one)
+			r.Get("/by/{author}", s.byPoster)
+			r.Get("/id/{id}/sign", s.signImage)
+			r.Post("/shares", s.createShare)
+			r.Get("/logs", bl.ServeHTTP)
+		})
+	})
+
+	r.Route("/api", func(r chi.Router) {
+		r.Use(s.isAuthed)
+		r.Use(s.checkCSRF)
+
+		r.Post("/images", s.apiUpload)
+		r.Get("/jobs", s.listJobs)
+		r.Get("/jobs/{id}", s.oneJob)
+	})
 
-		r.Get("/", s.renderTemplatePage("index.html", nil).ServeHTTP)
-		r.Get("/recent", s.recent)
-		r.Get("/id/{id}", s.one)
-		r.Get("/backup", s.backup)
-		r.Get("/logs", bl.ServeHTTP)
+	r.Route("/admin", func(r chi.Router) {
+		r.Use(s.isLoggedIn)
+		r.Use(s.isAdmin)
+		r.Use(s.checkCSRF)
+
+		r.Get("/shares", s.listShares)
+		r.Post("/shares/{id}/revoke", s.revokeShare)
+		r.Get("/sessions", s.listSessions)
+		r.Post("/sessions/{id}/revoke", s.revokeSession)
+		r.Get("/channels", s.listChannels)
+		r.Post("/channels", s.putChannel)
+		r.Post("/channels/{id}/delete", s.deleteChannel)
+		r.Get("/rules", s.listTagRules)
+		r.Post("/rules", s.addTagRule)
+		r.Post("/rules/{id}/delete", s.deleteTagRule)
+		r.Get("/export", s.exportImages)
+		r.Get("/backups", s.listBackups)
+		r.Post("/backups", s.snapshotNow)
+		r.Get("/backups/download", s.downloadBackup)
+		r.Get("/fsck", s.fsckReport)
+		r.Post("/fsck", s.scrubNow)
+		r.Get("/webhooks", s.listWebhooks)
+		r.Post("/webhooks", s.addWebhook)
+		r.Get("/webhooks/{id}", s.oneWebhook)
+		r.Post("/webhooks/{id}/delete", s.deleteWebhook)
 	})
 
 	mux := http.NewServeMux()
@@ -158,18 +385,36 @@ func main() {
 }
 
 type site struct {
-	cfg    config
-	oa2cfg *oauth2.Config
-	scfg   *session.Config
-	db     *storm.DB
-	dg     *discordgo.Session
-	i      database.Images
-	g      sandflake.Generator
+	cfg      config
+	oa2cfg   *oauth2.Config
+	scfg     *session.Config
+	db       *storm.DB
+	dg       *discordgo.Session
+	i        database.Images
+	shares   database.Shares
+	sessions database.Sessions
+	origins  database.Origins
+	cursors  database.Cursors
+	channels database.Channels
+	tagRules database.TagRules
+	events   *events.Bus
+	hooks    *webhook.Dispatcher
+	backups  *backup.Backups
+	scrubs   *scrubber
+	q        *ingest.Queue
+	slash    *slash.Handler
+	g        sandflake.Generator
+	keys     ksecretbox.Keyring
+
+	// guildsOf returns the archived guilds a user is in, see memberGuilds
+	guildsOf func(userID string) ([]string, error)
 }
 
 type sessionData struct {
-	ID   string
-	Code string
+	ID       string
+	UserID   string
+	Created  time.Time
+	LastSeen time.Time
 }
 
 func info(w http.ResponseWriter, r *http.Request) {
@@ -184,73 +429,102 @@ have any complaints or images you want removed.
 Be well, Creator.`)
 }
 
-func (s *site) isLoggedIn(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var ss sessionData
-		err := session.Get(r, &ss, s.scfg)
-		if err != nil {
-			ln.Error(r.Context(), err, ln.Action("redirecting to /login"))
-			http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
-			return
-		}
-
-		next.ServeHTTP(w, r)
-	})
-}
-
 func (s *site) messageCreate(ds *discordgo.Session, mc *discordgo.MessageCreate) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	found := false
-	for _, id := range s.cfg.DiscordMonitorChannels {
-		if id == mc.ChannelID {
-			found = true
-		}
+	if !s.monitored(mc.ChannelID) {
+		return
 	}
 
-	if !found {
-		return
+	s.enqueueMessage(ctx, mc.Message, false)
+
+	err := s.cursors.Advance(mc.ChannelID, mc.ID)
+	if err != nil {
+		ln.Error(ctx, err, ln.Action("advancing channel cursor"), ln.F{"channel_id": mc.ChannelID})
 	}
+}
 
-	for _, word := range strings.Fields(mc.Content) {
-		if !strings.HasPrefix(word, "http") {
-			continue
-		}
+func (s *site) login(w http.ResponseWriter, r *http.Request) {
+	u := s.oa2cfg.AuthCodeURL(s.g.Next().String())
+	http.Redirect(w, r, u, http.StatusTemporaryRedirect)
+}
 
-		i, err := s.i.Insert(word)
-		if err != nil {
-			ln.Error(ctx, err, ln.Action("saving attachments for message"), ln.F{"message_id": mc.ID, "author": mc.Author.Username, "url": word})
-			continue
-		}
+func (s *site) redirect(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	c := r.URL.Query().Get("code")
 
-		ln.Log(ctx, i, ln.Action("saved image"))
+	tok, err := s.oa2cfg.Exchange(ctx, c)
+	if err != nil {
+		ln.Error(ctx, err, ln.Action("exchanging oauth2 code"))
+		http.Error(w, "can't log in", http.StatusBadRequest)
+		return
+	}
 
-		ds.MessageReactionAdd(mc.ChannelID, mc.ID, "💾")
+	ud, err := discordgo.New("Bearer " + tok.AccessToken)
+	if err != nil {
+		ln.Error(ctx, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	for _, att := range mc.Attachments {
-		i, err := s.i.Insert(att.URL)
-		if err != nil {
-			ln.Error(ctx, err, ln.Action("saving attachments for message"), ln.F{"message_id": mc.ID, "author": mc.Author.Username})
-			continue
+	u, err := ud.User("@me")
+	if err != nil {
+		ln.Error(ctx, err, ln.Action("fetching discord user"))
+		http.Error(w, "can't log in", http.StatusBadGateway)
+		return
+	}
+
+	gs, err := ud.UserGuilds(100, "", "")
+	if err != nil {
+		ln.Error(ctx, err, ln.Action("fetching discord guilds"))
+		http.Error(w, "can't log in", http.StatusBadGateway)
+		return
+	}
+
+	var guilds []string
+	for _, g := range gs {
+		if contains(s.cfg.guilds(), g.ID) {
+			guilds = append(guilds, g.ID)
 		}
+	}
 
-		ln.Log(ctx, i, ln.Action("saved image"))
+	if len(guilds) == 0 {
+		ln.Log(ctx, ln.Action("rejecting login from outside the guilds"), ln.F{"user_id": u.ID, "username": u.Username})
+		http.Error(w, "you are not a member of any guild this archive is for", http.StatusForbidden)
+		return
+	}
 
-		ds.MessageReactionAdd(mc.ChannelID, mc.ID, "💾")
+	now := time.Now()
+	sd := &sessionData{
+		ID:       s.g.Next().String(),
+		UserID:   u.ID,
+		Created:  now,
+		LastSeen: now,
 	}
-}
 
-func (s *site) login(w http.ResponseWriter, r *http.Request) {
-	u := s.oa2cfg.AuthCodeURL(s.g.Next().String())
-	http.Redirect(w, r, u, http.StatusTemporaryRedirect)
-}
+	sess := &database.Session{
+		ID:           sd.ID,
+		UserID:       u.ID,
+		Username:     u.Username,
+		Created:      now,
+		LastSeen:     now,
+		GuildChecked: now,
+		Guilds:       guilds,
+		RemoteAddr:   r.RemoteAddr,
+		UserAgent:    r.UserAgent(),
+	}
 
-func (s *site) redirect(w http.ResponseWriter, r *http.Request) {
-	c := r.URL.Query().Get("code")
+	err = s.sessions.Put(sess)
+	if err != nil {
+		ln.Error(ctx, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ln.Log(ctx, sess, ln.Action("logged in"))
 
-	session.Set(w, &sessionData{ID: s.g.Next().String(), Code: c}, s.scfg)
+	session.Set(w, sd, s.scfg)
 	http.Redirect(w, r, "/images", http.StatusTemporaryRedirect)
 }
 
@@ -261,7 +535,7 @@ func (s *site) recent(w http.ResponseWriter, r *http.Request) {
 		pageID = keys[0]
 	}
 	i, _ := strconv.Atoi(pageID)
-	is, err := s.i.Recent(i)
+	is, err := s.i.Recent(i, visibleGuilds(r.Context()))
 	if err != nil {
 		ln.Error(r.Context(), err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -289,27 +563,96 @@ func (s *site) recent(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *site) one(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
+	i, ok := s.visible(r, chi.URLParam(r, "id"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
 
-	i, err := s.i.One(id)
+	origins, err := s.origins.ForImage(i.ID)
+	if err != nil {
+		ln.Error(r.Context(), err, i)
+	}
+	origins = visibleOrigins(r.Context(), origins)
+
+	data := struct {
+		*database.Image
+		Origins []database.Origin
+	}{
+		Image:   i,
+		Origins: origins,
+	}
+
+	s.renderTemplatePage("image.html", &data).ServeHTTP(w, r)
+}
+
+// byPoster lists the images a Discord user posted, newest first.
+func (s *site) byPoster(w http.ResponseWriter, r *http.Request) {
+	authorID := chi.URLParam(r, "author")
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+
+	origins, err := s.origins.ByAuthor(authorID, page)
 	if err != nil {
 		ln.Error(r.Context(), err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	origins = visibleOrigins(r.Context(), origins)
+
+	var is []database.Image
+	seen := map[string]bool{}
+	for _, o := range origins {
+		if seen[o.ImageID] {
+			continue
+		}
+		seen[o.ImageID] = true
+
+		i, err := s.i.One(o.ImageID)
+		if err != nil {
+			ln.Error(r.Context(), err, o)
+			continue
+		}
+
+		if i.Deleted {
+			continue
+		}
+
+		is = append(is, *i)
+	}
+
+	subtitle := "images posted by " + authorID
+	if len(origins) > 0 {
+		subtitle = "images posted by " + origins[0].Author
+	}
 
-	s.renderTemplatePage("image.html", i).ServeHTTP(w, r)
+	next := r.URL.Query()
+	next.Set("page", strconv.Itoa(page+1))
+	prev := r.URL.Query()
+	prev.Set("page", strconv.Itoa(page-1))
+
+	data := struct {
+		Subtitle string
+		Images   []database.Image
+		NextURL  string
+		PrevURL  string
+	}{
+		Subtitle: subtitle,
+		Images:   is,
+		NextURL:  r.URL.Path + "?" + next.Encode(),
+		PrevURL:  r.URL.Path + "?" + prev.Encode(),
+	}
+
+	s.renderTemplatePage("imagelist.html", &data).ServeHTTP(w, r)
 }
 
 func (s *site) image(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
-	i, err := s.i.One(id)
-	if err != nil {
-		ln.Error(r.Context(), err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	i, ok := s.visible(r, chi.URLParam(r, "id"))
+	if !ok {
+		http.NotFound(w, r)
 		return
 	}
 
+	var err error
 	if len(i.Data) == 0 {
 		i, err = s.i.Insert(i.URL)
 		if err != nil {
@@ -319,44 +662,48 @@ func (s *site) image(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	etag := "W/" + i.Blake2Hash
+	s.writeImage(w, r, i)
+}
 
-	if match := r.Header.Get("If-None-Match"); match != "" {
-		if strings.Contains(match, etag) {
-			w.WriteHeader(http.StatusNotModified)
+// writeImage sends the raw data of i, honoring ranges and If-None-Match.
+// With StripEXIF set, metadata is removed from the copy sent; the stored data
+// is unchanged. Data that can't be stripped isn't sent at all.
+func (s *site) writeImage(w http.ResponseWriter, r *http.Request, i *database.Image) {
+	data := i.Data
+	etag := i.Blake2Hash
+
+	if s.cfg.StripEXIF {
+		stripped, err := media.Strip(data)
+		if err == media.ErrUnknownFormat {
+			http.Error(w, "can't strip metadata from "+i.Mime+" files", http.StatusUnsupportedMediaType)
+			return
+		}
+		if err != nil {
+			ln.Error(r.Context(), err, i)
+			http.Error(w, "can't strip image metadata", http.StatusInternalServerError)
 			return
 		}
+		data = stripped
+		etag += "-stripped"
 	}
 
 	w.Header().Set("Content-Type", i.Mime)
 	w.Header().Set("Created-At", i.Added.Format(time.RFC3339))
 	w.Header().Set("Image-Hash", i.Blake2Hash)
-	w.Header().Set("ETag", etag)
-	w.Write(i.Data)
+	w.Header().Set("ETag", `W/"`+etag+`"`)
+
+	// ServeContent answers range requests, which browsers need to seek in
+	// videos, and conditional requests
+	http.ServeContent(w, r, "", i.Added, bytes.NewReader(data))
 }
 
 func (s *site) imageJSON(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
-	i, err := s.i.One(id)
-	if err != nil {
-		ln.Error(r.Context(), err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	i, ok := s.visible(r, chi.URLParam(r, "id"))
+	if !ok {
+		http.NotFound(w, r)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(i)
 }
-
-func (s *site) backup(w http.ResponseWriter, r *http.Request) {
-	err := s.db.Bolt.View(func(tx *bolt.Tx) error {
-		w.Header().Set("Content-Type", "application/octet-stream")
-		w.Header().Set("Content-Disposition", `attachment; filename="kinq.db"`)
-		w.Header().Set("Content-Length", strconv.Itoa(int(tx.Size())))
-		_, err := tx.WriteTo(w)
-		return err
-	})
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
-}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Xe/kinq/internal/events"
+	"github.com/Xe/kinq/internal/ingest"
+	"github.com/Xe/kinq/internal/notify"
+	"within.website/ln"
+)
+
+// startNotifier posts events to DISCORD_LOG_CHANNEL, if it is set.
+func (s *site) startNotifier(ctx context.Context) {
+	if s.cfg.DiscordLogChannel == "" {
+		return
+	}
+
+	n := notify.New(notify.Config{
+		Interval: s.cfg.NotifyInterval,
+		MaxLines: s.cfg.NotifyMaxLines,
+	}, func(ctx context.Context, content string) error {
+		_, err := s.dg.ChannelMessageSend(s.cfg.DiscordLogChannel, content)
+		return err
+	})
+
+	err := s.events.Subscribe(ctx, "discord", n.Add)
+	if err != nil {
+		ln.Error(ctx, err, ln.Action("subscribing discord notifier"))
+		return
+	}
+	go n.Run(ctx)
+
+	ln.Log(ctx, ln.Action("posting events to discord"), ln.F{"channel_id": s.cfg.DiscordLogChannel})
+}
+
+// publishIngestFailed reports a job that won't be retried.
+func (s *site) publishIngestFailed(j ingest.Job, err error) {
+	summary := fmt.Sprintf("couldn't archive %s: %v", j.URL, err)
+	if j.ChannelName != "" {
+		summary = fmt.Sprintf("couldn't archive %s from #%s: %v", j.URL, j.ChannelName, err)
+	}
+
+	s.events.Publish(context.Background(), events.Event{
+		Kind:    events.IngestFailed,
+		Summary: summary,
+		Fields: map[string]string{
+			"job_id":     j.ID,
+			"url":        j.URL,
+			"error":      err.Error(),
+			"channel_id": j.ChannelID,
+			"message_id": j.MessageID,
+		},
+	})
+}
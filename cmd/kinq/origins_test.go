@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Xe/kinq/internal/database"
+	"github.com/Xe/kinq/internal/ingest"
+)
+
+func TestIngestDoneRecordsOrigin(t *testing.T) {
+	s := testSite(t, "kinq.db")
+	s.tagRules = database.NewStormTagRules(s.db)
+
+	img, err := s.i.InsertBytes(testPNG(t, 1), "image/png", "https://example.com/a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	posted := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	jobs := []ingest.Job{
+		{
+			URL: img.URL, GuildID: "g1", ChannelID: "c1", ChannelName: "art", MessageID: "m1",
+			AuthorID: "u1", Author: "alice", Content: "look " + img.URL, Posted: posted, Quiet: true,
+		},
+		// reposted later by someone else
+		{
+			URL: img.URL, GuildID: "g1", ChannelID: "c2", ChannelName: "memes", MessageID: "m2",
+			AuthorID: "u2", Author: "bob", Content: img.URL, Posted: posted.Add(time.Hour), Quiet: true,
+		},
+	}
+	for _, j := range jobs {
+		s.ingestDone(j, img, nil)
+	}
+	// the same message finishing twice doesn't record it twice
+	s.ingestDone(jobs[0], img, nil)
+
+	origins, err := s.origins.ForImage(img.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(origins) != len(jobs) {
+		t.Fatalf("image has %d origins, want %d", len(origins), len(jobs))
+	}
+	for n, j := range jobs {
+		o := origins[n]
+		if o.GuildID != j.GuildID || o.ChannelID != j.ChannelID || o.ChannelName != j.ChannelName ||
+			o.MessageID != j.MessageID || o.AuthorID != j.AuthorID || o.Author != j.Author ||
+			o.Content != j.Content || !o.Posted.Equal(j.Posted) {
+			t.Errorf("origin %d = %+v, want the message of job %+v", n, o, j)
+		}
+	}
+
+	byAuthor, err := s.origins.ByAuthor("u2", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(byAuthor) != 1 || byAuthor[0].MessageID != "m2" {
+		t.Errorf("ByAuthor(u2) = %+v, want the origin in m2", byAuthor)
+	}
+
+	got, err := s.i.One(img.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Guilds) != 1 || got.Guilds[0] != "g1" {
+		t.Errorf("image guilds = %v, want [g1]", got.Guilds)
+	}
+}
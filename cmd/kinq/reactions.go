@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/Xe/kinq/internal/database"
+	"github.com/Xe/kinq/internal/discord"
+	"github.com/Xe/kinq/internal/slash"
+	"github.com/bwmarrin/discordgo"
+	"within.website/ln"
+)
+
+const (
+	emojiTagged  = "✅"
+	emojiNothing = "❓"
+)
+
+// sameEmoji compares emoji ignoring variation selectors, which clients
+// don't agree on sending.
+func sameEmoji(a, b string) bool {
+	return a != "" && strings.Trim(a, "\ufe0f") == strings.Trim(b, "\ufe0f")
+}
+
+// member looks up a guild member in the state cache, falling back to the API.
+func (s *site) member(guildID, userID string) (*discordgo.Member, error) {
+	if m, err := s.dg.State.Member(guildID, userID); err == nil {
+		return m, nil
+	}
+
+	return s.dg.GuildMember(guildID, userID)
+}
+
+// fromSelf returns true if userID is the bot itself, so its own reactions
+// aren't taken as requests.
+func (s *site) fromSelf(userID string) bool {
+	return s.dg.State.User != nil && s.dg.State.User.ID == userID
+}
+
+// messageReactionAdd archives messages reacted to with the archive emoji and
+// lets moderators delete archived images with the delete emoji.
+func (s *site) messageReactionAdd(ds *discordgo.Session, ra *discordgo.MessageReactionAdd) {
+	ctx := context.Background()
+	f := ln.F{"channel_id": ra.ChannelID, "message_id": ra.MessageID, "user_id": ra.UserID, "emoji": ra.Emoji.Name}
+
+	if s.fromSelf(ra.UserID) {
+		return
+	}
+
+	switch {
+	case sameEmoji(s.cfg.DiscordArchiveEmoji, ra.Emoji.Name):
+		if _, ok := s.guildOf(ra.ChannelID); !ok {
+			return
+		}
+
+		seen, err := s.q.HasMessage(ra.MessageID)
+		if err != nil {
+			ln.Error(ctx, err, f)
+			return
+		}
+		if seen {
+			return
+		}
+
+		m, err := s.dg.ChannelMessage(ra.ChannelID, ra.MessageID)
+		if err != nil {
+			ln.Error(ctx, err, f, ln.Action("getting reacted message"))
+			return
+		}
+
+		ln.Log(ctx, f, ln.Action("archiving message by reaction"))
+		s.enqueueMessage(ctx, m, false)
+
+	case sameEmoji(s.cfg.DiscordDeleteEmoji, ra.Emoji.Name):
+		guildID, ok := s.guildOf(ra.ChannelID)
+		if !ok {
+			return
+		}
+
+		mem, err := s.member(guildID, ra.UserID)
+		if err != nil {
+			ln.Error(ctx, err, f, ln.Action("getting member"))
+			return
+		}
+		if !discord.HasRole(mem, s.cfg.DiscordDeleteRoles) {
+			return
+		}
+
+		origins, err := s.origins.ForMessage(ra.MessageID)
+		if err != nil {
+			ln.Error(ctx, err, f)
+			return
+		}
+
+		// the image is only taken out of this guild, other guilds keep it
+		for _, o := range origins {
+			deleted, err := s.i.RemoveGuild(o.ImageID, guildID)
+			if err != nil {
+				ln.Error(ctx, err, f, o, ln.Action("deleting image by reaction"))
+				continue
+			}
+
+			err = s.origins.RemoveGuild(o.ImageID, guildID)
+			if err != nil {
+				ln.Error(ctx, err, f, o, ln.Action("removing origins of image deleted by reaction"))
+				continue
+			}
+
+			ln.Log(ctx, f, o, ln.Action("deleted image by reaction"), ln.F{"deleted_everywhere": deleted})
+		}
+
+		if len(origins) > 0 {
+			s.dg.MessageReactionRemove(ra.ChannelID, ra.MessageID, emojiSaved, "@me")
+		}
+	}
+}
+
+// tagReply adds tags to the images archived from a message when someone
+// replies to it with the tag emoji followed by tags, like "🏷️ cute -sad".
+// discordgo doesn't decode replies, so this reads raw events.
+func (s *site) tagReply(ds *discordgo.Session, e *discordgo.Event) {
+	ctx := context.Background()
+
+	m, ref, err := discord.ParseReply(e)
+	if err != nil {
+		ln.Error(ctx, err, ln.Action("parsing reply"))
+		return
+	}
+	if m == nil || m.Author == nil || s.fromSelf(m.Author.ID) {
+		return
+	}
+
+	words := strings.Fields(m.Content)
+	if len(words) < 2 || !sameEmoji(s.cfg.DiscordTagEmoji, words[0]) {
+		return
+	}
+
+	f := ln.F{"channel_id": m.ChannelID, "message_id": ref.MessageID, "user_id": m.Author.ID}
+
+	guildID, ok := s.guildOf(m.ChannelID)
+	if !ok {
+		return
+	}
+
+	if len(s.cfg.DiscordTagRoles) > 0 {
+		mem, err := s.member(guildID, m.Author.ID)
+		if err != nil {
+			ln.Error(ctx, err, f, ln.Action("getting member"))
+			return
+		}
+		if !discord.HasRole(mem, s.cfg.DiscordTagRoles) {
+			return
+		}
+	}
+
+	origins, err := s.origins.ForMessage(ref.MessageID)
+	if err != nil {
+		ln.Error(ctx, err, f)
+		return
+	}
+	if len(origins) == 0 {
+		s.dg.MessageReactionAdd(m.ChannelID, m.ID, emojiNothing)
+		return
+	}
+
+	add, remove := slash.ParseTagChanges(words[1:])
+	for _, o := range origins {
+		err = s.retag(o, add, remove)
+		if err != nil {
+			ln.Error(ctx, err, f, o, ln.Action("tagging image from reply"))
+			s.dg.MessageReactionAdd(m.ChannelID, m.ID, emojiFailed)
+			return
+		}
+	}
+
+	ln.Log(ctx, f, ln.Action("tagged images from reply"), ln.F{"add": add, "remove": remove, "images": len(origins)})
+	s.dg.MessageReactionAdd(m.ChannelID, m.ID, emojiTagged)
+}
+
+func (s *site) retag(o database.Origin, add, remove []string) error {
+	if len(add) > 0 {
+		if err := s.i.AddTags(o.ImageID, add); err != nil {
+			return err
+		}
+	}
+
+	if len(remove) > 0 {
+		if err := s.i.RemoveTags(o.ImageID, remove); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/Xe/kinq/internal/database"
+	"github.com/kr/session"
+	chi "gopkg.in/chi.v3"
+	"within.website/ln"
+)
+
+const (
+	// how often LastSeen is written back to the cookie and the registry
+	sessionTouchInterval = time.Minute
+	// how often a session's user is checked for guild memberships
+	guildCheckInterval = 10 * time.Minute
+	// how long to wait before asking Discord again after it failed to answer
+	guildRetryInterval = time.Minute
+	// how often sessions that can't be used anymore are removed
+	sessionPruneInterval = time.Hour
+)
+
+var (
+	errSessionExpired = errors.New("session expired")
+	errSessionIdle    = errors.New("session idle for too long")
+	errSessionRevoked = errors.New("session revoked")
+	errLeftGuild      = errors.New("user is no longer a member of any archived guild")
+)
+
+type ctxKey int
+
+const (
+	sessionDataKey ctxKey = iota
+	sessionGuildsKey
+)
+
+// currentSession returns the session data isLoggedIn put in ctx.
+func currentSession(ctx context.Context) (sessionData, bool) {
+	sd, ok := ctx.Value(sessionDataKey).(sessionData)
+	return sd, ok
+}
+
+func (s *site) clearSession(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     s.scfg.Name,
+		Path:     s.scfg.Path,
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+}
+
+// checkSession validates sd against the configured expiry and the session
+// registry. The registry record is returned so callers can update it.
+func (s *site) checkSession(sd sessionData, now time.Time) (*database.Session, error) {
+	if sd.Created.IsZero() || now.Sub(sd.Created) > s.cfg.SessionMaxAge {
+		return nil, errSessionExpired
+	}
+
+	if now.Sub(sd.LastSeen) > s.cfg.SessionIdleTimeout {
+		return nil, errSessionIdle
+	}
+
+	sess, err := s.sessions.One(sd.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if sess.Revoked {
+		return nil, errSessionRevoked
+	}
+
+	if sess.Guilds == nil || now.Sub(sess.GuildChecked) > guildCheckInterval {
+		guilds, err := s.guildsOf(sess.UserID)
+		switch {
+		case err != nil:
+			// Discord couldn't answer for every guild, so keep what the
+			// session had and ask again in guildRetryInterval instead of on
+			// every request
+			ln.Error(context.Background(), err, sess, ln.Action("checking guild membership"))
+			if sess.Guilds == nil {
+				sess.Guilds = guilds
+			}
+			sess.GuildChecked = now.Add(guildRetryInterval - guildCheckInterval)
+			err = s.sessions.Put(sess)
+			if err != nil {
+				return nil, err
+			}
+		case len(guilds) == 0:
+			s.sessions.RevokeUser(sess.UserID)
+			return nil, errLeftGuild
+		default:
+			sess.Guilds = guilds
+			sess.GuildChecked = now
+			err = s.sessions.Put(sess)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return sess, nil
+}
+
+func (s *site) isLoggedIn(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		var ss sessionData
+		err := session.Get(r, &ss, s.scfg)
+		if err != nil {
+			ln.Error(ctx, err, ln.Action("redirecting to /login"))
+			http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+			return
+		}
+
+		now := time.Now()
+		sess, err := s.checkSession(ss, now)
+		if err != nil {
+			ln.Error(ctx, err, ln.Action("redirecting to /login"), ln.F{"session_id": ss.ID, "user_id": ss.UserID})
+			s.clearSession(w)
+			http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+			return
+		}
+
+		if now.Sub(ss.LastSeen) > sessionTouchInterval || s.sealedWithOldKey(r) {
+			ss.LastSeen = now
+			session.Set(w, &ss, s.scfg)
+
+			sess.LastSeen = now
+			sess.RemoteAddr = r.RemoteAddr
+			sess.UserAgent = r.UserAgent()
+			err = s.sessions.Put(sess)
+			if err != nil {
+				ln.Error(ctx, err, sess)
+			}
+		}
+
+		ctx = context.WithValue(ctx, sessionDataKey, ss)
+		if !s.isAdminUser(ss.UserID) {
+			ctx = context.WithValue(ctx, sessionGuildsKey, append([]string{}, sess.Guilds...))
+		}
+		ctx = ln.WithF(ctx, ln.F{"user_id": ss.UserID})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// sealedWithOldKey reports whether the session cookie on r can only be opened
+// with one of the older keys, meaning it should be sealed again with the
+// newest one.
+func (s *site) sealedWithOldKey(r *http.Request) bool {
+	if len(s.scfg.Keys) < 2 {
+		return false
+	}
+
+	pcfg := *s.scfg
+	pcfg.Keys = s.scfg.Keys[:1]
+
+	var ss sessionData
+	return session.Get(r, &ss, &pcfg) != nil
+}
+
+func (s *site) isAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sd, ok := currentSession(r.Context())
+		if ok && s.isAdminUser(sd.UserID) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		http.Error(w, "you are not an admin", http.StatusForbidden)
+	})
+}
+
+// startSessionPrune removes expired sessions from the registry every
+// sessionPruneInterval.
+func (s *site) startSessionPrune(ctx context.Context) {
+	go func() {
+		t := time.NewTicker(sessionPruneInterval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-t.C:
+				n, err := s.sessions.Prune(now.Add(-s.cfg.SessionMaxAge), now.Add(-s.cfg.SessionIdleTimeout))
+				if err != nil {
+					ln.Error(ctx, err, ln.Action("pruning sessions"))
+					continue
+				}
+				if n > 0 {
+					ln.Log(ctx, ln.Action("pruned sessions"), ln.F{"count": n})
+				}
+			}
+		}
+	}()
+}
+
+func (s *site) logout(w http.ResponseWriter, r *http.Request) {
+	var ss sessionData
+	if err := session.Get(r, &ss, s.scfg); err == nil {
+		err = s.sessions.Revoke(ss.ID)
+		if err != nil {
+			ln.Error(r.Context(), err, ln.F{"session_id": ss.ID})
+		}
+	}
+
+	s.clearSession(w)
+	http.Redirect(w, r, "/info", http.StatusSeeOther)
+}
+
+func (s *site) listSessions(w http.ResponseWriter, r *http.Request) {
+	sessions, err := s.sessions.List()
+	if err != nil {
+		ln.Error(r.Context(), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	type sessionRow struct {
+		database.Session
+		Active bool
+	}
+
+	now := time.Now()
+	var rows []sessionRow
+	for _, sess := range sessions {
+		active := !sess.Revoked &&
+			now.Sub(sess.Created) <= s.cfg.SessionMaxAge &&
+			now.Sub(sess.LastSeen) <= s.cfg.SessionIdleTimeout
+
+		rows = append(rows, sessionRow{Session: sess, Active: active})
+	}
+
+	data := struct {
+		Subtitle string
+		Sessions []sessionRow
+	}{
+		Subtitle: "sessions",
+		Sessions: rows,
+	}
+
+	s.renderTemplatePage("sessions.html", &data).ServeHTTP(w, r)
+}
+
+func (s *site) revokeSession(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	err := s.sessions.Revoke(id)
+	if err != nil {
+		ln.Error(r.Context(), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ln.Log(r.Context(), ln.Action("revoked session"), ln.F{"session_id": id})
+
+	http.Redirect(w, r, "/admin/sessions", http.StatusSeeOther)
+}
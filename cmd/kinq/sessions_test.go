@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Xe/kinq/internal/database"
+)
+
+func TestCheckSession(t *testing.T) {
+	s := testSite(t, "sessions.db")
+	s.cfg.SessionMaxAge = 24 * time.Hour
+	s.cfg.SessionIdleTimeout = time.Hour
+	s.sessions = database.NewStormSessions(s.db)
+
+	now := time.Now()
+	put := func(sess database.Session) sessionData {
+		t.Helper()
+		if err := s.sessions.Put(&sess); err != nil {
+			t.Fatal(err)
+		}
+		return sessionData{ID: sess.ID, UserID: sess.UserID, Created: sess.Created, LastSeen: sess.LastSeen}
+	}
+
+	var calls int
+	var guilds []string
+	var lookupErr error
+	s.guildsOf = func(userID string) ([]string, error) {
+		calls++
+		return guilds, lookupErr
+	}
+
+	t.Run("expiry", func(t *testing.T) {
+		old := put(database.Session{ID: "old", UserID: "u", Created: now.Add(-48 * time.Hour), LastSeen: now})
+		if _, err := s.checkSession(old, now); err != errSessionExpired {
+			t.Errorf("old session: %v, want %v", err, errSessionExpired)
+		}
+
+		idle := put(database.Session{ID: "idle", UserID: "u", Created: now, LastSeen: now.Add(-2 * time.Hour)})
+		if _, err := s.checkSession(idle, now); err != errSessionIdle {
+			t.Errorf("idle session: %v, want %v", err, errSessionIdle)
+		}
+
+		revoked := put(database.Session{ID: "revoked", UserID: "u", Created: now, LastSeen: now, Revoked: true})
+		if _, err := s.checkSession(revoked, now); err != errSessionRevoked {
+			t.Errorf("revoked session: %v, want %v", err, errSessionRevoked)
+		}
+	})
+
+	t.Run("discord down", func(t *testing.T) {
+		sd := put(database.Session{ID: "down", UserID: "u", Created: now, LastSeen: now, Guilds: []string{"g1", "g2"}})
+		calls, guilds, lookupErr = 0, []string{"g1"}, errors.New("discord is down")
+
+		for n := 0; n < 3; n++ {
+			sess, err := s.checkSession(sd, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(sess.Guilds, []string{"g1", "g2"}) {
+				t.Errorf("guilds = %v, want the ones the session had", sess.Guilds)
+			}
+		}
+		if calls != 1 {
+			t.Errorf("asked Discord %d times, want once until guildRetryInterval passed", calls)
+		}
+
+		lookupErr = nil
+		sess, err := s.checkSession(sd, now.Add(guildRetryInterval+time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if calls != 2 || !reflect.DeepEqual(sess.Guilds, []string{"g1"}) {
+			t.Errorf("after the retry interval: %d calls, guilds %v", calls, sess.Guilds)
+		}
+	})
+
+	t.Run("left guild", func(t *testing.T) {
+		sd := put(database.Session{ID: "left", UserID: "leaver", Created: now, LastSeen: now})
+		other := put(database.Session{ID: "left2", UserID: "leaver", Created: now, LastSeen: now, Guilds: []string{"g1"}, GuildChecked: now})
+		guilds, lookupErr = nil, nil
+
+		if _, err := s.checkSession(sd, now); err != errLeftGuild {
+			t.Fatalf("session of a user in no guild: %v, want %v", err, errLeftGuild)
+		}
+		if _, err := s.checkSession(other, now); err != errSessionRevoked {
+			t.Errorf("other session of that user: %v, want %v", err, errSessionRevoked)
+		}
+	})
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Xe/kinq/internal/database"
+	chi "gopkg.in/chi.v3"
+	"within.website/ln"
+)
+
+const (
+	defaultShareTTL = 24 * time.Hour
+	maxShareTTL     = 30 * 24 * time.Hour
+
+	// shareViewTTL is how long the images of a gallery can be loaded after
+	// the page was viewed.
+	shareViewTTL = time.Hour
+)
+
+func shareSignatureMessage(sh *database.Share) []byte {
+	return []byte("share:" + sh.ID + ":" + strconv.FormatInt(sh.Expires.Unix(), 10))
+}
+
+func (s *site) shareSig(sh *database.Share) string {
+	return s.keys.Sign(shareSignatureMessage(sh))
+}
+
+// shareView lets the images of a share be loaded for a while after one
+// counted view of it.
+type shareView struct {
+	Number  int
+	Expires int64
+	Sig     string
+}
+
+func shareViewMessage(sh *database.Share, number int, expires int64) []byte {
+	return []byte("shareview:" + sh.ID + ":" + strconv.Itoa(number) + ":" + strconv.FormatInt(expires, 10))
+}
+
+// newShareView signs the view of sh that was just counted.
+func (s *site) newShareView(sh *database.Share) shareView {
+	expires := time.Now().Add(shareViewTTL)
+	if sh.Expires.Before(expires) {
+		expires = sh.Expires
+	}
+
+	v := shareView{Number: sh.Views, Expires: expires.Unix()}
+	v.Sig = s.keys.Sign(shareViewMessage(sh, v.Number, v.Expires))
+
+	return v
+}
+
+// validShareView checks the view token in the query of r.
+func (s *site) validShareView(r *http.Request, sh *database.Share) bool {
+	q := r.URL.Query()
+
+	number, err := strconv.Atoi(q.Get("view"))
+	if err != nil || number < 1 || (sh.MaxViews > 0 && number > sh.MaxViews) {
+		return false
+	}
+
+	expires, err := strconv.ParseInt(q.Get("vexp"), 10, 64)
+	if err != nil || time.Now().After(time.Unix(expires, 0)) {
+		return false
+	}
+
+	return s.keys.Verify(shareViewMessage(sh, number, expires), q.Get("vsig"))
+}
+
+// shareURL returns the public path for sh.
+func (s *site) shareURL(sh *database.Share) string {
+	return "/s/" + sh.ID + "?sig=" + s.shareSig(sh)
+}
+
+func (s *site) createShare(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ids := r.PostForm["id"]
+	for _, id := range ids {
+		if _, ok := s.visible(r, id); !ok {
+			http.Error(w, "unknown image: "+id, http.StatusBadRequest)
+			return
+		}
+	}
+
+	ttl := defaultShareTTL
+	if t := r.PostForm.Get("ttl"); t != "" {
+		ttl, err = time.ParseDuration(t)
+		if err != nil || ttl <= 0 || ttl > maxShareTTL {
+			http.Error(w, "ttl must be a duration between 0 and "+maxShareTTL.String(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var maxViews int
+	if mv := r.PostForm.Get("max_views"); mv != "" {
+		maxViews, err = strconv.Atoi(mv)
+		if err != nil || maxViews < 0 {
+			http.Error(w, "max_views must be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	sh, err := s.shares.Create(ids, time.Now().Add(ttl), maxViews)
+	if err != nil {
+		ln.Error(r.Context(), err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ln.Log(r.Context(), sh, ln.Action("created share"))
+
+	// only admins can see every share, everyone else gets the link once
+	if sd, ok := currentSession(r.Context()); ok && s.isAdminUser(sd.UserID) {
+		http.Redirect(w, r, "/admin/shares", http.StatusSeeOther)
+		return
+	}
+
+	s.renderShares(w, r, []database.Share{*sh}, false)
+}
+
+func (s *site) listShares(w http.ResponseWriter, r *http.Request) {
+	shares, err := s.shares.List()
+	if err != nil {
+		ln.Error(r.Context(), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.renderShares(w, r, shares, true)
+}
+
+// renderShares shows shares with their links. Only admins get to revoke
+// them.
+func (s *site) renderShares(w http.ResponseWriter, r *http.Request, shares []database.Share, admin bool) {
+	type shareRow struct {
+		database.Share
+		URL    string
+		Status string
+	}
+
+	now := time.Now()
+	rows := make([]shareRow, 0, len(shares))
+	for _, sh := range shares {
+		status := "active"
+		if err := sh.Valid(now); err != nil {
+			status = err.Error()
+		}
+
+		rows = append(rows, shareRow{
+			Share:  sh,
+			URL:    s.shareURL(&sh),
+			Status: status,
+		})
+	}
+
+	data := struct {
+		Subtitle string
+		Admin    bool
+		Shares   []shareRow
+	}{
+		Subtitle: "share links",
+		Admin:    admin,
+		Shares:   rows,
+	}
+
+	s.renderTemplatePage("shares.html", &data).ServeHTTP(w, r)
+}
+
+func (s *site) revokeShare(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	err := s.shares.Revoke(id)
+	if err != nil {
+		ln.Error(r.Context(), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ln.Log(r.Context(), ln.Action("revoked share"), ln.F{"share_id": id})
+
+	http.Redirect(w, r, "/admin/shares", http.StatusSeeOther)
+}
+
+// signedShare loads the share named in the URL and checks its signature.
+func (s *site) signedShare(r *http.Request) (*database.Share, bool) {
+	sh, err := s.shares.One(chi.URLParam(r, "id"))
+	if err != nil {
+		return nil, false
+	}
+
+	if !s.keys.Verify(shareSignatureMessage(sh), r.URL.Query().Get("sig")) {
+		return nil, false
+	}
+
+	return sh, true
+}
+
+func (s *site) viewShare(w http.ResponseWriter, r *http.Request) {
+	sh, ok := s.signedShare(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	sh, err := s.shares.View(sh.ID)
+	if err != nil {
+		ln.Error(r.Context(), err, ln.F{"share_id": chi.URLParam(r, "id")})
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+
+	ln.Log(r.Context(), sh, ln.Action("viewed share"))
+
+	if len(sh.ImageIDs) == 1 {
+		i, err := s.i.One(sh.ImageIDs[0])
+		if err != nil {
+			ln.Error(r.Context(), err)
+			http.NotFound(w, r)
+			return
+		}
+		if i.Deleted {
+			http.NotFound(w, r)
+			return
+		}
+
+		s.writeImage(w, r, i)
+		return
+	}
+
+	var images []database.Image
+	for _, id := range sh.ImageIDs {
+		i, err := s.i.One(id)
+		if err != nil {
+			ln.Error(r.Context(), err, sh)
+			continue
+		}
+		if i.Deleted {
+			continue
+		}
+
+		images = append(images, *i)
+	}
+
+	data := struct {
+		Subtitle string
+		Share    *database.Share
+		Sig      string
+		View     shareView
+		Images   []database.Image
+	}{
+		Subtitle: "shared images",
+		Share:    sh,
+		Sig:      s.shareSig(sh),
+		View:     s.newShareView(sh),
+		Images:   images,
+	}
+
+	s.renderTemplatePage("share.html", &data).ServeHTTP(w, r)
+}
+
+// shareImage serves one image of a gallery share. Views are counted when the
+// gallery page is loaded, which hands out a view token for its images, so
+// running out of views doesn't break the images on a page that was already
+// shown but the link alone can't load them anymore.
+func (s *site) shareImage(w http.ResponseWriter, r *http.Request) {
+	sh, ok := s.signedShare(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	err := sh.Valid(time.Now())
+	if err != nil && err != database.ErrShareExhausted {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+
+	if !s.validShareView(r, sh) {
+		http.Error(w, "view the share link again to load its images", http.StatusGone)
+		return
+	}
+
+	imageID := chi.URLParam(r, "image")
+	if !sh.Has(imageID) {
+		http.NotFound(w, r)
+		return
+	}
+
+	i, err := s.i.One(imageID)
+	if err != nil {
+		ln.Error(r.Context(), err)
+		http.NotFound(w, r)
+		return
+	}
+	if i.Deleted {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.writeImage(w, r, i)
+}
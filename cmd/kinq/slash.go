@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Xe/kinq/internal/discord"
+	"github.com/Xe/kinq/internal/slash"
+	"github.com/bwmarrin/discordgo"
+	"within.website/ln"
+)
+
+// embedImageTTL is how long image links in command responses work.
+const embedImageTTL = 24 * time.Hour
+
+// siteURL returns where the web UI is, guessing from the OAuth2 redirect URL
+// if it isn't configured.
+func siteURL(cfg config) string {
+	if cfg.SiteURL != "" {
+		return strings.TrimSuffix(cfg.SiteURL, "/")
+	}
+
+	u, err := url.Parse(cfg.DiscordOAuth2RedirectURL)
+	if err != nil {
+		return ""
+	}
+
+	return u.Scheme + "://" + u.Host
+}
+
+func (s *site) newSlashHandler() *slash.Handler {
+	base := siteURL(s.cfg)
+
+	return slash.New(slash.Config{
+		Guilds:      s.cfg.guilds(),
+		SiteURL:     base,
+		TagRoles:    s.cfg.DiscordTagRoles,
+		DeleteRoles: s.cfg.DiscordDeleteRoles,
+		ImageURL: func(id string) string {
+			return base + s.signedImageURL(id, time.Now().Add(embedImageTTL))
+		},
+	}, s.i, s.origins, func(ctx context.Context, in *discord.Interaction, r *discord.InteractionResponse) error {
+		return discord.Respond(s.dg, in, r)
+	})
+}
+
+// ready registers the /kinq command in every archived guild once the bot
+// knows who it is.
+func (s *site) ready(ds *discordgo.Session, r *discordgo.Ready) {
+	ctx := context.Background()
+
+	for _, g := range s.cfg.guilds() {
+		err := discord.RegisterGuildCommands(ds, r.User.ID, g, []*discord.ApplicationCommand{slash.Command})
+		if err != nil {
+			ln.Error(ctx, err, ln.Action("registering slash commands"), ln.F{"guild_id": g})
+			continue
+		}
+
+		ln.Log(ctx, ln.Action("registered slash commands"), ln.F{"guild_id": g})
+	}
+}
+
+// interactionCreate passes application commands to the slash handler. The
+// discordgo version in use doesn't know about them, so they arrive as raw
+// events.
+func (s *site) interactionCreate(ds *discordgo.Session, e *discordgo.Event) {
+	ctx := context.Background()
+
+	in, err := discord.ParseInteraction(e)
+	if err != nil {
+		ln.Error(ctx, err, ln.Action("parsing interaction"))
+		return
+	}
+	if in == nil {
+		return
+	}
+
+	err = s.slash.Handle(ctx, in)
+	if err != nil {
+		ln.Error(ctx, err, ln.Action("responding to interaction"), ln.F{"interaction_id": in.ID})
+	}
+}
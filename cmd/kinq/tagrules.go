@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/Xe/kinq/internal/database"
+	chi "gopkg.in/chi.v3"
+	"within.website/ln"
+)
+
+func (s *site) listTagRules(w http.ResponseWriter, r *http.Request) {
+	rules, err := s.tagRules.List()
+	if err != nil {
+		ln.Error(r.Context(), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	channels, err := s.channels.List()
+	if err != nil {
+		ln.Error(r.Context(), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	names := map[string]string{}
+	for _, c := range channels {
+		names[c.ChannelID] = c.Name
+	}
+
+	data := struct {
+		Subtitle     string
+		Rules        []database.TagRule
+		Channels     []database.ChannelConfig
+		ChannelNames map[string]string
+	}{
+		Subtitle:     "tag rules",
+		Rules:        rules,
+		Channels:     channels,
+		ChannelNames: names,
+	}
+
+	s.renderTemplatePage("tagrules.html", &data).ServeHTTP(w, r)
+}
+
+func (s *site) addTagRule(w http.ResponseWriter, r *http.Request) {
+	rule := &database.TagRule{
+		ChannelID:     r.FormValue("channel_id"),
+		Host:          strings.TrimSpace(r.FormValue("host")),
+		ScraperTag:    strings.TrimSpace(r.FormValue("scraper_tag")),
+		NoScraperTags: r.FormValue("no_scraper_tags") != "",
+		Tags:          splitList(r.FormValue("tags")),
+	}
+	if len(rule.Tags) == 0 {
+		http.Error(w, "a rule needs tags to add", http.StatusBadRequest)
+		return
+	}
+	if sd, ok := currentSession(r.Context()); ok {
+		rule.CreatedBy = sd.UserID
+	}
+
+	err := s.tagRules.Add(rule)
+	if err != nil {
+		ln.Error(r.Context(), err, rule)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ln.Log(r.Context(), rule, ln.Action("added tag rule"))
+
+	http.Redirect(w, r, "/admin/rules", http.StatusSeeOther)
+}
+
+func (s *site) deleteTagRule(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	err := s.tagRules.Delete(id)
+	if err != nil {
+		ln.Error(r.Context(), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ln.Log(r.Context(), ln.Action("deleted tag rule"), ln.F{"tag_rule_id": id})
+
+	http.Redirect(w, r, "/admin/rules", http.StatusSeeOther)
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Xe/kinq/internal/database"
+	"github.com/Xe/kinq/internal/ingest"
+	"within.website/ln"
+)
+
+const (
+	// maxUploadMemory is how much of a multipart upload is held in memory
+	// before the rest goes to temporary files.
+	maxUploadMemory = 32 << 20
+
+	// maxUploadFiles is how many files one request can upload.
+	maxUploadFiles = 20
+
+	// uploadSlack is room for the form fields and multipart headers of an
+	// upload on top of its files.
+	uploadSlack = 1 << 20
+)
+
+var (
+	errNoFiles         = errors.New("upload at least one file or give a url")
+	errSourceWithFiles = errors.New("a source url can only be given for a single file")
+	errBadSourceURL    = errors.New("urls must be http or https")
+	errNotYourGuild    = errors.New("you can't upload to that guild")
+	errTooManyFiles    = fmt.Errorf("upload at most %d files at once", maxUploadFiles)
+)
+
+// guildChoice is a guild uploads can go to.
+type guildChoice struct {
+	ID   string
+	Name string
+}
+
+// uploadGuilds returns the guilds the request may upload to.
+func (s *site) uploadGuilds(ctx context.Context) []guildChoice {
+	ids := visibleGuilds(ctx)
+	if ids == nil {
+		ids = s.cfg.guilds()
+	}
+
+	var result []guildChoice
+	for _, id := range ids {
+		gc := guildChoice{ID: id, Name: id}
+		if g, err := s.dg.State.Guild(id); err == nil && g != nil {
+			gc.Name = g.Name
+		}
+		result = append(result, gc)
+	}
+
+	return result
+}
+
+// uploadGuild returns the guild named in the guild form field, or the first
+// one the request may upload to.
+func (s *site) uploadGuild(r *http.Request) (string, error) {
+	choices := s.uploadGuilds(r.Context())
+	want := r.FormValue("guild")
+	if want == "" && len(choices) > 0 {
+		return choices[0].ID, nil
+	}
+
+	for _, c := range choices {
+		if c.ID == want {
+			return c.ID, nil
+		}
+	}
+
+	return "", errNotYourGuild
+}
+
+func checkSourceURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errBadSourceURL
+	}
+
+	return nil
+}
+
+// uploadFiles archives the files in the file fields of a multipart request,
+// adding tags and filing them under guildID.
+func (s *site) uploadFiles(r *http.Request, source string, tags []string, guildID string) ([]*database.Image, error) {
+	var files []io.Reader
+	var types []string
+	if r.MultipartForm != nil {
+		if len(r.MultipartForm.File["file"]) > maxUploadFiles {
+			return nil, errTooManyFiles
+		}
+
+		for _, fh := range r.MultipartForm.File["file"] {
+			if fh.Size > s.cfg.FetchMaxBytes {
+				return nil, fmt.Errorf("%s is bigger than %d bytes", fh.Filename, s.cfg.FetchMaxBytes)
+			}
+
+			f, err := fh.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+
+			files = append(files, f)
+			types = append(types, fh.Header.Get("Content-Type"))
+		}
+	}
+
+	if len(files) == 0 {
+		return nil, errNoFiles
+	}
+	if source != "" && len(files) > 1 {
+		return nil, errSourceWithFiles
+	}
+
+	var result []*database.Image
+	for n, f := range files {
+		data, err := ioutil.ReadAll(io.LimitReader(f, s.cfg.FetchMaxBytes))
+		if err != nil {
+			return result, err
+		}
+
+		img, err := s.i.InsertBytes(data, types[n], source)
+		if err != nil {
+			return result, err
+		}
+
+		err = s.fileImage(img, tags, guildID)
+		if err != nil {
+			return result, err
+		}
+
+		ln.Log(r.Context(), img, ln.Action("uploaded image"), ln.F{"guild_id": guildID})
+		result = append(result, img)
+	}
+
+	return result, nil
+}
+
+// fileImage adds tags to an image that was just archived and makes it
+// visible in guildID.
+func (s *site) fileImage(img *database.Image, tags []string, guildID string) error {
+	if len(tags) > 0 {
+		err := s.i.AddTags(img.ID, tags)
+		if err != nil {
+			return err
+		}
+		img.Tags = append(img.Tags, tags...)
+	}
+
+	return s.i.AddGuild(img.ID, guildID)
+}
+
+// parseUpload parses the multipart form of an upload, refusing bodies that
+// can't be more than maxUploadFiles files of FetchMaxBytes each.
+func (s *site) parseUpload(w http.ResponseWriter, r *http.Request) (int, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, s.cfg.FetchMaxBytes*maxUploadFiles+uploadSlack)
+
+	err := r.ParseMultipartForm(maxUploadMemory)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge, err
+	}
+
+	return http.StatusBadRequest, err
+}
+
+// uploadStatus is the status code for an error from uploadFiles.
+func uploadStatus(err error) int {
+	if err == database.ErrSourceTaken {
+		return http.StatusConflict
+	}
+
+	return http.StatusBadRequest
+}
+
+func (s *site) uploadForm(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		Subtitle string
+		Guilds   []guildChoice
+		MaxBytes int64
+	}{
+		Subtitle: "upload",
+		Guilds:   s.uploadGuilds(r.Context()),
+		MaxBytes: s.cfg.FetchMaxBytes,
+	}
+
+	s.renderTemplatePage("upload.html", &data).ServeHTTP(w, r)
+}
+
+func (s *site) upload(w http.ResponseWriter, r *http.Request) {
+	status, err := s.parseUpload(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	guildID, err := s.uploadGuild(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	source := strings.TrimSpace(r.FormValue("source"))
+	if source != "" {
+		if err := checkSourceURL(source); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	imgs, err := s.uploadFiles(r, source, splitList(r.FormValue("tags")), guildID)
+	if err != nil {
+		ln.Error(r.Context(), err, ln.Action("uploading images"))
+		http.Error(w, err.Error(), uploadStatus(err))
+		return
+	}
+
+	if len(imgs) == 1 {
+		http.Redirect(w, r, "/images/id/"+imgs[0].ID, http.StatusSeeOther)
+		return
+	}
+
+	http.Redirect(w, r, "/images/recent", http.StatusSeeOther)
+}
+
+// uploadResult describes an image archived through the API.
+type uploadResult struct {
+	ID   string   `json:"id"`
+	Mime string   `json:"mime"`
+	Size int64    `json:"size"`
+	Hash string   `json:"hash"`
+	Tags []string `json:"tags"`
+}
+
+// apiUpload archives the files of a multipart request right away, or queues
+// the url form field to be fetched like a link posted in Discord.
+func (s *site) apiUpload(w http.ResponseWriter, r *http.Request) {
+	status, err := s.parseUpload(w, r)
+	if err != nil && err != http.ErrNotMultipart {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	guildID, err := s.uploadGuild(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	tags := splitList(r.FormValue("tags"))
+	u := strings.TrimSpace(r.FormValue("url"))
+	if u != "" {
+		if err := checkSourceURL(u); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.MultipartForm != nil && len(r.MultipartForm.File["file"]) > 0 {
+		imgs, err := s.uploadFiles(r, u, tags, guildID)
+		if err != nil {
+			ln.Error(r.Context(), err, ln.Action("uploading images"))
+			http.Error(w, err.Error(), uploadStatus(err))
+			return
+		}
+
+		var result []uploadResult
+		for _, img := range imgs {
+			result = append(result, uploadResult{
+				ID:   img.ID,
+				Mime: img.Mime,
+				Size: img.Size,
+				Hash: img.Blake2Hash,
+				Tags: img.Tags,
+			})
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+
+	if u == "" {
+		http.Error(w, errNoFiles.Error(), http.StatusBadRequest)
+		return
+	}
+
+	j, err := s.q.Enqueue(ingest.Job{URL: u, GuildID: guildID, Tags: tags})
+	if err != nil {
+		ln.Error(r.Context(), err, ln.Action("queueing url from api"))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ln.Log(r.Context(), j, ln.Action("queued url from api"))
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(j)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Xe/kinq/internal/events"
+	"github.com/Xe/kinq/internal/webhook"
+	chi "gopkg.in/chi.v3"
+	"within.website/ln"
+)
+
+// webhookKinds are the events hooks can ask for.
+var webhookKinds = []events.Kind{
+	events.ImageCreated,
+	events.ImageTagged,
+	events.ImageDeleted,
+	events.IngestFailed,
+}
+
+// maxDeliveries is how much delivery history the hook page shows.
+const maxDeliveries = 100
+
+func (s *site) listWebhooks(w http.ResponseWriter, r *http.Request) {
+	hooks, err := s.hooks.Hooks()
+	if err != nil {
+		ln.Error(r.Context(), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Subtitle string
+		Hooks    []webhook.Hook
+		Kinds    []events.Kind
+	}{
+		Subtitle: "webhooks",
+		Hooks:    hooks,
+		Kinds:    webhookKinds,
+	}
+
+	s.renderTemplatePage("webhooks.html", &data).ServeHTTP(w, r)
+}
+
+func (s *site) addWebhook(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	u, err := url.Parse(strings.TrimSpace(r.PostForm.Get("url")))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		http.Error(w, "the hook needs an http or https url", http.StatusBadRequest)
+		return
+	}
+
+	h := &webhook.Hook{
+		URL:    u.String(),
+		Secret: strings.TrimSpace(r.PostForm.Get("secret")),
+	}
+	for _, k := range r.PostForm["kind"] {
+		h.Kinds = append(h.Kinds, events.Kind(k))
+	}
+	if sd, ok := currentSession(r.Context()); ok {
+		h.CreatedBy = sd.UserID
+	}
+
+	err = s.hooks.AddHook(h)
+	if err != nil {
+		ln.Error(r.Context(), err, h)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ln.Log(r.Context(), h, ln.Action("added webhook"))
+
+	http.Redirect(w, r, "/admin/webhooks/"+h.ID, http.StatusSeeOther)
+}
+
+func (s *site) oneWebhook(w http.ResponseWriter, r *http.Request) {
+	h, err := s.hooks.Hook(chi.URLParam(r, "id"))
+	if err != nil {
+		ln.Error(r.Context(), err)
+		http.NotFound(w, r)
+		return
+	}
+
+	deliveries, err := s.hooks.Deliveries(h.ID, maxDeliveries)
+	if err != nil {
+		ln.Error(r.Context(), err, h)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Subtitle   string
+		Hook       *webhook.Hook
+		Deliveries []webhook.Delivery
+	}{
+		Subtitle:   "webhook " + h.URL,
+		Hook:       h,
+		Deliveries: deliveries,
+	}
+
+	s.renderTemplatePage("webhook.html", &data).ServeHTTP(w, r)
+}
+
+func (s *site) deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	err := s.hooks.DeleteHook(id)
+	if err != nil {
+		ln.Error(r.Context(), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ln.Log(r.Context(), ln.Action("deleted webhook"), ln.F{"hook_id": id})
+
+	http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+}
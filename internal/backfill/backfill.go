@@ -0,0 +1,112 @@
+// Package backfill reads Discord channel history kinq wasn't online for.
+package backfill
+
+import (
+	"context"
+	"sort"
+
+	"github.com/Xe/kinq/internal/database"
+	"github.com/Xe/kinq/internal/discord"
+	"github.com/bwmarrin/discordgo"
+	"within.website/ln"
+	"within.website/ln/opname"
+)
+
+// pageSize is the most messages Discord returns per request.
+const pageSize = 100
+
+// Source is where channel history comes from, usually a *discordgo.Session.
+type Source interface {
+	ChannelMessages(channelID string, limit int, beforeID, afterID, aroundID string) ([]*discordgo.Message, error)
+}
+
+// Handler is given every message read, oldest first.
+type Handler func(ctx context.Context, m *discordgo.Message) error
+
+// Backfiller pages through channel history and remembers how far it got.
+type Backfiller struct {
+	src    Source
+	c      database.Cursors
+	handle Handler
+}
+
+func New(src Source, c database.Cursors, handle Handler) *Backfiller {
+	return &Backfiller{
+		src:    src,
+		c:      c,
+		handle: handle,
+	}
+}
+
+// Channel reads every message in channelID after the message ID after and
+// advances the channel's cursor as it goes. It returns how many messages
+// were read.
+func (b *Backfiller) Channel(ctx context.Context, channelID, after string) (int, error) {
+	ctx = opname.With(ctx, "backfill.Channel")
+	f := ln.F{"channel_id": channelID}
+	n := 0
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+
+		msgs, err := b.src.ChannelMessages(channelID, pageSize, "", after, "")
+		if err != nil {
+			return n, err
+		}
+		if len(msgs) == 0 {
+			break
+		}
+
+		sort.Slice(msgs, func(i, j int) bool {
+			return discord.SnowflakeLess(msgs[i].ID, msgs[j].ID)
+		})
+
+		for _, m := range msgs {
+			err = b.handle(ctx, m)
+			if err != nil {
+				return n, err
+			}
+			n++
+		}
+
+		after = msgs[len(msgs)-1].ID
+		err = b.c.Advance(channelID, after)
+		if err != nil {
+			return n, err
+		}
+
+		ln.Log(ctx, f, ln.Action("backfilled page"), ln.F{"messages": n, "after": after})
+	}
+
+	return n, nil
+}
+
+// CatchUp continues every channel from its cursor. Channels that have no
+// cursor yet are skipped, their history needs an explicit backfill.
+func (b *Backfiller) CatchUp(ctx context.Context, channelIDs []string) {
+	ctx = opname.With(ctx, "backfill.CatchUp")
+
+	for _, id := range channelIDs {
+		f := ln.F{"channel_id": id}
+
+		after, err := b.c.Get(id)
+		if err != nil {
+			ln.Error(ctx, err, f, ln.Action("getting channel cursor"))
+			continue
+		}
+		if after == "" {
+			ln.Log(ctx, f, ln.Action("no cursor for channel, not catching up"))
+			continue
+		}
+
+		n, err := b.Channel(ctx, id, after)
+		if err != nil {
+			ln.Error(ctx, err, f, ln.Action("catching up on channel"))
+			continue
+		}
+
+		ln.Log(ctx, f, ln.Action("caught up on channel"), ln.F{"messages": n})
+	}
+}
@@ -0,0 +1,104 @@
+package backfill
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/Xe/kinq/internal/discord"
+	"github.com/bwmarrin/discordgo"
+)
+
+// fakeSource serves messages with IDs 1 to n, newest first like Discord.
+type fakeSource struct {
+	n     int
+	calls int
+}
+
+func (f *fakeSource) ChannelMessages(channelID string, limit int, beforeID, afterID, aroundID string) ([]*discordgo.Message, error) {
+	f.calls++
+
+	start := 1
+	if afterID != "" {
+		a, err := strconv.Atoi(afterID)
+		if err != nil {
+			return nil, err
+		}
+		start = a + 1
+	}
+
+	var msgs []*discordgo.Message
+	for id := start; id <= f.n && len(msgs) < limit; id++ {
+		msgs = append([]*discordgo.Message{{ID: strconv.Itoa(id), ChannelID: channelID}}, msgs...)
+	}
+
+	return msgs, nil
+}
+
+type fakeCursors map[string]string
+
+func (f fakeCursors) Get(channelID string) (string, error) {
+	return f[channelID], nil
+}
+
+func (f fakeCursors) Advance(channelID, messageID string) error {
+	if f[channelID] == "" || discord.SnowflakeLess(f[channelID], messageID) {
+		f[channelID] = messageID
+	}
+	return nil
+}
+
+func TestChannel(t *testing.T) {
+	src := &fakeSource{n: 250}
+	cursors := fakeCursors{}
+
+	var seen []string
+	b := New(src, cursors, func(ctx context.Context, m *discordgo.Message) error {
+		seen = append(seen, m.ID)
+		return nil
+	})
+
+	n, err := b.Channel(context.Background(), "chan", "10")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 240 || len(seen) != 240 {
+		t.Fatalf("wanted 240 messages, got: %d", n)
+	}
+
+	for i := 1; i < len(seen); i++ {
+		if !discord.SnowflakeLess(seen[i-1], seen[i]) {
+			t.Fatalf("messages out of order at %d: %s then %s", i, seen[i-1], seen[i])
+		}
+	}
+
+	if cursors["chan"] != "250" {
+		t.Fatalf("wanted cursor at 250, got: %q", cursors["chan"])
+	}
+
+	if src.calls != 4 {
+		t.Fatalf("wanted 4 pages requested, got: %d", src.calls)
+	}
+}
+
+func TestCatchUp(t *testing.T) {
+	src := &fakeSource{n: 30}
+	cursors := fakeCursors{"known": "20"}
+
+	seen := map[string]int{}
+	b := New(src, cursors, func(ctx context.Context, m *discordgo.Message) error {
+		seen[m.ChannelID]++
+		return nil
+	})
+
+	b.CatchUp(context.Background(), []string{"known", "new"})
+
+	if seen["known"] != 10 {
+		t.Fatalf("wanted 10 messages caught up, got: %d", seen["known"])
+	}
+
+	if seen["new"] != 0 || cursors["new"] != "" {
+		t.Fatalf("channel without a cursor was read")
+	}
+}
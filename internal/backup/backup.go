@@ -0,0 +1,536 @@
+// Package backup writes snapshots of the database to a directory, checks
+// them and puts them back. Snapshots are either full copies of the database
+// or deltas with the changes since the newest full copy.
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"within.website/ln"
+	"within.website/ln/opname"
+)
+
+var (
+	ErrChecksum   = errors.New("backup: snapshot doesn't match its checksum")
+	ErrNoChecksum = errors.New("backup: snapshot has no checksum file")
+)
+
+const (
+	prefix     = "kinq-"
+	suffix     = ".db"
+	sumSuffix  = ".sha256"
+	timeFormat = "20060102T150405Z"
+)
+
+// Snapshot is a copy of the database in the backup directory.
+type Snapshot struct {
+	Name   string
+	Path   string
+	Time   time.Time
+	TxID   int // the last transaction the snapshot has
+	Size   int64
+	SHA256 string
+	Base   string // the full snapshot a delta has the changes since
+}
+
+// Full returns true if the snapshot is a copy of the whole database, not a
+// delta.
+func (s Snapshot) Full() bool {
+	return !strings.HasSuffix(s.Name, deltaSuffix)
+}
+
+func (s Snapshot) F() ln.F {
+	return ln.F{
+		"snapshot_name":   s.Name,
+		"snapshot_tx_id":  s.TxID,
+		"snapshot_size":   s.Size,
+		"snapshot_sha256": s.SHA256,
+		"snapshot_base":   s.Base,
+	}
+}
+
+// name returns the file name of a snapshot of transaction txID made at t.
+func name(t time.Time, txID int) string {
+	return prefix + t.UTC().Format(timeFormat) + "-tx" + strconv.Itoa(txID) + suffix
+}
+
+// parseName reads the time and transaction ID out of the file name of a
+// full or delta snapshot.
+func parseName(n string) (time.Time, int, bool) {
+	var trimmed string
+	switch {
+	case !strings.HasPrefix(n, prefix):
+		return time.Time{}, 0, false
+	case strings.HasSuffix(n, suffix):
+		trimmed = strings.TrimSuffix(n, suffix)
+	case strings.HasSuffix(n, deltaSuffix):
+		trimmed = strings.TrimSuffix(n, deltaSuffix)
+	default:
+		return time.Time{}, 0, false
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(trimmed, prefix), "-tx", 2)
+	if len(parts) != 2 {
+		return time.Time{}, 0, false
+	}
+
+	t, err := time.Parse(timeFormat, parts[0])
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+
+	txID, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+
+	return t, txID, true
+}
+
+type Config struct {
+	Dir      string        // where snapshots are written
+	Interval time.Duration // time between snapshots, Run does nothing if it is zero
+	Keep     int           // newest snapshots kept, older ones are removed unless a kept delta needs them
+
+	// FullEvery makes every FullEvery-th snapshot a full one, the ones in
+	// between are deltas. 0 or 1 makes every snapshot full.
+	FullEvery int
+
+	// Ignore are top level buckets that are always written to, like logs.
+	// Changes to them alone don't make a new snapshot.
+	Ignore []string
+}
+
+// Backups makes snapshots of db.
+type Backups struct {
+	db  *bolt.DB
+	cfg Config
+	now func() time.Time
+
+	mu       sync.Mutex
+	contents string // sum of the changes the newest snapshot has since the newest full one, once known
+}
+
+func New(db *bolt.DB, cfg Config) *Backups {
+	return &Backups{db: db, cfg: cfg, now: time.Now}
+}
+
+// List returns the snapshots in the backup directory, newest first.
+func (b *Backups) List() ([]Snapshot, error) {
+	return List(b.cfg.Dir)
+}
+
+// List returns the snapshots in dir, newest first.
+func List(dir string) ([]Snapshot, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var result []Snapshot
+	for _, fi := range fis {
+		t, txID, ok := parseName(fi.Name())
+		if !ok || !fi.Mode().IsRegular() {
+			continue
+		}
+
+		s := Snapshot{
+			Name: fi.Name(),
+			Path: filepath.Join(dir, fi.Name()),
+			Time: t,
+			TxID: txID,
+			Size: fi.Size(),
+		}
+		s.SHA256, _ = readChecksum(s.Path)
+		if !s.Full() {
+			s.Base, _ = readBase(s.Path)
+		}
+
+		result = append(result, s)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Time.After(result[j].Time)
+	})
+
+	return result, nil
+}
+
+// Snapshot writes a snapshot of the database, verifies it and removes
+// snapshots past the retention limit. The snapshot is a delta against the
+// newest full snapshot unless Config.FullEvery says a full one is due. If
+// nothing outside the ignored buckets changed since the newest snapshot, no
+// snapshot is made and nil is returned.
+func (b *Backups) Snapshot(ctx context.Context) (*Snapshot, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	err := os.MkdirAll(b.cfg.Dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := b.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		base   *Snapshot
+		deltas int
+	)
+	for n := range existing {
+		if existing[n].Full() {
+			base = &existing[n]
+			break
+		}
+		deltas++
+	}
+	full := base == nil || b.cfg.FullEvery <= 1 || deltas+1 >= b.cfg.FullEvery
+
+	if len(existing) > 0 && b.contents == "" {
+		b.contents = emptySum
+		if !existing[0].Full() {
+			b.contents, err = deltaContents(existing[0].Path)
+			if err != nil {
+				ln.Error(ctx, err, existing[0], ln.Action("reading newest snapshot"))
+			}
+		}
+	}
+
+	var s *Snapshot
+	contents := emptySum
+	err = b.db.View(func(tx *bolt.Tx) error {
+		if len(existing) > 0 && existing[0].TxID == tx.ID() {
+			return nil
+		}
+
+		if base != nil {
+			sum, err := deltaSum(tx, base.Path, b.cfg.Ignore)
+			switch {
+			case err != nil:
+				ln.Error(ctx, err, base, ln.Action("comparing with newest full snapshot"))
+				full = true
+			case sum == b.contents:
+				return nil
+			case !full:
+				contents = sum
+			}
+		}
+
+		if full {
+			s, err = write(tx, b.cfg.Dir, b.now())
+		} else {
+			s, err = writeDelta(tx, base, b.cfg.Dir, b.now(), b.cfg.Ignore)
+		}
+		return err
+	})
+	if err != nil || s == nil {
+		return s, err
+	}
+
+	err = Verify(s.Path)
+	if err != nil {
+		os.Remove(s.Path)
+		os.Remove(s.Path + sumSuffix)
+		return nil, err
+	}
+	b.contents = contents
+
+	b.prune(ctx)
+
+	return s, nil
+}
+
+// writeField writes data to h with its kind and length, so different
+// layouts of the same bytes hash differently.
+func writeField(h io.Writer, kind byte, data []byte) {
+	fmt.Fprintf(h, "%c%d:", kind, len(data))
+	h.Write(data)
+}
+
+// write copies the database as tx sees it into dir, along with a checksum
+// file in the format sha256sum reads.
+func write(tx *bolt.Tx, dir string, now time.Time) (*Snapshot, error) {
+	n := name(now, tx.ID())
+
+	size, sum, err := writeFile(dir, n, func(w io.Writer) error {
+		_, err := tx.WriteTo(w)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Snapshot{
+		Name:   n,
+		Path:   filepath.Join(dir, n),
+		Time:   now,
+		TxID:   tx.ID(),
+		Size:   size,
+		SHA256: sum,
+	}, nil
+}
+
+// writeFile writes the file n into dir with fn, along with a checksum file
+// in the format sha256sum reads. It returns the size and checksum of n.
+func writeFile(dir, n string, fn func(w io.Writer) error) (int64, string, error) {
+	path := filepath.Join(dir, n)
+
+	f, err := ioutil.TempFile(dir, n+".tmp")
+	if err != nil {
+		return 0, "", err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	h := sha256.New()
+	err = fn(io.MultiWriter(f, h))
+	if err != nil {
+		return 0, "", err
+	}
+
+	err = f.Sync()
+	if err != nil {
+		return 0, "", err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, "", err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return 0, "", err
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	err = ioutil.WriteFile(path+sumSuffix, []byte(sum+"  "+n+"\n"), 0600)
+	if err != nil {
+		return 0, "", err
+	}
+
+	err = os.Rename(f.Name(), path)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return fi.Size(), sum, nil
+}
+
+// prune removes the snapshots past the retention limit, except for full
+// snapshots that kept deltas are based on.
+func (b *Backups) prune(ctx context.Context) {
+	if b.cfg.Keep <= 0 {
+		return
+	}
+
+	snaps, err := b.List()
+	if err != nil {
+		ln.Error(ctx, err, ln.Action("listing snapshots to prune"))
+		return
+	}
+
+	needed := map[string]bool{}
+	for n, s := range snaps {
+		if n < b.cfg.Keep && !s.Full() {
+			needed[s.Base] = true
+		}
+	}
+
+	for n, s := range snaps {
+		if n < b.cfg.Keep || needed[s.Name] {
+			continue
+		}
+
+		err = os.Remove(s.Path)
+		if err != nil {
+			ln.Error(ctx, err, s, ln.Action("removing old snapshot"))
+			continue
+		}
+		os.Remove(s.Path + sumSuffix)
+
+		ln.Log(ctx, s, ln.Action("removed old snapshot"))
+	}
+}
+
+// Run makes a snapshot every Interval until ctx is cancelled, calling done
+// after each attempt. done gets a nil Snapshot if nothing changed. Without
+// an Interval, Run returns right away.
+func (b *Backups) Run(ctx context.Context, done func(*Snapshot, error)) {
+	ctx = opname.With(ctx, "backup.Backups.Run")
+
+	if b.cfg.Interval <= 0 {
+		return
+	}
+
+	t := time.NewTicker(b.cfg.Interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			s, err := b.Snapshot(ctx)
+			done(s, err)
+		}
+	}
+}
+
+func readChecksum(path string) (string, error) {
+	data, err := ioutil.ReadFile(path + sumSuffix)
+	if os.IsNotExist(err) {
+		return "", ErrNoChecksum
+	}
+	if err != nil {
+		return "", err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return "", ErrNoChecksum
+	}
+
+	return fields[0], nil
+}
+
+// Verify checks a snapshot against its checksum. Full snapshots are then
+// opened read-only to check that every page of them is consistent, deltas
+// are read through to check that every change in them is well formed.
+func Verify(path string) error {
+	want, err := readChecksum(path)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	if hex.EncodeToString(h.Sum(nil)) != want {
+		return ErrChecksum
+	}
+
+	if strings.HasSuffix(path, deltaSuffix) {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = readDelta(f, func(deltaRecord) error { return nil })
+		return err
+	}
+
+	db, err := bolt.Open(path, 0400, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return fmt.Errorf("backup: can't open snapshot: %v", err)
+	}
+	defer db.Close()
+
+	return db.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			return fmt.Errorf("backup: snapshot is inconsistent: %v", err)
+		}
+		return nil
+	})
+}
+
+// Restore verifies a snapshot and puts it in place of the database at
+// dbPath, which must not be open. A delta is restored by applying it to a
+// copy of its base, which must be next to it. The database it replaces is
+// kept next to it, and its path is returned.
+func Restore(snapshot, dbPath string) (string, error) {
+	err := Verify(snapshot)
+	if err != nil {
+		return "", err
+	}
+
+	src, delta := snapshot, ""
+	if strings.HasSuffix(snapshot, deltaSuffix) {
+		base, err := readBase(snapshot)
+		if err != nil {
+			return "", err
+		}
+
+		src, delta = filepath.Join(filepath.Dir(snapshot), base), snapshot
+		err = Verify(src)
+		if err != nil {
+			return "", fmt.Errorf("backup: base %s of the delta: %v", base, err)
+		}
+	}
+
+	// make sure nothing has the database open
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return "", fmt.Errorf("backup: can't lock %s, is kinq still running? %v", dbPath, err)
+	}
+	db.Close()
+
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	tmp := dbPath + ".restore"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp)
+
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && delta != "" {
+		err = applyDelta(tmp, delta)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	previous := dbPath + ".before-restore-" + time.Now().UTC().Format(timeFormat)
+	err = os.Rename(dbPath, previous)
+	if err != nil {
+		return "", err
+	}
+
+	err = os.Rename(tmp, dbPath)
+	if err != nil {
+		os.Rename(previous, dbPath)
+		return "", err
+	}
+
+	return previous, nil
+}
@@ -0,0 +1,424 @@
+package backup
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func openDB(t *testing.T, path string) *bolt.DB {
+	t.Helper()
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+func put(t *testing.T, db *bolt.DB, key, value string) {
+	t.Helper()
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("test"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), []byte(value))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func get(t *testing.T, db *bolt.DB, key string) string {
+	t.Helper()
+
+	var value string
+	err := db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte("test")); b != nil {
+			value = string(b.Get([]byte(key)))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return value
+}
+
+func TestName(t *testing.T) {
+	now := time.Date(2019, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	tm, txID, ok := parseName(name(now, 42))
+	if !ok || !tm.Equal(now) || txID != 42 {
+		t.Fatalf("parseName(name()) = %v, %d, %v", tm, txID, ok)
+	}
+
+	for _, n := range []string{"kinq.db", "kinq-nope-tx1.db", "kinq-20190304T050607Z-txno.db", "kinq-20190304T050607Z-tx1.db.sha256"} {
+		if _, _, ok := parseName(n); ok {
+			t.Errorf("parseName(%q) should fail", n)
+		}
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kinq-backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db := openDB(t, filepath.Join(dir, "kinq.db"))
+	defer db.Close()
+
+	b := New(db, Config{Dir: filepath.Join(dir, "backups"), Keep: 2, Ignore: []string{"logs"}})
+	ctx := context.Background()
+
+	// names only have second precision
+	now := time.Date(2019, 3, 4, 5, 6, 7, 0, time.UTC)
+	b.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+
+	var names []string
+	for n := 0; n < 3; n++ {
+		put(t, db, "key", string(rune('a'+n)))
+
+		s, err := b.Snapshot(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s == nil {
+			t.Fatal("database changed but no snapshot was made")
+		}
+		if s.SHA256 == "" || s.Size == 0 {
+			t.Errorf("snapshot is missing details: %+v", s)
+		}
+		names = append(names, s.Name)
+
+		s, err = b.Snapshot(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s != nil {
+			t.Errorf("database didn't change but %s was made", s.Name)
+		}
+
+		err = db.Update(func(tx *bolt.Tx) error {
+			bk, err := tx.CreateBucketIfNotExists([]byte("logs"))
+			if err != nil {
+				return err
+			}
+			return bk.Put([]byte{byte(n)}, []byte("logged"))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s, err = b.Snapshot(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s != nil {
+			t.Errorf("only logs changed but %s was made", s.Name)
+		}
+	}
+
+	// a restart finds what the newest snapshot has
+	b = New(db, b.cfg)
+	if s, err := b.Snapshot(ctx); err != nil || s != nil {
+		t.Errorf("Snapshot after a restart = %v, %v, want nothing", s, err)
+	}
+
+	snaps, err := b.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snaps) != 2 {
+		t.Fatalf("kept %d snapshots, want 2", len(snaps))
+	}
+	if snaps[0].Name != names[2] || snaps[1].Name != names[1] {
+		t.Errorf("kept %s and %s, want the newest two of %v", snaps[0].Name, snaps[1].Name, names)
+	}
+	if _, err := os.Stat(filepath.Join(b.cfg.Dir, names[0]) + sumSuffix); !os.IsNotExist(err) {
+		t.Errorf("checksum of pruned snapshot is still there: %v", err)
+	}
+
+	for _, s := range snaps {
+		if err := Verify(s.Path); err != nil {
+			t.Errorf("Verify(%s): %v", s.Name, err)
+		}
+	}
+}
+
+func TestVerifyCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kinq-backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db := openDB(t, filepath.Join(dir, "kinq.db"))
+	defer db.Close()
+	put(t, db, "key", "value")
+
+	s, err := New(db, Config{Dir: dir}).Snapshot(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	err = ioutil.WriteFile(s.Path, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Verify(s.Path); err != ErrChecksum {
+		t.Errorf("Verify of a changed snapshot = %v, want %v", err, ErrChecksum)
+	}
+
+	os.Remove(s.Path + sumSuffix)
+	if err := Verify(s.Path); err != ErrNoChecksum {
+		t.Errorf("Verify without a checksum = %v, want %v", err, ErrNoChecksum)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kinq-backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "kinq.db")
+	db := openDB(t, path)
+	put(t, db, "key", "old")
+
+	s, err := New(db, Config{Dir: filepath.Join(dir, "backups")}).Snapshot(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(t, db, "key", "new")
+
+	if _, err := Restore(s.Path, path); err == nil {
+		t.Error("restored over a database that is still open")
+	}
+	db.Close()
+
+	previous, err := Restore(s.Path, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db = openDB(t, path)
+	if v := get(t, db, "key"); v != "old" {
+		t.Errorf("restored database has %q, want %q", v, "old")
+	}
+	db.Close()
+
+	db = openDB(t, previous)
+	if v := get(t, db, "key"); v != "new" {
+		t.Errorf("database kept from before the restore has %q, want %q", v, "new")
+	}
+	db.Close()
+}
+
+func TestRunWithoutInterval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kinq-backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db := openDB(t, filepath.Join(dir, "kinq.db"))
+	defer db.Close()
+
+	// returns instead of panicking in time.NewTicker
+	New(db, Config{Dir: dir}).Run(context.Background(), func(*Snapshot, error) {
+		t.Error("made a snapshot without an interval")
+	})
+}
+
+func TestIncrementalSnapshot(t *testing.T) {
+	// restoring commits along the way
+	defer func(n int) { applyBatch = n }(applyBatch)
+	applyBatch = 2
+
+	dir, err := ioutil.TempDir("", "kinq-backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db := openDB(t, filepath.Join(dir, "kinq.db"))
+	defer db.Close()
+
+	b := New(db, Config{Dir: filepath.Join(dir, "backups"), Keep: 2, FullEvery: 3, Ignore: []string{"logs"}})
+	ctx := context.Background()
+
+	now := time.Date(2019, 3, 4, 5, 6, 7, 0, time.UTC)
+	b.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+
+	snapshot := func() *Snapshot {
+		t.Helper()
+		s, err := b.Snapshot(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	put(t, db, "kept", "a")
+	put(t, db, "changed", "a")
+	put(t, db, "deleted", "a")
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{"gone", "logs"} {
+			if _, err := tx.CreateBucket([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	full := snapshot()
+	if full == nil || !full.Full() {
+		t.Fatalf("first snapshot = %+v, want a full one", full)
+	}
+
+	// every kind of change a delta can hold
+	put(t, db, "changed", "b")
+	put(t, db, "added", "b")
+	err = db.Update(func(tx *bolt.Tx) error {
+		bk := tx.Bucket([]byte("test"))
+		if err := bk.Delete([]byte("deleted")); err != nil {
+			return err
+		}
+		if _, err := bk.NextSequence(); err != nil {
+			return err
+		}
+		nested, err := bk.CreateBucket([]byte("nested"))
+		if err != nil {
+			return err
+		}
+		if err := nested.Put([]byte("inner"), []byte("c")); err != nil {
+			return err
+		}
+		if err := tx.DeleteBucket([]byte("gone")); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte("logs")).Put([]byte("1"), []byte("logged"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	delta := snapshot()
+	if delta == nil || delta.Full() || delta.Base != full.Name {
+		t.Fatalf("second snapshot = %+v, want a delta from %s", delta, full.Name)
+	}
+	if delta.Size >= full.Size {
+		t.Errorf("delta is %d bytes, no smaller than the full snapshot's %d", delta.Size, full.Size)
+	}
+
+	// logs aren't changes, neither after a delta nor after a restart
+	put(t, db, "unchanged", "x")
+	err = db.Update(func(tx *bolt.Tx) error {
+		bk := tx.Bucket([]byte("test"))
+		if err := bk.Delete([]byte("unchanged")); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte("logs")).Put([]byte("2"), []byte("logged"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := snapshot(); s != nil {
+		t.Errorf("nothing changed since the delta but %s was made", s.Name)
+	}
+	b = New(db, b.cfg)
+	b.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+	if s := snapshot(); s != nil {
+		t.Errorf("nothing changed since the delta but %s was made after a restart", s.Name)
+	}
+
+	put(t, db, "changed", "c")
+	if s := snapshot(); s == nil || s.Full() {
+		t.Fatalf("third snapshot = %+v, want a delta", s)
+	}
+	put(t, db, "changed", "d")
+	if s := snapshot(); s == nil || !s.Full() {
+		t.Fatalf("fourth snapshot = %+v, want a full one", s)
+	}
+
+	// the newest two are kept, and the base of the second delta
+	snaps, err := b.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kept []string
+	for _, s := range snaps {
+		kept = append(kept, s.Name)
+	}
+	if len(snaps) != 3 || snaps[2].Name != full.Name {
+		t.Errorf("kept %v, want the newest two and %s", kept, full.Name)
+	}
+	if _, err := os.Stat(delta.Path); !os.IsNotExist(err) {
+		t.Errorf("first delta wasn't pruned: %v", err)
+	}
+
+	path := filepath.Join(dir, "restored.db")
+	openDB(t, path).Close()
+	if _, err := Restore(snaps[1].Path, path); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := openDB(t, path)
+	defer restored.Close()
+	want := map[string]string{"kept": "a", "changed": "c", "added": "b", "deleted": ""}
+	for k, v := range want {
+		if got := get(t, restored, k); got != v {
+			t.Errorf("restored %s = %q, want %q", k, got, v)
+		}
+	}
+	err = restored.View(func(tx *bolt.Tx) error {
+		bk := tx.Bucket([]byte("test"))
+		if seq := bk.Sequence(); seq != 1 {
+			t.Errorf("restored sequence = %d, want 1", seq)
+		}
+		if v := bk.Bucket([]byte("nested")).Get([]byte("inner")); string(v) != "c" {
+			t.Errorf("restored nested key = %q, want %q", v, "c")
+		}
+		if tx.Bucket([]byte("gone")) != nil {
+			t.Error("deleted bucket was restored")
+		}
+		if logs := tx.Bucket([]byte("logs")).Stats().KeyN; logs != 0 {
+			t.Errorf("restored %d logs, want none, like the base", logs)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
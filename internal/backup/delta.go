@@ -0,0 +1,476 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// A delta snapshot holds the changes to the database since a full snapshot,
+// its base. It is a header naming the base followed by records of fields
+// written by writeField:
+//
+//	h<base name>                     the header, once
+//	p b<bucket>... k<key> v<value>   put a key
+//	d b<bucket>... k<key>            delete a key
+//	B b<bucket>... k<name>           create a bucket
+//	D b<bucket>... k<name>           delete a bucket
+//	s b<bucket>... v<sequence>       set the sequence of a bucket
+//
+// The b fields are the path of the bucket the change is made in, from the
+// top level. Ignored buckets aren't in deltas, restoring one leaves them as
+// they were in the base.
+
+const deltaSuffix = ".delta"
+
+// maxField is the largest field readDelta accepts, well over the largest
+// image kinq fetches.
+const maxField = 1 << 30
+
+// applyBatch is how many records of a delta are applied per transaction.
+var applyBatch = 1000
+
+// emptySum is the sum of a delta with no changes.
+var emptySum = hex.EncodeToString(sha256.New().Sum(nil))
+
+var errMalformed = errors.New("backup: delta is malformed")
+
+func deltaName(t time.Time, txID int) string {
+	return prefix + t.UTC().Format(timeFormat) + "-tx" + strconv.Itoa(txID) + deltaSuffix
+}
+
+// bucketer is a transaction or a bucket.
+type bucketer interface {
+	Cursor() *bolt.Cursor
+	Bucket(name []byte) *bolt.Bucket
+}
+
+// diff writes the records that turn base into live to w. base may be nil
+// for a bucket that isn't in the base. Top level buckets named in ignore
+// are skipped.
+func diff(w io.Writer, path [][]byte, base, live bucketer, ignore []string) {
+	var (
+		bc     *bolt.Cursor
+		bk, bv []byte
+	)
+	if base != nil {
+		bc = base.Cursor()
+		bk, bv = bc.First()
+	}
+	lc := live.Cursor()
+	lk, lv := lc.First()
+
+	for bk != nil || lk != nil {
+		switch {
+		case lk == nil || (bk != nil && bytes.Compare(bk, lk) < 0):
+			if !ignored(path, bk, ignore) {
+				remove(w, path, bk, bv == nil)
+			}
+			bk, bv = bc.Next()
+
+		case bk == nil || bytes.Compare(bk, lk) > 0:
+			if !ignored(path, lk, ignore) {
+				add(w, path, live, lk, lv)
+			}
+			lk, lv = lc.Next()
+
+		default:
+			if !ignored(path, lk, ignore) {
+				switch {
+				case bv == nil && lv == nil:
+					diffBucket(w, join(path, lk), base.Bucket(bk), live.Bucket(lk))
+				case bv == nil:
+					remove(w, path, bk, true)
+					add(w, path, live, lk, lv)
+				case lv == nil:
+					remove(w, path, bk, false)
+					add(w, path, live, lk, lv)
+				case !bytes.Equal(bv, lv):
+					add(w, path, live, lk, lv)
+				}
+			}
+			bk, bv = bc.Next()
+			lk, lv = lc.Next()
+		}
+	}
+}
+
+// diffBucket writes the records that turn the bucket base, which may be
+// nil, into live.
+func diffBucket(w io.Writer, path [][]byte, base, live *bolt.Bucket) {
+	var (
+		b   bucketer
+		seq uint64
+	)
+	if base != nil {
+		b, seq = base, base.Sequence()
+	}
+
+	if live.Sequence() != seq {
+		record(w, 's', path, nil)
+		writeField(w, 'v', []byte(strconv.FormatUint(live.Sequence(), 10)))
+	}
+
+	diff(w, path, b, live, nil)
+}
+
+func ignored(path [][]byte, name []byte, ignore []string) bool {
+	if len(path) > 0 {
+		return false
+	}
+
+	for _, ig := range ignore {
+		if string(name) == ig {
+			return true
+		}
+	}
+
+	return false
+}
+
+// join returns path with name added, without changing path.
+func join(path [][]byte, name []byte) [][]byte {
+	return append(path[:len(path):len(path)], name)
+}
+
+// add writes the records that put the key or bucket k of live in path.
+func add(w io.Writer, path [][]byte, live bucketer, k, v []byte) {
+	if v != nil {
+		record(w, 'p', path, k)
+		writeField(w, 'v', v)
+		return
+	}
+
+	record(w, 'B', path, k)
+	diffBucket(w, join(path, k), nil, live.Bucket(k))
+}
+
+func remove(w io.Writer, path [][]byte, k []byte, bucket bool) {
+	op := byte('d')
+	if bucket {
+		op = 'D'
+	}
+
+	record(w, op, path, k)
+}
+
+// record writes the start of a record, without its value.
+func record(w io.Writer, op byte, path [][]byte, key []byte) {
+	writeField(w, op, nil)
+	for _, p := range path {
+		writeField(w, 'b', p)
+	}
+	if key != nil {
+		writeField(w, 'k', key)
+	}
+}
+
+// deltaRecord is a change read from a delta.
+type deltaRecord struct {
+	op         byte
+	path       [][]byte
+	key, value []byte
+}
+
+func (r deltaRecord) valid() bool {
+	switch r.op {
+	case 'p':
+		return r.key != nil && r.value != nil
+	case 'd', 'B', 'D':
+		return r.key != nil && r.value == nil
+	case 's':
+		_, err := strconv.ParseUint(string(r.value), 10, 64)
+		return len(r.path) > 0 && r.key == nil && err == nil
+	}
+
+	return false
+}
+
+// apply makes the change in tx.
+func (r deltaRecord) apply(tx *bolt.Tx) error {
+	if len(r.path) == 0 {
+		switch r.op {
+		case 'B':
+			_, err := tx.CreateBucket(r.key)
+			return err
+		case 'D':
+			return tx.DeleteBucket(r.key)
+		}
+
+		return errMalformed
+	}
+
+	bk := tx.Bucket(r.path[0])
+	for _, p := range r.path[1:] {
+		if bk == nil {
+			break
+		}
+		bk = bk.Bucket(p)
+	}
+	if bk == nil {
+		return fmt.Errorf("backup: delta changes bucket %q, which isn't in its base", bytes.Join(r.path, []byte("/")))
+	}
+
+	switch r.op {
+	case 'p':
+		return bk.Put(r.key, r.value)
+	case 'd':
+		return bk.Delete(r.key)
+	case 'B':
+		_, err := bk.CreateBucket(r.key)
+		return err
+	case 'D':
+		return bk.DeleteBucket(r.key)
+	case 's':
+		seq, _ := strconv.ParseUint(string(r.value), 10, 64)
+		return bk.SetSequence(seq)
+	}
+
+	return errMalformed
+}
+
+// readField reads a field written by writeField.
+func readField(r *bufio.Reader) (byte, []byte, error) {
+	kind, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	length, err := r.ReadString(':')
+	if err != nil {
+		return 0, nil, errMalformed
+	}
+	n, err := strconv.Atoi(length[:len(length)-1])
+	if err != nil || n < 0 || n > maxField {
+		return 0, nil, errMalformed
+	}
+
+	data := make([]byte, n)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return 0, nil, errMalformed
+	}
+
+	return kind, data, nil
+}
+
+// readDelta reads the header of a delta and then calls fn with each of its
+// records. It returns the name of the base.
+func readDelta(r io.Reader, fn func(deltaRecord) error) (string, error) {
+	br := bufio.NewReader(r)
+
+	kind, base, err := readField(br)
+	if err != nil || kind != 'h' {
+		return "", errMalformed
+	}
+
+	var rec *deltaRecord
+	done := func() error {
+		if rec == nil {
+			return nil
+		}
+		if !rec.valid() {
+			return errMalformed
+		}
+		return fn(*rec)
+	}
+
+	for {
+		kind, data, err := readField(br)
+		if err == io.EOF {
+			return string(base), done()
+		}
+		if err != nil {
+			return "", err
+		}
+
+		switch kind {
+		case 'p', 'd', 'B', 'D', 's':
+			err = done()
+			if err != nil {
+				return "", err
+			}
+			rec = &deltaRecord{op: kind}
+		case 'b':
+			if rec == nil || rec.key != nil || rec.value != nil {
+				return "", errMalformed
+			}
+			rec.path = append(rec.path, data)
+		case 'k':
+			if rec == nil || rec.key != nil || rec.value != nil {
+				return "", errMalformed
+			}
+			rec.key = data
+		case 'v':
+			if rec == nil || rec.value != nil {
+				return "", errMalformed
+			}
+			rec.value = data
+		default:
+			return "", errMalformed
+		}
+	}
+}
+
+// readBase returns the name of the base of the delta at path.
+func readBase(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	kind, base, err := readField(bufio.NewReader(f))
+	if err != nil || kind != 'h' {
+		return "", errMalformed
+	}
+
+	return string(base), nil
+}
+
+// deltaContents returns the sum of the records of the delta at path, the
+// same as deltaSum returned when it was written.
+func deltaContents(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	kind, _, err := readField(br)
+	if err != nil || kind != 'h' {
+		return "", errMalformed
+	}
+
+	h := sha256.New()
+	_, err = io.Copy(h, br)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// withBase runs fn with the full snapshot at path open read-only.
+func withBase(path string, fn func(base *bolt.Tx) error) error {
+	db, err := bolt.Open(path, 0400, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.View(fn)
+}
+
+// deltaSum returns the sum of the records of a delta from the full snapshot
+// at basePath to the database as tx sees it. Outside the ignored buckets,
+// the database is unchanged since the snapshot if it is emptySum.
+func deltaSum(tx *bolt.Tx, basePath string, ignore []string) (string, error) {
+	h := sha256.New()
+
+	err := withBase(basePath, func(base *bolt.Tx) error {
+		diff(h, nil, base, tx, ignore)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeDelta writes the changes to the database since the full snapshot
+// base as tx sees them into dir, along with a checksum file.
+func writeDelta(tx *bolt.Tx, base *Snapshot, dir string, now time.Time, ignore []string) (*Snapshot, error) {
+	n := deltaName(now, tx.ID())
+
+	size, sum, err := writeFile(dir, n, func(w io.Writer) error {
+		return withBase(base.Path, func(btx *bolt.Tx) error {
+			bw := bufio.NewWriter(w)
+			writeField(bw, 'h', []byte(base.Name))
+			diff(bw, nil, btx, tx, ignore)
+			return bw.Flush()
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Snapshot{
+		Name:   n,
+		Path:   filepath.Join(dir, n),
+		Time:   now,
+		TxID:   tx.ID(),
+		Size:   size,
+		SHA256: sum,
+		Base:   base.Name,
+	}, nil
+}
+
+// applyDelta makes the changes in the delta at path to the database at
+// dbPath, then checks that every page of it is consistent.
+func applyDelta(dbPath, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer func() { tx.Rollback() }()
+
+	n := 0
+	_, err = readDelta(f, func(r deltaRecord) error {
+		err := r.apply(tx)
+		if err != nil {
+			return err
+		}
+
+		n++
+		if n%applyBatch != 0 {
+			return nil
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+		tx, err = db.Begin(true)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	return db.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			return fmt.Errorf("backup: restored database is inconsistent: %v", err)
+		}
+		return nil
+	})
+}
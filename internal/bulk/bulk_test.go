@@ -0,0 +1,172 @@
+package bulk
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Xe/kinq/internal/database"
+)
+
+func TestMetadata(t *testing.T) {
+	c := &Collection{Sidecars: map[string][]byte{
+		"e621/1.png.json":   []byte(`{"file_url": "https://static1.e621.net/1.png", "tags": {"general": ["cute"], "artist": ["someone"]}}`),
+		"danbooru/2.json":   []byte(`{"source": "https://example.com/2", "tag_string": "a b a"}`),
+		"danbooru/2.txt":    []byte("c\n\nb\n"),
+		"kinq/abc.json":     []byte(`{"id": "1", "url": "https://derpicdn.net/3.png", "tags": ["safe", "twilight sparkle"]}`),
+		"upload/def.json":   []byte(`{"id": "2", "url": "upload:2", "tags": []}`),
+		"broken/4.gif.json": []byte(`{`),
+	}}
+
+	cases := []struct {
+		name string
+		want Metadata
+		err  bool
+	}{
+		{name: "e621/1.png", want: Metadata{Source: "https://static1.e621.net/1.png", Tags: []string{"artist:someone", "cute"}}},
+		{name: "danbooru/2.jpg", want: Metadata{Source: "https://example.com/2", Tags: []string{"a", "b", "c"}}},
+		{name: "kinq/abc.png", want: Metadata{Source: "https://derpicdn.net/3.png", Tags: []string{"safe", "twilight sparkle"}}},
+		{name: "upload/def.png", want: Metadata{}},
+		{name: "none.png", want: Metadata{}},
+		{name: "broken/4.gif", err: true},
+	}
+
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			got, err := c.Metadata(cs.name)
+			if cs.err {
+				if err == nil {
+					t.Fatal("wanted an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, cs.want) {
+				t.Fatalf("wanted %+v, got: %+v", cs.want, got)
+			}
+		})
+	}
+}
+
+func TestScan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kinq-bulk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"a.png":      "png",
+		"a.png.json": `{"tags": ["x"]}`,
+		"sub/b.gif":  "gif",
+	}
+
+	zf, err := os.Create(filepath.Join(dir, "c.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(zf)
+	for name, body := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(body))
+
+		os.MkdirAll(filepath.Join(dir, "d", filepath.Dir(name)), 0755)
+		err = ioutil.WriteFile(filepath.Join(dir, "d", name), []byte(body), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	zw.Close()
+	zf.Close()
+
+	for _, path := range []string{filepath.Join(dir, "d"), filepath.Join(dir, "c.zip")} {
+		c, err := Scan(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(c.Files) != 2 || len(c.Sidecars) != 1 {
+			t.Fatalf("%s: wrong files %v and sidecars %v", path, c.Files, c.Sidecars)
+		}
+
+		md, err := c.Metadata("a.png")
+		if err != nil || len(md.Tags) != 1 {
+			t.Fatalf("%s: wrong metadata %+v: %v", path, md, err)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kinq-bulk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	added := time.Date(2020, 4, 1, 12, 0, 0, 0, time.UTC)
+	img := &database.Image{
+		ID:         "1",
+		URL:        "https://derpicdn.net/1.png",
+		Blake2Hash: "AAEC",
+		Ext:        ".png",
+		Tags:       []string{"safe", "twilight sparkle"},
+		Added:      added,
+		Guilds:     []string{"guild"},
+	}
+	origins := []database.Origin{{GuildID: "guild", ChannelID: "2", MessageID: "3", Author: "cadey", Posted: added}}
+
+	for _, format := range []string{"tar", "zip"} {
+		path := filepath.Join(dir, "export."+format)
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w, err := NewWriter(f, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta, _ := json.Marshal(NewSidecar(img, origins))
+		name := FileName(img)
+		if name != "000102.png" {
+			t.Fatalf("wrong file name: %s", name)
+		}
+		w.Add(name, added, []byte("png"))
+		w.Add(name+".json", added, meta)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		c, err := Scan(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		md, err := c.Metadata(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if md.Source != img.URL || !reflect.DeepEqual(md.Tags, img.Tags) || md.Kinq == nil {
+			t.Fatalf("%s: wrong metadata: %+v", format, md)
+		}
+		if !md.Kinq.Added.Equal(added) || !reflect.DeepEqual(md.Kinq.Guilds, img.Guilds) {
+			t.Fatalf("%s: wrong sidecar: %+v", format, md.Kinq)
+		}
+		if got := md.Kinq.DatabaseOrigins("new"); len(got) != 1 || got[0].ImageID != "new" || got[0].Author != "cadey" {
+			t.Fatalf("%s: wrong origins: %+v", format, got)
+		}
+	}
+}
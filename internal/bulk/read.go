@@ -0,0 +1,227 @@
+// Package bulk reads and writes collections of images on disk: directories,
+// zip files and tarballs, with sidecar metadata next to the images.
+package bulk
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// maxSidecarSize is the biggest file read as a sidecar. Anything bigger is
+// not metadata.
+const maxSidecarSize = 1 << 20
+
+// WalkFunc is called with every file of a collection. r is only valid until
+// it returns.
+type WalkFunc func(name string, size int64, r io.Reader) error
+
+// Walk calls fn with every regular file in path, which is a directory, a
+// zip file or a tarball, optionally gzipped. Names use forward slashes and
+// are relative to path.
+func Walk(path string, fn WalkFunc) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	lower := strings.ToLower(path)
+	switch {
+	case fi.IsDir():
+		return walkDir(path, fn)
+	case strings.HasSuffix(lower, ".zip"):
+		return walkZip(path, fn)
+	case strings.HasSuffix(lower, ".tar"), strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return walkTar(path, fn)
+	}
+
+	return &os.PathError{Op: "import", Path: path, Err: os.ErrInvalid}
+}
+
+func walkDir(root string, fn WalkFunc) error {
+	var names []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			names = append(names, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	for _, path := range names {
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		err = walkFile(path, filepath.ToSlash(rel), fn)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func walkFile(path, name string, fn WalkFunc) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	return fn(name, fi.Size(), f)
+}
+
+func walkZip(path string, fn WalkFunc) error {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	for _, zf := range zr.File {
+		if !zf.Mode().IsRegular() {
+			continue
+		}
+
+		err = func() error {
+			rc, err := zf.Open()
+			if err != nil {
+				return err
+			}
+			defer rc.Close()
+
+			return fn(zf.Name, int64(zf.UncompressedSize64), rc)
+		}()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func walkTar(path string, fn WalkFunc) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	lower := strings.ToLower(path)
+	if strings.HasSuffix(lower, ".gz") || strings.HasSuffix(lower, ".tgz") {
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		r = gr
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if h.Typeflag != tar.TypeReg && h.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		err = fn(strings.TrimPrefix(h.Name, "./"), h.Size, tr)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Collection is what is in a directory or archive, with the sidecars read
+// ahead of time so they can be matched to images in any order.
+type Collection struct {
+	Path     string
+	Files    []string          // everything that isn't a sidecar
+	Sidecars map[string][]byte // sidecar name to contents
+}
+
+// IsSidecar returns true for files that may hold metadata for an image.
+func IsSidecar(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return ext == ".json" || ext == ".txt"
+}
+
+// Scan reads the names of the files in path and the contents of its
+// sidecars.
+func Scan(path string) (*Collection, error) {
+	c := &Collection{Path: path, Sidecars: map[string][]byte{}}
+
+	err := Walk(path, func(name string, size int64, r io.Reader) error {
+		if !IsSidecar(name) {
+			c.Files = append(c.Files, name)
+			return nil
+		}
+
+		if size > maxSidecarSize {
+			return nil
+		}
+
+		data, err := ioutil.ReadAll(io.LimitReader(r, maxSidecarSize))
+		if err != nil {
+			return err
+		}
+		c.Sidecars[name] = data
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Metadata returns what the sidecars of the file called name say about it.
+func (c *Collection) Metadata(name string) (Metadata, error) {
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+
+	var md Metadata
+	for _, sc := range []string{name + ".json", base + ".json", name + ".txt", base + ".txt"} {
+		data, ok := c.Sidecars[sc]
+		if !ok {
+			continue
+		}
+
+		var err error
+		if strings.HasSuffix(sc, ".json") {
+			err = md.parseJSON(data)
+		} else {
+			md.parseTags(data)
+		}
+		if err != nil {
+			return md, err
+		}
+	}
+
+	return md, nil
+}
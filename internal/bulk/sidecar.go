@@ -0,0 +1,125 @@
+package bulk
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// Metadata is what is known about an image from its sidecars.
+type Metadata struct {
+	Source string
+	Tags   []string
+
+	// Kinq is set when the image was exported by kinq.
+	Kinq *Sidecar
+}
+
+// sourceKeys are the JSON fields a source URL is looked for in, best first.
+// kinq exports use url; gallery-dl uses file_url, source or post_url
+// depending on the site.
+var sourceKeys = []string{"url", "file_url", "post_url", "source"}
+
+// tagKeys are the JSON fields tags are looked for in.
+var tagKeys = []string{"tags", "tag_string"}
+
+func (m *Metadata) addTags(tags ...string) {
+	for _, t := range tags {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+
+		found := false
+		for _, have := range m.Tags {
+			if have == t {
+				found = true
+				break
+			}
+		}
+		if !found {
+			m.Tags = append(m.Tags, t)
+		}
+	}
+}
+
+// parseJSON reads a JSON sidecar, like kinq's own or the info files
+// gallery-dl writes with --write-metadata.
+func (m *Metadata) parseJSON(data []byte) error {
+	var doc map[string]interface{}
+	err := json.Unmarshal(data, &doc)
+	if err != nil {
+		return err
+	}
+
+	if doc["format"] == Format {
+		var sc Sidecar
+		err = json.Unmarshal(data, &sc)
+		if err != nil {
+			return err
+		}
+		m.Kinq = &sc
+	}
+
+	if m.Source == "" {
+		for _, k := range sourceKeys {
+			if s, ok := doc[k].(string); ok && (strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")) {
+				m.Source = s
+				break
+			}
+		}
+	}
+
+	for _, k := range tagKeys {
+		m.addTags(jsonTags(doc[k])...)
+	}
+
+	return nil
+}
+
+// jsonTags reads tags from a list, a space separated string or, like e621
+// sidecars have, lists by category. Tags outside the general category get
+// it as a namespace, like artist:someone.
+func jsonTags(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return strings.Fields(v)
+	case []interface{}:
+		var tags []string
+		for _, t := range v {
+			if s, ok := t.(string); ok {
+				tags = append(tags, s)
+			}
+		}
+		return tags
+	case map[string]interface{}:
+		var categories []string
+		for c := range v {
+			categories = append(categories, c)
+		}
+		sort.Strings(categories)
+
+		var tags []string
+		for _, c := range categories {
+			for _, t := range jsonTags(v[c]) {
+				if c != "general" {
+					t = c + ":" + t
+				}
+				tags = append(tags, t)
+			}
+		}
+		return tags
+	}
+
+	return nil
+}
+
+// parseTags reads a text sidecar with one tag per line.
+func (m *Metadata) parseTags(data []byte) {
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		m.addTags(sc.Text())
+	}
+}
@@ -0,0 +1,178 @@
+package bulk
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/Xe/kinq/internal/database"
+)
+
+// Format marks sidecars written by kinq, which hold everything needed to
+// import an image back as it was.
+const Format = "kinq/1"
+
+// Sidecar is the metadata of an exported image, stored next to it as JSON.
+type Sidecar struct {
+	Format   string    `json:"format"`
+	ID       string    `json:"id"`
+	URL      string    `json:"url"`
+	Hash     string    `json:"hash"`
+	Mime     string    `json:"mime"`
+	Size     int64     `json:"size"`
+	Width    int       `json:"width,omitempty"`
+	Height   int       `json:"height,omitempty"`
+	Tags     []string  `json:"tags"`
+	Added    time.Time `json:"added"`
+	Guilds   []string  `json:"guilds,omitempty"`
+	Uploaded bool      `json:"uploaded,omitempty"`
+	Origins  []Origin  `json:"origins,omitempty"`
+}
+
+// Origin is where an exported image was posted, see database.Origin.
+type Origin struct {
+	GuildID        string    `json:"guild_id"`
+	ChannelID      string    `json:"channel_id"`
+	ChannelName    string    `json:"channel_name"`
+	MessageID      string    `json:"message_id"`
+	AuthorID       string    `json:"author_id"`
+	Author         string    `json:"author"`
+	Content        string    `json:"content,omitempty"`
+	Posted         time.Time `json:"posted"`
+	MessageDeleted bool      `json:"message_deleted,omitempty"`
+}
+
+// NewSidecar describes i and where it was posted.
+func NewSidecar(i *database.Image, origins []database.Origin) Sidecar {
+	sc := Sidecar{
+		Format:   Format,
+		ID:       i.ID,
+		URL:      i.URL,
+		Hash:     i.Blake2Hash,
+		Mime:     i.Mime,
+		Size:     i.Size,
+		Width:    i.Width,
+		Height:   i.Height,
+		Tags:     i.Tags,
+		Added:    i.Added,
+		Guilds:   i.Guilds,
+		Uploaded: i.Uploaded,
+	}
+
+	for _, o := range origins {
+		sc.Origins = append(sc.Origins, Origin{
+			GuildID:        o.GuildID,
+			ChannelID:      o.ChannelID,
+			ChannelName:    o.ChannelName,
+			MessageID:      o.MessageID,
+			AuthorID:       o.AuthorID,
+			Author:         o.Author,
+			Content:        o.Content,
+			Posted:         o.Posted,
+			MessageDeleted: o.MessageDeleted,
+		})
+	}
+
+	return sc
+}
+
+// DatabaseOrigins returns the origins of the sidecar for imageID.
+func (sc Sidecar) DatabaseOrigins(imageID string) []database.Origin {
+	var result []database.Origin
+	for _, o := range sc.Origins {
+		result = append(result, database.Origin{
+			ImageID:        imageID,
+			GuildID:        o.GuildID,
+			ChannelID:      o.ChannelID,
+			ChannelName:    o.ChannelName,
+			MessageID:      o.MessageID,
+			AuthorID:       o.AuthorID,
+			Author:         o.Author,
+			Content:        o.Content,
+			Posted:         o.Posted,
+			MessageDeleted: o.MessageDeleted,
+		})
+	}
+
+	return result
+}
+
+// FileName is the name of an exported image: its hash in hex and its
+// extension.
+func FileName(i *database.Image) string {
+	hsh, err := base64.StdEncoding.DecodeString(i.Blake2Hash)
+	if err != nil || len(hsh) == 0 {
+		return i.ID + i.Ext
+	}
+
+	return hex.EncodeToString(hsh) + i.Ext
+}
+
+// Writer adds files to an archive.
+type Writer interface {
+	Add(name string, modTime time.Time, data []byte) error
+	Close() error
+}
+
+// NewWriter returns a Writer for format, which is tar or zip.
+func NewWriter(w io.Writer, format string) (Writer, error) {
+	switch format {
+	case "tar":
+		return &tarWriter{tw: tar.NewWriter(w)}, nil
+	case "zip":
+		return &zipWriter{zw: zip.NewWriter(w)}, nil
+	}
+
+	return nil, errors.New("bulk: archives can be tar or zip, not " + format)
+}
+
+type tarWriter struct {
+	tw *tar.Writer
+}
+
+func (t *tarWriter) Add(name string, modTime time.Time, data []byte) error {
+	err := t.tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  modTime,
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = t.tw.Write(data)
+	return err
+}
+
+func (t *tarWriter) Close() error {
+	return t.tw.Close()
+}
+
+type zipWriter struct {
+	zw *zip.Writer
+}
+
+func (z *zipWriter) Add(name string, modTime time.Time, data []byte) error {
+	// images are compressed already, so they are only stored
+	w, err := z.zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: modTime,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+func (z *zipWriter) Close() error {
+	return z.zw.Close()
+}
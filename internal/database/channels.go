@@ -0,0 +1,114 @@
+package database
+
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/asdine/storm/v2"
+	"within.website/ln"
+)
+
+// ChannelConfig is how kinq treats a Discord channel. It can be changed
+// while kinq runs.
+type ChannelConfig struct {
+	ChannelID string `storm:"id"`
+	GuildID   string `storm:"index"`
+	Name      string
+	Monitored bool `storm:"index"` // archive every link posted
+
+	// DefaultTags are added to every image archived from the channel.
+	DefaultTags []string
+	// Blocklist is hosts links to aren't archived from the channel,
+	// including their subdomains.
+	Blocklist []string
+
+	Updated   time.Time
+	UpdatedBy string
+}
+
+func (c ChannelConfig) F() ln.F {
+	return ln.F{
+		"channel_id":        c.ChannelID,
+		"channel_guild_id":  c.GuildID,
+		"channel_name":      c.Name,
+		"channel_monitored": c.Monitored,
+	}
+}
+
+// Blocked returns true if u is on a host in the blocklist.
+func (c ChannelConfig) Blocked(u string) bool {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(pu.Hostname())
+
+	for _, b := range c.Blocklist {
+		b = strings.ToLower(strings.TrimPrefix(b, "."))
+		if host == b || strings.HasSuffix(host, "."+b) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type Channels interface {
+	// One returns the config of a channel, or nil if it has none.
+	One(channelID string) (*ChannelConfig, error)
+	List() ([]ChannelConfig, error)
+	Monitored() ([]ChannelConfig, error)
+	Put(c *ChannelConfig) error
+	Delete(channelID string) error
+}
+
+type stormChannels struct {
+	db *storm.DB
+}
+
+func NewStormChannels(db *storm.DB) Channels {
+	return &stormChannels{db: db}
+}
+
+func (s *stormChannels) One(channelID string) (*ChannelConfig, error) {
+	var c ChannelConfig
+	err := s.db.One("ChannelID", channelID, &c)
+	switch err {
+	case nil:
+		return &c, nil
+	case storm.ErrNotFound:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+func (s *stormChannels) List() ([]ChannelConfig, error) {
+	var cs []ChannelConfig
+	err := s.db.All(&cs)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	return cs, nil
+}
+
+func (s *stormChannels) Monitored() ([]ChannelConfig, error) {
+	var cs []ChannelConfig
+	err := s.db.Find("Monitored", true, &cs)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	return cs, nil
+}
+
+func (s *stormChannels) Put(c *ChannelConfig) error {
+	c.Updated = time.Now()
+	return s.db.Save(c)
+}
+
+func (s *stormChannels) Delete(channelID string) error {
+	return s.db.DeleteStruct(&ChannelConfig{ChannelID: channelID})
+}
@@ -0,0 +1,56 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/asdine/storm/v2"
+)
+
+func TestChannelConfigBlocked(t *testing.T) {
+	c := ChannelConfig{Blocklist: []string{"example.com", ".Tracker.net"}}
+
+	cases := []struct {
+		url     string
+		blocked bool
+	}{
+		{"https://example.com/a.png", true},
+		{"https://cdn.example.com/a.png", true},
+		{"https://EXAMPLE.com:8080/a.png", true},
+		{"https://notexample.com/a.png", false},
+		{"https://tracker.net/x", true},
+		{"https://example.org/a.png", false},
+		{"https://other.host/example.com", false},
+		{"::not a url", false},
+	}
+
+	for _, cs := range cases {
+		if got := c.Blocked(cs.url); got != cs.blocked {
+			t.Errorf("%s: wanted blocked %v, got: %v", cs.url, cs.blocked, got)
+		}
+	}
+}
+
+func TestChannelsDelete(t *testing.T) {
+	c := NewStormChannels(openTestDB(t))
+
+	err := c.Put(&ChannelConfig{ChannelID: "c1", Monitored: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Delete("unknown"); err != storm.ErrNotFound {
+		t.Errorf("deleting an unknown channel = %v, want %v", err, storm.ErrNotFound)
+	}
+
+	if err := c.Delete("c1"); err != nil {
+		t.Fatal(err)
+	}
+
+	cs, err := c.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cs) != 0 {
+		t.Errorf("%d channels left after deleting the only one", len(cs))
+	}
+}
@@ -0,0 +1,75 @@
+package database
+
+import (
+	"time"
+
+	"github.com/Xe/kinq/internal/discord"
+	"github.com/asdine/storm/v2"
+)
+
+// ChannelCursor remembers the newest message kinq has read in a Discord
+// channel, so it can catch up on what it missed while it was offline.
+type ChannelCursor struct {
+	ChannelID string `storm:"id"`
+	MessageID string
+	Updated   time.Time
+}
+
+type Cursors interface {
+	// Get returns the newest message read in a channel, or "" if nothing
+	// has been read there yet.
+	Get(channelID string) (string, error)
+	// Advance moves the cursor of a channel to messageID if that message is
+	// newer than the one already there.
+	Advance(channelID, messageID string) error
+}
+
+type stormCursors struct {
+	db *storm.DB
+}
+
+func NewStormCursors(db *storm.DB) Cursors {
+	return &stormCursors{db: db}
+}
+
+func (s *stormCursors) Get(channelID string) (string, error) {
+	var c ChannelCursor
+	err := s.db.One("ChannelID", channelID, &c)
+	switch err {
+	case nil:
+		return c.MessageID, nil
+	case storm.ErrNotFound:
+		return "", nil
+	default:
+		return "", err
+	}
+}
+
+func (s *stormCursors) Advance(channelID, messageID string) error {
+	tx, err := s.db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var c ChannelCursor
+	err = tx.One("ChannelID", channelID, &c)
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+
+	if c.MessageID != "" && !discord.SnowflakeLess(c.MessageID, messageID) {
+		return nil
+	}
+
+	c.ChannelID = channelID
+	c.MessageID = messageID
+	c.Updated = time.Now()
+
+	err = tx.Save(&c)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,66 @@
+package database
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/asdine/storm/v2"
+	bolt "go.etcd.io/bbolt"
+)
+
+// openTestDB opens a new database that is removed when the test ends.
+func openTestDB(t *testing.T) *storm.DB {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "kinq-database")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := storm.Open(filepath.Join(dir, "kinq.db"), storm.BoltOptions(0600, &bolt.Options{Timeout: time.Second}))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		db.Close()
+		os.RemoveAll(dir)
+	})
+
+	return db
+}
+
+// testPNG returns a PNG that is different for every n.
+func testPNG(t *testing.T, n int) []byte {
+	t.Helper()
+
+	img := image.NewGray(image.Rect(0, 0, 8, 8))
+	img.Pix[0] = uint8(n)
+	img.Pix[1] = uint8(n >> 8)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// rawImage reads an image record as stored, without opening its data.
+func rawImage(t *testing.T, db *storm.DB, id string) Image {
+	t.Helper()
+
+	var i Image
+	if err := db.One("ID", id, &i); err != nil {
+		t.Fatal(err)
+	}
+
+	return i
+}
@@ -0,0 +1,82 @@
+package database
+
+import (
+	"context"
+	"errors"
+
+	"github.com/Xe/kinq/internal/ksecretbox"
+	"github.com/asdine/storm/v2"
+	"within.website/ln"
+)
+
+// ErrNoImageKeys is returned when an encrypted image is read without any keys
+// to open it with.
+var ErrNoImageKeys = errors.New("database: image is encrypted but no image keys are configured")
+
+// ImageKeyPurpose is what the image keyring is derived for from the
+// configured secret box keys.
+const ImageKeyPurpose = "kinq image data"
+
+// EncryptImages seals the data of every plaintext image with the primary key
+// of keys, and re-seals images that were sealed with an older key. It returns
+// the number of images it changed.
+func EncryptImages(ctx context.Context, db *storm.DB, keys ksecretbox.Keyring) (int, error) {
+	if len(keys) == 0 {
+		return 0, ErrNoImageKeys
+	}
+
+	// storm can't write inside Each, so collect the IDs first
+	var ids []string
+	err := db.Select().Each(new(Image), func(rec interface{}) error {
+		i := rec.(*Image)
+		ids = append(ids, i.ID)
+		return nil
+	})
+	if err != nil && err != storm.ErrNotFound {
+		return 0, err
+	}
+
+	primary := ksecretbox.KeyID(keys.Primary())
+	n := 0
+
+	for _, id := range ids {
+		var i Image
+		err := db.One("ID", id, &i)
+		if err != nil {
+			return n, err
+		}
+
+		if len(i.Data) == 0 {
+			continue
+		}
+
+		if i.Encrypted {
+			kid, _ := ksecretbox.BoxKeyID(i.Data)
+			if kid == primary {
+				continue
+			}
+
+			i.Data, err = keys.Open(i.Data)
+			if err != nil {
+				ln.Error(ctx, err, i, ln.Action("opening image data to re-seal it"))
+				continue
+			}
+		}
+
+		i.Data, err = keys.Seal(i.Data)
+		if err != nil {
+			return n, err
+		}
+		i.Encrypted = true
+
+		err = db.Save(&i)
+		if err != nil {
+			return n, err
+		}
+
+		ln.Log(ctx, i, ln.Action("encrypted image"))
+		n++
+	}
+
+	return n, nil
+}
@@ -0,0 +1,164 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Xe/kinq/internal/ksecretbox"
+	"github.com/Xe/kinq/internal/linkscraper"
+)
+
+func TestEncryptImages(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	oldKey, err := ksecretbox.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, err := ksecretbox.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKeys := ksecretbox.Keyring{oldKey}
+	rotated := ksecretbox.Keyring{newKey, oldKey}
+
+	plain := NewStormImages(db, &linkscraper.Rules{})
+
+	type inserted struct {
+		id   string
+		data []byte
+	}
+
+	var ids []inserted
+	for n := 0; n < 3; n++ {
+		data := testPNG(t, n)
+		i, err := plain.InsertBytes(data, "image/png", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, inserted{i.ID, data})
+	}
+
+	if _, err := EncryptImages(ctx, db, nil); err != ErrNoImageKeys {
+		t.Errorf("EncryptImages without keys = %v, want %v", err, ErrNoImageKeys)
+	}
+
+	n, err := EncryptImages(ctx, db, oldKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(ids) {
+		t.Errorf("encrypted %d images, want %d", n, len(ids))
+	}
+
+	for _, id := range ids {
+		i := rawImage(t, db, id.id)
+		if !i.Encrypted || bytes.Equal(i.Data, id.data) {
+			t.Errorf("image %s is stored in plaintext", i.ID)
+		}
+	}
+
+	if _, err := plain.One(ids[0].id); err != ErrNoImageKeys {
+		t.Errorf("One of an encrypted image without keys = %v, want %v", err, ErrNoImageKeys)
+	}
+
+	// nothing to do with the same key
+	n, err = EncryptImages(ctx, db, oldKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("encrypted %d images a second time", n)
+	}
+
+	// a new primary key re-seals everything
+	n, err = EncryptImages(ctx, db, rotated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(ids) {
+		t.Errorf("re-sealed %d images, want %d", n, len(ids))
+	}
+
+	// the old key isn't needed anymore
+	i := NewStormImages(db, &linkscraper.Rules{}, WithKeys(ksecretbox.Keyring{newKey}, true))
+	for _, id := range ids {
+		img, err := i.One(id.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img.Encrypted || !bytes.Equal(img.Data, id.data) {
+			t.Errorf("image %s didn't open to its plaintext", img.ID)
+		}
+	}
+
+	// new images are sealed when they are inserted
+	data := testPNG(t, 100)
+	img, err := i.InsertBytes(data, "image/png", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(img.Data, data) {
+		t.Error("InsertBytes didn't return the plaintext")
+	}
+	if stored := rawImage(t, db, img.ID); !stored.Encrypted || bytes.Equal(stored.Data, data) {
+		t.Error("new image is stored in plaintext")
+	}
+}
+
+func TestReinsertWithoutEncryption(t *testing.T) {
+	db := openTestDB(t)
+
+	key, err := ksecretbox.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := ksecretbox.Keyring{key}
+
+	// the URL serves different data every time
+	served := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served++
+		w.Write(testPNG(t, served))
+	}))
+	defer srv.Close()
+	f := NewFetcher(testFetchConfig(t))
+
+	sealed := NewStormImages(db, &linkscraper.Rules{}, WithKeys(keys, true), WithFetcher(f))
+	first, err := sealed.Insert(srv.URL + "/a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sealed.AddGuild(first.ID, "g1"); err != nil {
+		t.Fatal(err)
+	}
+
+	plain := NewStormImages(db, &linkscraper.Rules{}, WithKeys(keys, false), WithFetcher(f))
+	again, err := plain.Insert(srv.URL + "/a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != first.ID {
+		t.Fatalf("same URL was stored as %s and %s", first.ID, again.ID)
+	}
+
+	stored := rawImage(t, db, first.ID)
+	if stored.Encrypted || !bytes.Equal(stored.Data, testPNG(t, 2)) {
+		t.Errorf("new plaintext data is stored with Encrypted = %v", stored.Encrypted)
+	}
+	if len(stored.Guilds) != 1 || stored.Guilds[0] != "g1" {
+		t.Errorf("guilds = %v, want them kept", stored.Guilds)
+	}
+
+	img, err := plain.One(first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Blake2Hash != Hash(testPNG(t, 2)) {
+		t.Error("hash wasn't updated for the new data")
+	}
+}
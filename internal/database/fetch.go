@@ -0,0 +1,302 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// BlockedAddressError is returned when a URL resolves to an address in a
+// private, loopback or otherwise internal range that isn't allowlisted.
+type BlockedAddressError struct {
+	IP net.IP
+}
+
+func (e *BlockedAddressError) Error() string {
+	return "fetch: refusing to connect to internal address " + e.IP.String()
+}
+
+// TooLargeError is returned when a response body is bigger than the limit.
+type TooLargeError struct {
+	Limit int64
+}
+
+func (e *TooLargeError) Error() string {
+	return fmt.Sprintf("fetch: response is larger than %d bytes", e.Limit)
+}
+
+// RedirectLimitError is returned when a URL redirects too many times.
+type RedirectLimitError struct {
+	Limit int
+}
+
+func (e *RedirectLimitError) Error() string {
+	return fmt.Sprintf("fetch: stopped after %d redirects", e.Limit)
+}
+
+// SchemeError is returned for URLs that aren't http or https.
+type SchemeError struct {
+	Scheme string
+}
+
+func (e *SchemeError) Error() string {
+	return "fetch: unsupported url scheme " + strconv.Quote(e.Scheme)
+}
+
+// StatusError is returned when the server doesn't answer with HTTP 200.
+type StatusError struct {
+	Code int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("expected http 200, got: %d", e.Code)
+}
+
+// blockedNets are never fetched from unless allowlisted.
+var blockedNets = mustParseCIDRs(
+	"0.0.0.0/8",      // "this" network
+	"10.0.0.0/8",     // private
+	"100.64.0.0/10",  // carrier grade NAT
+	"127.0.0.0/8",    // loopback
+	"169.254.0.0/16", // link local, cloud metadata services
+	"172.16.0.0/12",  // private
+	"192.0.0.0/24",   // IETF protocol assignments
+	"192.168.0.0/16", // private
+	"198.18.0.0/15",  // benchmarking
+	"224.0.0.0/4",    // multicast
+	"240.0.0.0/4",    // reserved, broadcast
+	"::/128",         // unspecified
+	"::1/128",        // loopback
+	"64:ff9b::/96",   // NAT64
+	"fc00::/7",       // unique local
+	"fe80::/10",      // link local
+	"ff00::/8",       // multicast
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+
+	return nets
+}
+
+// ParseCIDRs parses a list of CIDR ranges for FetchConfig.Allow.
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+// FetchConfig limits what a Fetcher will download.
+type FetchConfig struct {
+	MaxBytes       int64         // largest response body accepted
+	ConnectTimeout time.Duration // time allowed to connect to the server
+	Timeout        time.Duration // time allowed for the whole request
+	MaxRedirects   int           // redirects followed before giving up
+	Allow          []*net.IPNet  // internal ranges that may be fetched from anyway
+	UserAgent      string
+}
+
+// DefaultFetchConfig is used when Images isn't given a Fetcher.
+var DefaultFetchConfig = FetchConfig{
+	MaxBytes:       50 << 20,
+	ConnectTimeout: 10 * time.Second,
+	Timeout:        time.Minute,
+	MaxRedirects:   5,
+}
+
+// FetchResult is a downloaded response body.
+type FetchResult struct {
+	URL         string // after redirects
+	ContentType string
+	Data        []byte
+}
+
+// Fetcher downloads untrusted URLs posted in chat.
+type Fetcher struct {
+	cfg    FetchConfig
+	client *http.Client
+}
+
+func NewFetcher(cfg FetchConfig) *Fetcher {
+	f := &Fetcher{cfg: cfg}
+
+	dialer := &net.Dialer{
+		Timeout: cfg.ConnectTimeout,
+		Control: f.control,
+	}
+
+	f.client = &http.Client{
+		Timeout: cfg.Timeout,
+		Transport: &http.Transport{
+			// no proxy, it would connect to the internal addresses for us
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   cfg.ConnectTimeout,
+			ResponseHeaderTimeout: cfg.Timeout,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       90 * time.Second,
+		},
+		CheckRedirect: f.checkRedirect,
+	}
+
+	return f
+}
+
+// DialControl refuses connections to the addresses the Fetcher won't
+// download from. Other clients that connect to URLs users give, like
+// webhooks, use it as the Control of their net.Dialer.
+func (f *Fetcher) DialControl(network, address string, c syscall.RawConn) error {
+	return f.control(network, address, c)
+}
+
+// control runs after DNS resolution, just before connecting, so it sees the
+// address that is actually used.
+func (f *Fetcher) control(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return &BlockedAddressError{IP: ip}
+	}
+
+	if !f.allowed(ip) {
+		return &BlockedAddressError{IP: ip}
+	}
+
+	return nil
+}
+
+func (f *Fetcher) allowed(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	for _, n := range f.cfg.Allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	for _, n := range blockedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (f *Fetcher) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > f.cfg.MaxRedirects {
+		return &RedirectLimitError{Limit: f.cfg.MaxRedirects}
+	}
+
+	return checkScheme(req.URL)
+}
+
+func checkScheme(u *url.URL) error {
+	switch u.Scheme {
+	case "http", "https":
+		return nil
+	}
+
+	return &SchemeError{Scheme: u.Scheme}
+}
+
+// Fetch downloads u, enforcing the limits of the Fetcher.
+func (f *Fetcher) Fetch(ctx context.Context, u string) (*FetchResult, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	err = checkScheme(req.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.cfg.UserAgent != "" {
+		req.Header.Set("User-Agent", f.cfg.UserAgent)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, unwrapFetchError(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{Code: resp.StatusCode}
+	}
+
+	if f.cfg.MaxBytes > 0 && resp.ContentLength > f.cfg.MaxBytes {
+		return nil, &TooLargeError{Limit: f.cfg.MaxBytes}
+	}
+
+	var body io.Reader = resp.Body
+	if f.cfg.MaxBytes > 0 {
+		body = io.LimitReader(resp.Body, f.cfg.MaxBytes+1)
+	}
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, unwrapFetchError(err)
+	}
+
+	if f.cfg.MaxBytes > 0 && int64(len(data)) > f.cfg.MaxBytes {
+		return nil, &TooLargeError{Limit: f.cfg.MaxBytes}
+	}
+
+	return &FetchResult{
+		URL:         resp.Request.URL.String(),
+		ContentType: resp.Header.Get("Content-Type"),
+		Data:        data,
+	}, nil
+}
+
+// unwrapFetchError digs the typed errors of this file out of the url.Error
+// and net.OpError wrappers net/http puts around them.
+func unwrapFetchError(err error) error {
+	var (
+		bae *BlockedAddressError
+		rle *RedirectLimitError
+		se  *SchemeError
+	)
+
+	switch {
+	case errors.As(err, &bae):
+		return bae
+	case errors.As(err, &rle):
+		return rle
+	case errors.As(err, &se):
+		return se
+	}
+
+	return err
+}
@@ -0,0 +1,182 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testFetchConfig(t *testing.T) FetchConfig {
+	allow, err := ParseCIDRs([]string{"127.0.0.0/8", "::1/128"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return FetchConfig{
+		MaxBytes:       1024,
+		ConnectTimeout: time.Second,
+		Timeout:        time.Second,
+		MaxRedirects:   2,
+		Allow:          allow,
+		UserAgent:      "kinq-test",
+	}
+}
+
+func TestFetcher(t *testing.T) {
+	body := bytes.Repeat([]byte("a"), 512)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		if ua := r.Header.Get("User-Agent"); ua != "kinq-test" {
+			t.Errorf("wanted user agent kinq-test, got: %q", ua)
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(body)
+	})
+	mux.HandleFunc("/big", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("a"), 2048))
+	})
+	mux.HandleFunc("/big-chunked", func(w http.ResponseWriter, r *http.Request) {
+		for n := 0; n < 4; n++ {
+			w.Write(bytes.Repeat([]byte("a"), 512))
+			w.(http.Flusher).Flush()
+		}
+	})
+	mux.HandleFunc("/missing", http.NotFound)
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(5 * time.Second):
+		case <-r.Context().Done():
+		}
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/ok", http.StatusFound)
+	})
+	mux.HandleFunc("/ftp", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "ftp://example.com/image.png", http.StatusFound)
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	ctx := context.Background()
+	f := NewFetcher(testFetchConfig(t))
+
+	t.Run("ok", func(t *testing.T) {
+		res, err := f.Fetch(ctx, srv.URL+"/redirect")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(res.Data, body) {
+			t.Fatalf("wanted %d bytes, got: %d", len(body), len(res.Data))
+		}
+
+		if res.ContentType != "image/png" {
+			t.Fatalf("wanted content type image/png, got: %q", res.ContentType)
+		}
+
+		if res.URL != srv.URL+"/ok" {
+			t.Fatalf("wanted final url %s/ok, got: %s", srv.URL, res.URL)
+		}
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		for _, path := range []string{"/big", "/big-chunked"} {
+			_, err := f.Fetch(ctx, srv.URL+path)
+			if _, ok := err.(*TooLargeError); !ok {
+				t.Errorf("%s: wanted *TooLargeError, got: %v", path, err)
+			}
+		}
+	})
+
+	t.Run("bad status", func(t *testing.T) {
+		_, err := f.Fetch(ctx, srv.URL+"/missing")
+		if se, ok := err.(*StatusError); !ok || se.Code != http.StatusNotFound {
+			t.Fatalf("wanted *StatusError with 404, got: %v", err)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		start := time.Now()
+		_, err := f.Fetch(ctx, srv.URL+"/slow")
+		if err == nil {
+			t.Fatal("wanted an error")
+		}
+
+		if time.Since(start) > 3*time.Second {
+			t.Fatalf("timeout was not enforced, took %v", time.Since(start))
+		}
+	})
+
+	t.Run("redirect loop", func(t *testing.T) {
+		_, err := f.Fetch(ctx, srv.URL+"/loop")
+		if rle, ok := err.(*RedirectLimitError); !ok || rle.Limit != 2 {
+			t.Fatalf("wanted *RedirectLimitError, got: %v", err)
+		}
+	})
+
+	t.Run("bad scheme", func(t *testing.T) {
+		_, err := f.Fetch(ctx, srv.URL+"/ftp")
+		if _, ok := err.(*SchemeError); !ok {
+			t.Fatalf("wanted *SchemeError, got: %v", err)
+		}
+
+		_, err = f.Fetch(ctx, "file:///etc/passwd")
+		if _, ok := err.(*SchemeError); !ok {
+			t.Fatalf("wanted *SchemeError, got: %v", err)
+		}
+	})
+
+	t.Run("blocked address", func(t *testing.T) {
+		cfg := testFetchConfig(t)
+		cfg.Allow = nil
+		bf := NewFetcher(cfg)
+
+		_, err := bf.Fetch(ctx, srv.URL+"/ok")
+		bae, ok := err.(*BlockedAddressError)
+		if !ok {
+			t.Fatalf("wanted *BlockedAddressError, got: %v", err)
+		}
+
+		if !bae.IP.IsLoopback() {
+			t.Fatalf("wanted a loopback address, got: %v", bae.IP)
+		}
+	})
+}
+
+func TestFetcherAllowed(t *testing.T) {
+	f := NewFetcher(FetchConfig{})
+
+	cases := []struct {
+		ip   string
+		want bool
+	}{
+		{"1.1.1.1", true},
+		{"2606:4700:4700::1111", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.20.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.100.100.200", false},
+		{"0.0.0.0", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+	}
+
+	for _, cs := range cases {
+		if got := f.allowed(net.ParseIP(cs.ip)); got != cs.want {
+			t.Errorf("%s: wanted allowed=%v, got: %v", cs.ip, cs.want, got)
+		}
+	}
+}
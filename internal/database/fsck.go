@@ -0,0 +1,468 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Xe/kinq/internal/ksecretbox"
+	"github.com/asdine/storm/v2"
+	bolt "go.etcd.io/bbolt"
+	"within.website/ln"
+)
+
+// Problem is something wrong with a stored image.
+type Problem string
+
+const (
+	ProblemUndecodable   Problem = "undecodable"    // the record can't be decoded
+	ProblemEmpty         Problem = "empty"          // the record has no data
+	ProblemUnreadable    Problem = "unreadable"     // encrypted data can't be opened
+	ProblemHashMismatch  Problem = "hash mismatch"  // the data doesn't hash to Blake2Hash
+	ProblemDuplicateHash Problem = "duplicate hash" // more than one record has the hash
+	ProblemMissingIndex  Problem = "missing index"  // the hash index doesn't point at the record
+	ProblemOrphanedIndex Problem = "orphaned index" // the hash index points at a record that doesn't exist
+)
+
+// Finding is one problem fsck found.
+type Finding struct {
+	ImageID  string
+	URL      string
+	Problem  Problem
+	Detail   string
+	Repaired bool
+}
+
+// FsckReport is the result of checking every stored image.
+type FsckReport struct {
+	Started  time.Time
+	Finished time.Time
+	Repair   bool
+	Images   int   // records checked
+	Bytes    int64 // stored data read
+	Findings []Finding
+}
+
+func (r FsckReport) F() ln.F {
+	return ln.F{
+		"fsck_images":     r.Images,
+		"fsck_bytes":      r.Bytes,
+		"fsck_findings":   len(r.Findings),
+		"fsck_unrepaired": r.Unrepaired(),
+		"fsck_repair":     r.Repair,
+		"fsck_duration":   r.Finished.Sub(r.Started),
+	}
+}
+
+// Unrepaired returns how many findings are still problems.
+func (r FsckReport) Unrepaired() int {
+	n := 0
+	for _, f := range r.Findings {
+		if !f.Repaired {
+			n++
+		}
+	}
+
+	return n
+}
+
+// FsckConfig controls what Fsck does about problems.
+type FsckConfig struct {
+	Keys    ksecretbox.Keyring // opens encrypted images
+	Encrypt bool               // seal re-fetched data with Keys
+	Repair  bool               // re-fetch broken images and rebuild the hash index
+	Fetcher *Fetcher           // re-fetches images, DefaultFetchConfig if nil
+}
+
+// storm keeps unique indexes in a bucket inside the bucket of their type,
+// mapping each value to the ID of its record. The bucket is named with
+// storm's unexported indexPrefix and the field name, as of storm 2.0.0 (see
+// storm.Version). TestFsck finds a healthy database broken if that changes.
+const (
+	imageBucket    = "Image"
+	imageHashIndex = "__storm_index_Blake2Hash"
+)
+
+// fsckBatch is how many records are read per transaction, so a scrub of a
+// big archive doesn't hold one read transaction open the whole time.
+var fsckBatch = 100
+
+// record is what the index check needs to know about an image.
+type record struct {
+	Hash string
+	URL  string
+}
+
+// Fsck checks that the data of every stored image is there and matches its
+// hash, and that the hash index agrees with the records. With cfg.Repair,
+// broken images are fetched again from their URL and the index is rebuilt.
+func Fsck(ctx context.Context, db *storm.DB, cfg FsckConfig) (*FsckReport, error) {
+	r := &FsckReport{Started: time.Now(), Repair: cfg.Repair}
+
+	records := map[string]record{}
+	var after []byte
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		batch, err := readBatch(db, after)
+		if err != nil {
+			return nil, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		after = batch[len(batch)-1].key
+
+		for _, raw := range batch {
+			r.Images++
+
+			var i Image
+			err := db.Codec().Unmarshal(raw.value, &i)
+			if err != nil {
+				r.Findings = append(r.Findings, Finding{ImageID: string(raw.key), Problem: ProblemUndecodable, Detail: err.Error()})
+				continue
+			}
+
+			records[i.ID] = record{Hash: i.Blake2Hash, URL: i.URL}
+			r.Bytes += int64(len(i.Data))
+
+			if p, detail := checkData(&i, cfg.Keys); p != "" {
+				r.Findings = append(r.Findings, Finding{ImageID: i.ID, URL: i.URL, Problem: p, Detail: detail})
+			}
+		}
+	}
+
+	index, err := hashIndex(db, records)
+	if err != nil {
+		return nil, err
+	}
+	r.Findings = append(r.Findings, checkIndex(records, index)...)
+
+	if cfg.Repair {
+		repair(ctx, db, cfg, r.Findings)
+	}
+
+	r.Finished = time.Now()
+
+	return r, nil
+}
+
+// checkData returns what is wrong with the data of i, if anything.
+func checkData(i *Image, keys ksecretbox.Keyring) (Problem, string) {
+	if len(i.Data) == 0 {
+		return ProblemEmpty, ""
+	}
+
+	data := i.Data
+	if i.Encrypted {
+		if len(keys) == 0 {
+			return ProblemUnreadable, ErrNoImageKeys.Error()
+		}
+
+		var err error
+		data, err = keys.Open(data)
+		if err != nil {
+			return ProblemUnreadable, err.Error()
+		}
+	}
+
+	if h := Hash(data); h != i.Blake2Hash {
+		return ProblemHashMismatch, "data hashes to " + h
+	}
+
+	return "", ""
+}
+
+// rawRecord is a stored image as read from the database.
+type rawRecord struct {
+	key, value []byte
+}
+
+// readBatch reads up to fsckBatch image records with keys after the given
+// one, or from the start if after is nil.
+func readBatch(db *storm.DB, after []byte) ([]rawRecord, error) {
+	var batch []rawRecord
+
+	err := db.Bolt.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(imageBucket))
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		k, v := c.First()
+		if after != nil {
+			k, v = c.Seek(after)
+			if bytes.Equal(k, after) {
+				k, v = c.Next()
+			}
+		}
+
+		for ; k != nil && len(batch) < fsckBatch; k, v = c.Next() {
+			// storm's indexes and metadata are buckets next to the records
+			if v == nil {
+				continue
+			}
+
+			batch = append(batch, rawRecord{
+				key:   append([]byte(nil), k...),
+				value: append([]byte(nil), v...),
+			})
+		}
+
+		return nil
+	})
+
+	return batch, err
+}
+
+// hashIndex reads the unique index storm keeps of Blake2Hash. Images were
+// read over many transactions, so records that disagree with the index are
+// read again alongside it, keeping images that changed during the scan from
+// showing up as index problems.
+func hashIndex(db *storm.DB, records map[string]record) (map[string]string, error) {
+	index := map[string]string{}
+
+	err := db.Bolt.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(imageBucket))
+		if b == nil {
+			return nil
+		}
+
+		ib := b.Bucket([]byte(imageHashIndex))
+		if ib == nil {
+			return nil
+		}
+
+		err := ib.ForEach(func(k, v []byte) error {
+			index[string(k)] = string(v)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		reread := func(id string) {
+			var i Image
+			if v := b.Get([]byte(id)); v != nil && db.Codec().Unmarshal(v, &i) == nil {
+				records[id] = record{Hash: i.Blake2Hash, URL: i.URL}
+			}
+		}
+
+		for hash, id := range index {
+			if records[id].Hash != hash {
+				reread(id)
+			}
+		}
+		for id, rec := range records {
+			if index[rec.Hash] != id {
+				reread(id)
+			}
+		}
+
+		return nil
+	})
+
+	return index, err
+}
+
+// checkIndex compares the records of images with the hash index.
+func checkIndex(records map[string]record, index map[string]string) []Finding {
+	byHash := map[string][]string{}
+	for id, rec := range records {
+		byHash[rec.Hash] = append(byHash[rec.Hash], id)
+	}
+
+	var findings []Finding
+
+	for _, hash := range sortedKeys(byHash) {
+		ids := byHash[hash]
+		sort.Strings(ids)
+
+		if len(ids) > 1 {
+			findings = append(findings, Finding{
+				ImageID: ids[0],
+				URL:     records[ids[0]].URL,
+				Problem: ProblemDuplicateHash,
+				Detail:  "also stored as " + strings.Join(ids[1:], ", "),
+			})
+		}
+
+		indexed, ok := index[hash]
+		for _, id := range ids {
+			switch {
+			case !ok:
+				findings = append(findings, Finding{ImageID: id, URL: records[id].URL, Problem: ProblemMissingIndex, Detail: "hash isn't indexed"})
+			case indexed != id && len(ids) == 1:
+				findings = append(findings, Finding{ImageID: id, URL: records[id].URL, Problem: ProblemMissingIndex, Detail: "hash is indexed as " + indexed})
+			}
+		}
+	}
+
+	var hashes []string
+	for hash := range index {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+
+	for _, hash := range hashes {
+		id := index[hash]
+		if rec, ok := records[id]; !ok || rec.Hash != hash {
+			findings = append(findings, Finding{ImageID: id, Problem: ProblemOrphanedIndex, Detail: "indexed hash " + hash})
+		}
+	}
+
+	return findings
+}
+
+func sortedKeys(m map[string][]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// repair fetches images with missing or damaged data again and rebuilds the
+// hash index, marking the findings it fixed. Duplicates are left for people
+// to sort out.
+func repair(ctx context.Context, db *storm.DB, cfg FsckConfig, findings []Finding) {
+	f := cfg.Fetcher
+	if f == nil {
+		f = NewFetcher(DefaultFetchConfig)
+	}
+
+	reindex := false
+	duplicates := false
+
+	for n := range findings {
+		fi := &findings[n]
+
+		switch fi.Problem {
+		case ProblemEmpty, ProblemUnreadable, ProblemHashMismatch:
+			err := refetch(ctx, db, cfg, f, fi.ImageID)
+			if err != nil {
+				addDetail(fi, "repair: "+err.Error())
+				ln.Error(ctx, err, ln.Action("refetching image"), ln.F{"image_id": fi.ImageID, "problem": fi.Problem})
+				continue
+			}
+			fi.Repaired = true
+			ln.Log(ctx, ln.Action("refetched image"), ln.F{"image_id": fi.ImageID, "problem": fi.Problem})
+		case ProblemMissingIndex, ProblemOrphanedIndex:
+			reindex = true
+		case ProblemDuplicateHash:
+			duplicates = true
+		}
+	}
+
+	if !reindex {
+		return
+	}
+
+	// rebuilding a unique index fails while the hash is stored twice
+	if duplicates {
+		markIndex(findings, false, "repair: sort out duplicate hashes before the index can be rebuilt")
+		return
+	}
+
+	err := db.ReIndex(&Image{})
+	if err != nil {
+		ln.Error(ctx, err, ln.Action("rebuilding image indexes"))
+		markIndex(findings, false, "repair: "+err.Error())
+		return
+	}
+
+	ln.Log(ctx, ln.Action("rebuilt image indexes"))
+	markIndex(findings, true, "")
+}
+
+func markIndex(findings []Finding, repaired bool, detail string) {
+	for n := range findings {
+		fi := &findings[n]
+		if fi.Problem != ProblemMissingIndex && fi.Problem != ProblemOrphanedIndex {
+			continue
+		}
+
+		fi.Repaired = repaired
+		addDetail(fi, detail)
+	}
+}
+
+func addDetail(fi *Finding, detail string) {
+	switch {
+	case detail == "":
+	case fi.Detail == "":
+		fi.Detail = detail
+	default:
+		fi.Detail += "; " + detail
+	}
+}
+
+// refetch downloads an image from its URL again and stores the data if it
+// still matches the hash it was archived with.
+func refetch(ctx context.Context, db *storm.DB, cfg FsckConfig, f *Fetcher, id string) error {
+	var i Image
+	err := db.One("ID", id, &i)
+	if err != nil {
+		return err
+	}
+
+	if i.Deleted {
+		return fmt.Errorf("image was deleted, not fetching it again")
+	}
+	if i.SourceURL() == "" {
+		return fmt.Errorf("image was uploaded without a source, nothing to fetch")
+	}
+
+	res, err := f.Fetch(ctx, i.URL)
+	if err != nil {
+		return err
+	}
+
+	if h := Hash(res.Data); h != i.Blake2Hash {
+		return fmt.Errorf("%s now serves different data (hash %s)", i.URL, h)
+	}
+
+	i.Data = res.Data
+	i.Encrypted = false
+	if cfg.Encrypt {
+		i.Data, err = cfg.Keys.Seal(res.Data)
+		if err != nil {
+			return err
+		}
+		i.Encrypted = true
+	}
+
+	return db.Save(&i)
+}
+
+const (
+	fsckBucket    = "fsck"
+	fsckReportKey = "last"
+)
+
+// SaveFsckReport keeps r as the latest report.
+func SaveFsckReport(db *storm.DB, r *FsckReport) error {
+	return db.Set(fsckBucket, fsckReportKey, r)
+}
+
+// LastFsckReport returns the latest report, or nil if fsck never ran.
+func LastFsckReport(db *storm.DB) (*FsckReport, error) {
+	var r FsckReport
+	err := db.Get(fsckBucket, fsckReportKey, &r)
+	if err == storm.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
@@ -0,0 +1,188 @@
+package database
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/Xe/kinq/internal/ksecretbox"
+	"github.com/Xe/kinq/internal/linkscraper"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestCheckData(t *testing.T) {
+	key, err := ksecretbox.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := ksecretbox.Keyring{key}
+
+	other, err := ksecretbox.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("not really a png")
+	sealed, err := keys.Seal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		i    Image
+		keys ksecretbox.Keyring
+		want Problem
+	}{
+		{"fine", Image{Data: data, Blake2Hash: Hash(data)}, nil, ""},
+		{"encrypted", Image{Data: sealed, Encrypted: true, Blake2Hash: Hash(data)}, keys, ""},
+		{"empty", Image{Blake2Hash: Hash(data)}, keys, ProblemEmpty},
+		{"no keys", Image{Data: sealed, Encrypted: true, Blake2Hash: Hash(data)}, nil, ProblemUnreadable},
+		{"wrong key", Image{Data: sealed, Encrypted: true, Blake2Hash: Hash(data)}, ksecretbox.Keyring{other}, ProblemUnreadable},
+		{"changed", Image{Data: []byte("something else"), Blake2Hash: Hash(data)}, nil, ProblemHashMismatch},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got, detail := checkData(&c.i, c.keys); got != c.want {
+				t.Errorf("checkData() = %q (%s), want %q", got, detail, c.want)
+			}
+		})
+	}
+}
+
+func TestCheckIndex(t *testing.T) {
+	records := map[string]record{
+		"a": {Hash: "ha", URL: "https://a"},
+		"b": {Hash: "hb", URL: "https://b"},
+		"c": {Hash: "hc", URL: "https://c"},
+		"d": {Hash: "hd", URL: "https://d"},
+		"e": {Hash: "hd", URL: "https://e"},
+	}
+	index := map[string]string{
+		"ha": "a",
+		"hc": "a",
+		"hd": "d",
+		"hz": "z",
+	}
+
+	var got []Problem
+	var ids []string
+	for _, f := range checkIndex(records, index) {
+		got = append(got, f.Problem)
+		ids = append(ids, f.ImageID)
+	}
+
+	want := []Problem{ProblemMissingIndex, ProblemMissingIndex, ProblemDuplicateHash, ProblemOrphanedIndex, ProblemOrphanedIndex}
+	wantIDs := []string{"b", "c", "d", "a", "z"}
+	if !reflect.DeepEqual(got, want) || !reflect.DeepEqual(ids, wantIDs) {
+		t.Errorf("checkIndex() = %v for %v, want %v for %v", got, ids, want, wantIDs)
+	}
+}
+
+func TestFsckReportUnrepaired(t *testing.T) {
+	r := FsckReport{Findings: []Finding{
+		{Problem: ProblemEmpty, Repaired: true},
+		{Problem: ProblemHashMismatch},
+		{Problem: ProblemDuplicateHash},
+	}}
+
+	if n := r.Unrepaired(); n != 2 {
+		t.Errorf("Unrepaired() = %d, want 2", n)
+	}
+}
+
+func TestFsck(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	imgs := NewStormImages(db, &linkscraper.Rules{})
+
+	// read a few records per transaction
+	defer func(n int) { fsckBatch = n }(fsckBatch)
+	fsckBatch = 2
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, err := strconv.Atoi(r.URL.Path[1:])
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(testPNG(t, n))
+	}))
+	defer srv.Close()
+
+	var ids []string
+	for n := 0; n < 5; n++ {
+		i, err := imgs.InsertBytes(testPNG(t, n), "image/png", srv.URL+"/"+strconv.Itoa(n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, i.ID)
+	}
+
+	r, err := Fsck(ctx, db, FsckConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Images != len(ids) || len(r.Findings) != 0 {
+		t.Fatalf("healthy database: checked %d images, found %+v", r.Images, r.Findings)
+	}
+
+	broken := rawImage(t, db, ids[0])
+	broken.Data = []byte("bit rot")
+	if err := db.Save(&broken); err != nil {
+		t.Fatal(err)
+	}
+
+	unindexed := rawImage(t, db, ids[1])
+	err = db.Bolt.Update(func(tx *bolt.Tx) error {
+		ib := tx.Bucket([]byte(imageBucket)).Bucket([]byte(imageHashIndex))
+		if err := ib.Delete([]byte(unindexed.Blake2Hash)); err != nil {
+			return err
+		}
+		return ib.Put([]byte("orphaned"), []byte("nope"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]Problem{
+		ids[0]: ProblemHashMismatch,
+		ids[1]: ProblemMissingIndex,
+		"nope": ProblemOrphanedIndex,
+	}
+
+	r, err = Fsck(ctx, db, FsckConfig{Repair: true, Fetcher: NewFetcher(testFetchConfig(t))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]Problem{}
+	for _, f := range r.Findings {
+		got[f.ImageID] = f.Problem
+		if !f.Repaired {
+			t.Errorf("%s of %s wasn't repaired: %s", f.Problem, f.ImageID, f.Detail)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("found %v, want %v", got, want)
+	}
+
+	r, err = Fsck(ctx, db, FsckConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Findings) != 0 {
+		t.Errorf("repaired database still has %+v", r.Findings)
+	}
+
+	i, err := imgs.One(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Hash(i.Data) != i.Blake2Hash {
+		t.Error("refetched image doesn't match its hash")
+	}
+}
@@ -0,0 +1,96 @@
+package database
+
+import (
+	"context"
+
+	"github.com/asdine/storm/v2"
+	"github.com/asdine/storm/v2/q"
+	"within.website/ln"
+)
+
+// VisibleTo returns true if i was posted in one of guilds. A nil guilds
+// means there is no limit, which is what admins and API tokens get.
+func (i Image) VisibleTo(guilds []string) bool {
+	if guilds == nil {
+		return true
+	}
+
+	return sharesGuild(i.Guilds, guilds)
+}
+
+func sharesGuild(have, want []string) bool {
+	for _, h := range have {
+		for _, w := range want {
+			if h == w {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// inGuilds matches the Guilds field of images against a list of guilds.
+type inGuilds []string
+
+func (g inGuilds) MatchField(v interface{}) (bool, error) {
+	have, _ := v.([]string)
+	return sharesGuild(have, g), nil
+}
+
+// guildMatchers returns the matchers limiting a query to images visible to
+// guilds, following the rules of VisibleTo.
+func guildMatchers(guilds []string) []q.Matcher {
+	if guilds == nil {
+		return nil
+	}
+
+	return []q.Matcher{q.NewFieldMatcher("Guilds", inGuilds(guilds))}
+}
+
+// AssignGuilds sets the guilds of images archived before kinq served more
+// than one guild. Images get the guilds of their origins, or guildID if
+// they have none. It returns the number of images it changed.
+func AssignGuilds(ctx context.Context, db *storm.DB, guildID string) (int, error) {
+	// storm can't write inside Each, so collect the IDs first
+	var ids []string
+	err := db.Select().Each(new(Image), func(rec interface{}) error {
+		i := rec.(*Image)
+		if len(i.Guilds) == 0 {
+			ids = append(ids, i.ID)
+		}
+		return nil
+	})
+	if err != nil && err != storm.ErrNotFound {
+		return 0, err
+	}
+
+	n := 0
+	for _, id := range ids {
+		var origins []Origin
+		err := db.Find("ImageID", id, &origins)
+		if err != nil && err != storm.ErrNotFound {
+			return n, err
+		}
+
+		var guilds []string
+		for _, o := range origins {
+			if o.GuildID != "" && !sharesGuild(guilds, []string{o.GuildID}) {
+				guilds = append(guilds, o.GuildID)
+			}
+		}
+		if len(guilds) == 0 {
+			guilds = []string{guildID}
+		}
+
+		err = db.UpdateField(&Image{ID: id}, "Guilds", guilds)
+		if err != nil {
+			return n, err
+		}
+
+		ln.Log(ctx, ln.Action("assigned image guilds"), ln.F{"image_id": id, "guilds": guilds})
+		n++
+	}
+
+	return n, nil
+}
@@ -0,0 +1,92 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Xe/kinq/internal/linkscraper"
+)
+
+func TestVisibleTo(t *testing.T) {
+	i := Image{Guilds: []string{"a", "b"}}
+
+	cases := []struct {
+		name   string
+		guilds []string
+		want   bool
+	}{
+		{name: "no limit", guilds: nil, want: true},
+		{name: "member of one", guilds: []string{"c", "b"}, want: true},
+		{name: "member of none", guilds: []string{"c"}, want: false},
+		{name: "member of nothing", guilds: []string{}, want: false},
+	}
+
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			if got := i.VisibleTo(cs.guilds); got != cs.want {
+				t.Fatalf("wanted %v, got: %v", cs.want, got)
+			}
+
+			ok, err := inGuilds(cs.guilds).MatchField(i.Guilds)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cs.guilds != nil && ok != cs.want {
+				t.Fatalf("matcher wanted %v, got: %v", cs.want, ok)
+			}
+		})
+	}
+}
+
+func TestRemoveGuild(t *testing.T) {
+	db := openTestDB(t)
+	i := NewStormImages(db, &linkscraper.Rules{})
+	o := NewStormOrigins(db)
+
+	img, err := i.InsertBytes(testPNG(t, 1), "image/png", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, g := range []string{"a", "b"} {
+		if err := i.AddGuild(img.ID, g); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := o.Add(Origin{ImageID: img.ID, GuildID: g, MessageID: "m" + g, Posted: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deleted, err := i.RemoveGuild(img.ID, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.RemoveGuild(img.ID, "a"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := i.One(img.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted || got.Deleted || got.VisibleTo([]string{"a"}) || !got.VisibleTo([]string{"b"}) {
+		t.Fatalf("removing one of two guilds: deleted %v, image %+v", deleted, got)
+	}
+	origins, err := o.ForImage(img.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(origins) != 1 || origins[0].GuildID != "b" {
+		t.Fatalf("wanted only the origin in b left, got: %+v", origins)
+	}
+
+	deleted, err = i.RemoveGuild(img.ID, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = i.One(img.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !deleted || !got.Deleted {
+		t.Fatalf("removing the last guild: deleted %v, image %+v", deleted, got)
+	}
+}
@@ -5,13 +5,15 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"net/http"
-	"path/filepath"
+	"math/rand"
+	"strings"
 	"time"
 
+	"github.com/Xe/kinq/internal/events"
+	"github.com/Xe/kinq/internal/ksecretbox"
 	"github.com/Xe/kinq/internal/linkscraper"
+	"github.com/Xe/kinq/internal/media"
 	"github.com/asdine/storm/v2"
 	"github.com/asdine/storm/v2/q"
 	"github.com/celrenheit/sandflake"
@@ -30,6 +32,31 @@ type Image struct {
 	Data       []byte
 	Ext        string
 	Mime       string
+	Width      int
+	Height     int
+	Frames     int
+	Duration   time.Duration
+
+	// ColorProfile and EXIF are read from the original data when the image
+	// is archived.
+	ColorProfile string
+	EXIF         *media.EXIF
+
+	// Guilds are the Discord guilds the image was posted in. Only their
+	// members can see it.
+	Guilds []string
+
+	// Uploaded is set for images sent to kinq instead of fetched by it.
+	// Without a source, their URL is "upload:" and their ID.
+	Uploaded bool
+
+	// Encrypted is set when Data holds bytes sealed with the image keyring
+	// instead of the image itself.
+	Encrypted bool
+
+	// Scraped are the tags scrapers gave the URL the image was just
+	// inserted from. Only Insert and InsertBytes set it, it isn't stored.
+	Scraped []string `json:"-"`
 }
 
 func (i Image) F() ln.F {
@@ -43,105 +70,365 @@ func (i Image) F() ln.F {
 	}
 }
 
+// IsVideo returns true if the image should be shown with a video player.
+func (i Image) IsVideo() bool {
+	return strings.HasPrefix(i.Mime, "video/")
+}
+
+// SourceURL returns where the image came from, or nothing for uploads
+// without a source.
+func (i Image) SourceURL() string {
+	if strings.HasPrefix(i.URL, "upload:") {
+		return ""
+	}
+
+	return i.URL
+}
+
+// Images is the image archive. Images returned by One and Insert always have
+// their plaintext Data. Images returned in lists may still be Encrypted.
+// Search, Random and Recent only return images visible to guilds, see
+// Image.VisibleTo.
 type Images interface {
 	Insert(url string) (*Image, error)
+	InsertBytes(data []byte, contentType, source string) (*Image, error)
 	One(id string) (*Image, error)
+	ByHash(hash string) (*Image, error)
+	ByURL(url string) (*Image, error)
 	AddTags(id string, tags []string) error
 	RemoveTags(id string, tags []string) error
-	Search(numPerPage, pageNumber int, tags []string) ([]Image, error)
-	Recent(pageID int) ([]Image, error)
+	AddGuild(id, guildID string) error
+	// RemoveGuild takes an image out of a guild. An image left in no guild
+	// is deleted, which RemoveGuild reports.
+	RemoveGuild(id, guildID string) (deleted bool, err error)
+	Search(numPerPage, pageNumber int, tags, guilds []string) ([]Image, error)
+	Random(tags, guilds []string) (*Image, error)
+	Recent(pageID int, guilds []string) ([]Image, error)
+	Each(f Filter, fn func(*Image) error) error
+	SetAdded(id string, added time.Time) error
+	SetUploaded(id string, uploaded bool) error
 	Delete(id string) error
 }
 
+// Filter picks the images Each goes through.
+type Filter struct {
+	Tags   []string  // images with any of these tags, or every image
+	After  time.Time // images added at or after this, if set
+	Before time.Time // images added before this, if set
+	Guilds []string  // see Image.VisibleTo
+}
+
+func (f Filter) matchers() []q.Matcher {
+	matchers := append([]q.Matcher{q.Eq("Deleted", false)}, guildMatchers(f.Guilds)...)
+	if len(f.Tags) > 0 {
+		matchers = append(matchers, q.In("Tags", f.Tags))
+	}
+	if !f.After.IsZero() {
+		matchers = append(matchers, q.Gte("Added", f.After))
+	}
+	if !f.Before.IsZero() {
+		matchers = append(matchers, q.Lt("Added", f.Before))
+	}
+
+	return matchers
+}
+
 type stormImages struct {
-	db *storm.DB
-	r  *linkscraper.Rules
-	g  sandflake.Generator
+	db      *storm.DB
+	r       *linkscraper.Rules
+	g       sandflake.Generator
+	keys    ksecretbox.Keyring
+	encrypt bool
+	f       *Fetcher
+	events  *events.Bus
+	health  scraperHealth
+
+	// distance is how many bits perceptual hashes may differ in for
+	// images to be duplicates, see WithDuplicateDistance
+	distance int
 }
 
-func NewStormImages(db *storm.DB, r *linkscraper.Rules) Images {
-	return &stormImages{db: db, r: r}
+// ImagesOption configures an Images implementation.
+type ImagesOption func(*stormImages)
+
+// WithKeys lets Images open encrypted image data with keys. If encrypt is
+// set, newly inserted images are sealed with the primary key.
+func WithKeys(keys ksecretbox.Keyring, encrypt bool) ImagesOption {
+	return func(s *stormImages) {
+		s.keys = keys
+		s.encrypt = encrypt
+	}
 }
 
-func validContentType(ct string) bool {
-	switch ct {
-	case "image/png", "image/jpeg", "image/gif":
-		return true
+// WithFetcher makes Images download with f instead of a Fetcher using
+// DefaultFetchConfig.
+func WithFetcher(f *Fetcher) ImagesOption {
+	return func(s *stormImages) {
+		s.f = f
 	}
+}
 
-	return false
+// WithEvents publishes deletions, duplicates and scraper outages to bus.
+func WithEvents(bus *events.Bus) ImagesOption {
+	return func(s *stormImages) {
+		s.events = bus
+	}
 }
 
-func (s *stormImages) Insert(url string) (*Image, error) {
-	id := s.g.Next().String()
+func NewStormImages(db *storm.DB, r *linkscraper.Rules, opts ...ImagesOption) Images {
+	s := &stormImages{db: db, r: r, f: NewFetcher(DefaultFetchConfig), distance: DefaultDuplicateDistance}
+
+	for _, o := range opts {
+		o(s)
+	}
+
+	return s
+}
+
+// open replaces the sealed data of i with its plaintext.
+func (s *stormImages) open(i *Image) error {
+	if !i.Encrypted {
+		return nil
+	}
 
-	req, err := http.NewRequest("GET", url, nil)
+	if len(s.keys) == 0 {
+		return ErrNoImageKeys
+	}
+
+	data, err := s.keys.Open(i.Data)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	i.Data = data
+	i.Encrypted = false
+
+	return nil
+}
+
+func (s *stormImages) Insert(url string) (*Image, error) {
+	res, err := s.f.Fetch(context.Background(), url)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 
-	if !validContentType(resp.Header.Get("Content-Type")) {
-		return nil, errors.New("bad content type: " + resp.Header.Get("Content-Type"))
-	}
+	return s.insert(res.Data, res.ContentType, url, false)
+}
 
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("expected http 200, got: %d", resp.StatusCode)
-	}
+// ErrSourceTaken is returned by InsertBytes when another image was already
+// archived from the given source.
+var ErrSourceTaken = errors.New("database: another image was already archived from that source")
+
+// InsertBytes archives image data sent to kinq. source is where it came
+// from, if known; tags are scraped from it like with Insert. Data that was
+// already archived returns the existing image.
+func (s *stormImages) InsertBytes(data []byte, contentType, source string) (*Image, error) {
+	return s.insert(data, contentType, source, true)
+}
 
-	data, err := ioutil.ReadAll(resp.Body)
+func (s *stormImages) insert(data []byte, contentType, url string, uploaded bool) (*Image, error) {
+	id := s.g.Next().String()
+
+	sn, err := sniff(data, contentType)
 	if err != nil {
 		return nil, err
 	}
 
+	var tags []string
+	if url == "" {
+		url = "upload:" + id
+	} else {
+		tags = s.scrape(url)
+	}
+
 	log.Printf("%s: %d bytes", url, len(data))
 
-	hsh := blake2b.Sum256(data)
-	strhsh := base64.StdEncoding.EncodeToString(hsh[:])
+	strhsh := Hash(data)
 
-	tags, err := s.r.Test(context.Background(), url)
-	if err != nil && err != linkscraper.ErrNotFound {
-		ln.Error(context.Background(), err, ln.Action("scrape for tags"))
+	i := &Image{
+		ID:           id,
+		URL:          url,
+		Added:        time.Now(),
+		Blake2Hash:   strhsh,
+		Size:         int64(len(data)),
+		Tags:         tags,
+		Ext:          sn.Ext,
+		Data:         data,
+		Mime:         sn.Mime,
+		Width:        sn.Width,
+		Height:       sn.Height,
+		Frames:       sn.Frames,
+		Duration:     sn.Duration,
+		ColorProfile: sn.ColorProfile,
+		EXIF:         sn.EXIF,
+		Uploaded:     uploaded,
+		Scraped:      tags,
 	}
 
-	i := &Image{
-		ID:         id,
-		URL:        url,
-		Added:      time.Now(),
-		Blake2Hash: strhsh,
-		Size:       int64(len(data)),
-		Tags:       tags,
-		Ext:        filepath.Ext(url),
-		Data:       data,
-		Mime:       resp.Header.Get("Content-Type"),
-	}
-
-	err = s.db.Save(i)
+	stored := *i
+	if s.encrypt {
+		stored.Data, err = s.keys.Seal(data)
+		if err != nil {
+			return nil, err
+		}
+		stored.Encrypted = true
+	}
+
+	err = s.db.Save(&stored)
 	if err == storm.ErrAlreadyExists {
 		log.Printf("repeat: %s %v", i.URL, i.Blake2Hash)
-		var newImage Image
-		err = s.db.One("URL", i.URL, &newImage)
+
+		// the same data from another URL, likely posted in another guild
+		var same Image
+		if s.db.One("Blake2Hash", i.Blake2Hash, &same) == nil && same.URL != i.URL {
+			if len(tags) > 0 {
+				err = s.AddTags(same.ID, tags)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			s.events.Publish(context.Background(), events.Event{
+				Kind:    events.ImageDuplicate,
+				Summary: fmt.Sprintf("%s is the same as image %s from %s", url, same.ID, same.URL),
+				Fields:  map[string]string{"image_id": same.ID, "url": url, "original_url": same.URL},
+			})
+
+			img, err := s.One(same.ID)
+			if err != nil {
+				return nil, err
+			}
+			img.Scraped = tags
+
+			return img, nil
+		}
+
+		// an upload can't replace an image archived from its source
+		if uploaded {
+			if same.URL == i.URL {
+				img, err := s.One(same.ID)
+				if err != nil {
+					return nil, err
+				}
+				img.Scraped = tags
+
+				return img, nil
+			}
+
+			return nil, ErrSourceTaken
+		}
+
+		// the URL serves new data, replace the stored record but keep where
+		// it is visible and whether it was deleted
+		var existing Image
+		err = s.db.One("URL", i.URL, &existing)
 		if err != nil {
-			log.Printf("????")
 			return nil, err
 		}
-		i.ID = newImage.ID
+		if len(tags) == 0 {
+			stored.Tags = existing.Tags
+		}
+		stored.ID = existing.ID
+		stored.Guilds = existing.Guilds
+		stored.Deleted = existing.Deleted
+
+		err = s.db.Save(&stored)
+		if err != nil {
+			return nil, err
+		}
+
+		i.ID, i.Tags, i.Guilds, i.Deleted = stored.ID, stored.Tags, stored.Guilds, stored.Deleted
+		s.fingerprint(i)
 
-		s.db.Update(i)
-		err = nil
+		return i, nil
 	}
 	if err != nil {
 		return nil, err
 	}
 
+	s.events.Publish(context.Background(), events.Event{
+		Kind:    events.ImageCreated,
+		Summary: fmt.Sprintf("archived %s as image %s", i.URL, i.ID),
+		Fields: map[string]string{
+			"image_id": i.ID,
+			"url":      i.URL,
+			"mime":     i.Mime,
+			"hash":     i.Blake2Hash,
+			"tags":     strings.Join(i.Tags, " "),
+		},
+	})
+	s.fingerprint(i)
+
 	return i, nil
 }
 
+// scrape returns the tags scrapers know for url, keeping track of scrapers
+// that are down.
+func (s *stormImages) scrape(url string) []string {
+	tags, err := s.r.Test(context.Background(), url)
+	if err != nil && err != linkscraper.ErrNotFound {
+		ln.Error(context.Background(), err, ln.Action("scrape for tags"))
+	}
+	if err != linkscraper.ErrNotFound {
+		if e := s.health.record(url, err); e != nil {
+			s.events.Publish(context.Background(), *e)
+		}
+	}
+
+	return tags
+}
+
+// publishTagged tells subscribers about changed tags.
+func (s *stormImages) publishTagged(id string, added, removed []string) {
+	s.events.Publish(context.Background(), events.Event{
+		Kind:    events.ImageTagged,
+		Summary: fmt.Sprintf("image %s tagged +%v -%v", id, added, removed),
+		Fields: map[string]string{
+			"image_id": id,
+			"added":    strings.Join(added, " "),
+			"removed":  strings.Join(removed, " "),
+		},
+	})
+}
+
+// Hash returns the hash images are deduplicated by.
+func Hash(data []byte) string {
+	hsh := blake2b.Sum256(data)
+	return base64.StdEncoding.EncodeToString(hsh[:])
+}
+
+// ByURL returns the image archived from url.
+func (s *stormImages) ByURL(url string) (*Image, error) {
+	var i Image
+	err := s.db.One("URL", url, &i)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.open(&i)
+	if err != nil {
+		return nil, err
+	}
+
+	return &i, nil
+}
+
+// ByHash returns the image with the given Hash.
+func (s *stormImages) ByHash(hash string) (*Image, error) {
+	var i Image
+	err := s.db.One("Blake2Hash", hash, &i)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.open(&i)
+	if err != nil {
+		return nil, err
+	}
+
+	return &i, nil
+}
+
 func (s *stormImages) One(id string) (*Image, error) {
 	var i Image
 	err := s.db.One("ID", id, &i)
@@ -149,6 +436,11 @@ func (s *stormImages) One(id string) (*Image, error) {
 		return nil, err
 	}
 
+	err = s.open(&i)
+	if err != nil {
+		return nil, err
+	}
+
 	return &i, nil
 }
 
@@ -181,20 +473,88 @@ func (s *stormImages) AddTags(id string, tags []string) error {
 		return err
 	}
 
+	s.publishTagged(id, tags, nil)
+
 	return nil
 }
 
 func (s *stormImages) RemoveTags(id string, tags []string) error {
-	return errors.New("not implemented")
+	var i Image
+	err := s.db.One("ID", id, &i)
+	if err != nil {
+		return err
+	}
+
+	rm := map[string]struct{}{}
+	for _, t := range tags {
+		rm[t] = struct{}{}
+	}
+
+	res := []string{}
+	for _, t := range i.Tags {
+		if _, ok := rm[t]; !ok {
+			res = append(res, t)
+		}
+	}
+
+	i.Tags = res
+
+	err = s.db.Save(&i)
+	if err != nil {
+		return err
+	}
+
+	s.publishTagged(id, nil, tags)
+
+	return nil
+}
+
+// AddGuild records that an image was posted in a guild.
+func (s *stormImages) AddGuild(id, guildID string) error {
+	var i Image
+	err := s.db.One("ID", id, &i)
+	if err != nil {
+		return err
+	}
+
+	for _, g := range i.Guilds {
+		if g == guildID {
+			return nil
+		}
+	}
+
+	return s.db.UpdateField(&Image{ID: id}, "Guilds", append(i.Guilds, guildID))
+}
+
+func (s *stormImages) RemoveGuild(id, guildID string) (bool, error) {
+	var i Image
+	err := s.db.One("ID", id, &i)
+	if err != nil {
+		return false, err
+	}
+
+	var guilds []string
+	for _, g := range i.Guilds {
+		if g != guildID {
+			guilds = append(guilds, g)
+		}
+	}
+
+	// the last guild is kept so a restored image shows up where it was
+	if len(guilds) == 0 {
+		return true, s.Delete(id)
+	}
+
+	return false, s.db.UpdateField(&Image{ID: id}, "Guilds", guilds)
 }
 
-func (s *stormImages) Search(numPerPage, pageNumber int, tags []string) ([]Image, error) {
-	qq := q.And(
+func (s *stormImages) Search(numPerPage, pageNumber int, tags, guilds []string) ([]Image, error) {
+	matchers := append([]q.Matcher{
 		q.Eq("Deleted", false),
 		q.In("Tags", tags),
-	)
+	}, guildMatchers(guilds)...)
 
-	query := s.db.Select(qq)
+	query := s.db.Select(matchers...)
 	query.Limit(numPerPage)
 	query.Skip(pageNumber * numPerPage)
 
@@ -207,14 +567,164 @@ func (s *stormImages) Search(numPerPage, pageNumber int, tags []string) ([]Image
 	return images, nil
 }
 
-func (s *stormImages) Recent(pageID int) ([]Image, error) {
-	var images []Image
-	err := s.db.AllByIndex("Added", &images, storm.Reverse(), storm.Limit(30), storm.Skip(30*pageID))
-	if err != nil {
-		return nil, err
+// Random returns a random image that isn't deleted, optionally one matching
+// tags.
+// imageSummary is what Random needs to know about an image. Decoding
+// records into it skips over their Data instead of copying it.
+type imageSummary struct {
+	ID      string
+	Deleted bool
+	Tags    []string
+	Guilds  []string
+}
+
+// hasAnyTag returns true if the image has one of tags, or if there are no
+// tags to look for.
+func (sum imageSummary) hasAnyTag(tags []string) bool {
+	if len(tags) == 0 {
+		return true
 	}
 
-	return images, nil
+	for _, t := range sum.Tags {
+		for _, want := range tags {
+			if t == want {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Random picks an image in one pass over the raw records, so picking from
+// a big archive doesn't decode every image's data.
+func (s *stormImages) Random(tags, guilds []string) (*Image, error) {
+	var picked string
+	seen := 0
+
+	var after []byte
+	for {
+		batch, err := readBatch(s.db, after)
+		if err != nil {
+			return nil, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		after = batch[len(batch)-1].key
+
+		for _, rec := range batch {
+			var sum imageSummary
+			if err := s.db.Codec().Unmarshal(rec.value, &sum); err != nil {
+				return nil, err
+			}
+
+			if sum.Deleted || !(Image{Guilds: sum.Guilds}).VisibleTo(guilds) || !sum.hasAnyTag(tags) {
+				continue
+			}
+
+			// reservoir sampling: the nth match replaces the pick with a
+			// chance of 1/n, which leaves every match equally likely
+			seen++
+			if rand.Intn(seen) == 0 {
+				picked = sum.ID
+			}
+		}
+	}
+
+	if picked == "" {
+		return nil, storm.ErrNotFound
+	}
+
+	return s.One(picked)
+}
+
+// recentBatch is how many images Recent reads at a time when it has to
+// skip images other guilds posted.
+var recentBatch = 100
+
+func (s *stormImages) Recent(pageID int, guilds []string) ([]Image, error) {
+	if guilds == nil {
+		var images []Image
+		err := s.db.AllByIndex("Added", &images, storm.Reverse(), storm.Limit(30), storm.Skip(30*pageID))
+		if err != nil && err != storm.ErrNotFound {
+			return nil, err
+		}
+
+		return images, nil
+	}
+
+	// go through the newest images until the page is full instead of
+	// filtering every image in the archive
+	var page []Image
+	matched := 0
+	for skip := 0; ; skip += recentBatch {
+		var images []Image
+		err := s.db.AllByIndex("Added", &images, storm.Reverse(), storm.Limit(recentBatch), storm.Skip(skip))
+		if err != nil && err != storm.ErrNotFound {
+			return nil, err
+		}
+
+		for _, i := range images {
+			if !i.VisibleTo(guilds) {
+				continue
+			}
+
+			matched++
+			if matched <= 30*pageID {
+				continue
+			}
+
+			page = append(page, i)
+			if len(page) == 30 {
+				return page, nil
+			}
+		}
+
+		if len(images) < recentBatch {
+			return page, nil
+		}
+	}
+}
+
+// Each calls fn with every image that isn't deleted and matches f, oldest
+// first, with its plaintext Data.
+func (s *stormImages) Each(f Filter, fn func(*Image) error) error {
+	// storm can't read other records inside Each, so collect the IDs first
+	var ids []string
+	err := s.db.Select(f.matchers()...).OrderBy("Added").Each(new(Image), func(rec interface{}) error {
+		ids = append(ids, rec.(*Image).ID)
+		return nil
+	})
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+
+	for _, id := range ids {
+		i, err := s.One(id)
+		if err != nil {
+			return err
+		}
+
+		err = fn(i)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetAdded changes when an image counts as added, for imports of images
+// that were archived before.
+func (s *stormImages) SetAdded(id string, added time.Time) error {
+	return s.db.UpdateField(&Image{ID: id}, "Added", added)
+}
+
+// SetUploaded changes whether an image counts as uploaded, for imports of
+// images that kinq fetched before.
+func (s *stormImages) SetUploaded(id string, uploaded bool) error {
+	return s.db.UpdateField(&Image{ID: id}, "Uploaded", uploaded)
 }
 
 func (s *stormImages) Delete(id string) error {
@@ -226,5 +736,16 @@ func (s *stormImages) Delete(id string) error {
 
 	i.Deleted = true
 
-	return s.db.Save(&i)
+	err = s.db.Save(&i)
+	if err != nil {
+		return err
+	}
+
+	s.events.Publish(context.Background(), events.Event{
+		Kind:    events.ImageDeleted,
+		Summary: fmt.Sprintf("image %s from %s was deleted", i.ID, i.URL),
+		Fields:  map[string]string{"image_id": i.ID, "url": i.URL},
+	})
+
+	return nil
 }
@@ -0,0 +1,134 @@
+package database
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/Xe/kinq/internal/linkscraper"
+	"github.com/asdine/storm/v2"
+)
+
+func TestInsertBytes(t *testing.T) {
+	db := openTestDB(t)
+	i := NewStormImages(db, &linkscraper.Rules{})
+
+	const source = "https://example.com/a.png"
+
+	first, err := i.InsertBytes(testPNG(t, 1), "image/png", source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !first.Uploaded || first.URL != source || first.Mime != "image/png" {
+		t.Errorf("new upload = %+v", first)
+	}
+
+	anon, err := i.InsertBytes(testPNG(t, 2), "image/png", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if anon.URL != "upload:"+anon.ID || anon.SourceURL() != "" {
+		t.Errorf("upload without a source has URL %q", anon.URL)
+	}
+
+	// the same bytes again, with or without the source
+	for _, src := range []string{source, ""} {
+		again, err := i.InsertBytes(testPNG(t, 1), "image/png", src)
+		if err != nil {
+			t.Fatalf("InsertBytes(same data, %q): %v", src, err)
+		}
+		if again.ID != first.ID {
+			t.Errorf("InsertBytes(same data, %q) = image %s, want %s", src, again.ID, first.ID)
+		}
+	}
+
+	_, err = i.InsertBytes(testPNG(t, 3), "image/png", source)
+	if err != ErrSourceTaken {
+		t.Errorf("InsertBytes(other data, same source) = %v, want %v", err, ErrSourceTaken)
+	}
+
+	stored, err := i.One(first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored.Data, testPNG(t, 1)) || stored.Blake2Hash != first.Blake2Hash {
+		t.Error("a colliding upload replaced the archived image")
+	}
+
+	byURL, err := i.ByURL(source)
+	if err != nil || byURL.ID != first.ID {
+		t.Errorf("ByURL = %v, %v, want image %s", byURL, err, first.ID)
+	}
+}
+
+func TestRecentAndRandomInGuilds(t *testing.T) {
+	defer func(n int) { recentBatch = n }(recentBatch)
+	recentBatch = 7
+
+	db := openTestDB(t)
+	i := NewStormImages(db, &linkscraper.Rules{})
+
+	// even images are in g1, odd ones in g2, and the newest have the
+	// highest numbers
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	ids := map[int]string{}
+	for n := 0; n < 70; n++ {
+		img, err := i.InsertBytes(testPNG(t, n), "image/png", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := i.AddGuild(img.ID, []string{"g1", "g2"}[n%2]); err != nil {
+			t.Fatal(err)
+		}
+		if err := i.SetAdded(img.ID, start.Add(time.Duration(n)*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		if n%5 == 0 {
+			if err := i.AddTags(img.ID, []string{"fives"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ids[n] = img.ID
+	}
+
+	for page, want := range [][]int{{68, 10}, {8, 0}} {
+		got, err := i.Recent(page, []string{"g1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wantLen := (want[0]-want[1])/2 + 1
+		if len(got) != wantLen || got[0].ID != ids[want[0]] || got[len(got)-1].ID != ids[want[1]] {
+			t.Fatalf("page %d: wanted %d images from %d to %d, got %d", page, wantLen, want[0], want[1], len(got))
+		}
+		for _, img := range got {
+			if !img.VisibleTo([]string{"g1"}) {
+				t.Fatalf("page %d has image %s of another guild", page, img.ID)
+			}
+		}
+	}
+
+	if err := i.Delete(ids[20]); err != nil {
+		t.Fatal(err)
+	}
+	allowed := map[string]bool{}
+	for _, n := range []int{0, 10, 30, 40, 50, 60} {
+		allowed[ids[n]] = true
+	}
+	for n := 0; n < 50; n++ {
+		img, err := i.Random([]string{"fives"}, []string{"g1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !allowed[img.ID] {
+			t.Fatalf("Random picked image %s, which isn't tagged, is deleted or is in another guild", img.ID)
+		}
+		if len(img.Data) == 0 {
+			t.Fatal("Random returned an image without its data")
+		}
+	}
+
+	if _, err := i.Random([]string{"fives"}, []string{"g3"}); err != storm.ErrNotFound {
+		t.Fatalf("Random without matches = %v, want %v", err, storm.ErrNotFound)
+	}
+}
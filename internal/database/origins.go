@@ -0,0 +1,233 @@
+package database
+
+import (
+	"net/url"
+	"time"
+
+	"github.com/asdine/storm/v2"
+	"github.com/asdine/storm/v2/q"
+	"github.com/celrenheit/sandflake"
+	"within.website/ln"
+)
+
+// Origin is a Discord message an image was posted in. An image has one
+// Origin for every time it was posted.
+type Origin struct {
+	ID          string `storm:"id"`
+	ImageID     string `storm:"index"`
+	GuildID     string
+	ChannelID   string `storm:"index"`
+	ChannelName string
+	MessageID   string `storm:"index"`
+	AuthorID    string `storm:"index"`
+	Author      string
+	Content     string
+	Posted      time.Time `storm:"index"`
+
+	// MessageDeleted is set when the message was deleted from Discord.
+	MessageDeleted bool
+}
+
+func (o Origin) F() ln.F {
+	return ln.F{
+		"origin_id":  o.ID,
+		"image_id":   o.ImageID,
+		"guild_id":   o.GuildID,
+		"channel_id": o.ChannelID,
+		"message_id": o.MessageID,
+		"author_id":  o.AuthorID,
+		"author":     o.Author,
+	}
+}
+
+type Origins interface {
+	// Add records that an image was posted in a message. Adding the same
+	// image and message again returns the existing Origin.
+	Add(o Origin) (*Origin, error)
+	ForImage(imageID string) ([]Origin, error)
+	ForMessage(messageID string) ([]Origin, error)
+	ByAuthor(authorID string, pageID int) ([]Origin, error)
+	// MarkDeleted records that a message was deleted and returns the
+	// origins it was for.
+	MarkDeleted(messageID string) ([]Origin, error)
+	// RemoveGuild removes the origins of an image in a guild.
+	RemoveGuild(imageID, guildID string) error
+	// Abandoned returns the IDs of the images of origins that have no
+	// origin left whose message still exists. Images that exist apart from
+	// Discord messages are never abandoned: uploads, images from links to
+	// other sites and images in guilds they weren't posted in.
+	Abandoned(origins []Origin) ([]string, error)
+}
+
+type stormOrigins struct {
+	db *storm.DB
+	g  sandflake.Generator
+}
+
+func NewStormOrigins(db *storm.DB) Origins {
+	return &stormOrigins{db: db}
+}
+
+func (s *stormOrigins) Add(o Origin) (*Origin, error) {
+	var existing Origin
+	err := s.db.Select(q.Eq("MessageID", o.MessageID), q.Eq("ImageID", o.ImageID)).First(&existing)
+	switch err {
+	case nil:
+		return &existing, nil
+	case storm.ErrNotFound:
+	default:
+		return nil, err
+	}
+
+	o.ID = s.g.Next().String()
+	err = s.db.Save(&o)
+	if err != nil {
+		return nil, err
+	}
+
+	return &o, nil
+}
+
+// ForImage returns the origins of an image, oldest first.
+func (s *stormOrigins) ForImage(imageID string) ([]Origin, error) {
+	var origins []Origin
+	err := s.db.Select(q.Eq("ImageID", imageID)).OrderBy("Posted").Find(&origins)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	return origins, nil
+}
+
+// ForMessage returns the origins of every image archived from a message.
+func (s *stormOrigins) ForMessage(messageID string) ([]Origin, error) {
+	var origins []Origin
+	err := s.db.Find("MessageID", messageID, &origins)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	return origins, nil
+}
+
+// ByAuthor returns a page of what a Discord user posted, newest first.
+func (s *stormOrigins) ByAuthor(authorID string, pageID int) ([]Origin, error) {
+	var origins []Origin
+	err := s.db.Select(q.Eq("AuthorID", authorID)).OrderBy("Posted").Reverse().Limit(30).Skip(30 * pageID).Find(&origins)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	return origins, nil
+}
+
+func (s *stormOrigins) MarkDeleted(messageID string) ([]Origin, error) {
+	tx, err := s.db.Begin(true)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var origins []Origin
+	err = tx.Find("MessageID", messageID, &origins)
+	if err == storm.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for n := range origins {
+		origins[n].MessageDeleted = true
+		err = tx.Save(&origins[n])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return origins, nil
+}
+
+func (s *stormOrigins) RemoveGuild(imageID, guildID string) error {
+	err := s.db.Select(q.Eq("ImageID", imageID), q.Eq("GuildID", guildID)).Delete(new(Origin))
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+
+	return nil
+}
+
+func (s *stormOrigins) Abandoned(origins []Origin) ([]string, error) {
+	var result []string
+	seen := map[string]bool{}
+
+	for _, o := range origins {
+		if seen[o.ImageID] {
+			continue
+		}
+		seen[o.ImageID] = true
+
+		var i Image
+		err := s.db.One("ID", o.ImageID, &i)
+		if err == storm.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if i.Uploaded || !discordAttachment(i.URL) {
+			continue
+		}
+
+		all, err := s.ForImage(o.ImageID)
+		if err != nil {
+			return nil, err
+		}
+
+		remaining := 0
+		posted := map[string]bool{}
+		for _, other := range all {
+			posted[other.GuildID] = true
+			if !other.MessageDeleted {
+				remaining++
+			}
+		}
+		if remaining > 0 {
+			continue
+		}
+
+		unposted := false
+		for _, g := range i.Guilds {
+			if !posted[g] {
+				unposted = true
+			}
+		}
+		if !unposted {
+			result = append(result, o.ImageID)
+		}
+	}
+
+	return result, nil
+}
+
+// discordHosts are where Discord keeps message attachments.
+var discordHosts = map[string]bool{
+	"cdn.discordapp.com":   true,
+	"media.discordapp.net": true,
+}
+
+// discordAttachment returns true if u is a file attached to a Discord
+// message, which goes away with the message.
+func discordAttachment(u string) bool {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return false
+	}
+
+	return discordHosts[pu.Hostname()]
+}
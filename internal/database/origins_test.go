@@ -0,0 +1,178 @@
+package database
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestOrigins(t *testing.T) {
+	db := openTestDB(t)
+	o := NewStormOrigins(db)
+	now := time.Now()
+
+	for _, id := range []string{"a", "b", "c"} {
+		if err := db.Save(&Image{ID: id, URL: "https://cdn.discordapp.com/attachments/1/2/" + id + ".png"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a posted alone in m1, b in m1 and m2, c alone in m3
+	posts := []Origin{
+		{ImageID: "a", MessageID: "m1", AuthorID: "u1", Posted: now},
+		{ImageID: "b", MessageID: "m1", AuthorID: "u1", Posted: now},
+		{ImageID: "b", MessageID: "m2", AuthorID: "u2", Posted: now.Add(time.Minute)},
+		{ImageID: "c", MessageID: "m3", AuthorID: "u2", Posted: now.Add(2 * time.Minute)},
+	}
+	for _, p := range posts {
+		if _, err := o.Add(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	again, err := o.Add(posts[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := o.ForImage("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 || all[0].ID != again.ID {
+		t.Errorf("adding an origin twice stored %d origins", len(all))
+	}
+
+	deleted, err := o.MarkDeleted("m1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 2 {
+		t.Fatalf("MarkDeleted returned %d origins, want 2", len(deleted))
+	}
+
+	forMessage, err := o.ForMessage("m1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fm := range forMessage {
+		if !fm.MessageDeleted {
+			t.Errorf("origin of image %s in m1 isn't marked deleted", fm.ImageID)
+		}
+	}
+
+	// b is still in m2
+	abandoned, err := o.Abandoned(deleted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(abandoned, []string{"a"}) {
+		t.Errorf("Abandoned after deleting m1 = %v, want [a]", abandoned)
+	}
+
+	deleted, err = o.MarkDeleted("m2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	abandoned, err = o.Abandoned(deleted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(abandoned, []string{"b"}) {
+		t.Errorf("Abandoned after deleting m2 = %v, want [b]", abandoned)
+	}
+
+	deleted, err = o.MarkDeleted("unknown")
+	if err != nil || deleted != nil {
+		t.Errorf("MarkDeleted of an unknown message = %v, %v", deleted, err)
+	}
+
+	byAuthor, err := o.ByAuthor("u2", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var images []string
+	for _, ba := range byAuthor {
+		images = append(images, ba.ImageID)
+	}
+	sort.Strings(images)
+	if !reflect.DeepEqual(images, []string{"b", "c"}) {
+		t.Errorf("ByAuthor(u2) = %v, want [b c]", images)
+	}
+}
+
+func TestOriginsByAuthorPages(t *testing.T) {
+	o := NewStormOrigins(openTestDB(t))
+	now := time.Now()
+
+	for n := 0; n < 35; n++ {
+		_, err := o.Add(Origin{
+			ImageID:   fmt.Sprint("i", n),
+			MessageID: fmt.Sprint("m", n),
+			AuthorID:  "u1",
+			Posted:    now.Add(time.Duration(n) * time.Minute),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := o.Add(Origin{ImageID: "other", MessageID: "mo", AuthorID: "u2", Posted: now}); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := o.ByAuthor("u1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 30 || first[0].ImageID != "i34" || first[29].ImageID != "i5" {
+		t.Errorf("first page has %d origins from %s to %s, want 30 from i34 to i5",
+			len(first), first[0].ImageID, first[len(first)-1].ImageID)
+	}
+
+	second, err := o.ByAuthor("u1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(second) != 5 || second[4].ImageID != "i0" {
+		t.Errorf("second page = %+v, want 5 origins ending with i0", second)
+	}
+
+	none, err := o.ByAuthor("u3", 0)
+	if err != nil || len(none) != 0 {
+		t.Errorf("ByAuthor of someone who posted nothing = %v, %v", none, err)
+	}
+}
+
+func TestAbandonedKeepsImagesFromElsewhere(t *testing.T) {
+	db := openTestDB(t)
+	o := NewStormOrigins(db)
+
+	const attachment = "https://cdn.discordapp.com/attachments/1/2/"
+	images := []Image{
+		{ID: "attached", URL: attachment + "a.png", Guilds: []string{"g1"}},
+		{ID: "uploaded", URL: attachment + "b.png", Guilds: []string{"g1"}, Uploaded: true},
+		{ID: "linked", URL: "https://example.com/c.png", Guilds: []string{"g1"}},
+		{ID: "imported", URL: attachment + "d.png", Guilds: []string{"g1", "g2"}},
+	}
+	for _, i := range images {
+		if err := db.Save(&i); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := o.Add(Origin{ImageID: i.ID, GuildID: "g1", MessageID: "m1", Posted: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deleted, err := o.MarkDeleted("m1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	abandoned, err := o.Abandoned(deleted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(abandoned, []string{"attached"}) {
+		t.Errorf("Abandoned = %v, want [attached]", abandoned)
+	}
+}
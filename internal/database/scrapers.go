@@ -0,0 +1,62 @@
+package database
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+
+	"github.com/Xe/kinq/internal/events"
+)
+
+// scraperDownAfter is how many scrapes of one host have to fail in a row
+// before the host counts as down.
+const scraperDownAfter = 3
+
+// scraperHealth follows scrapes by host so an outage is reported once when
+// it starts and once when it ends, not for every image.
+type scraperHealth struct {
+	mu       sync.Mutex
+	failures map[string]int
+}
+
+// record notes how scraping rawurl went, returning the event to publish if
+// its host just went down or came back up.
+func (h *scraperHealth) record(rawurl string, err error) *events.Event {
+	u, perr := url.Parse(rawurl)
+	if perr != nil {
+		return nil
+	}
+	host := u.Host
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.failures == nil {
+		h.failures = map[string]int{}
+	}
+
+	if err == nil {
+		down := h.failures[host] >= scraperDownAfter
+		delete(h.failures, host)
+		if !down {
+			return nil
+		}
+
+		return &events.Event{
+			Kind:    events.ScraperUp,
+			Summary: fmt.Sprintf("scraping tags from %s works again", host),
+			Fields:  map[string]string{"host": host},
+		}
+	}
+
+	h.failures[host]++
+	if h.failures[host] != scraperDownAfter {
+		return nil
+	}
+
+	return &events.Event{
+		Kind:    events.ScraperDown,
+		Summary: fmt.Sprintf("scraping tags from %s failed %d times in a row: %v", host, scraperDownAfter, err),
+		Fields:  map[string]string{"host": host, "error": err.Error()},
+	}
+}
@@ -0,0 +1,36 @@
+package database
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Xe/kinq/internal/events"
+)
+
+func TestScraperHealth(t *testing.T) {
+	var h scraperHealth
+	fail := errors.New("502 bad gateway")
+
+	var got []events.Kind
+	record := func(err error) {
+		if e := h.record("https://derpibooru.org/1", err); e != nil {
+			got = append(got, e.Kind)
+		}
+	}
+
+	record(fail)
+	record(nil)
+	for i := 0; i < scraperDownAfter+2; i++ {
+		record(fail)
+	}
+	record(nil)
+	record(nil)
+
+	if len(got) != 2 || got[0] != events.ScraperDown || got[1] != events.ScraperUp {
+		t.Fatalf("wrong events: %v", got)
+	}
+
+	if e := h.record("https://e621.net/1", nil); e != nil {
+		t.Fatalf("other host affected: %+v", e)
+	}
+}
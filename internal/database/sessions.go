@@ -0,0 +1,130 @@
+package database
+
+import (
+	"time"
+
+	"github.com/asdine/storm/v2"
+	"github.com/asdine/storm/v2/q"
+	"within.website/ln"
+)
+
+// Session is the server side record of a login session, keyed by the ID
+// stored in the session cookie.
+type Session struct {
+	ID           string `storm:"id"`
+	UserID       string `storm:"index"`
+	Username     string
+	Created      time.Time `storm:"index"`
+	LastSeen     time.Time
+	GuildChecked time.Time
+	Guilds       []string // the archived guilds the user is a member of
+	RemoteAddr   string
+	UserAgent    string
+	Revoked      bool
+}
+
+func (s Session) F() ln.F {
+	return ln.F{
+		"session_id":       s.ID,
+		"session_user_id":  s.UserID,
+		"session_username": s.Username,
+		"session_created":  s.Created,
+		"session_revoked":  s.Revoked,
+	}
+}
+
+type Sessions interface {
+	Put(s *Session) error
+	One(id string) (*Session, error)
+	List() ([]Session, error)
+	Revoke(id string) error
+	RevokeUser(userID string) error
+	Prune(createdBefore, seenBefore time.Time) (int, error)
+}
+
+type stormSessions struct {
+	db *storm.DB
+}
+
+func NewStormSessions(db *storm.DB) Sessions {
+	return &stormSessions{db: db}
+}
+
+func (s *stormSessions) Put(sess *Session) error {
+	return s.db.Save(sess)
+}
+
+func (s *stormSessions) One(id string) (*Session, error) {
+	var sess Session
+	err := s.db.One("ID", id, &sess)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sess, nil
+}
+
+func (s *stormSessions) List() ([]Session, error) {
+	var sessions []Session
+	err := s.db.AllByIndex("Created", &sessions, storm.Reverse())
+	if err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+func (s *stormSessions) Revoke(id string) error {
+	var sess Session
+	err := s.db.One("ID", id, &sess)
+	if err != nil {
+		return err
+	}
+
+	sess.Revoked = true
+
+	return s.db.Save(&sess)
+}
+
+func (s *stormSessions) RevokeUser(userID string) error {
+	var sessions []Session
+	err := s.db.Select(q.Eq("UserID", userID), q.Eq("Revoked", false)).Find(&sessions)
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+
+	for _, sess := range sessions {
+		sess.Revoked = true
+		err = s.db.Save(&sess)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Prune removes sessions created before createdBefore or last seen before
+// seenBefore, which can't be used anymore, and returns how many it removed.
+func (s *stormSessions) Prune(createdBefore, seenBefore time.Time) (int, error) {
+	var sessions []Session
+	err := s.db.Select(q.Or(
+		q.Lt("Created", createdBefore),
+		q.Lt("LastSeen", seenBefore),
+	)).Find(&sessions)
+	if err == storm.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	for n := range sessions {
+		err = s.db.DeleteStruct(&sessions[n])
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return len(sessions), nil
+}
@@ -0,0 +1,69 @@
+package database
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestSessions(t *testing.T) {
+	s := NewStormSessions(openTestDB(t))
+	now := time.Now()
+
+	for _, sess := range []*Session{
+		{ID: "fresh", UserID: "u1", Created: now, LastSeen: now},
+		{ID: "other", UserID: "u2", Created: now, LastSeen: now},
+		{ID: "old", UserID: "u1", Created: now.Add(-48 * time.Hour), LastSeen: now},
+		{ID: "idle", UserID: "u1", Created: now.Add(-time.Hour), LastSeen: now.Add(-2 * time.Hour)},
+	} {
+		if err := s.Put(sess); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.RevokeUser("u1"); err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[string]bool{"fresh": true, "other": false, "old": true} {
+		sess, err := s.One(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sess.Revoked != want {
+			t.Errorf("session %s revoked = %v, want %v", id, sess.Revoked, want)
+		}
+	}
+
+	if err := s.Revoke("other"); err != nil {
+		t.Fatal(err)
+	}
+	if sess, err := s.One("other"); err != nil || !sess.Revoked {
+		t.Errorf("Revoke(other) didn't revoke it: %+v, %v", sess, err)
+	}
+
+	n, err := s.Prune(now.Add(-24*time.Hour), now.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("pruned %d sessions, want 2", n)
+	}
+
+	left, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, sess := range left {
+		ids = append(ids, sess.ID)
+	}
+	sort.Strings(ids)
+	if !reflect.DeepEqual(ids, []string{"fresh", "other"}) {
+		t.Errorf("sessions left after pruning: %v, want fresh and other", ids)
+	}
+
+	if n, err := s.Prune(now.Add(-24*time.Hour), now.Add(-time.Hour)); err != nil || n != 0 {
+		t.Errorf("second Prune = %d, %v, want nothing to do", n, err)
+	}
+}
@@ -0,0 +1,162 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"github.com/asdine/storm/v2"
+	"github.com/celrenheit/sandflake"
+	"within.website/ln"
+)
+
+var (
+	ErrShareExpired   = errors.New("database: share link has expired")
+	ErrShareRevoked   = errors.New("database: share link has been revoked")
+	ErrShareExhausted = errors.New("database: share link has no views left")
+)
+
+// Share is a link that lets someone without a session see a fixed set of
+// images until it expires, is revoked or runs out of views.
+type Share struct {
+	ID       string `storm:"id"`
+	ImageIDs []string
+	Created  time.Time `storm:"index"`
+	Expires  time.Time
+	MaxViews int // 0 means unlimited
+	Views    int
+	Revoked  bool
+}
+
+func (s Share) F() ln.F {
+	return ln.F{
+		"share_id":        s.ID,
+		"share_images":    len(s.ImageIDs),
+		"share_expires":   s.Expires,
+		"share_max_views": s.MaxViews,
+		"share_views":     s.Views,
+		"share_revoked":   s.Revoked,
+	}
+}
+
+// Valid returns an error if the share can no longer be used at time now.
+func (s Share) Valid(now time.Time) error {
+	switch {
+	case s.Revoked:
+		return ErrShareRevoked
+	case now.After(s.Expires):
+		return ErrShareExpired
+	case s.MaxViews > 0 && s.Views >= s.MaxViews:
+		return ErrShareExhausted
+	}
+
+	return nil
+}
+
+// Has returns true if imageID is part of this share.
+func (s Share) Has(imageID string) bool {
+	for _, id := range s.ImageIDs {
+		if id == imageID {
+			return true
+		}
+	}
+
+	return false
+}
+
+type Shares interface {
+	Create(imageIDs []string, expires time.Time, maxViews int) (*Share, error)
+	One(id string) (*Share, error)
+	View(id string) (*Share, error)
+	List() ([]Share, error)
+	Revoke(id string) error
+}
+
+type stormShares struct {
+	db *storm.DB
+	g  sandflake.Generator
+}
+
+func NewStormShares(db *storm.DB) Shares {
+	return &stormShares{db: db}
+}
+
+func (s *stormShares) Create(imageIDs []string, expires time.Time, maxViews int) (*Share, error) {
+	if len(imageIDs) == 0 {
+		return nil, errors.New("database: can't share zero images")
+	}
+
+	sh := &Share{
+		ID:       s.g.Next().String(),
+		ImageIDs: imageIDs,
+		Created:  time.Now(),
+		Expires:  expires,
+		MaxViews: maxViews,
+	}
+
+	err := s.db.Save(sh)
+	if err != nil {
+		return nil, err
+	}
+
+	return sh, nil
+}
+
+func (s *stormShares) One(id string) (*Share, error) {
+	var sh Share
+	err := s.db.One("ID", id, &sh)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sh, nil
+}
+
+// View checks that the share is still usable and counts one view against it.
+func (s *stormShares) View(id string) (*Share, error) {
+	tx, err := s.db.Begin(true)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var sh Share
+	err = tx.One("ID", id, &sh)
+	if err != nil {
+		return nil, err
+	}
+
+	err = sh.Valid(time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	sh.Views++
+	err = tx.Save(&sh)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sh, tx.Commit()
+}
+
+func (s *stormShares) List() ([]Share, error) {
+	var shares []Share
+	err := s.db.AllByIndex("Created", &shares, storm.Reverse())
+	if err != nil {
+		return nil, err
+	}
+
+	return shares, nil
+}
+
+func (s *stormShares) Revoke(id string) error {
+	var sh Share
+	err := s.db.One("ID", id, &sh)
+	if err != nil {
+		return err
+	}
+
+	sh.Revoked = true
+
+	return s.db.Save(&sh)
+}
@@ -0,0 +1,84 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShareValid(t *testing.T) {
+	now := time.Now()
+
+	cases := []struct {
+		name string
+		sh   Share
+		want error
+	}{
+		{"fresh", Share{Expires: now.Add(time.Hour)}, nil},
+		{"unlimited", Share{Expires: now.Add(time.Hour), Views: 1000}, nil},
+		{"views left", Share{Expires: now.Add(time.Hour), MaxViews: 2, Views: 1}, nil},
+		{"exhausted", Share{Expires: now.Add(time.Hour), MaxViews: 2, Views: 2}, ErrShareExhausted},
+		{"expired", Share{Expires: now.Add(-time.Second)}, ErrShareExpired},
+		{"revoked", Share{Expires: now.Add(time.Hour), Revoked: true}, ErrShareRevoked},
+		{"revoked and expired", Share{Expires: now.Add(-time.Second), Revoked: true}, ErrShareRevoked},
+	}
+
+	for _, c := range cases {
+		if err := c.sh.Valid(now); err != c.want {
+			t.Errorf("%s: Valid() = %v, want %v", c.name, err, c.want)
+		}
+	}
+}
+
+func TestSharesView(t *testing.T) {
+	s := NewStormShares(openTestDB(t))
+
+	if _, err := s.Create(nil, time.Now().Add(time.Hour), 0); err == nil {
+		t.Error("created a share of no images")
+	}
+
+	sh, err := s.Create([]string{"a", "b"}, time.Now().Add(time.Hour), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for n := 1; n <= 2; n++ {
+		viewed, err := s.View(sh.ID)
+		if err != nil {
+			t.Fatalf("view %d: %v", n, err)
+		}
+		if viewed.Views != n {
+			t.Errorf("view %d counted as %d", n, viewed.Views)
+		}
+	}
+
+	if _, err := s.View(sh.ID); err != ErrShareExhausted {
+		t.Errorf("third view of a share with two views: %v, want %v", err, ErrShareExhausted)
+	}
+
+	stored, err := s.One(sh.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Views != 2 {
+		t.Errorf("refused view was counted, views = %d", stored.Views)
+	}
+
+	expired, err := s.Create([]string{"a"}, time.Now().Add(-time.Second), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.View(expired.ID); err != ErrShareExpired {
+		t.Errorf("view of expired share: %v, want %v", err, ErrShareExpired)
+	}
+
+	unlimited, err := s.Create([]string{"a"}, time.Now().Add(time.Hour), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Revoke(unlimited.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.View(unlimited.ID); err != ErrShareRevoked {
+		t.Errorf("view of revoked share: %v, want %v", err, ErrShareRevoked)
+	}
+}
@@ -0,0 +1,120 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/Xe/kinq/internal/events"
+	"github.com/Xe/kinq/internal/media"
+	"github.com/asdine/storm/v2"
+	"within.website/ln"
+)
+
+// DefaultDuplicateDistance is how many bits the perceptual hashes of two
+// images may differ in for them to count as the same picture.
+const DefaultDuplicateDistance = 10
+
+// Fingerprint is the perceptual hash of a still image. They are kept apart
+// from images so looking for similar ones doesn't read any image data.
+type Fingerprint struct {
+	ImageID string `storm:"id"`
+	DHash   uint64
+}
+
+// WithDuplicateDistance sets how many bits perceptual hashes may differ in
+// for a new image to be reported as a duplicate of an older one. Negative
+// distances only report exact copies.
+func WithDuplicateDistance(n int) ImagesOption {
+	return func(s *stormImages) {
+		s.distance = n
+	}
+}
+
+// fingerprint stores the perceptual hash of a newly archived image and
+// publishes an ImageDuplicate event if it looks like an image that is
+// already archived. Failing to do so never fails archiving the image.
+func (s *stormImages) fingerprint(i *Image) {
+	if s.distance < 0 {
+		return
+	}
+
+	hash, err := media.DHash(i.Data)
+	if err != nil {
+		// videos and formats the image package can't decode
+		return
+	}
+
+	fp := Fingerprint{ImageID: i.ID, DHash: hash}
+	err = s.db.Save(&fp)
+	if err != nil {
+		ln.Error(context.Background(), err, i.F(), ln.Action("save fingerprint"))
+		return
+	}
+
+	similar, distance, err := s.similar(fp)
+	if err != nil {
+		ln.Error(context.Background(), err, i.F(), ln.Action("look for similar images"))
+		return
+	}
+	if similar == nil {
+		return
+	}
+
+	s.events.Publish(context.Background(), events.Event{
+		Kind:    events.ImageDuplicate,
+		Summary: fmt.Sprintf("%s looks like image %s from %s", i.URL, similar.ID, similar.URL),
+		Fields: map[string]string{
+			"image_id":         i.ID,
+			"url":              i.URL,
+			"similar_image_id": similar.ID,
+			"similar_url":      similar.URL,
+			"distance":         strconv.Itoa(distance),
+		},
+	})
+}
+
+// similar returns the image that isn't deleted whose fingerprint is closest
+// to fp, if it is within the duplicate distance.
+func (s *stormImages) similar(fp Fingerprint) (*Image, int, error) {
+	var candidates []Fingerprint
+	err := s.db.Select().Each(new(Fingerprint), func(rec interface{}) error {
+		other := rec.(*Fingerprint)
+		if other.ImageID != fp.ImageID && media.Distance(fp.DHash, other.DHash) <= s.distance {
+			candidates = append(candidates, *other)
+		}
+
+		return nil
+	})
+	if err != nil && err != storm.ErrNotFound {
+		return nil, 0, err
+	}
+
+	var (
+		best     *Image
+		distance int
+	)
+	for _, c := range candidates {
+		d := media.Distance(fp.DHash, c.DHash)
+		if best != nil && d >= distance {
+			continue
+		}
+
+		var i Image
+		err := s.db.One("ID", c.ImageID, &i)
+		if err == storm.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if i.Deleted {
+			continue
+		}
+
+		i.Data = nil
+		best, distance = &i, d
+	}
+
+	return best, distance, nil
+}
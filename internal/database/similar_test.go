@@ -0,0 +1,89 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"testing"
+	"time"
+
+	"github.com/Xe/kinq/internal/events"
+	"github.com/Xe/kinq/internal/linkscraper"
+)
+
+func TestNearDuplicates(t *testing.T) {
+	db := openTestDB(t)
+	bus := events.NewBus()
+	i := NewStormImages(db, &linkscraper.Rules{}, WithEvents(bus))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dups := make(chan events.Event, 10)
+	err := bus.Subscribe(ctx, "test", func(e events.Event) {
+		if e.Kind == events.ImageDuplicate {
+			dups <- e
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := func() events.Event {
+		t.Helper()
+		select {
+		case e := <-dups:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("no duplicate event")
+			return events.Event{}
+		}
+	}
+
+	// a picture nothing like testPNG, which is dark with a pixel or two set
+	stripes := image.NewGray(image.Rect(0, 0, 16, 16))
+	for n := range stripes.Pix {
+		if n%4 < 2 {
+			stripes.Pix[n] = 255
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, stripes); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := i.InsertBytes(testPNG(t, 1), "image/png", "https://example.com/a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := i.InsertBytes(buf.Bytes(), "image/png", "https://example.com/stripes.png"); err != nil {
+		t.Fatal(err)
+	}
+	second, err := i.InsertBytes(testPNG(t, 2), "image/png", "https://example.com/b.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the stripes didn't look like anything, so the first event is for b
+	e := next()
+	if e.Fields["image_id"] != second.ID || e.Fields["similar_image_id"] != first.ID {
+		t.Errorf("duplicate event = %v, want image %s like %s", e.Fields, second.ID, first.ID)
+	}
+
+	// deleted images aren't duplicates
+	if err := i.Delete(first.ID); err != nil {
+		t.Fatal(err)
+	}
+	third, err := i.InsertBytes(testPNG(t, 3), "image/png", "https://example.com/c.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e = next()
+	if e.Fields["image_id"] != third.ID || e.Fields["similar_image_id"] != second.ID {
+		t.Errorf("duplicate event = %v, want image %s like %s", e.Fields, third.ID, second.ID)
+	}
+
+	var fp Fingerprint
+	if err := db.One("ImageID", third.ID, &fp); err != nil {
+		t.Errorf("no fingerprint was saved for image %s: %v", third.ID, err)
+	}
+}
@@ -0,0 +1,101 @@
+package database
+
+import (
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/Xe/kinq/internal/media"
+)
+
+// UnsupportedTypeError is returned when downloaded data isn't an image kinq
+// can archive.
+type UnsupportedTypeError struct {
+	ContentType string // as claimed by the server
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	return "sniff: data is not a supported image, server said " + strconv.Quote(e.ContentType)
+}
+
+// ContentTypeMismatchError is returned when the server claims a specific
+// content type that doesn't match the data.
+type ContentTypeMismatchError struct {
+	Claimed  string
+	Detected string
+}
+
+func (e *ContentTypeMismatchError) Error() string {
+	return "sniff: server said " + strconv.Quote(e.Claimed) + " but data is " + strconv.Quote(e.Detected)
+}
+
+// contentTypeAliases maps non-standard content types servers use to the
+// standard ones.
+var contentTypeAliases = map[string]string{
+	"image/jpg":   "image/jpeg",
+	"image/pjpeg": "image/jpeg",
+	"image/x-png": "image/png",
+	"video/x-m4v": "video/mp4",
+}
+
+// compatibleContentTypes lists what servers may claim for a detected type
+// besides the type itself.
+var compatibleContentTypes = map[string][]string{
+	"image/apng": {"image/png", "image/vnd.mozilla.apng"},
+	"video/webm": {"audio/webm"},
+	"video/mp4":  {"application/mp4", "audio/mp4"},
+}
+
+// genericContentType returns true for content types that don't say anything
+// about the data, so only the data itself can be trusted.
+func genericContentType(ct string) bool {
+	switch ct {
+	case "", "application/octet-stream", "binary/octet-stream", "application/binary":
+		return true
+	}
+
+	return false
+}
+
+// normalizeContentType strips parameters and aliases from a Content-Type.
+func normalizeContentType(ct string) string {
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		mt = strings.ToLower(strings.TrimSpace(ct))
+	}
+
+	if alias, ok := contentTypeAliases[mt]; ok {
+		return alias
+	}
+
+	return mt
+}
+
+func compatibleContentType(claimed, detected string) bool {
+	if genericContentType(claimed) || claimed == detected {
+		return true
+	}
+
+	for _, ct := range compatibleContentTypes[detected] {
+		if ct == claimed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sniff detects the type and dimensions of data from its magic bytes and
+// checks it against the content type the server claimed.
+func sniff(data []byte, claimed string) (*media.Info, error) {
+	info, err := media.Detect(data)
+	if err != nil {
+		return nil, &UnsupportedTypeError{ContentType: claimed}
+	}
+
+	if !compatibleContentType(normalizeContentType(claimed), info.Mime) {
+		return nil, &ContentTypeMismatchError{Claimed: claimed, Detected: info.Mime}
+	}
+
+	return info, nil
+}
@@ -0,0 +1,88 @@
+package database
+
+import (
+	"bytes"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func testImages(t *testing.T) map[string][]byte {
+	img := image.NewRGBA(image.Rect(0, 0, 12, 34))
+	result := map[string][]byte{}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	result["image/png"] = buf.Bytes()
+
+	buf = bytes.Buffer{}
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	result["image/jpeg"] = buf.Bytes()
+
+	buf = bytes.Buffer{}
+	if err := gif.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	result["image/gif"] = buf.Bytes()
+
+	return result
+}
+
+func TestSniff(t *testing.T) {
+	imgs := testImages(t)
+
+	cases := []struct {
+		name    string
+		data    []byte
+		claimed string
+		mime    string
+		ext     string
+		err     error
+	}{
+		{"png", imgs["image/png"], "image/png", "image/png", ".png", nil},
+		{"jpeg with jpg alias", imgs["image/jpeg"], "image/jpg", "image/jpeg", ".jpg", nil},
+		{"gif as octet-stream", imgs["image/gif"], "application/octet-stream", "image/gif", ".gif", nil},
+		{"png with parameters", imgs["image/png"], "image/png; charset=binary", "image/png", ".png", nil},
+		{"no content type", imgs["image/png"], "", "image/png", ".png", nil},
+		{"jpeg claiming png", imgs["image/jpeg"], "image/png", "", "", &ContentTypeMismatchError{}},
+		{"html", []byte("<html><body>hi</body></html>"), "text/html", "", "", &UnsupportedTypeError{}},
+		{"png claiming html", imgs["image/png"], "text/html", "", "", &ContentTypeMismatchError{}},
+	}
+
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			res, err := sniff(cs.data, cs.claimed)
+
+			switch cs.err.(type) {
+			case nil:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case *ContentTypeMismatchError:
+				if _, ok := err.(*ContentTypeMismatchError); !ok {
+					t.Fatalf("wanted *ContentTypeMismatchError, got: %v", err)
+				}
+				return
+			case *UnsupportedTypeError:
+				if _, ok := err.(*UnsupportedTypeError); !ok {
+					t.Fatalf("wanted *UnsupportedTypeError, got: %v", err)
+				}
+				return
+			}
+
+			if res.Mime != cs.mime || res.Ext != cs.ext {
+				t.Fatalf("wanted %s %s, got: %s %s", cs.mime, cs.ext, res.Mime, res.Ext)
+			}
+
+			if res.Width != 12 || res.Height != 34 {
+				t.Fatalf("wanted 12x34, got: %dx%d", res.Width, res.Height)
+			}
+		})
+	}
+}
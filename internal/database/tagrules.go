@@ -0,0 +1,163 @@
+package database
+
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/asdine/storm/v2"
+	"github.com/asdine/storm/v2/q"
+	"github.com/celrenheit/sandflake"
+	"within.website/ln"
+)
+
+// TagRule adds tags to images archived from a channel when its conditions
+// match. Empty conditions match everything.
+type TagRule struct {
+	ID        string `storm:"id"`
+	ChannelID string `storm:"index"` // empty for every channel
+
+	Host          string // the URL is on this host or a subdomain of it
+	ScraperTag    string // a scraper tagged the image with this
+	NoScraperTags bool   // no scraper had tags for the image
+
+	// Tags are added when the rule matches. A tag with a namespace, like
+	// rating:explicit, is a default: it isn't added if the image already
+	// has a tag in that namespace.
+	Tags []string
+
+	Created   time.Time
+	CreatedBy string
+}
+
+func (r TagRule) F() ln.F {
+	return ln.F{
+		"tag_rule_id":         r.ID,
+		"tag_rule_channel_id": r.ChannelID,
+		"tag_rule_tags":       r.Tags,
+	}
+}
+
+// Match returns true if the rule applies to an image from u that scrapers
+// gave scraped.
+func (r TagRule) Match(u string, scraped []string) bool {
+	if r.Host != "" {
+		pu, err := url.Parse(u)
+		if err != nil {
+			return false
+		}
+
+		host := strings.ToLower(pu.Hostname())
+		want := strings.ToLower(r.Host)
+		if host != want && !strings.HasSuffix(host, "."+want) {
+			return false
+		}
+	}
+
+	if r.NoScraperTags && len(scraped) > 0 {
+		return false
+	}
+
+	if r.ScraperTag != "" {
+		found := false
+		for _, t := range scraped {
+			if t == r.ScraperTag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+func tagNamespace(tag string) string {
+	if i := strings.Index(tag, ":"); i > 0 {
+		return tag[:i]
+	}
+	return ""
+}
+
+// RuleTags returns the tags rules add to an image from u. Rules match on
+// what scrapers said, scraped; tags the image already has or is getting
+// anyway, like the image's current tags and channel defaults, are in tags.
+// Neither is returned again, and neither has its namespace defaulted.
+func RuleTags(rules []TagRule, u string, scraped, tags []string) []string {
+	have := map[string]bool{}
+	namespaces := map[string]bool{}
+	for _, t := range append(append([]string{}, scraped...), tags...) {
+		have[t] = true
+		namespaces[tagNamespace(t)] = true
+	}
+
+	var result []string
+	for _, r := range rules {
+		if !r.Match(u, scraped) {
+			continue
+		}
+
+		for _, t := range r.Tags {
+			ns := tagNamespace(t)
+			if have[t] || (ns != "" && namespaces[ns]) {
+				continue
+			}
+
+			have[t] = true
+			namespaces[ns] = true
+			result = append(result, t)
+		}
+	}
+
+	return result
+}
+
+type TagRules interface {
+	List() ([]TagRule, error)
+	// ForChannel returns the rules for a channel and the ones for every
+	// channel.
+	ForChannel(channelID string) ([]TagRule, error)
+	Add(r *TagRule) error
+	Delete(id string) error
+}
+
+type stormTagRules struct {
+	db *storm.DB
+	g  sandflake.Generator
+}
+
+func NewStormTagRules(db *storm.DB) TagRules {
+	return &stormTagRules{db: db}
+}
+
+func (s *stormTagRules) List() ([]TagRule, error) {
+	var rules []TagRule
+	err := s.db.All(&rules)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+func (s *stormTagRules) ForChannel(channelID string) ([]TagRule, error) {
+	var rules []TagRule
+	err := s.db.Select(q.In("ChannelID", []string{"", channelID})).OrderBy("Created").Find(&rules)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+func (s *stormTagRules) Add(r *TagRule) error {
+	r.ID = s.g.Next().String()
+	r.Created = time.Now()
+	return s.db.Save(r)
+}
+
+func (s *stormTagRules) Delete(id string) error {
+	return s.db.DeleteStruct(&TagRule{ID: id})
+}
@@ -0,0 +1,75 @@
+package database
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRuleTags(t *testing.T) {
+	rules := []TagRule{
+		{Tags: []string{"source:x", "rating:explicit"}},
+		{Host: "derpibooru.org", Tags: []string{"pony"}},
+		{ScraperTag: "safe", Tags: []string{"rating:safe"}},
+		{NoScraperTags: true, Tags: []string{"untagged"}},
+	}
+
+	cases := []struct {
+		name    string
+		url     string
+		scraped []string
+		tags    []string
+		want    []string
+	}{
+		{
+			name: "no scraper tags",
+			url:  "https://example.com/a.png",
+			want: []string{"source:x", "rating:explicit", "untagged"},
+		},
+		{
+			name:    "host rule on a subdomain",
+			url:     "https://cdn.derpibooru.org/a.png",
+			scraped: []string{"cute"},
+			want:    []string{"source:x", "rating:explicit", "pony"},
+		},
+		{
+			name:    "scraper rating wins over the default",
+			url:     "https://example.com/a.png",
+			scraped: []string{"rating:safe"},
+			want:    []string{"source:x"},
+		},
+		{
+			name:    "first rule's rating wins",
+			url:     "https://example.com/a.png",
+			scraped: []string{"safe"},
+			want:    []string{"source:x", "rating:explicit"},
+		},
+		{
+			name:    "tags already there",
+			url:     "https://example.com/a.png",
+			scraped: []string{"source:x"},
+			want:    []string{"rating:explicit"},
+		},
+		{
+			name: "rating someone already gave the image",
+			url:  "https://example.com/a.png",
+			tags: []string{"rating:questionable"},
+			want: []string{"source:x", "untagged"},
+		},
+		{
+			name:    "other tags don't make rules match",
+			url:     "https://example.com/a.png",
+			scraped: []string{"cute"},
+			tags:    []string{"safe"},
+			want:    []string{"source:x", "rating:explicit"},
+		},
+	}
+
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			got := RuleTags(rules, cs.url, cs.scraped, cs.tags)
+			if !reflect.DeepEqual(got, cs.want) {
+				t.Fatalf("wanted %v, got: %v", cs.want, got)
+			}
+		})
+	}
+}
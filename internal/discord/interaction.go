@@ -0,0 +1,160 @@
+package discord
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// The version of discordgo kinq uses predates application commands, so what
+// is needed of them is defined here and sent with raw API requests.
+
+// APIBase is the Discord API version application commands are used with.
+var APIBase = "https://discord.com/api/v8/"
+
+// EventInteractionCreate is the gateway event sent when someone uses an
+// application command.
+const EventInteractionCreate = "INTERACTION_CREATE"
+
+type InteractionType int
+
+const (
+	InteractionPing               InteractionType = 1
+	InteractionApplicationCommand InteractionType = 2
+)
+
+type OptionType int
+
+const (
+	OptionSubCommand      OptionType = 1
+	OptionSubCommandGroup OptionType = 2
+	OptionString          OptionType = 3
+	OptionInteger         OptionType = 4
+	OptionBoolean         OptionType = 5
+	OptionUser            OptionType = 6
+	OptionChannel         OptionType = 7
+	OptionRole            OptionType = 8
+)
+
+// ApplicationCommand is a slash command as it is registered.
+type ApplicationCommand struct {
+	ID          string               `json:"id,omitempty"`
+	Name        string               `json:"name"`
+	Description string               `json:"description"`
+	Options     []*ApplicationOption `json:"options,omitempty"`
+}
+
+type ApplicationOption struct {
+	Type        OptionType           `json:"type"`
+	Name        string               `json:"name"`
+	Description string               `json:"description"`
+	Required    bool                 `json:"required,omitempty"`
+	Options     []*ApplicationOption `json:"options,omitempty"`
+}
+
+// Interaction is someone using an application command.
+type Interaction struct {
+	ID            string            `json:"id"`
+	ApplicationID string            `json:"application_id"`
+	Type          InteractionType   `json:"type"`
+	Data          *CommandData      `json:"data"`
+	GuildID       string            `json:"guild_id"`
+	ChannelID     string            `json:"channel_id"`
+	Member        *discordgo.Member `json:"member"`
+	User          *discordgo.User   `json:"user"` // only set in direct messages
+	Token         string            `json:"token"`
+}
+
+// CommandData is the command and options that were used.
+type CommandData struct {
+	ID      string           `json:"id"`
+	Name    string           `json:"name"`
+	Options []*CommandOption `json:"options"`
+}
+
+type CommandOption struct {
+	Name    string           `json:"name"`
+	Type    OptionType       `json:"type"`
+	Value   interface{}      `json:"value,omitempty"`
+	Options []*CommandOption `json:"options,omitempty"`
+}
+
+// String returns the value of o as a string.
+func (o *CommandOption) String() string {
+	switch v := o.Value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// Option returns the option called name, or nil.
+func Option(opts []*CommandOption, name string) *CommandOption {
+	for _, o := range opts {
+		if o.Name == name {
+			return o
+		}
+	}
+
+	return nil
+}
+
+// ParseInteraction returns the interaction in a raw gateway event, if it is
+// one.
+func ParseInteraction(e *discordgo.Event) (*Interaction, error) {
+	if e.Type != EventInteractionCreate {
+		return nil, nil
+	}
+
+	var in Interaction
+	err := json.Unmarshal(e.RawData, &in)
+	if err != nil {
+		return nil, err
+	}
+
+	return &in, nil
+}
+
+type ResponseType int
+
+const (
+	ResponsePong                     ResponseType = 1
+	ResponseChannelMessageWithSource ResponseType = 4
+)
+
+// FlagEphemeral makes a response only visible to whoever used the command.
+const FlagEphemeral = 1 << 6
+
+// InteractionResponse is the answer to an Interaction.
+type InteractionResponse struct {
+	Type ResponseType  `json:"type"`
+	Data *ResponseData `json:"data,omitempty"`
+}
+
+type ResponseData struct {
+	Content string                    `json:"content,omitempty"`
+	Embeds  []*discordgo.MessageEmbed `json:"embeds,omitempty"`
+	Flags   int                       `json:"flags,omitempty"`
+}
+
+// RegisterGuildCommands replaces the application commands of a guild with
+// cmds.
+func RegisterGuildCommands(dg *discordgo.Session, appID, guildID string, cmds []*ApplicationCommand) error {
+	u := APIBase + "applications/" + appID + "/guilds/" + guildID + "/commands"
+	_, err := dg.RequestWithBucketID("PUT", u, cmds, u)
+	return err
+}
+
+// Respond answers an interaction.
+func Respond(dg *discordgo.Session, in *Interaction, r *InteractionResponse) error {
+	u := APIBase + "interactions/" + in.ID + "/" + in.Token + "/callback"
+	_, err := dg.RequestWithBucketID("POST", u, r, APIBase+"interactions")
+	return err
+}
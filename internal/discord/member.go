@@ -0,0 +1,16 @@
+package discord
+
+import "github.com/bwmarrin/discordgo"
+
+// HasRole returns true if m has any of roles.
+func HasRole(m *discordgo.Member, roles []string) bool {
+	for _, have := range m.Roles {
+		for _, want := range roles {
+			if have == want {
+				return true
+			}
+		}
+	}
+
+	return false
+}
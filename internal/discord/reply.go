@@ -0,0 +1,46 @@
+package discord
+
+import (
+	"encoding/json"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// MessageReference is the message a reply is to. discordgo doesn't decode it
+// yet, so it is read from the raw MESSAGE_CREATE event.
+type MessageReference struct {
+	MessageID string `json:"message_id"`
+	ChannelID string `json:"channel_id"`
+	GuildID   string `json:"guild_id"`
+}
+
+// ParseReply returns the message in a raw MESSAGE_CREATE event and what it
+// replies to. The reference is nil if the event isn't a reply.
+func ParseReply(e *discordgo.Event) (*discordgo.Message, *MessageReference, error) {
+	if e.Type != "MESSAGE_CREATE" {
+		return nil, nil, nil
+	}
+
+	// the reference is decoded on its own: newer discordgo versions decode
+	// it themselves, and a Message with its own UnmarshalJSON can't be
+	// embedded next to other fields
+	var ref struct {
+		Reference *MessageReference `json:"message_reference"`
+	}
+	err := json.Unmarshal(e.RawData, &ref)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if ref.Reference == nil || ref.Reference.MessageID == "" {
+		return nil, nil, nil
+	}
+
+	var m discordgo.Message
+	err = json.Unmarshal(e.RawData, &m)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &m, ref.Reference, nil
+}
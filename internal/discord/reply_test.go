@@ -0,0 +1,33 @@
+package discord
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestParseReply(t *testing.T) {
+	reply := &discordgo.Event{
+		Type:    "MESSAGE_CREATE",
+		RawData: []byte(`{"id":"2","channel_id":"c","content":"🏷️ cute","message_reference":{"message_id":"1","channel_id":"c"}}`),
+	}
+
+	m, ref, err := ParseReply(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m == nil || ref == nil || m.ID != "2" || m.Content != "🏷️ cute" || ref.MessageID != "1" {
+		t.Fatalf("wrong reply: %+v %+v", m, ref)
+	}
+
+	plain := &discordgo.Event{
+		Type:    "MESSAGE_CREATE",
+		RawData: []byte(`{"id":"3","channel_id":"c","content":"hi"}`),
+	}
+
+	m, ref, err = ParseReply(plain)
+	if err != nil || m != nil || ref != nil {
+		t.Fatalf("wanted nothing for a message that isn't a reply, got: %+v %+v %v", m, ref, err)
+	}
+}
@@ -0,0 +1,31 @@
+package discord
+
+import (
+	"strconv"
+	"time"
+)
+
+// discordEpoch is the first second of 2015 in milliseconds, which Discord
+// IDs count from.
+const discordEpoch = 1420070400000
+
+// SnowflakeAt returns the smallest ID Discord could give something made at
+// t, for paging through messages by time.
+func SnowflakeAt(t time.Time) string {
+	ms := t.UnixNano()/int64(time.Millisecond) - discordEpoch
+	if ms < 0 {
+		ms = 0
+	}
+
+	return strconv.FormatUint(uint64(ms)<<22, 10)
+}
+
+// SnowflakeLess returns true if the ID a is older than b. IDs are decimal
+// numbers, so shorter ones are smaller.
+func SnowflakeLess(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+
+	return a < b
+}
@@ -0,0 +1,18 @@
+package discord
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSnowflake(t *testing.T) {
+	// the smallest ID of anything made at 2018-12-01T00:00:00.000Z
+	at := time.Date(2018, 12, 1, 0, 0, 0, 0, time.UTC)
+	if got := SnowflakeAt(at); got != "518214647808000000" {
+		t.Fatalf("wrong snowflake for %s: %s", at, got)
+	}
+
+	if !SnowflakeLess("99", "100") || SnowflakeLess("100", "99") || SnowflakeLess("5", "5") {
+		t.Fatal("SnowflakeLess is wrong")
+	}
+}
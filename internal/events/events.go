@@ -0,0 +1,126 @@
+// Package events passes notable things that happen in the archive to
+// whatever wants to know about them, like the Discord log channel.
+package events
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/celrenheit/sandflake"
+	"within.website/ln"
+)
+
+type Kind string
+
+const (
+	ImageCreated   Kind = "image.created"   // an image was archived
+	ImageTagged    Kind = "image.tagged"    // tags were added to or removed from an image
+	IngestFailed   Kind = "ingest.failed"   // a URL couldn't be archived
+	ImageDeleted   Kind = "image.deleted"   // an image was taken down
+	ImageDuplicate Kind = "image.duplicate" // the same or a similar picture was archived from another URL
+	BackupDone     Kind = "backup.done"     // a backup of the database was made
+	BackupFailed   Kind = "backup.failed"   // a scheduled backup couldn't be made or verified
+	ScraperDown    Kind = "scraper.down"    // scraping tags from a host keeps failing
+	ScraperUp      Kind = "scraper.up"      // a host that was down scraped fine again
+	FsckProblems   Kind = "fsck.problems"   // a scrub found damaged images it couldn't repair
+)
+
+// Event is something that happened. Fields hold the details sinks may want
+// to show or send on.
+type Event struct {
+	ID      string
+	Kind    Kind
+	Time    time.Time
+	Summary string
+	Fields  map[string]string
+}
+
+func (e Event) F() ln.F {
+	f := ln.F{
+		"event_id":      e.ID,
+		"event_kind":    e.Kind,
+		"event_summary": e.Summary,
+	}
+	for k, v := range e.Fields {
+		f["event_"+k] = v
+	}
+
+	return f
+}
+
+// subscriberBuffer is how many events a slow subscriber can fall behind by
+// before events for it are dropped.
+const subscriberBuffer = 256
+
+// Bus hands published events to every subscriber. Publishing never blocks,
+// so a stuck subscriber can't hold up archiving.
+type Bus struct {
+	mu   sync.Mutex
+	subs map[string]chan Event
+	g    sandflake.Generator
+}
+
+func NewBus() *Bus {
+	return &Bus{subs: map[string]chan Event{}}
+}
+
+// Subscribe runs fn with every event published from now on, one at a time,
+// until ctx is cancelled. Names are used in logs and must be unique.
+func (b *Bus) Subscribe(ctx context.Context, name string, fn func(Event)) error {
+	ch := make(chan Event, subscriberBuffer)
+
+	b.mu.Lock()
+	if _, ok := b.subs[name]; ok {
+		b.mu.Unlock()
+		return fmt.Errorf("events: %q is already subscribed", name)
+	}
+	b.subs[name] = ch
+	b.mu.Unlock()
+
+	go func() {
+		defer func() {
+			b.mu.Lock()
+			delete(b.subs, name)
+			b.mu.Unlock()
+		}()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e := <-ch:
+				fn(e)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Publish sends an event to the subscribers, filling in its ID and Time.
+// A nil Bus drops every event.
+func (b *Bus) Publish(ctx context.Context, e Event) {
+	if b == nil {
+		return
+	}
+
+	e.ID = b.g.Next().String()
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	ln.Log(ctx, e, ln.Action("published event"))
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for name, ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			ln.Log(ctx, e, ln.Action("dropping event for slow subscriber"), ln.F{"subscriber": name})
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package events
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBus(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b := NewBus()
+	got := make(chan Event, 2)
+	for _, name := range []string{"a", "b"} {
+		if err := b.Subscribe(ctx, name, func(e Event) { got <- e }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Subscribe(ctx, "a", func(Event) {}); err == nil {
+		t.Error("subscribed a second time as a")
+	}
+
+	b.Publish(ctx, Event{Kind: BackupDone, Summary: "backed up"})
+
+	for n := 0; n < 2; n++ {
+		select {
+		case e := <-got:
+			if e.Kind != BackupDone || e.ID == "" || e.Time.IsZero() {
+				t.Fatalf("wrong event: %+v", e)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("subscriber %d got nothing", n)
+		}
+	}
+
+	var nilBus *Bus
+	nilBus.Publish(ctx, Event{Kind: BackupDone})
+}
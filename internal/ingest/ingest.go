@@ -0,0 +1,376 @@
+// Package ingest is a persistent queue of URLs to archive, worked through by
+// a bounded number of goroutines.
+package ingest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/Xe/kinq/internal/database"
+	"github.com/asdine/storm/v2"
+	"github.com/asdine/storm/v2/q"
+	"github.com/celrenheit/sandflake"
+	"within.website/ln"
+	"within.website/ln/opname"
+)
+
+type Status string
+
+const (
+	StatusQueued  Status = "queued"
+	StatusRunning Status = "running"
+	StatusDone    Status = "done"
+	StatusFailed  Status = "failed"
+)
+
+// Job is one URL to archive.
+type Job struct {
+	ID          string `storm:"id"`
+	URL         string
+	Status      Status `storm:"index"`
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string
+	ImageID     string
+	Created     time.Time `storm:"index"`
+	Updated     time.Time
+
+	// The Discord message the URL was found in, if any.
+	GuildID     string
+	ChannelID   string
+	ChannelName string
+	MessageID   string `storm:"index"`
+	AuthorID    string
+	Author      string
+	Content     string
+	Posted      time.Time
+
+	// Tags are added to the image once it is archived.
+	Tags []string
+
+	// Quiet jobs don't get reactions on their message, for backfilling old
+	// messages without notifying everyone.
+	Quiet bool
+}
+
+func (j Job) F() ln.F {
+	return ln.F{
+		"job_id":       j.ID,
+		"job_url":      j.URL,
+		"job_status":   j.Status,
+		"job_attempts": j.Attempts,
+		"job_image_id": j.ImageID,
+		"message_id":   j.MessageID,
+		"author":       j.Author,
+	}
+}
+
+// Config controls how the queue works through jobs.
+type Config struct {
+	Workers      int           // number of concurrent downloads
+	HostInterval time.Duration // minimum time between requests to one host
+	MaxAttempts  int           // attempts before a job fails for good
+	Backoff      time.Duration // wait after the first failed attempt, doubled each time after
+	Retention    time.Duration // finished jobs older than this are removed, if set
+}
+
+// pruneInterval is how often finished jobs past Retention are removed.
+const pruneInterval = time.Hour
+
+// Queue stores jobs in the database and runs them.
+type Queue struct {
+	db    *storm.DB
+	i     database.Images
+	cfg   Config
+	g     sandflake.Generator
+	hosts *hostLimiter
+	wake  chan struct{}
+
+	// OnDone is called after a job finishes, successfully or not. err is the
+	// error of the last attempt.
+	OnDone func(j Job, img *database.Image, err error)
+}
+
+func New(db *storm.DB, i database.Images, cfg Config) *Queue {
+	if cfg.Workers <= 0 {
+		cfg.Workers = 1
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 1
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = 30 * time.Second
+	}
+
+	return &Queue{
+		db:    db,
+		i:     i,
+		cfg:   cfg,
+		hosts: newHostLimiter(cfg.HostInterval),
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+// Enqueue stores a new job for j.URL. The message fields of j are kept, the
+// rest is filled in.
+func (qu *Queue) Enqueue(j Job) (*Job, error) {
+	now := time.Now()
+	j.ID = qu.g.Next().String()
+	j.Status = StatusQueued
+	j.Attempts = 0
+	j.NextAttempt = now
+	j.Created = now
+	j.Updated = now
+
+	err := qu.db.Save(&j)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case qu.wake <- struct{}{}:
+	default:
+	}
+
+	return &j, nil
+}
+
+func (qu *Queue) One(id string) (*Job, error) {
+	var j Job
+	err := qu.db.One("ID", id, &j)
+	if err != nil {
+		return nil, err
+	}
+
+	return &j, nil
+}
+
+// List returns the newest jobs, optionally only ones with the given status.
+// Unless guilds is nil, only jobs for messages in guilds are returned.
+func (qu *Queue) List(status Status, guilds []string, limit int) ([]Job, error) {
+	var matchers []q.Matcher
+	if status != "" {
+		matchers = append(matchers, q.Eq("Status", status))
+	}
+	if guilds != nil {
+		matchers = append(matchers, q.In("GuildID", guilds))
+	}
+
+	var jobs []Job
+	err := qu.db.Select(matchers...).OrderBy("Created").Reverse().Limit(limit).Find(&jobs)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	return jobs, nil
+}
+
+// Pending returns how many jobs for a Discord message are not finished yet.
+func (qu *Queue) Pending(messageID string) (int, error) {
+	return qu.db.Select(
+		q.Eq("MessageID", messageID),
+		q.In("Status", []Status{StatusQueued, StatusRunning}),
+	).Count(new(Job))
+}
+
+// URLs returns the URLs jobs were made for from a Discord message.
+func (qu *Queue) URLs(messageID string) ([]string, error) {
+	var jobs []Job
+	err := qu.db.Find("MessageID", messageID, &jobs)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	var urls []string
+	for _, j := range jobs {
+		urls = append(urls, j.URL)
+	}
+
+	return urls, nil
+}
+
+// HasMessage returns true if any job was made for a Discord message.
+func (qu *Queue) HasMessage(messageID string) (bool, error) {
+	n, err := qu.db.Select(q.Eq("MessageID", messageID)).Count(new(Job))
+	return n > 0, err
+}
+
+// Run works through the queue until ctx is cancelled.
+func (qu *Queue) Run(ctx context.Context) {
+	ctx = opname.With(ctx, "ingest.Queue.Run")
+
+	// jobs that were running when the process stopped never finished
+	var stale []Job
+	err := qu.db.Find("Status", StatusRunning, &stale)
+	if err != nil && err != storm.ErrNotFound {
+		ln.Error(ctx, err, ln.Action("finding stale jobs"))
+	}
+	for _, j := range stale {
+		j.Status = StatusQueued
+		err = qu.db.Save(&j)
+		if err != nil {
+			ln.Error(ctx, err, j)
+		}
+	}
+
+	jobs := make(chan Job)
+	var wg sync.WaitGroup
+	for n := 0; n < qu.cfg.Workers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				qu.work(ctx, j)
+			}
+		}()
+	}
+	defer wg.Wait()
+	defer close(jobs)
+
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+
+	qu.prune(ctx)
+	pt := time.NewTicker(pruneInterval)
+	defer pt.Stop()
+
+	for {
+		for _, j := range qu.due(ctx, qu.cfg.Workers) {
+			select {
+			case jobs <- j:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-qu.wake:
+		case <-t.C:
+		case <-pt.C:
+			qu.prune(ctx)
+		}
+	}
+}
+
+// prune removes jobs that finished more than Retention ago.
+func (qu *Queue) prune(ctx context.Context) {
+	if qu.cfg.Retention <= 0 {
+		return
+	}
+
+	err := qu.db.Select(
+		q.In("Status", []Status{StatusDone, StatusFailed}),
+		q.Lt("Updated", time.Now().Add(-qu.cfg.Retention)),
+	).Delete(new(Job))
+	if err != nil && err != storm.ErrNotFound {
+		ln.Error(ctx, err, ln.Action("pruning finished jobs"))
+	}
+}
+
+// due claims up to n queued jobs whose next attempt is due.
+func (qu *Queue) due(ctx context.Context, n int) []Job {
+	now := time.Now()
+
+	var queued []Job
+	err := qu.db.Select(
+		q.Eq("Status", StatusQueued),
+		q.Lte("NextAttempt", now),
+	).OrderBy("Created").Limit(n).Find(&queued)
+	if err != nil {
+		if err != storm.ErrNotFound {
+			ln.Error(ctx, err, ln.Action("finding queued jobs"))
+		}
+		return nil
+	}
+
+	var result []Job
+	for _, j := range queued {
+		j.Status = StatusRunning
+		j.Updated = now
+		err = qu.db.Save(&j)
+		if err != nil {
+			ln.Error(ctx, err, j)
+			continue
+		}
+
+		result = append(result, j)
+	}
+
+	return result
+}
+
+func (qu *Queue) work(ctx context.Context, j Job) {
+	if u, err := url.Parse(j.URL); err == nil {
+		if err := qu.hosts.Wait(ctx, u.Host); err != nil {
+			return
+		}
+	}
+
+	j.Attempts++
+	img, err := qu.i.Insert(j.URL)
+
+	j.Updated = time.Now()
+	switch {
+	case err == nil:
+		j.Status = StatusDone
+		j.ImageID = img.ID
+		j.LastError = ""
+	case j.Attempts >= qu.cfg.MaxAttempts || permanent(err):
+		j.Status = StatusFailed
+		j.LastError = err.Error()
+	default:
+		j.Status = StatusQueued
+		j.LastError = err.Error()
+		j.NextAttempt = j.Updated.Add(backoff(qu.cfg.Backoff, j.Attempts))
+	}
+
+	if serr := qu.db.Save(&j); serr != nil {
+		ln.Error(ctx, serr, j, ln.Action("saving job"))
+	}
+
+	switch j.Status {
+	case StatusDone:
+		ln.Log(ctx, j, img, ln.Action("saved image"))
+	case StatusFailed:
+		ln.Error(ctx, err, j, ln.Action("giving up on job"))
+	default:
+		ln.Error(ctx, err, j, ln.Action("will retry job"), ln.F{"next_attempt": j.NextAttempt})
+		return
+	}
+
+	if qu.OnDone != nil {
+		qu.OnDone(j, img, err)
+	}
+}
+
+// permanent returns true if trying again can't make err go away, like for
+// URLs kinq won't fetch or data that isn't an image.
+func permanent(err error) bool {
+	var (
+		scheme   *database.SchemeError
+		blocked  *database.BlockedAddressError
+		large    *database.TooLargeError
+		redirect *database.RedirectLimitError
+		typ      *database.UnsupportedTypeError
+		mismatch *database.ContentTypeMismatchError
+		status   *database.StatusError
+	)
+
+	switch {
+	case errors.As(err, &scheme), errors.As(err, &blocked), errors.As(err, &large),
+		errors.As(err, &redirect), errors.As(err, &typ), errors.As(err, &mismatch):
+		return true
+	case errors.As(err, &status):
+		// the server may come back or stop rate limiting
+		return status.Code >= 400 && status.Code < 500 &&
+			status.Code != http.StatusRequestTimeout && status.Code != http.StatusTooManyRequests
+	}
+
+	return false
+}
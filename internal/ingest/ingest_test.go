@@ -0,0 +1,227 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Xe/kinq/internal/database"
+	"github.com/asdine/storm/v2"
+)
+
+func openTestDB(t *testing.T) *storm.DB {
+	db, err := storm.Open(filepath.Join(t.TempDir(), "kinq.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+func TestQueueMessages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kinq-ingest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := storm.Open(filepath.Join(dir, "kinq.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	qu := New(db, nil, Config{})
+
+	var jobs []*Job
+	for _, u := range []string{"https://a.example/1.png", "https://a.example/2.png"} {
+		j, err := qu.Enqueue(Job{URL: u, MessageID: "m1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		jobs = append(jobs, j)
+	}
+
+	// one is archived already
+	jobs[0].Status = StatusDone
+	if err := db.Save(jobs[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	// an edit adding a link must not queue the done or queued ones again
+	urls, err := qu.URLs("m1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(urls)
+	if want := []string{"https://a.example/1.png", "https://a.example/2.png"}; !reflect.DeepEqual(urls, want) {
+		t.Errorf("URLs(m1) = %v, want %v", urls, want)
+	}
+
+	n, err := qu.Pending("m1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("Pending(m1) = %d, want 1", n)
+	}
+
+	if ok, err := qu.HasMessage("m1"); err != nil || !ok {
+		t.Errorf("HasMessage(m1) = %v, %v", ok, err)
+	}
+	if ok, err := qu.HasMessage("m2"); err != nil || ok {
+		t.Errorf("HasMessage(m2) = %v, %v", ok, err)
+	}
+	if urls, err := qu.URLs("m2"); err != nil || len(urls) != 0 {
+		t.Errorf("URLs(m2) = %v, %v", urls, err)
+	}
+}
+
+func TestQueueDue(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	qu := New(db, nil, Config{})
+
+	var ids []string
+	for n := 0; n < 4; n++ {
+		j, err := qu.Enqueue(Job{URL: fmt.Sprintf("https://a.example/%d.png", n)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, j.ID)
+	}
+
+	// one is waiting out its backoff
+	later, err := qu.One(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	later.NextAttempt = time.Now().Add(time.Hour)
+	if err := db.Save(later); err != nil {
+		t.Fatal(err)
+	}
+
+	got := qu.due(ctx, 2)
+	if len(got) != 2 || got[0].ID != ids[1] || got[1].ID != ids[2] {
+		t.Fatalf("due(2) = %+v, want jobs %v", got, ids[1:3])
+	}
+	for _, j := range got {
+		stored, err := qu.One(j.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Status != StatusRunning {
+			t.Errorf("claimed job %s is %s, want %s", j.ID, stored.Status, StatusRunning)
+		}
+	}
+
+	got = qu.due(ctx, 2)
+	if len(got) != 1 || got[0].ID != ids[3] {
+		t.Errorf("second due(2) = %+v, want job %s", got, ids[3])
+	}
+}
+
+func TestQueuePrune(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	qu := New(db, nil, Config{Retention: time.Hour})
+
+	old := time.Now().Add(-2 * time.Hour)
+	cases := []struct {
+		status  Status
+		updated time.Time
+		kept    bool
+	}{
+		{StatusDone, old, false},
+		{StatusFailed, old, false},
+		{StatusQueued, old, true},
+		{StatusDone, time.Now(), true},
+	}
+
+	var ids []string
+	for n, cs := range cases {
+		j, err := qu.Enqueue(Job{URL: fmt.Sprintf("https://a.example/%d.png", n)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		j.Status = cs.status
+		j.Updated = cs.updated
+		if err := db.Save(j); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, j.ID)
+	}
+
+	qu.prune(ctx)
+
+	for n, cs := range cases {
+		_, err := qu.One(ids[n])
+		if kept := err == nil; kept != cs.kept {
+			t.Errorf("%s job updated %v: kept = %v, want %v (%v)", cs.status, cs.updated, kept, cs.kept, err)
+		}
+	}
+}
+
+func TestPermanent(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{&database.SchemeError{Scheme: "file"}, true},
+		{&database.BlockedAddressError{}, true},
+		{&database.TooLargeError{Limit: 1}, true},
+		{&database.UnsupportedTypeError{ContentType: "text/html"}, true},
+		{&database.StatusError{Code: 404}, true},
+		{&database.StatusError{Code: 429}, false},
+		{&database.StatusError{Code: 503}, false},
+		{errors.New("connection reset"), false},
+	}
+
+	for _, cs := range cases {
+		if got := permanent(cs.err); got != cs.want {
+			t.Errorf("permanent(%v) = %v, want %v", cs.err, got, cs.want)
+		}
+	}
+}
+
+func TestQueueListGuilds(t *testing.T) {
+	qu := New(openTestDB(t), nil, Config{})
+
+	for n, g := range []string{"g1", "g2", ""} {
+		if _, err := qu.Enqueue(Job{URL: fmt.Sprintf("https://a.example/%d.png", n), GuildID: g}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		guilds []string
+		want   int
+	}{
+		{nil, 3},
+		{[]string{"g1"}, 1},
+		{[]string{"g1", "g2"}, 2},
+		{[]string{}, 0},
+	}
+	for _, cs := range cases {
+		jobs, err := qu.List("", cs.guilds, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(jobs) != cs.want {
+			t.Errorf("List(%v) returned %d jobs, want %d", cs.guilds, len(jobs), cs.want)
+		}
+		for _, j := range jobs {
+			if cs.guilds != nil && j.GuildID != "g1" && j.GuildID != "g2" {
+				t.Errorf("List(%v) returned a job of guild %q", cs.guilds, j.GuildID)
+			}
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package ingest
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// hostLimiter spaces out requests to the same host.
+type hostLimiter struct {
+	interval time.Duration
+
+	lock sync.Mutex
+	next map[string]time.Time
+}
+
+func newHostLimiter(interval time.Duration) *hostLimiter {
+	return &hostLimiter{
+		interval: interval,
+		next:     map[string]time.Time{},
+	}
+}
+
+// reserve claims the next free slot for host and returns when it starts.
+func (h *hostLimiter) reserve(host string, now time.Time) time.Time {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	at := h.next[host]
+	if at.Before(now) {
+		at = now
+	}
+	h.next[host] = at.Add(h.interval)
+
+	return at
+}
+
+// Wait blocks until a request to host may be made or ctx is done.
+func (h *hostLimiter) Wait(ctx context.Context, host string) error {
+	if h.interval <= 0 {
+		return nil
+	}
+
+	d := time.Until(h.reserve(host, time.Now()))
+	if d <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// backoff returns how long to wait before retrying a job that has failed
+// attempts times.
+func backoff(base time.Duration, attempts int) time.Duration {
+	const max = time.Hour
+
+	d := base
+	for i := 1; i < attempts; i++ {
+		d *= 2
+		if d >= max {
+			return max
+		}
+	}
+
+	return d
+}
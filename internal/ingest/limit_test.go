@@ -0,0 +1,46 @@
+package ingest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHostLimiter(t *testing.T) {
+	h := newHostLimiter(time.Second)
+	now := time.Now()
+
+	if at := h.reserve("a.example", now); !at.Equal(now) {
+		t.Fatalf("first request should not wait, got slot at %v", at.Sub(now))
+	}
+
+	if at := h.reserve("a.example", now); !at.Equal(now.Add(time.Second)) {
+		t.Fatalf("second request should wait one interval, got slot at %v", at.Sub(now))
+	}
+
+	if at := h.reserve("b.example", now); !at.Equal(now) {
+		t.Fatalf("other hosts should not wait, got slot at %v", at.Sub(now))
+	}
+
+	later := now.Add(time.Minute)
+	if at := h.reserve("a.example", later); !at.Equal(later) {
+		t.Fatalf("idle host should not wait, got slot at %v", at.Sub(later))
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	cases := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{20, time.Hour},
+	}
+
+	for _, cs := range cases {
+		if got := backoff(30*time.Second, cs.attempts); got != cs.want {
+			t.Errorf("backoff after %d attempts: wanted %v, got: %v", cs.attempts, cs.want, got)
+		}
+	}
+}
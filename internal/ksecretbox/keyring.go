@@ -0,0 +1,189 @@
+package ksecretbox
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+var (
+	ErrNoKeys     = errors.New("ksecretbox: no keys")
+	ErrUnknownKey = errors.New("ksecretbox: message was sealed with an unknown key")
+	ErrInvalidBox = errors.New("ksecretbox: message is invalid or corrupt")
+)
+
+const (
+	keyIDSize = 4
+	nonceSize = 24
+)
+
+// KeyID returns a short identifier for key that is safe to store next to
+// data sealed with it.
+func KeyID(key *[32]byte) [keyIDSize]byte {
+	var id [keyIDSize]byte
+	sum := sha256.Sum256(append([]byte("ksecretbox key id\x00"), key[:]...))
+	copy(id[:], sum[:])
+	return id
+}
+
+// DeriveKey derives an independent key from key for the given purpose, so
+// one configured key can safely be used for several kinds of data.
+func DeriveKey(key *[32]byte, purpose string) *[32]byte {
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte("ksecretbox derive\x00" + purpose))
+
+	var dk [32]byte
+	copy(dk[:], mac.Sum(nil))
+	return &dk
+}
+
+// BoxKeyID returns the ID of the key a message made by Seal was sealed with.
+func BoxKeyID(box []byte) ([keyIDSize]byte, bool) {
+	var id [keyIDSize]byte
+	if len(box) < keyIDSize+nonceSize+secretbox.Overhead {
+		return id, false
+	}
+
+	copy(id[:], box)
+	return id, true
+}
+
+// Keyring is a list of keys. The first key is used to seal and sign, every
+// key is tried when opening or verifying so older keys can be rotated out.
+type Keyring []*[32]byte
+
+// ParseKeys decodes a comma-separated list of keys.
+func ParseKeys(s string) (Keyring, error) {
+	var k Keyring
+	for _, ks := range strings.Split(s, ",") {
+		ks = strings.TrimSpace(ks)
+		if ks == "" {
+			continue
+		}
+
+		key, err := ParseKey(ks)
+		if err != nil {
+			return nil, err
+		}
+
+		k = append(k, key)
+	}
+
+	if len(k) == 0 {
+		return nil, ErrNoKeys
+	}
+
+	return k, nil
+}
+
+// Primary returns the key used for sealing and signing.
+func (k Keyring) Primary() *[32]byte {
+	return k[0]
+}
+
+// Derive returns a keyring of keys derived for purpose, in the same order.
+func (k Keyring) Derive(purpose string) Keyring {
+	dk := make(Keyring, 0, len(k))
+	for _, key := range k {
+		dk = append(dk, DeriveKey(key, purpose))
+	}
+
+	return dk
+}
+
+// Find returns the key with the given ID.
+func (k Keyring) Find(id [keyIDSize]byte) (*[32]byte, bool) {
+	for _, key := range k {
+		if KeyID(key) == id {
+			return key, true
+		}
+	}
+
+	return nil, false
+}
+
+// Seal encrypts msg with the primary key. The output starts with the ID of
+// the key and a random nonce.
+func (k Keyring) Seal(msg []byte) ([]byte, error) {
+	if len(k) == 0 {
+		return nil, ErrNoKeys
+	}
+
+	return Seal(k.Primary(), msg)
+}
+
+// Open decrypts a message made by Seal with any key in the keyring.
+func (k Keyring) Open(box []byte) ([]byte, error) {
+	if len(box) < keyIDSize+nonceSize+secretbox.Overhead {
+		return nil, ErrInvalidBox
+	}
+
+	id, _ := BoxKeyID(box)
+
+	key, ok := k.Find(id)
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	return Open(key, box)
+}
+
+// Sign signs msg with the primary key.
+func (k Keyring) Sign(msg []byte) string {
+	return Sign(k.Primary(), msg)
+}
+
+// Verify checks sig against every key in the keyring.
+func (k Keyring) Verify(msg []byte, sig string) bool {
+	for _, key := range k {
+		if Verify(key, msg, sig) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Seal encrypts msg with key. The output starts with the ID of key and a
+// random nonce.
+func Seal(key *[32]byte, msg []byte) ([]byte, error) {
+	var nonce [nonceSize]byte
+	_, err := rand.Read(nonce[:])
+	if err != nil {
+		return nil, err
+	}
+
+	id := KeyID(key)
+	out := make([]byte, 0, keyIDSize+nonceSize+len(msg)+secretbox.Overhead)
+	out = append(out, id[:]...)
+	out = append(out, nonce[:]...)
+
+	return secretbox.Seal(out, msg, &nonce, key), nil
+}
+
+// Open decrypts a message made by Seal with key.
+func Open(key *[32]byte, box []byte) ([]byte, error) {
+	if len(box) < keyIDSize+nonceSize+secretbox.Overhead {
+		return nil, ErrInvalidBox
+	}
+
+	id := KeyID(key)
+	if !bytes.Equal(box[:keyIDSize], id[:]) {
+		return nil, ErrUnknownKey
+	}
+
+	var nonce [nonceSize]byte
+	copy(nonce[:], box[keyIDSize:])
+
+	msg, ok := secretbox.Open(nil, box[keyIDSize+nonceSize:], &nonce, key)
+	if !ok {
+		return nil, ErrInvalidBox
+	}
+
+	return msg, nil
+}
@@ -0,0 +1,125 @@
+package ksecretbox
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestKeyring(t *testing.T) {
+	oldKey, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newKey, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := []byte("hello, world")
+
+	oldRing, err := ParseKeys(ShowKey(oldKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldBox, err := oldRing.Seal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ring, err := ParseKeys(ShowKey(newKey) + ", " + ShowKey(oldKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ring) != 2 || *ring.Primary() != *newKey {
+		t.Fatal("keys did not parse out in order")
+	}
+
+	t.Run("open with old key", func(t *testing.T) {
+		out, err := ring.Open(oldBox)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(out, msg) {
+			t.Fatalf("wanted %q, got: %q", msg, out)
+		}
+	})
+
+	t.Run("seal with new key", func(t *testing.T) {
+		box, err := ring.Seal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := oldRing.Open(box); err != ErrUnknownKey {
+			t.Fatalf("wanted ErrUnknownKey, got: %v", err)
+		}
+
+		out, err := Open(newKey, box)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(out, msg) {
+			t.Fatalf("wanted %q, got: %q", msg, out)
+		}
+	})
+
+	t.Run("corrupt box", func(t *testing.T) {
+		box := append([]byte{}, oldBox...)
+		box[len(box)-1] ^= 0xff
+
+		if _, err := ring.Open(box); err != ErrInvalidBox {
+			t.Fatalf("wanted ErrInvalidBox, got: %v", err)
+		}
+
+		if _, err := ring.Open(box[:10]); err != ErrInvalidBox {
+			t.Fatalf("wanted ErrInvalidBox, got: %v", err)
+		}
+	})
+
+	t.Run("verify with old key", func(t *testing.T) {
+		sig := oldRing.Sign(msg)
+		if !ring.Verify(msg, sig) {
+			t.Fatal("signature from the old key did not verify")
+		}
+	})
+
+	t.Run("derive", func(t *testing.T) {
+		dk := ring.Derive("test")
+		if len(dk) != len(ring) {
+			t.Fatalf("wanted %d derived keys, got: %d", len(ring), len(dk))
+		}
+
+		if *dk.Primary() == *ring.Primary() {
+			t.Fatal("derived key is the same as the original key")
+		}
+
+		if *dk.Primary() != *DeriveKey(newKey, "test") {
+			t.Fatal("key derivation is not deterministic")
+		}
+
+		if *dk.Primary() == *DeriveKey(newKey, "other") {
+			t.Fatal("keys for different purposes are the same")
+		}
+
+		box, err := dk.Seal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		id, ok := BoxKeyID(box)
+		if !ok || id != KeyID(dk.Primary()) {
+			t.Fatal("box does not carry the ID of the derived key")
+		}
+	})
+
+	t.Run("no keys", func(t *testing.T) {
+		if _, err := ParseKeys(" , "); err != ErrNoKeys {
+			t.Fatalf("wanted ErrNoKeys, got: %v", err)
+		}
+	})
+}
@@ -1,7 +1,9 @@
 package ksecretbox
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
 	"errors"
 )
@@ -33,3 +35,22 @@ func ParseKey(s string) (*[32]byte, error) {
 	}
 	return k, nil
 }
+
+// Sign creates a HMAC-SHA256 signature of msg using key.
+func Sign(key *[32]byte, msg []byte) string {
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write(msg)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks that sig is a valid signature of msg for key.
+func Verify(key *[32]byte, msg []byte, sig string) bool {
+	raw, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write(msg)
+	return hmac.Equal(raw, mac.Sum(nil))
+}
@@ -37,4 +37,26 @@ func TestSecretBox(t *testing.T) {
 			t.Fatal("key did not parse out correctly")
 		}
 	})
+
+	t.Run("sign and verify", func(t *testing.T) {
+		msg := []byte("hello, world")
+		sig := Sign(key, msg)
+
+		if !Verify(key, msg, sig) {
+			t.Fatal("signature did not verify")
+		}
+
+		if Verify(key, []byte("hello, world!"), sig) {
+			t.Fatal("signature verified for the wrong message")
+		}
+
+		other, err := GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if Verify(other, msg, sig) {
+			t.Fatal("signature verified with the wrong key")
+		}
+	})
 }
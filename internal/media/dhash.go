@@ -0,0 +1,72 @@
+package media
+
+import (
+	"bytes"
+	"image"
+	"math/bits"
+)
+
+// maxDHashPixels is the largest image DHash decodes, so a small file that
+// claims to be huge can't use up all memory.
+const maxDHashPixels = 64 << 20
+
+// dhashSamples is how many points along each side of a cell of the 9x8 grid
+// DHash averages, instead of looking at every pixel.
+const dhashSamples = 4
+
+// DHash returns the difference hash of a still image: the image is shrunk
+// to 9x8 grey cells, and each bit says whether a cell is brighter than the
+// one to its right. Resized, recompressed or slightly edited copies of an
+// image get hashes a few bits apart, see Distance. Formats the image package
+// can't decode fail with ErrUnknownFormat.
+func DHash(data []byte) (uint64, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, ErrUnknownFormat
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > maxDHashPixels {
+		return 0, ErrTruncated
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return 0, ErrTruncated
+	}
+
+	var grey [8][9]float64
+	b := img.Bounds()
+	for cy := 0; cy < 8; cy++ {
+		for cx := 0; cx < 9; cx++ {
+			var sum float64
+			for sy := 0; sy < dhashSamples; sy++ {
+				for sx := 0; sx < dhashSamples; sx++ {
+					// the middle of each of the samples in the cell
+					x := b.Min.X + ((cx*dhashSamples+sx)*2+1)*b.Dx()/(9*dhashSamples*2)
+					y := b.Min.Y + ((cy*dhashSamples+sy)*2+1)*b.Dy()/(8*dhashSamples*2)
+
+					r, g, bl, _ := img.At(x, y).RGBA()
+					sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)
+				}
+			}
+			grey[cy][cx] = sum
+		}
+	}
+
+	var hash uint64
+	for cy := 0; cy < 8; cy++ {
+		for cx := 0; cx < 8; cx++ {
+			hash <<= 1
+			if grey[cy][cx] > grey[cy][cx+1] {
+				hash |= 1
+			}
+		}
+	}
+
+	return hash, nil
+}
+
+// Distance returns how many bits two hashes made by DHash differ in. 0 is
+// the same picture, and more than about 10 out of 64 is a different one.
+func Distance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
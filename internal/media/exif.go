@@ -0,0 +1,159 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"time"
+)
+
+// EXIF is the subset of EXIF data kinq keeps about an image.
+type EXIF struct {
+	Make        string    `json:",omitempty"`
+	Model       string    `json:",omitempty"`
+	Software    string    `json:",omitempty"`
+	Taken       time.Time `json:",omitempty"`
+	Orientation int       `json:",omitempty"`
+
+	// GPS is set when the image has location data. The location itself is
+	// not kept.
+	GPS bool `json:",omitempty"`
+}
+
+// TIFF tags read by parseEXIF.
+const (
+	tagMake             = 0x010f
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagSoftware         = 0x0131
+	tagDateTime         = 0x0132
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagDateTimeOriginal = 0x9003
+)
+
+const exifTimeLayout = "2006:01:02 15:04:05"
+
+// exifHeader is put before the TIFF data in JPEG files and sometimes in
+// others.
+var exifHeader = []byte("Exif\x00\x00")
+
+type tiffEntry struct {
+	tag, typ uint16
+	count    uint32
+	value    []byte // the 4 byte value or offset field
+}
+
+type tiffReader struct {
+	data []byte
+	bo   binary.ByteOrder
+}
+
+// ifd returns the entries of the IFD at off.
+func (t tiffReader) ifd(off uint32) []tiffEntry {
+	if uint64(off)+2 > uint64(len(t.data)) {
+		return nil
+	}
+
+	n := int(t.bo.Uint16(t.data[off:]))
+	b := t.data[off+2:]
+	if len(b) < n*12 {
+		return nil
+	}
+
+	entries := make([]tiffEntry, n)
+	for i := range entries {
+		e := b[i*12:]
+		entries[i] = tiffEntry{
+			tag:   t.bo.Uint16(e),
+			typ:   t.bo.Uint16(e[2:]),
+			count: t.bo.Uint32(e[4:]),
+			value: e[8:12],
+		}
+	}
+
+	return entries
+}
+
+func (t tiffReader) uint(e tiffEntry) uint32 {
+	switch e.typ {
+	case 3: // SHORT
+		return uint32(t.bo.Uint16(e.value))
+	case 4: // LONG
+		return t.bo.Uint32(e.value)
+	}
+	return 0
+}
+
+func (t tiffReader) string(e tiffEntry) string {
+	if e.typ != 2 { // ASCII
+		return ""
+	}
+
+	b := e.value
+	if e.count > 4 {
+		off := t.bo.Uint32(e.value)
+		if uint64(off)+uint64(e.count) > uint64(len(t.data)) {
+			return ""
+		}
+		b = t.data[off : off+e.count]
+	} else {
+		b = b[:e.count]
+	}
+
+	return strings.TrimSpace(string(bytes.TrimRight(b, "\x00")))
+}
+
+// parseEXIF reads EXIF data from the TIFF structure in data, with or without
+// the Exif header in front of it.
+func parseEXIF(data []byte) *EXIF {
+	data = bytes.TrimPrefix(data, exifHeader)
+	if len(data) < 8 {
+		return nil
+	}
+
+	t := tiffReader{data: data}
+	switch string(data[:2]) {
+	case "II":
+		t.bo = binary.LittleEndian
+	case "MM":
+		t.bo = binary.BigEndian
+	default:
+		return nil
+	}
+
+	x := &EXIF{}
+	var exifIFD uint32
+	for _, e := range t.ifd(t.bo.Uint32(data[4:])) {
+		switch e.tag {
+		case tagMake:
+			x.Make = t.string(e)
+		case tagModel:
+			x.Model = t.string(e)
+		case tagSoftware:
+			x.Software = t.string(e)
+		case tagOrientation:
+			x.Orientation = int(t.uint(e))
+		case tagDateTime:
+			if x.Taken.IsZero() {
+				x.Taken, _ = time.Parse(exifTimeLayout, t.string(e))
+			}
+		case tagExifIFD:
+			exifIFD = t.uint(e)
+		case tagGPSIFD:
+			x.GPS = len(t.ifd(t.uint(e))) > 0
+		}
+	}
+
+	if exifIFD != 0 {
+		for _, e := range t.ifd(exifIFD) {
+			if e.tag == tagDateTimeOriginal {
+				if taken, err := time.Parse(exifTimeLayout, t.string(e)); err == nil {
+					x.Taken = taken
+				}
+			}
+		}
+	}
+
+	return x
+}
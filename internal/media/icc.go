@@ -0,0 +1,64 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"unicode/utf16"
+)
+
+// iccDescription returns the description of an ICC colour profile, such as
+// "sRGB IEC61966-2.1" or "Display P3".
+func iccDescription(profile []byte) string {
+	if len(profile) < 132 {
+		return ""
+	}
+
+	n := binary.BigEndian.Uint32(profile[128:])
+	tags := profile[132:]
+	for i := uint32(0); i < n && len(tags) >= 12; i++ {
+		sig := string(tags[:4])
+		off := binary.BigEndian.Uint32(tags[4:])
+		size := binary.BigEndian.Uint32(tags[8:])
+		tags = tags[12:]
+
+		if sig != "desc" || uint64(off)+uint64(size) > uint64(len(profile)) || size < 12 {
+			continue
+		}
+
+		return iccText(profile[off : off+size])
+	}
+
+	return ""
+}
+
+// iccText decodes a textDescriptionType (ICC v2) or
+// multiLocalizedUnicodeType (ICC v4) tag.
+func iccText(tag []byte) string {
+	switch string(tag[:4]) {
+	case "desc":
+		n := binary.BigEndian.Uint32(tag[8:])
+		if uint64(n) > uint64(len(tag)-12) {
+			return ""
+		}
+		return strings.TrimSpace(string(bytes.TrimRight(tag[12:12+n], "\x00")))
+	case "mluc":
+		if len(tag) < 28 {
+			return ""
+		}
+		// use the first record
+		n := binary.BigEndian.Uint32(tag[20:])
+		off := binary.BigEndian.Uint32(tag[24:])
+		if uint64(off)+uint64(n) > uint64(len(tag)) {
+			return ""
+		}
+		s := tag[off : off+n]
+		u := make([]uint16, len(s)/2)
+		for i := range u {
+			u[i] = binary.BigEndian.Uint16(s[i*2:])
+		}
+		return strings.TrimSpace(strings.TrimRight(string(utf16.Decode(u)), "\x00"))
+	}
+
+	return ""
+}
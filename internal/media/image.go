@@ -0,0 +1,333 @@
+package media
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"io"
+	"io/ioutil"
+	"time"
+
+	// formats decoded by the standard library
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+)
+
+// stdDecoder reads formats the image package knows about.
+type stdDecoder struct {
+	magic string
+	mime  string
+	ext   string
+}
+
+func (d stdDecoder) Match(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(d.magic))
+}
+
+func (d stdDecoder) Decode(data []byte) (*Info, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrTruncated
+	}
+
+	return &Info{
+		Mime:   d.mime,
+		Ext:    d.ext,
+		Width:  cfg.Width,
+		Height: cfg.Height,
+	}, nil
+}
+
+var (
+	jpegStd = stdDecoder{magic: "\xff\xd8\xff", mime: "image/jpeg", ext: ".jpg"}
+	gifStd  = stdDecoder{magic: "GIF8", mime: "image/gif", ext: ".gif"}
+)
+
+// JPEG markers used by jpegDecoder and Strip.
+const (
+	jpegSOS   = 0xda
+	jpegEOI   = 0xd9
+	jpegAPP1  = 0xe1
+	jpegAPP2  = 0xe2
+	jpegAPP13 = 0xed
+)
+
+var iccHeader = []byte("ICC_PROFILE\x00")
+
+// eachJPEGSegment calls fn for every marker segment up to and including the
+// start of scan, after which the image data follows. fn returns false to
+// stop. The offset after the last segment fn saw is returned.
+func eachJPEGSegment(data []byte, fn func(marker byte, seg []byte) bool) (int, error) {
+	pos := 2
+	for {
+		// markers may be padded with any number of 0xff bytes
+		for pos+1 < len(data) && data[pos] == 0xff && data[pos+1] == 0xff {
+			pos++
+		}
+		if pos+1 >= len(data) || data[pos] != 0xff {
+			return pos, ErrTruncated
+		}
+
+		marker := data[pos+1]
+		if marker == jpegEOI || marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			// standalone markers have no length
+			pos += 2
+			continue
+		}
+
+		if pos+4 > len(data) {
+			return pos, ErrTruncated
+		}
+		size := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if size < 2 || pos+2+size > len(data) {
+			return pos, ErrTruncated
+		}
+
+		seg := data[pos : pos+2+size]
+		pos += len(seg)
+		if !fn(marker, seg) || marker == jpegSOS {
+			return pos, nil
+		}
+	}
+}
+
+// jpegDecoder reads JPEG files with their EXIF data and colour profile.
+type jpegDecoder struct{}
+
+func (jpegDecoder) Match(data []byte) bool {
+	return jpegStd.Match(data)
+}
+
+func (jpegDecoder) Decode(data []byte) (*Info, error) {
+	info, err := jpegStd.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// ICC profiles may be split over several APP2 segments, numbered from 1
+	var icc [][]byte
+	eachJPEGSegment(data, func(marker byte, seg []byte) bool {
+		body := seg[4:]
+		switch {
+		case marker == jpegAPP1 && bytes.HasPrefix(body, exifHeader) && info.EXIF == nil:
+			info.EXIF = parseEXIF(body)
+		case marker == jpegAPP2 && bytes.HasPrefix(body, iccHeader) && len(body) >= len(iccHeader)+2:
+			seq, count := int(body[len(iccHeader)]), int(body[len(iccHeader)+1])
+			if icc == nil {
+				icc = make([][]byte, count)
+			}
+			if seq >= 1 && seq <= len(icc) {
+				icc[seq-1] = body[len(iccHeader)+2:]
+			}
+		}
+		return true
+	})
+
+	if icc != nil {
+		info.ColorProfile = iccDescription(bytes.Join(icc, nil))
+	}
+
+	return info, nil
+}
+
+// gifDecoder reads GIF files and counts the frames of animated ones.
+type gifDecoder struct{}
+
+func (gifDecoder) Match(data []byte) bool {
+	return gifStd.Match(data)
+}
+
+// skip returns data without its first n bytes, or nothing if it is shorter.
+func skip(data []byte, n int) []byte {
+	if n > len(data) {
+		return nil
+	}
+	return data[n:]
+}
+
+// skipSubBlocks skips a sequence of GIF data sub-blocks and the terminator.
+func skipSubBlocks(data []byte) ([]byte, error) {
+	for {
+		if len(data) == 0 {
+			return nil, ErrTruncated
+		}
+		n := int(data[0])
+		if n == 0 {
+			return data[1:], nil
+		}
+		if len(data) < n+1 {
+			return nil, ErrTruncated
+		}
+		data = data[n+1:]
+	}
+}
+
+func (gifDecoder) Decode(data []byte) (*Info, error) {
+	info, err := gifStd.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < 13 {
+		return nil, ErrTruncated
+	}
+
+	rest := data[13:]
+	if flags := data[10]; flags&0x80 != 0 {
+		rest = skip(rest, 3<<(flags&7+1))
+	}
+
+	frames := 0
+	var delay time.Duration
+loop:
+	for len(rest) > 0 {
+		switch rest[0] {
+		case 0x21: // extension
+			if len(rest) < 2 {
+				return nil, ErrTruncated
+			}
+			if rest[1] == 0xf9 && len(rest) >= 8 {
+				// graphic control extension, delay in hundredths of a second
+				delay += time.Duration(binary.LittleEndian.Uint16(rest[4:])) * 10 * time.Millisecond
+			}
+			if rest, err = skipSubBlocks(rest[2:]); err != nil {
+				return nil, err
+			}
+		case 0x2c: // image descriptor
+			if len(rest) < 11 {
+				return nil, ErrTruncated
+			}
+			frames++
+			flags := rest[9]
+			rest = rest[10:]
+			if flags&0x80 != 0 {
+				rest = skip(rest, 3<<(flags&7+1))
+			}
+			if len(rest) < 1 {
+				return nil, ErrTruncated
+			}
+			// skip the LZW minimum code size, then the image data
+			if rest, err = skipSubBlocks(rest[1:]); err != nil {
+				return nil, err
+			}
+		case 0x3b: // trailer
+			break loop
+		default:
+			return nil, ErrTruncated
+		}
+	}
+
+	if frames > 1 {
+		info.Frames = frames
+		info.Duration = delay
+	}
+
+	return info, nil
+}
+
+const pngMagic = "\x89PNG\r\n\x1a\n"
+
+// pngDecoder reads PNG and animated PNG files.
+type pngDecoder struct{}
+
+func (pngDecoder) Match(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(pngMagic))
+}
+
+func (pngDecoder) Decode(data []byte) (*Info, error) {
+	info := &Info{Mime: "image/png", Ext: ".png"}
+	animated := false
+
+	rest := data[len(pngMagic):]
+	for len(rest) >= 12 {
+		length := binary.BigEndian.Uint32(rest)
+		typ := string(rest[4:8])
+		if uint64(len(rest)) < 12+uint64(length) {
+			return nil, ErrTruncated
+		}
+		chunk := rest[8 : 8+length]
+		rest = rest[12+length:]
+
+		switch typ {
+		case "IHDR":
+			if len(chunk) < 8 {
+				return nil, ErrTruncated
+			}
+			info.Width = int(binary.BigEndian.Uint32(chunk))
+			info.Height = int(binary.BigEndian.Uint32(chunk[4:]))
+		case "acTL":
+			// must come before the image data to make this an APNG
+			if len(chunk) < 8 {
+				return nil, ErrTruncated
+			}
+			animated = true
+			info.Frames = int(binary.BigEndian.Uint32(chunk))
+		case "fcTL":
+			if len(chunk) < 26 {
+				return nil, ErrTruncated
+			}
+			num := time.Duration(binary.BigEndian.Uint16(chunk[20:]))
+			den := time.Duration(binary.BigEndian.Uint16(chunk[22:]))
+			if den == 0 {
+				den = 100
+			}
+			info.Duration += num * time.Second / den
+		case "iCCP":
+			info.ColorProfile = pngICCProfile(chunk)
+		case "sRGB":
+			if info.ColorProfile == "" {
+				info.ColorProfile = "sRGB"
+			}
+		case "eXIf":
+			info.EXIF = parseEXIF(chunk)
+		case "IDAT":
+			// eXIf may come after the image data, but almost never does
+			if !animated {
+				return info, nil
+			}
+		case "IEND":
+			rest = nil
+		}
+	}
+
+	if info.Width == 0 {
+		return nil, ErrTruncated
+	}
+
+	if animated {
+		info.Mime = "image/apng"
+	}
+
+	return info, nil
+}
+
+// maxICCProfile limits how much of a compressed ICC profile is inflated.
+const maxICCProfile = 1 << 20
+
+// pngICCProfile returns the description of the profile in an iCCP chunk.
+func pngICCProfile(chunk []byte) string {
+	i := bytes.IndexByte(chunk, 0)
+	if i < 0 || len(chunk) < i+2 {
+		return ""
+	}
+
+	// the profile name is followed by a compression method, always zlib
+	zr, err := zlib.NewReader(bytes.NewReader(chunk[i+2:]))
+	if err != nil {
+		return ""
+	}
+	defer zr.Close()
+
+	profile, err := ioutil.ReadAll(io.LimitReader(zr, maxICCProfile))
+	if err != nil {
+		return ""
+	}
+
+	if desc := iccDescription(profile); desc != "" {
+		return desc
+	}
+
+	return string(chunk[:i])
+}
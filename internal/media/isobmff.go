@@ -0,0 +1,191 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+)
+
+// isobmffDecoder reads files in the ISO base media file format: MP4 videos
+// and AVIF images.
+type isobmffDecoder struct{}
+
+func (isobmffDecoder) Match(data []byte) bool {
+	return len(data) >= 12 && bytes.Equal(data[4:8], []byte("ftyp"))
+}
+
+// eachBox calls fn with the type and body of every box in data.
+func eachBox(data []byte, fn func(typ string, body []byte)) error {
+	for len(data) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(data))
+		typ := string(data[4:8])
+		hdr := uint64(8)
+
+		switch size {
+		case 0: // box extends to the end of the data
+			size = uint64(len(data))
+		case 1: // 64 bit size follows the type
+			if len(data) < 16 {
+				return ErrTruncated
+			}
+			size = binary.BigEndian.Uint64(data[8:])
+			hdr = 16
+		}
+
+		if size < hdr || size > uint64(len(data)) {
+			return ErrTruncated
+		}
+
+		fn(typ, data[hdr:size])
+		data = data[size:]
+	}
+
+	return nil
+}
+
+// findBox returns the body of the first box at the end of path.
+func findBox(data []byte, path ...string) []byte {
+	var found []byte
+	eachBox(data, func(typ string, body []byte) {
+		if found != nil || typ != path[0] {
+			return
+		}
+
+		if typ == "meta" {
+			// meta is a full box, skip version and flags
+			if len(body) < 4 {
+				return
+			}
+			body = body[4:]
+		}
+
+		if len(path) == 1 {
+			found = body
+			return
+		}
+
+		found = findBox(body, path[1:]...)
+	})
+
+	return found
+}
+
+var mp4Brands = map[string]bool{
+	"isom": true, "iso2": true, "iso4": true, "iso5": true, "iso6": true,
+	"mp41": true, "mp42": true, "avc1": true, "dash": true, "M4V ": true,
+}
+
+func (isobmffDecoder) Decode(data []byte) (*Info, error) {
+	ftyp := findBox(data, "ftyp")
+	if len(ftyp) < 8 {
+		return nil, ErrTruncated
+	}
+
+	brands := []string{string(ftyp[:4])}
+	for b := ftyp[8:]; len(b) >= 4; b = b[4:] {
+		brands = append(brands, string(b[:4]))
+	}
+
+	var avif, mp4 bool
+	for _, b := range brands {
+		switch {
+		case b == "avif" || b == "avis":
+			avif = true
+		case mp4Brands[b]:
+			mp4 = true
+		}
+	}
+
+	var info *Info
+	switch {
+	case avif:
+		info = &Info{Mime: "image/avif", Ext: ".avif"}
+		decodeAVIF(data, info)
+	case mp4:
+		info = &Info{Mime: "video/mp4", Ext: ".mp4"}
+		decodeMP4Tracks(data, info)
+	default:
+		return nil, ErrUnknownFormat
+	}
+
+	info.Duration = mp4Duration(data)
+
+	if info.Width == 0 {
+		return nil, ErrTruncated
+	}
+
+	return info, nil
+}
+
+// decodeAVIF uses the largest image spatial extents property as the size.
+func decodeAVIF(data []byte, info *Info) {
+	ipco := findBox(data, "meta", "iprp", "ipco")
+	eachBox(ipco, func(typ string, body []byte) {
+		if typ != "ispe" || len(body) < 12 {
+			return
+		}
+
+		w := int(binary.BigEndian.Uint32(body[4:]))
+		h := int(binary.BigEndian.Uint32(body[8:]))
+		if w*h > info.Width*info.Height {
+			info.Width, info.Height = w, h
+		}
+	})
+}
+
+// decodeMP4Tracks uses the size of the first track with one as the size.
+func decodeMP4Tracks(data []byte, info *Info) {
+	moov := findBox(data, "moov")
+	eachBox(moov, func(typ string, body []byte) {
+		if typ != "trak" || info.Width != 0 {
+			return
+		}
+
+		tkhd := findBox(body, "tkhd")
+		if len(tkhd) < 4 {
+			return
+		}
+
+		// width and height are 16.16 fixed point numbers at the end
+		off := 76
+		if tkhd[0] == 1 {
+			off = 88
+		}
+		if len(tkhd) < off+8 {
+			return
+		}
+
+		info.Width = int(binary.BigEndian.Uint32(tkhd[off:]) >> 16)
+		info.Height = int(binary.BigEndian.Uint32(tkhd[off+4:]) >> 16)
+	})
+}
+
+// mp4Duration reads the duration from the movie header, if there is one.
+func mp4Duration(data []byte) time.Duration {
+	mvhd := findBox(data, "moov", "mvhd")
+	if len(mvhd) < 4 {
+		return 0
+	}
+
+	var scale, dur uint64
+	switch mvhd[0] {
+	case 0:
+		if len(mvhd) < 20 {
+			return 0
+		}
+		scale = uint64(binary.BigEndian.Uint32(mvhd[12:]))
+		dur = uint64(binary.BigEndian.Uint32(mvhd[16:]))
+	case 1:
+		if len(mvhd) < 32 {
+			return 0
+		}
+		scale = uint64(binary.BigEndian.Uint32(mvhd[20:]))
+		dur = binary.BigEndian.Uint64(mvhd[24:])
+	}
+
+	if scale == 0 {
+		return 0
+	}
+
+	return time.Duration(float64(dur) / float64(scale) * float64(time.Second))
+}
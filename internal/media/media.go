@@ -0,0 +1,76 @@
+// Package media detects the format of archived files and extracts basic
+// information about them without decoding every pixel.
+package media
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownFormat = errors.New("media: unknown format")
+	ErrTruncated     = errors.New("media: data is truncated or corrupt")
+)
+
+// Info is what a Decoder found out about some data.
+type Info struct {
+	Mime     string
+	Ext      string
+	Width    int
+	Height   int
+	Frames   int           // 0 if unknown or not animated
+	Duration time.Duration // 0 for still images
+
+	ColorProfile string // description of the embedded colour profile
+	EXIF         *EXIF  // nil if the file has no EXIF data
+}
+
+// Video returns true if the data should be shown with a video player.
+func (i Info) Video() bool {
+	return strings.HasPrefix(i.Mime, "video/")
+}
+
+// Decoder recognizes one format by its magic bytes and reads its metadata.
+type Decoder interface {
+	Match(data []byte) bool
+	Decode(data []byte) (*Info, error)
+}
+
+var (
+	decodersLock sync.RWMutex
+	decoders     []Decoder
+)
+
+// Register adds a decoder. Decoders are tried in the order they were
+// registered.
+func Register(d Decoder) {
+	decodersLock.Lock()
+	defer decodersLock.Unlock()
+
+	decoders = append(decoders, d)
+}
+
+// Detect finds the decoder for data and returns what it found.
+func Detect(data []byte) (*Info, error) {
+	decodersLock.RLock()
+	defer decodersLock.RUnlock()
+
+	for _, d := range decoders {
+		if d.Match(data) {
+			return d.Decode(data)
+		}
+	}
+
+	return nil, ErrUnknownFormat
+}
+
+func init() {
+	Register(pngDecoder{})
+	Register(jpegDecoder{})
+	Register(gifDecoder{})
+	Register(webpDecoder{})
+	Register(isobmffDecoder{})
+	Register(webmDecoder{})
+}
@@ -0,0 +1,518 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func u16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func le32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
+
+func le24b(v int) []byte {
+	return []byte{byte(v), byte(v >> 8), byte(v >> 16)}
+}
+
+func cat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func pngChunk(typ string, data []byte) []byte {
+	crc := crc32.ChecksumIEEE(append([]byte(typ), data...))
+	return cat(u32(uint32(len(data))), []byte(typ), data, u32(crc))
+}
+
+func riffChunk(fourcc string, data []byte) []byte {
+	c := cat([]byte(fourcc), le32(uint32(len(data))), data)
+	if len(data)%2 == 1 {
+		c = append(c, 0)
+	}
+	return c
+}
+
+func box(typ string, parts ...[]byte) []byte {
+	body := cat(parts...)
+	return cat(u32(uint32(8+len(body))), []byte(typ), body)
+}
+
+func ebml(id []byte, parts ...[]byte) []byte {
+	body := cat(parts...)
+	// 8 byte size vint
+	size := make([]byte, 8)
+	binary.BigEndian.PutUint64(size, uint64(len(body)))
+	size[0] = 0x01
+	return cat(id, size, body)
+}
+
+func jpegSegment(marker byte, body []byte) []byte {
+	return cat([]byte{0xff, marker}, u16(uint16(len(body)+2)), body)
+}
+
+// testEXIF is a big endian TIFF structure with a camera make, an
+// orientation and a GPS IFD.
+func testEXIF() []byte {
+	return cat(
+		[]byte("MM\x00\x2a"), u32(8),
+		// IFD0 at 8, 3 entries, strings start at 50
+		u16(3),
+		u16(tagMake), u16(2), u32(6), u32(50),
+		u16(tagOrientation), u16(3), u32(1), u16(6), u16(0),
+		u16(tagGPSIFD), u16(4), u32(1), u32(56),
+		u32(0),
+		[]byte("Canon\x00"),
+		// GPS IFD at 56 with the version tag
+		u16(1),
+		u16(0), u16(1), u32(4), []byte{2, 2, 0, 0},
+		u32(0),
+	)
+}
+
+// testICC is an ICC profile with only a description tag.
+func testICC() []byte {
+	desc := cat([]byte("desc"), u32(0), u32(11), []byte("Display P3\x00"))
+	return cat(make([]byte, 128), u32(1), []byte("desc"), u32(144), u32(uint32(len(desc))), desc)
+}
+
+var wantEXIF = &EXIF{Make: "Canon", Orientation: 6, GPS: true}
+
+func encode(t *testing.T, fn func(*bytes.Buffer, image.Image) error) []byte {
+	var buf bytes.Buffer
+	if err := fn(&buf, image.NewRGBA(image.Rect(0, 0, 12, 34))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDetect(t *testing.T) {
+	pngData := encode(t, func(b *bytes.Buffer, i image.Image) error { return png.Encode(b, i) })
+
+	// turn the png into a two frame apng by putting animation chunks before
+	// the image data
+	ihdrEnd := len(pngMagic) + 12 + 13
+	fctl := cat(u32(0), u32(12), u32(34), u32(0), u32(0), u16(1), u16(4), []byte{0, 0})
+	apngData := cat(
+		pngData[:ihdrEnd],
+		pngChunk("acTL", cat(u32(2), u32(0))),
+		pngChunk("fcTL", fctl),
+		pngChunk("fcTL", fctl),
+		pngData[ihdrEnd:],
+	)
+
+	webpAnim := cat([]byte("RIFF"), le32(0), []byte("WEBP"),
+		riffChunk("VP8X", cat([]byte{0x02, 0, 0, 0}, le24b(99), le24b(199))),
+		riffChunk("ANIM", make([]byte, 6)),
+		riffChunk("ANMF", cat(make([]byte, 12), le24b(250), []byte{0})),
+		riffChunk("ANMF", cat(make([]byte, 12), le24b(250), []byte{0})),
+	)
+
+	webpLossless := cat([]byte("RIFF"), le32(0), []byte("WEBP"),
+		riffChunk("VP8L", cat([]byte{0x2f}, le32(uint32(63)|uint32(31)<<14), []byte{0})),
+	)
+
+	tkhd := cat([]byte{0, 0, 0, 0}, make([]byte, 72), u32(640<<16), u32(480<<16))
+	mp4Data := cat(
+		box("ftyp", []byte("isom"), u32(512), []byte("isomiso2mp41")),
+		box("moov",
+			box("mvhd", []byte{0, 0, 0, 0}, u32(0), u32(0), u32(1000), u32(2500)),
+			box("trak", box("tkhd", tkhd)),
+		),
+	)
+
+	avifData := cat(
+		box("ftyp", []byte("avif"), u32(0), []byte("mif1miaf")),
+		box("meta", u32(0),
+			box("hdlr", make([]byte, 24)),
+			box("iprp", box("ipco", box("ispe", u32(0), u32(1920), u32(1080)))),
+		),
+	)
+
+	dur := make([]byte, 8)
+	binary.BigEndian.PutUint64(dur, math.Float64bits(1500))
+	webmData := cat(
+		ebml([]byte{0x1a, 0x45, 0xdf, 0xa3}, ebml([]byte{0x42, 0x82}, []byte("webm"))),
+		ebml([]byte{0x18, 0x53, 0x80, 0x67},
+			ebml([]byte{0x15, 0x49, 0xa9, 0x66},
+				ebml([]byte{0x2a, 0xd7, 0xb1}, []byte{0x0f, 0x42, 0x40}),
+				ebml([]byte{0x44, 0x89}, dur),
+			),
+			ebml([]byte{0x16, 0x54, 0xae, 0x6b},
+				ebml([]byte{0xae},
+					ebml([]byte{0x83}, []byte{1}),
+					ebml([]byte{0xe0},
+						ebml([]byte{0xb0}, u16(320)),
+						ebml([]byte{0xba}, u16(240)),
+					),
+				),
+			),
+			ebml([]byte{0x1f, 0x43, 0xb6, 0x75}, make([]byte, 16)),
+		),
+	)
+
+	jpegData := encode(t, func(b *bytes.Buffer, i image.Image) error { return jpeg.Encode(b, i, nil) })
+	jpegMeta := cat(
+		jpegData[:2],
+		jpegSegment(jpegAPP1, cat(exifHeader, testEXIF())),
+		jpegSegment(jpegAPP2, cat(iccHeader, []byte{1, 1}, testICC())),
+		jpegData[2:],
+	)
+
+	pngMeta := cat(
+		pngData[:ihdrEnd],
+		pngChunk("sRGB", []byte{0}),
+		pngChunk("eXIf", testEXIF()),
+		pngChunk("tEXt", []byte("Comment\x00hello")),
+		pngData[ihdrEnd:],
+	)
+
+	var gifAnim bytes.Buffer
+	frame := image.NewPaletted(image.Rect(0, 0, 12, 34), []color.Color{color.Black, color.White})
+	err := gif.EncodeAll(&gifAnim, &gif.GIF{
+		Image: []*image.Paletted{frame, frame, frame},
+		Delay: []int{10, 20, 30},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		data []byte
+		want Info
+	}{
+		{"png", pngData, Info{Mime: "image/png", Ext: ".png", Width: 12, Height: 34}},
+		{"apng", apngData, Info{Mime: "image/apng", Ext: ".png", Width: 12, Height: 34, Frames: 2, Duration: 500 * time.Millisecond}},
+		{"jpeg", encode(t, func(b *bytes.Buffer, i image.Image) error { return jpeg.Encode(b, i, nil) }), Info{Mime: "image/jpeg", Ext: ".jpg", Width: 12, Height: 34}},
+		{"jpeg with metadata", jpegMeta, Info{Mime: "image/jpeg", Ext: ".jpg", Width: 12, Height: 34, ColorProfile: "Display P3", EXIF: wantEXIF}},
+		{"png with metadata", pngMeta, Info{Mime: "image/png", Ext: ".png", Width: 12, Height: 34, ColorProfile: "sRGB", EXIF: wantEXIF}},
+		{"animated gif", gifAnim.Bytes(), Info{Mime: "image/gif", Ext: ".gif", Width: 12, Height: 34, Frames: 3, Duration: 600 * time.Millisecond}},
+		{"gif", encode(t, func(b *bytes.Buffer, i image.Image) error { return gif.Encode(b, i, nil) }), Info{Mime: "image/gif", Ext: ".gif", Width: 12, Height: 34}},
+		{"animated webp", webpAnim, Info{Mime: "image/webp", Ext: ".webp", Width: 100, Height: 200, Frames: 2, Duration: 500 * time.Millisecond}},
+		{"lossless webp", webpLossless, Info{Mime: "image/webp", Ext: ".webp", Width: 64, Height: 32}},
+		{"mp4", mp4Data, Info{Mime: "video/mp4", Ext: ".mp4", Width: 640, Height: 480, Duration: 2500 * time.Millisecond}},
+		{"avif", avifData, Info{Mime: "image/avif", Ext: ".avif", Width: 1920, Height: 1080}},
+		{"webm", webmData, Info{Mime: "video/webm", Ext: ".webm", Width: 320, Height: 240, Duration: 1500 * time.Millisecond}},
+	}
+
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			info, err := Detect(cs.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(*info, cs.want) {
+				t.Fatalf("wanted %+v, got: %+v", cs.want, *info)
+			}
+		})
+	}
+
+	t.Run("unknown", func(t *testing.T) {
+		if _, err := Detect([]byte("<html></html>")); err != ErrUnknownFormat {
+			t.Fatalf("wanted ErrUnknownFormat, got: %v", err)
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		for _, cs := range cases {
+			if _, err := Detect(cs.data[:16]); err == nil {
+				t.Errorf("%s: wanted an error for truncated data", cs.name)
+			}
+		}
+	})
+}
+
+func TestStrip(t *testing.T) {
+	jpegData := encode(t, func(b *bytes.Buffer, i image.Image) error { return jpeg.Encode(b, i, nil) })
+	pngData := encode(t, func(b *bytes.Buffer, i image.Image) error { return png.Encode(b, i) })
+	ihdrEnd := len(pngMagic) + 12 + 13
+
+	webpData := cat([]byte("RIFF"), le32(0), []byte("WEBP"),
+		riffChunk("VP8X", cat([]byte{vp8xEXIF, 0, 0, 0}, le24b(63), le24b(31))),
+		riffChunk("VP8L", cat([]byte{0x2f}, le32(uint32(63)|uint32(31)<<14), []byte{0})),
+		riffChunk("EXIF", testEXIF()),
+	)
+
+	cases := []struct {
+		name string
+		data []byte
+	}{
+		{"jpeg", cat(
+			jpegData[:2],
+			jpegSegment(jpegAPP1, cat(exifHeader, testEXIF())),
+			jpegSegment(jpegAPP2, cat(iccHeader, []byte{1, 1}, testICC())),
+			jpegData[2:],
+		)},
+		{"png", cat(
+			pngData[:ihdrEnd],
+			pngChunk("eXIf", testEXIF()),
+			pngChunk("tEXt", []byte("Comment\x00hello")),
+			pngData[ihdrEnd:],
+		)},
+		{"webp", webpData},
+	}
+
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			before, err := Detect(cs.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if before.EXIF == nil {
+				t.Fatal("test data has no EXIF")
+			}
+
+			stripped, err := Strip(cs.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			after, err := Detect(stripped)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if after.EXIF != nil {
+				t.Fatalf("EXIF was not stripped: %+v", after.EXIF)
+			}
+
+			if after.Width != before.Width || after.Height != before.Height || after.ColorProfile != before.ColorProfile {
+				t.Fatalf("wanted %+v without EXIF, got: %+v", before, after)
+			}
+		})
+	}
+
+	// formats without EXIF that Detect reads, but that can carry metadata
+	// elsewhere
+	const secret = "+37.7749-122.4194/"
+
+	var gifData bytes.Buffer
+	frame := image.NewPaletted(image.Rect(0, 0, 12, 34), []color.Color{color.Black, color.White})
+	err := gif.EncodeAll(&gifData, &gif.GIF{Image: []*image.Paletted{frame, frame}, Delay: []int{10, 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gifMeta := gifData.Bytes()
+	gifMeta = cat(
+		gifMeta[:len(gifMeta)-1],
+		[]byte{0x21, 0xfe, byte(len(secret))}, []byte(secret), []byte{0},
+		[]byte{0x21, 0xff, 11}, []byte("XMP DataXMP"), []byte{byte(len(secret))}, []byte(secret), []byte{0},
+		[]byte{0x3b},
+	)
+
+	tkhd := cat([]byte{0, 0, 0, 0}, make([]byte, 72), u32(640<<16), u32(480<<16))
+	mp4Data := cat(
+		box("ftyp", []byte("isom"), u32(512), []byte("isomiso2mp41")),
+		box("moov",
+			box("mvhd", []byte{0, 0, 0, 0}, u32(0), u32(0), u32(1000), u32(2500)),
+			box("trak", box("tkhd", tkhd), box("udta", box("\xa9xyz", []byte(secret)))),
+			box("udta", box("\xa9xyz", []byte(secret))),
+		),
+		box("uuid", xmpUUID, []byte(secret)),
+		box("mdat", make([]byte, 16)),
+	)
+
+	avifFtyp := box("ftyp", []byte("avif"), u32(0), []byte("mif1miaf"))
+	avifMeta := func(exifAt uint32) []byte {
+		return box("meta", u32(0),
+			box("hdlr", make([]byte, 24)),
+			box("iinf", u32(0), u16(2),
+				box("infe", []byte{2, 0, 0, 0}, u16(1), u16(0), []byte("av01\x00")),
+				box("infe", []byte{2, 0, 0, 0}, u16(2), u16(0), []byte("Exif\x00")),
+			),
+			box("iloc", u32(0), []byte{0x44, 0}, u16(1), u16(2), u16(0), u16(1), u32(exifAt), u32(uint32(len(secret)))),
+			box("iprp", box("ipco", box("ispe", u32(0), u32(1920), u32(1080)))),
+		)
+	}
+	exifAt := uint32(len(avifFtyp) + len(avifMeta(0)) + 8)
+	avifData := cat(avifFtyp, avifMeta(exifAt), box("mdat", []byte(secret)))
+
+	webmData := cat(
+		ebml([]byte{0x1a, 0x45, 0xdf, 0xa3}, ebml([]byte{0x42, 0x82}, []byte("webm"))),
+		ebml([]byte{0x18, 0x53, 0x80, 0x67},
+			ebml([]byte{0x16, 0x54, 0xae, 0x6b},
+				ebml([]byte{0xae},
+					ebml([]byte{0xe0},
+						ebml([]byte{0xb0}, u16(320)),
+						ebml([]byte{0xba}, u16(240)),
+					),
+				),
+			),
+			ebml([]byte{0x12, 0x54, 0xc3, 0x67}, ebml([]byte{0x73, 0x73}, []byte(secret))),
+			ebml([]byte{0x1f, 0x43, 0xb6, 0x75}, make([]byte, 16)),
+		),
+	)
+
+	containers := []struct {
+		name string
+		data []byte
+		keep string // something Strip must leave alone
+	}{
+		{"gif", gifMeta, "NETSCAPE2.0"},
+		{"mp4", mp4Data, "mdat"},
+		{"avif", avifData, "ispe"},
+		{"webm", webmData, "webm"},
+	}
+
+	for _, cs := range containers {
+		t.Run(cs.name, func(t *testing.T) {
+			before, err := Detect(cs.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			stripped, err := Strip(cs.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if bytes.Contains(stripped, []byte(secret)) {
+				t.Fatal("metadata was not stripped")
+			}
+			if !bytes.Contains(stripped, []byte(cs.keep)) {
+				t.Fatalf("%q was stripped too", cs.keep)
+			}
+			if cs.name != "gif" && len(stripped) != len(cs.data) {
+				t.Fatalf("stripping moved data: %d bytes became %d", len(cs.data), len(stripped))
+			}
+
+			after, err := Detect(stripped)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(after, before) {
+				t.Fatalf("wanted %+v without metadata, got: %+v", before, after)
+			}
+		})
+	}
+
+	t.Run("gif still decodes", func(t *testing.T) {
+		stripped, err := Strip(gifMeta)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		g, err := gif.DecodeAll(bytes.NewReader(stripped))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(g.Image) != 2 {
+			t.Fatalf("wanted 2 frames, got: %d", len(g.Image))
+		}
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		if _, err := Strip([]byte("<html></html>")); err != ErrUnknownFormat {
+			t.Fatalf("wanted ErrUnknownFormat, got: %v", err)
+		}
+	})
+
+	t.Run("jpeg still decodes", func(t *testing.T) {
+		stripped, err := Strip(cases[0].data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := jpeg.Decode(bytes.NewReader(stripped)); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("webp flags", func(t *testing.T) {
+		stripped, err := Strip(webpData)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if flags := stripped[20]; flags&vp8xEXIF != 0 {
+			t.Fatalf("EXIF flag still set: %x", flags)
+		}
+
+		if size := binary.LittleEndian.Uint32(stripped[4:]); int(size) != len(stripped)-8 {
+			t.Fatalf("wanted RIFF size %d, got: %d", len(stripped)-8, size)
+		}
+	})
+}
+
+func TestDHash(t *testing.T) {
+	// a blob of light on a dark background, w pixels wide and tall
+	picture := func(w int, cx, cy float64) image.Image {
+		img := image.NewRGBA(image.Rect(0, 0, w, w))
+		for y := 0; y < w; y++ {
+			for x := 0; x < w; x++ {
+				dx, dy := float64(x)/float64(w)-cx, float64(y)/float64(w)-cy
+				v := uint8(255 * math.Exp(-8*(dx*dx+dy*dy)))
+				img.Set(x, y, color.RGBA{v, v / 2, 255 - v, 255})
+			}
+		}
+		return img
+	}
+	encode := func(img image.Image, jpg bool) []byte {
+		var buf bytes.Buffer
+		var err error
+		if jpg {
+			err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 40})
+		} else {
+			err = png.Encode(&buf, img)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	hash := func(data []byte) uint64 {
+		h, err := DHash(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	original := hash(encode(picture(128, 0.3, 0.4), false))
+
+	cases := []struct {
+		name    string
+		data    []byte
+		similar bool
+	}{
+		{"same", encode(picture(128, 0.3, 0.4), false), true},
+		{"recompressed", encode(picture(128, 0.3, 0.4), true), true},
+		{"resized", encode(picture(300, 0.3, 0.4), true), true},
+		{"different", encode(picture(128, 0.8, 0.7), false), false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			d := Distance(original, hash(c.data))
+			if similar := d <= 10; similar != c.similar {
+				t.Errorf("distance = %d, want similar = %v", d, c.similar)
+			}
+		})
+	}
+
+	if _, err := DHash([]byte("not an image")); err != ErrUnknownFormat {
+		t.Errorf("DHash of text = %v, want ErrUnknownFormat", err)
+	}
+}
@@ -0,0 +1,524 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+)
+
+// Strip returns a copy of data without EXIF, XMP and text metadata, so
+// camera details and locations aren't passed on. Colour profiles are kept.
+// Formats Strip doesn't know about could carry anything, so they fail with
+// ErrUnknownFormat instead of being passed on as is.
+func Strip(data []byte) ([]byte, error) {
+	switch {
+	case jpegStd.Match(data):
+		return stripJPEG(data)
+	case (pngDecoder{}).Match(data):
+		return stripPNG(data)
+	case (webpDecoder{}).Match(data):
+		return stripWebP(data)
+	case (gifDecoder{}).Match(data):
+		return stripGIF(data)
+	case (isobmffDecoder{}).Match(data):
+		return stripISOBMFF(data)
+	case (webmDecoder{}).Match(data):
+		return stripWebM(data)
+	}
+
+	return nil, ErrUnknownFormat
+}
+
+func stripJPEG(data []byte) ([]byte, error) {
+	out := make([]byte, 2, len(data))
+	copy(out, data)
+
+	end, err := eachJPEGSegment(data, func(marker byte, seg []byte) bool {
+		switch marker {
+		case jpegAPP1, jpegAPP13: // EXIF and XMP, Photoshop and IPTC
+			return true
+		}
+
+		out = append(out, seg...)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// everything after the start of scan segment is image data
+	return append(out, data[end:]...), nil
+}
+
+// pngMetadataChunks are the PNG chunks Strip removes.
+var pngMetadataChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"tIME": true,
+}
+
+func stripPNG(data []byte) ([]byte, error) {
+	out := make([]byte, len(pngMagic), len(data))
+	copy(out, pngMagic)
+
+	rest := data[len(pngMagic):]
+	for len(rest) >= 12 {
+		length := binary.BigEndian.Uint32(rest)
+		if uint64(len(rest)) < 12+uint64(length) {
+			return nil, ErrTruncated
+		}
+		chunk := rest[:12+length]
+		rest = rest[12+length:]
+
+		if !pngMetadataChunks[string(chunk[4:8])] {
+			out = append(out, chunk...)
+		}
+	}
+
+	return append(out, rest...), nil
+}
+
+// VP8X flags for metadata chunks.
+const (
+	vp8xEXIF = 0x08
+	vp8xXMP  = 0x04
+)
+
+func stripWebP(data []byte) ([]byte, error) {
+	out := make([]byte, 12, len(data))
+	copy(out, data)
+
+	rest := data[12:]
+	for len(rest) >= 8 {
+		fourcc := string(rest[:4])
+		size := uint64(binary.LittleEndian.Uint32(rest[4:]))
+		next := 8 + size + size&1
+		if uint64(len(rest)) < 8+size {
+			return nil, ErrTruncated
+		}
+		if next > uint64(len(rest)) {
+			next = uint64(len(rest))
+		}
+		chunk := rest[:next]
+		rest = rest[next:]
+
+		switch fourcc {
+		case "EXIF", "XMP ":
+			continue
+		case "VP8X":
+			if len(chunk) < 9 {
+				return nil, ErrTruncated
+			}
+			chunk = append([]byte(nil), chunk...)
+			chunk[8] &^= vp8xEXIF | vp8xXMP
+		}
+
+		out = append(out, chunk...)
+	}
+	out = append(out, rest...)
+
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+
+	return out, nil
+}
+
+// gifKeptApplications are the GIF application extensions Strip keeps: loop
+// counts and colour profiles. Anything else, like XMP, is removed.
+var gifKeptApplications = map[string]bool{
+	"NETSCAPE2.0": true,
+	"ANIMEXTS1.0": true,
+	"ICCRGBG1012": true,
+}
+
+func stripGIF(data []byte) ([]byte, error) {
+	if len(data) < 13 {
+		return nil, ErrTruncated
+	}
+
+	rest := data[13:]
+	if flags := data[10]; flags&0x80 != 0 {
+		rest = skip(rest, 3<<(flags&7+1))
+	}
+
+	out := make([]byte, len(data)-len(rest), len(data))
+	copy(out, data)
+
+	for len(rest) > 0 {
+		var next []byte
+		var err error
+		keep := true
+
+		switch rest[0] {
+		case 0x21: // extension
+			if len(rest) < 2 {
+				return nil, ErrTruncated
+			}
+			switch rest[1] {
+			case 0xfe: // comment
+				keep = false
+			case 0xff: // application, named by the first sub-block
+				keep = len(rest) >= 14 && rest[2] == 11 && gifKeptApplications[string(rest[3:14])]
+			}
+			next, err = skipSubBlocks(rest[2:])
+		case 0x2c: // image descriptor
+			if len(rest) < 11 {
+				return nil, ErrTruncated
+			}
+			flags := rest[9]
+			next = rest[10:]
+			if flags&0x80 != 0 {
+				next = skip(next, 3<<(flags&7+1))
+			}
+			if len(next) < 1 {
+				return nil, ErrTruncated
+			}
+			next, err = skipSubBlocks(next[1:])
+		case 0x3b: // trailer
+			return append(out, rest...), nil
+		default:
+			return nil, ErrTruncated
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if keep {
+			out = append(out, rest[:len(rest)-len(next)]...)
+		}
+		rest = next
+	}
+
+	return out, nil
+}
+
+// xmpUUID is the type of the uuid box XMP is stored in.
+var xmpUUID = []byte{0xbe, 0x7a, 0xcf, 0xcb, 0x97, 0xa9, 0x42, 0xe8, 0x9c, 0x71, 0x99, 0x94, 0x91, 0xe3, 0xaf, 0xac}
+
+// stripISOBMFF removes the user data and metadata boxes of MP4 videos, where
+// phones put locations (as ©xyz) and camera details, and the Exif and XMP
+// items of AVIF images. Chunk offsets in MP4s and item locations in AVIFs
+// point into the file, so nothing is moved: boxes are turned into free boxes
+// and items are overwritten with zeros.
+func stripISOBMFF(data []byte) ([]byte, error) {
+	info, err := (isobmffDecoder{}).Decode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	out := append([]byte(nil), data...)
+	avif := info.Mime == "image/avif"
+
+	err = freeBoxes(out, func(path, typ string, body []byte) bool {
+		switch {
+		case typ == "uuid":
+			return bytes.HasPrefix(body, xmpUUID)
+		case typ == "udta":
+			return true
+		case typ == "meta":
+			// the top level meta box of an AVIF holds the image itself
+			return !(avif && path == "")
+		}
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if avif {
+		err = zeroAVIFMetadata(out)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
+
+// freeBoxes turns every box remove returns true for into a free box filled
+// with zeros, looking into moov, trak and mdia boxes. path is the types of
+// the boxes around the box, separated by slashes.
+func freeBoxes(data []byte, remove func(path, typ string, body []byte) bool) error {
+	var walk func(path string, data []byte) error
+	walk = func(path string, data []byte) error {
+		for len(data) >= 8 {
+			size := uint64(binary.BigEndian.Uint32(data))
+			typ := string(data[4:8])
+			hdr := uint64(8)
+
+			switch size {
+			case 0:
+				size = uint64(len(data))
+			case 1:
+				if len(data) < 16 {
+					return ErrTruncated
+				}
+				size = binary.BigEndian.Uint64(data[8:])
+				hdr = 16
+			}
+
+			if size < hdr || size > uint64(len(data)) {
+				return ErrTruncated
+			}
+			body := data[hdr:size]
+
+			switch {
+			case remove(path, typ, body):
+				copy(data[4:8], "free")
+				for n := range body {
+					body[n] = 0
+				}
+			case typ == "moov" || typ == "trak" || typ == "mdia":
+				if err := walk(strings.TrimPrefix(path+"/"+typ, "/"), body); err != nil {
+					return err
+				}
+			}
+
+			data = data[size:]
+		}
+
+		return nil
+	}
+
+	return walk("", data)
+}
+
+// avifMetadataItem returns true for the types of items that are metadata
+// about an AVIF image rather than a part of it.
+func avifMetadataItem(typ, contentType string) bool {
+	return typ == "Exif" || (typ == "mime" && strings.HasPrefix(contentType, "application/rdf+xml"))
+}
+
+// zeroAVIFMetadata overwrites the data of the Exif and XMP items of an AVIF.
+func zeroAVIFMetadata(data []byte) error {
+	items := map[uint32]bool{}
+
+	iinf := findBox(data, "meta", "iinf")
+	if len(iinf) < 4 {
+		return nil
+	}
+	entries := skip(iinf, 6)
+	if iinf[0] != 0 {
+		entries = skip(iinf, 8)
+	}
+	eachBox(entries, func(typ string, body []byte) {
+		if typ != "infe" || len(body) < 4 || body[0] < 2 {
+			return
+		}
+
+		var id uint32
+		rest := body[4:]
+		if body[0] == 2 {
+			if len(rest) < 2 {
+				return
+			}
+			id = uint32(binary.BigEndian.Uint16(rest))
+			rest = rest[2:]
+		} else {
+			if len(rest) < 4 {
+				return
+			}
+			id = binary.BigEndian.Uint32(rest)
+			rest = rest[4:]
+		}
+
+		// protection index, then the item type
+		if len(rest) < 6 {
+			return
+		}
+		itemType := string(rest[2:6])
+
+		// the name and, for mime items, the content type are zero terminated
+		var contentType string
+		if fields := bytes.SplitN(rest[6:], []byte{0}, 3); len(fields) >= 2 {
+			contentType = string(fields[1])
+		}
+
+		if avifMetadataItem(itemType, contentType) {
+			items[id] = true
+		}
+	})
+	if len(items) == 0 {
+		return nil
+	}
+
+	idat := findBox(data, "meta", "idat")
+	return eachItemExtent(findBox(data, "meta", "iloc"), func(id uint32, method int, off, length uint64) error {
+		if !items[id] {
+			return nil
+		}
+
+		target := data
+		switch method {
+		case 0: // file offset
+		case 1: // offset into idat
+			target = idat
+		default:
+			return nil
+		}
+		if off > uint64(len(target)) || length > uint64(len(target))-off {
+			return ErrTruncated
+		}
+
+		for n := off; n < off+length; n++ {
+			target[n] = 0
+		}
+		return nil
+	})
+}
+
+// eachItemExtent calls fn with every extent of every item in an iloc box.
+func eachItemExtent(iloc []byte, fn func(id uint32, method int, off, length uint64) error) error {
+	if len(iloc) < 6 {
+		return nil
+	}
+
+	version := iloc[0]
+	offSize := int(iloc[4] >> 4)
+	lenSize := int(iloc[4] & 0xf)
+	baseSize := int(iloc[5] >> 4)
+	indexSize := 0
+	if version == 1 || version == 2 {
+		indexSize = int(iloc[5] & 0xf)
+	}
+	r := iloc[6:]
+
+	read := func(size int) (uint64, bool) {
+		if len(r) < size {
+			return 0, false
+		}
+		var v uint64
+		for _, b := range r[:size] {
+			v = v<<8 | uint64(b)
+		}
+		r = r[size:]
+		return v, true
+	}
+
+	idSize := 2
+	if version == 2 {
+		idSize = 4
+	}
+	count, ok := read(idSize)
+	if !ok {
+		return ErrTruncated
+	}
+
+	for ; count > 0; count-- {
+		id, ok := read(idSize)
+		if !ok {
+			return ErrTruncated
+		}
+
+		method := 0
+		if version == 1 || version == 2 {
+			v, ok := read(2)
+			if !ok {
+				return ErrTruncated
+			}
+			method = int(v & 0xf)
+		}
+
+		// data reference index, then the base offset
+		if _, ok := read(2); !ok {
+			return ErrTruncated
+		}
+		base, ok := read(baseSize)
+		if !ok {
+			return ErrTruncated
+		}
+
+		extents, ok := read(2)
+		if !ok {
+			return ErrTruncated
+		}
+		for ; extents > 0; extents-- {
+			if _, ok := read(indexSize); !ok {
+				return ErrTruncated
+			}
+			off, ok := read(offSize)
+			if !ok {
+				return ErrTruncated
+			}
+			length, ok := read(lenSize)
+			if !ok {
+				return ErrTruncated
+			}
+
+			if err := fn(uint32(id), method, base+off, length); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// EBML IDs of the WebM elements Strip removes.
+const (
+	mkvTags = 0x1254c367
+	mkvVoid = 0xec
+)
+
+// stripWebM turns the Tags elements of a WebM, which can hold anything from
+// the title to where it was recorded, into Void elements. Cues point into
+// the file, so nothing is moved.
+func stripWebM(data []byte) ([]byte, error) {
+	out := append([]byte(nil), data...)
+
+	for rest := out; len(rest) > 0; {
+		id, idLen, ok := readVint(rest, true)
+		if !ok {
+			return nil, ErrTruncated
+		}
+		size, sizeLen, ok := readVint(rest[idLen:], false)
+		if !ok {
+			return nil, ErrTruncated
+		}
+		hdr := idLen + sizeLen
+
+		if id == mkvSegment || size == ebmlUnknownLength {
+			// look at the children of the segment, and of clusters that go
+			// on until the next one, instead of skipping them
+			rest = rest[hdr:]
+			continue
+		}
+
+		if size > uint64(len(rest)-hdr) {
+			size = uint64(len(rest) - hdr)
+		}
+		end := hdr + int(size)
+
+		if id == mkvTags {
+			voidElement(rest[:end])
+		}
+		rest = rest[end:]
+	}
+
+	return out, nil
+}
+
+// voidElement overwrites el, a whole EBML element, with a Void element of the
+// same length.
+func voidElement(el []byte) {
+	// the size of the void is written with as many bytes as it takes to fill
+	// the element exactly
+	for sizeLen := 1; sizeLen <= 8; sizeLen++ {
+		body := uint64(len(el) - 1 - sizeLen)
+		if len(el) < 1+sizeLen || body >= 1<<(7*uint(sizeLen))-1 {
+			continue
+		}
+
+		for n := range el {
+			el[n] = 0
+		}
+		el[0] = mkvVoid
+		for n := sizeLen; n > 0; n-- {
+			el[n] = byte(body)
+			body >>= 8
+		}
+		el[1] |= 0x80 >> uint(sizeLen-1)
+		return
+	}
+}
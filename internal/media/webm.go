@@ -0,0 +1,194 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"time"
+)
+
+// EBML element IDs used by webmDecoder.
+const (
+	ebmlHeader        = 0x1a45dfa3
+	ebmlDocType       = 0x4282
+	mkvSegment        = 0x18538067
+	mkvInfo           = 0x1549a966
+	mkvTimecodeScale  = 0x2ad7b1
+	mkvDuration       = 0x4489
+	mkvTracks         = 0x1654ae6b
+	mkvTrackEntry     = 0xae
+	mkvVideo          = 0xe0
+	mkvPixelWidth     = 0xb0
+	mkvPixelHeight    = 0xba
+	mkvCluster        = 0x1f43b675
+	ebmlUnknownLength = math.MaxUint64
+)
+
+// webmDecoder reads WebM videos.
+type webmDecoder struct{}
+
+func (webmDecoder) Match(data []byte) bool {
+	return bytes.HasPrefix(data, []byte{0x1a, 0x45, 0xdf, 0xa3})
+}
+
+// readVint reads an EBML variable length integer. If keepMarker is set, the
+// length marker bit is kept, as it is for element IDs.
+func readVint(data []byte, keepMarker bool) (uint64, int, bool) {
+	if len(data) == 0 || data[0] == 0 {
+		return 0, 0, false
+	}
+
+	n := 1
+	for mask := byte(0x80); data[0]&mask == 0; mask >>= 1 {
+		n++
+	}
+	if n > 8 || len(data) < n {
+		return 0, 0, false
+	}
+
+	v := uint64(data[0])
+	if !keepMarker {
+		v &= uint64(0xff >> uint(n))
+	}
+
+	allOnes := v == uint64(0xff>>uint(n))
+	for _, b := range data[1:n] {
+		v = v<<8 | uint64(b)
+		allOnes = allOnes && b == 0xff
+	}
+
+	if !keepMarker && allOnes {
+		return ebmlUnknownLength, n, true
+	}
+
+	return v, n, true
+}
+
+// eachElement calls fn for every EBML element in data. Elements of unknown
+// length extend to the end of data. fn returns false to stop.
+func eachElement(data []byte, fn func(id uint64, body []byte) bool) error {
+	for len(data) > 0 {
+		id, n, ok := readVint(data, true)
+		if !ok {
+			return ErrTruncated
+		}
+		data = data[n:]
+
+		size, n, ok := readVint(data, false)
+		if !ok {
+			return ErrTruncated
+		}
+		data = data[n:]
+
+		if size == ebmlUnknownLength || size > uint64(len(data)) {
+			// the file may just be cut off, use what is there
+			size = uint64(len(data))
+		}
+
+		if !fn(id, data[:size]) {
+			return nil
+		}
+		data = data[size:]
+	}
+
+	return nil
+}
+
+func ebmlUint(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+func ebmlFloat(b []byte) float64 {
+	switch len(b) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (webmDecoder) Decode(data []byte) (*Info, error) {
+	info := &Info{Mime: "video/webm", Ext: ".webm"}
+
+	var docType string
+	var segment []byte
+	err := eachElement(data, func(id uint64, body []byte) bool {
+		switch id {
+		case ebmlHeader:
+			eachElement(body, func(id uint64, body []byte) bool {
+				if id == ebmlDocType {
+					docType = string(bytes.TrimRight(body, "\x00"))
+				}
+				return true
+			})
+		case mkvSegment:
+			segment = body
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if docType != "webm" {
+		return nil, ErrUnknownFormat
+	}
+
+	scale := uint64(1000000) // nanoseconds per timecode tick
+	var duration float64
+
+	eachElement(segment, func(id uint64, body []byte) bool {
+		switch id {
+		case mkvInfo:
+			eachElement(body, func(id uint64, body []byte) bool {
+				switch id {
+				case mkvTimecodeScale:
+					scale = ebmlUint(body)
+				case mkvDuration:
+					duration = ebmlFloat(body)
+				}
+				return true
+			})
+		case mkvTracks:
+			eachElement(body, func(id uint64, body []byte) bool {
+				if id != mkvTrackEntry {
+					return true
+				}
+				eachElement(body, func(id uint64, body []byte) bool {
+					if id != mkvVideo {
+						return true
+					}
+					eachElement(body, func(id uint64, body []byte) bool {
+						switch id {
+						case mkvPixelWidth:
+							info.Width = int(ebmlUint(body))
+						case mkvPixelHeight:
+							info.Height = int(ebmlUint(body))
+						}
+						return true
+					})
+					return false
+				})
+				return info.Width == 0
+			})
+		case mkvCluster:
+			// media data follows, everything interesting came before it
+			return false
+		}
+		return true
+	})
+
+	if info.Width == 0 {
+		return nil, ErrTruncated
+	}
+
+	info.Duration = time.Duration(duration * float64(scale))
+
+	return info, nil
+}
@@ -0,0 +1,82 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+)
+
+// webpDecoder reads still and animated WebP files. EXIF usually comes after
+// the image data in extended files, so every chunk is looked at.
+type webpDecoder struct{}
+
+func (webpDecoder) Match(data []byte) bool {
+	return len(data) >= 12 && bytes.Equal(data[:4], []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WEBP"))
+}
+
+func le24(b []byte) int {
+	return int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+}
+
+func (webpDecoder) Decode(data []byte) (*Info, error) {
+	info := &Info{Mime: "image/webp", Ext: ".webp"}
+
+	rest := data[12:]
+	for len(rest) >= 8 {
+		fourcc := string(rest[:4])
+		size := binary.LittleEndian.Uint32(rest[4:])
+		if uint64(len(rest)) < 8+uint64(size) {
+			return nil, ErrTruncated
+		}
+		chunk := rest[8 : 8+size]
+
+		// chunks are padded to an even size
+		next := 8 + uint64(size) + uint64(size&1)
+		if next > uint64(len(rest)) {
+			next = uint64(len(rest))
+		}
+		rest = rest[next:]
+
+		switch fourcc {
+		case "VP8X":
+			if len(chunk) < 10 {
+				return nil, ErrTruncated
+			}
+			info.Width = le24(chunk[4:]) + 1
+			info.Height = le24(chunk[7:]) + 1
+		case "VP8 ":
+			if len(chunk) < 10 || !bytes.Equal(chunk[3:6], []byte{0x9d, 0x01, 0x2a}) {
+				return nil, ErrTruncated
+			}
+			if info.Width == 0 {
+				info.Width = int(binary.LittleEndian.Uint16(chunk[6:]) & 0x3fff)
+				info.Height = int(binary.LittleEndian.Uint16(chunk[8:]) & 0x3fff)
+			}
+		case "VP8L":
+			if len(chunk) < 5 || chunk[0] != 0x2f {
+				return nil, ErrTruncated
+			}
+			if info.Width == 0 {
+				b := binary.LittleEndian.Uint32(chunk[1:])
+				info.Width = int(b&0x3fff) + 1
+				info.Height = int((b>>14)&0x3fff) + 1
+			}
+		case "ICCP":
+			info.ColorProfile = iccDescription(chunk)
+		case "EXIF":
+			info.EXIF = parseEXIF(chunk)
+		case "ANMF":
+			if len(chunk) < 16 {
+				return nil, ErrTruncated
+			}
+			info.Frames++
+			info.Duration += time.Duration(le24(chunk[12:])) * time.Millisecond
+		}
+	}
+
+	if info.Width == 0 {
+		return nil, ErrTruncated
+	}
+
+	return info, nil
+}
@@ -0,0 +1,144 @@
+// Package notify posts archive events to a Discord channel, batched so a
+// burst of failures becomes one message instead of hundreds.
+package notify
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Xe/kinq/internal/events"
+	"within.website/ln"
+)
+
+// maxMessageLen keeps messages under Discord's limit of 2000 characters.
+const maxMessageLen = 1900
+
+// icons are the kinds of events worth telling the log channel about.
+var icons = map[events.Kind]string{
+	events.IngestFailed:   "❌",
+	events.ImageDeleted:   "🗑️",
+	events.ImageDuplicate: "👯",
+	events.BackupDone:     "💾",
+	events.BackupFailed:   "🚨",
+	events.ScraperDown:    "🔥",
+	events.ScraperUp:      "✅",
+	events.FsckProblems:   "🩹",
+}
+
+// Sender posts a message to the log channel.
+type Sender func(ctx context.Context, content string) error
+
+type Config struct {
+	Interval time.Duration // at most one message is sent per interval
+	MaxLines int           // events listed in one message, the rest are only counted
+}
+
+// Notifier collects events and sends what it has every Interval.
+type Notifier struct {
+	cfg  Config
+	send Sender
+
+	mu     sync.Mutex
+	shown  []events.Event
+	counts map[events.Kind]int
+	order  []events.Kind
+}
+
+func New(cfg Config, send Sender) *Notifier {
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Minute
+	}
+
+	return &Notifier{
+		cfg:    cfg,
+		send:   send,
+		counts: map[events.Kind]int{},
+	}
+}
+
+// Add queues an event for the next message, unless it is too common to be
+// worth a mention. It is meant to be subscribed to an events.Bus.
+func (n *Notifier) Add(e events.Event) {
+	if _, ok := icons[e.Kind]; !ok {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.counts[e.Kind] == 0 {
+		n.order = append(n.order, e.Kind)
+	}
+	n.counts[e.Kind]++
+
+	if len(n.shown) < n.cfg.MaxLines {
+		n.shown = append(n.shown, e)
+	}
+}
+
+// Run sends the queued events every Interval until ctx is cancelled.
+func (n *Notifier) Run(ctx context.Context) {
+	t := time.NewTicker(n.cfg.Interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			n.Flush(ctx)
+		}
+	}
+}
+
+// Flush sends the queued events now, if there are any. A batch that can't be
+// sent is dropped rather than retried, so an outage of Discord doesn't make
+// the next message huge.
+func (n *Notifier) Flush(ctx context.Context) {
+	n.mu.Lock()
+	shown, counts, order := n.shown, n.counts, n.order
+	n.shown, n.counts, n.order = nil, map[events.Kind]int{}, nil
+	n.mu.Unlock()
+
+	if len(order) == 0 {
+		return
+	}
+
+	err := n.send(ctx, Format(shown, counts, order))
+	if err != nil {
+		ln.Error(ctx, err, ln.Action("sending notification"), ln.F{"events": len(shown)})
+	}
+}
+
+// Format writes a message listing shown, followed by how many events of
+// each kind there were in total.
+func Format(shown []events.Event, counts map[events.Kind]int, order []events.Kind) string {
+	var sb strings.Builder
+	total := 0
+	for _, k := range order {
+		total += counts[k]
+	}
+
+	listed := 0
+	for _, e := range shown {
+		line := fmt.Sprintf("%s %s\n", icons[e.Kind], e.Summary)
+		if sb.Len()+len(line) > maxMessageLen-200 {
+			break
+		}
+		sb.WriteString(line)
+		listed++
+	}
+
+	if listed < total {
+		var parts []string
+		for _, k := range order {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[k], k))
+		}
+		fmt.Fprintf(&sb, "…and %d more (%s)", total-listed, strings.Join(parts, ", "))
+	}
+
+	return strings.TrimSuffix(sb.String(), "\n")
+}
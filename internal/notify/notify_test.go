@@ -0,0 +1,46 @@
+package notify
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/Xe/kinq/internal/events"
+)
+
+func TestNotifier(t *testing.T) {
+	var sent []string
+	n := New(Config{MaxLines: 2}, func(ctx context.Context, content string) error {
+		sent = append(sent, content)
+		return nil
+	})
+
+	n.Flush(context.Background())
+	if len(sent) != 0 {
+		t.Fatalf("sent a message without events: %q", sent)
+	}
+
+	for i := 0; i < 4; i++ {
+		n.Add(events.Event{Kind: events.IngestFailed, Summary: "failed"})
+	}
+	n.Add(events.Event{Kind: events.BackupDone, Summary: "backed up"})
+	n.Add(events.Event{Kind: events.ImageCreated, Summary: "archived"})
+	n.Flush(context.Background())
+
+	if len(sent) != 1 {
+		t.Fatalf("wanted one message, got: %q", sent)
+	}
+
+	msg := sent[0]
+	if strings.Count(msg, "❌ failed") != 2 {
+		t.Errorf("wanted two listed failures, got: %q", msg)
+	}
+	if !strings.Contains(msg, "…and 3 more (4 ingest.failed, 1 backup.done)") {
+		t.Errorf("wrong summary: %q", msg)
+	}
+
+	n.Flush(context.Background())
+	if len(sent) != 1 {
+		t.Fatalf("events were sent twice: %q", sent)
+	}
+}
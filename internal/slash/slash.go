@@ -0,0 +1,399 @@
+// Package slash answers the /kinq application command in Discord.
+package slash
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Xe/kinq/internal/database"
+	"github.com/Xe/kinq/internal/discord"
+	"github.com/asdine/storm/v2"
+	"github.com/bwmarrin/discordgo"
+	"within.website/ln"
+)
+
+var (
+	ErrNotInGuild = errors.New("slash: commands only work in the archive's guilds")
+	ErrForbidden  = errors.New("slash: you don't have a role allowed to do that")
+)
+
+// embedColor is the colour of the bar beside embeds.
+const embedColor = 0x9b59b6
+
+const (
+	maxResults = 5  // images shown by search
+	maxOrigins = 10 // origins shown by info
+)
+
+// Command is the application command Handler answers.
+var Command = &discord.ApplicationCommand{
+	Name:        "kinq",
+	Description: "search and manage the image archive",
+	Options: []*discord.ApplicationOption{
+		{
+			Type:        discord.OptionSubCommand,
+			Name:        "search",
+			Description: "find images by tag",
+			Options: []*discord.ApplicationOption{
+				{Type: discord.OptionString, Name: "query", Description: "tags to look for", Required: true},
+			},
+		},
+		{
+			Type:        discord.OptionSubCommand,
+			Name:        "tag",
+			Description: "add or remove tags, like +cute -sad",
+			Options: []*discord.ApplicationOption{
+				{Type: discord.OptionString, Name: "id", Description: "image id", Required: true},
+				{Type: discord.OptionString, Name: "tags", Description: "+tag to add, -tag to remove", Required: true},
+			},
+		},
+		{
+			Type:        discord.OptionSubCommand,
+			Name:        "random",
+			Description: "show a random image",
+			Options: []*discord.ApplicationOption{
+				{Type: discord.OptionString, Name: "query", Description: "tags the image must have"},
+			},
+		},
+		{
+			Type:        discord.OptionSubCommand,
+			Name:        "info",
+			Description: "show what is known about an image",
+			Options: []*discord.ApplicationOption{
+				{Type: discord.OptionString, Name: "id", Description: "image id", Required: true},
+			},
+		},
+		{
+			Type:        discord.OptionSubCommand,
+			Name:        "delete",
+			Description: "delete an image from this server",
+			Options: []*discord.ApplicationOption{
+				{Type: discord.OptionString, Name: "id", Description: "image id", Required: true},
+			},
+		},
+	},
+}
+
+// Responder sends the answer to an interaction.
+type Responder func(ctx context.Context, in *discord.Interaction, r *discord.InteractionResponse) error
+
+// Config controls who may use which subcommands and how links are made.
+type Config struct {
+	Guilds      []string // the only guilds commands are answered in
+	SiteURL     string   // where the web UI is, without a trailing slash
+	TagRoles    []string // roles that may tag; if empty, every member may
+	DeleteRoles []string // roles that may delete; if empty, nobody may
+
+	// ImageURL returns a URL Discord can load the image data from without a
+	// session.
+	ImageURL func(id string) string
+}
+
+// Handler answers the /kinq command.
+type Handler struct {
+	cfg     Config
+	i       database.Images
+	o       database.Origins
+	respond Responder
+}
+
+func New(cfg Config, i database.Images, o database.Origins, respond Responder) *Handler {
+	return &Handler{
+		cfg:     cfg,
+		i:       i,
+		o:       o,
+		respond: respond,
+	}
+}
+
+// Handle answers in. Errors that are the user's fault are sent back to them
+// privately; only errors sending the response are returned.
+func (h *Handler) Handle(ctx context.Context, in *discord.Interaction) error {
+	if in.Type == discord.InteractionPing {
+		return h.respond(ctx, in, &discord.InteractionResponse{Type: discord.ResponsePong})
+	}
+
+	if in.Data == nil || in.Data.Name != Command.Name || len(in.Data.Options) == 0 {
+		return nil
+	}
+
+	sub := in.Data.Options[0]
+	f := ln.F{"interaction_id": in.ID, "subcommand": sub.Name, "guild_id": in.GuildID, "channel_id": in.ChannelID}
+	if in.Member != nil && in.Member.User != nil {
+		f["user_id"] = in.Member.User.ID
+	}
+
+	resp, err := h.run(in, sub)
+	if err != nil {
+		ln.Error(ctx, err, f, ln.Action("running slash command"))
+		resp = &discord.ResponseData{
+			Content: err.Error(),
+			Flags:   discord.FlagEphemeral,
+		}
+	} else {
+		ln.Log(ctx, f, ln.Action("ran slash command"))
+	}
+
+	return h.respond(ctx, in, &discord.InteractionResponse{
+		Type: discord.ResponseChannelMessageWithSource,
+		Data: resp,
+	})
+}
+
+func (h *Handler) run(in *discord.Interaction, sub *discord.CommandOption) (*discord.ResponseData, error) {
+	if in.Member == nil || in.GuildID == "" || !contains(h.cfg.Guilds, in.GuildID) {
+		return nil, ErrNotInGuild
+	}
+
+	// answers only show what was archived from the guild asking
+	guilds := []string{in.GuildID}
+
+	arg := func(name string) string {
+		if o := discord.Option(sub.Options, name); o != nil {
+			return strings.TrimSpace(o.String())
+		}
+		return ""
+	}
+
+	switch sub.Name {
+	case "search":
+		return h.search(strings.Fields(arg("query")), guilds)
+	case "tag":
+		if len(h.cfg.TagRoles) > 0 && !discord.HasRole(in.Member, h.cfg.TagRoles) {
+			return nil, ErrForbidden
+		}
+		return h.tag(arg("id"), strings.Fields(arg("tags")), guilds)
+	case "random":
+		return h.random(strings.Fields(arg("query")), guilds)
+	case "info":
+		return h.info(arg("id"), guilds)
+	case "delete":
+		if !discord.HasRole(in.Member, h.cfg.DeleteRoles) {
+			return nil, ErrForbidden
+		}
+		return h.delete(arg("id"), in.GuildID)
+	}
+
+	return nil, fmt.Errorf("slash: unknown subcommand %q", sub.Name)
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// one loads an image that isn't deleted and was archived from one of guilds.
+func (h *Handler) one(id string, guilds []string) (*database.Image, error) {
+	i, err := h.i.One(id)
+	if err == storm.ErrNotFound || (err == nil && (i.Deleted || !i.VisibleTo(guilds))) {
+		return nil, fmt.Errorf("no image with id %q", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return i, nil
+}
+
+func (h *Handler) pageURL(id string) string {
+	return h.cfg.SiteURL + "/images/id/" + id
+}
+
+// embed shows i as a link to its page in the web UI.
+func (h *Handler) embed(i *database.Image) *discordgo.MessageEmbed {
+	e := &discordgo.MessageEmbed{
+		URL:       h.pageURL(i.ID),
+		Title:     i.ID,
+		Timestamp: i.Added.Format(time.RFC3339),
+		Color:     embedColor,
+	}
+
+	if len(i.Tags) > 0 {
+		e.Description = strings.Join(i.Tags, ", ")
+	}
+
+	if h.cfg.ImageURL != nil && !i.IsVideo() {
+		e.Image = &discordgo.MessageEmbedImage{URL: h.cfg.ImageURL(i.ID)}
+	}
+
+	return e
+}
+
+func (h *Handler) search(tags, guilds []string) (*discord.ResponseData, error) {
+	if len(tags) == 0 {
+		return nil, errors.New("search for at least one tag")
+	}
+
+	is, err := h.i.Search(maxResults, 0, tags, guilds)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	if len(is) == 0 {
+		return &discord.ResponseData{
+			Content: "nothing is tagged " + strings.Join(tags, ", "),
+			Flags:   discord.FlagEphemeral,
+		}, nil
+	}
+
+	// results may be anything in the archive, so only whoever asked sees them
+	resp := &discord.ResponseData{
+		Content: fmt.Sprintf("images tagged %s:", strings.Join(tags, ", ")),
+		Flags:   discord.FlagEphemeral,
+	}
+	for n := range is {
+		resp.Embeds = append(resp.Embeds, h.embed(&is[n]))
+	}
+
+	return resp, nil
+}
+
+// ParseTagChanges splits "+a -b c" into tags to add and remove. Tags without
+// a sign are added.
+func ParseTagChanges(words []string) (add, remove []string) {
+	for _, w := range words {
+		switch {
+		case strings.HasPrefix(w, "-"):
+			if t := strings.TrimPrefix(w, "-"); t != "" {
+				remove = append(remove, t)
+			}
+		default:
+			if t := strings.TrimPrefix(w, "+"); t != "" {
+				add = append(add, t)
+			}
+		}
+	}
+
+	return add, remove
+}
+
+func (h *Handler) tag(id string, words, guilds []string) (*discord.ResponseData, error) {
+	if _, err := h.one(id, guilds); err != nil {
+		return nil, err
+	}
+
+	add, remove := ParseTagChanges(words)
+	if len(add) == 0 && len(remove) == 0 {
+		return nil, errors.New("give tags to change, like +cute -sad")
+	}
+
+	if len(add) > 0 {
+		if err := h.i.AddTags(id, add); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(remove) > 0 {
+		if err := h.i.RemoveTags(id, remove); err != nil {
+			return nil, err
+		}
+	}
+
+	i, err := h.one(id, guilds)
+	if err != nil {
+		return nil, err
+	}
+
+	return &discord.ResponseData{
+		Content: "updated tags",
+		Embeds:  []*discordgo.MessageEmbed{h.embed(i)},
+	}, nil
+}
+
+func (h *Handler) random(tags, guilds []string) (*discord.ResponseData, error) {
+	i, err := h.i.Random(tags, guilds)
+	if err == storm.ErrNotFound {
+		return &discord.ResponseData{
+			Content: "there are no images to pick from",
+			Flags:   discord.FlagEphemeral,
+		}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &discord.ResponseData{
+		Embeds: []*discordgo.MessageEmbed{h.embed(i)},
+		Flags:  discord.FlagEphemeral,
+	}, nil
+}
+
+func (h *Handler) info(id string, guilds []string) (*discord.ResponseData, error) {
+	i, err := h.one(id, guilds)
+	if err != nil {
+		return nil, err
+	}
+
+	e := h.embed(i)
+	e.Fields = []*discordgo.MessageEmbedField{
+		{Name: "type", Value: i.Mime, Inline: true},
+		{Name: "size", Value: strconv.FormatInt(i.Size, 10) + " bytes", Inline: true},
+	}
+	if i.Width != 0 {
+		e.Fields = append(e.Fields, &discordgo.MessageEmbedField{
+			Name:   "dimensions",
+			Value:  fmt.Sprintf("%dx%d", i.Width, i.Height),
+			Inline: true,
+		})
+	}
+
+	origins, err := h.o.ForImage(i.ID)
+	if err != nil {
+		return nil, err
+	}
+	shown := 0
+	for _, o := range origins {
+		if !contains(guilds, o.GuildID) {
+			continue
+		}
+		if shown == maxOrigins {
+			break
+		}
+		shown++
+
+		e.Fields = append(e.Fields, &discordgo.MessageEmbedField{
+			Name:  "posted by " + o.Author,
+			Value: "in <#" + o.ChannelID + "> on " + o.Posted.Format("2006-01-02"),
+		})
+	}
+
+	return &discord.ResponseData{
+		Embeds: []*discordgo.MessageEmbed{e},
+	}, nil
+}
+
+// delete takes an image out of the guild asking. It is only deleted from the
+// archive when no other guild has it.
+func (h *Handler) delete(id, guildID string) (*discord.ResponseData, error) {
+	if _, err := h.one(id, []string{guildID}); err != nil {
+		return nil, err
+	}
+
+	deleted, err := h.i.RemoveGuild(id, guildID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := h.o.RemoveGuild(id, guildID); err != nil {
+		return nil, err
+	}
+
+	content := "deleted " + id
+	if !deleted {
+		content += " from this server"
+	}
+
+	return &discord.ResponseData{
+		Content: content,
+		Flags:   discord.FlagEphemeral,
+	}, nil
+}
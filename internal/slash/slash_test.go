@@ -0,0 +1,360 @@
+package slash
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Xe/kinq/internal/database"
+	"github.com/Xe/kinq/internal/discord"
+	"github.com/asdine/storm/v2"
+	"github.com/bwmarrin/discordgo"
+)
+
+type fakeImages struct {
+	database.Images
+	images map[string]*database.Image
+}
+
+func (f *fakeImages) One(id string) (*database.Image, error) {
+	i, ok := f.images[id]
+	if !ok {
+		return nil, storm.ErrNotFound
+	}
+
+	ii := *i
+	return &ii, nil
+}
+
+func (f *fakeImages) AddTags(id string, tags []string) error {
+	f.images[id].Tags = append(f.images[id].Tags, tags...)
+	return nil
+}
+
+func (f *fakeImages) RemoveTags(id string, tags []string) error {
+	var res []string
+	for _, t := range f.images[id].Tags {
+		if !contains(tags, t) {
+			res = append(res, t)
+		}
+	}
+	f.images[id].Tags = res
+	return nil
+}
+
+func (f *fakeImages) Search(numPerPage, pageNumber int, tags, guilds []string) ([]database.Image, error) {
+	var res []database.Image
+	for _, i := range f.images {
+		if !i.VisibleTo(guilds) {
+			continue
+		}
+		for _, t := range tags {
+			if contains(i.Tags, t) && !i.Deleted {
+				res = append(res, *i)
+				break
+			}
+		}
+	}
+	return res, nil
+}
+
+func (f *fakeImages) Random(tags, guilds []string) (*database.Image, error) {
+	is, _ := f.Search(1, 0, tags, guilds)
+	if len(is) == 0 {
+		return nil, storm.ErrNotFound
+	}
+	return &is[0], nil
+}
+
+func (f *fakeImages) RemoveGuild(id, guildID string) (bool, error) {
+	i := f.images[id]
+
+	var guilds []string
+	for _, g := range i.Guilds {
+		if g != guildID {
+			guilds = append(guilds, g)
+		}
+	}
+	if len(guilds) == 0 {
+		i.Deleted = true
+		return true, nil
+	}
+
+	i.Guilds = guilds
+	return false, nil
+}
+
+type fakeOrigins struct {
+	database.Origins
+	origins []database.Origin
+}
+
+func (f *fakeOrigins) RemoveGuild(imageID, guildID string) error {
+	var res []database.Origin
+	for _, o := range f.origins {
+		if o.ImageID != imageID || o.GuildID != guildID {
+			res = append(res, o)
+		}
+	}
+	f.origins = res
+	return nil
+}
+
+func (f *fakeOrigins) ForImage(imageID string) ([]database.Origin, error) {
+	var res []database.Origin
+	for _, o := range f.origins {
+		if o.ImageID == imageID {
+			res = append(res, o)
+		}
+	}
+	return res, nil
+}
+
+// event builds the raw gateway event for a /kinq subcommand.
+func event(t *testing.T, guildID string, roles []string, sub string, opts map[string]string) *discordgo.Event {
+	data := map[string]interface{}{
+		"id":       "1",
+		"type":     discord.InteractionApplicationCommand,
+		"guild_id": guildID,
+		"token":    "token",
+		"member": map[string]interface{}{
+			"user":  map[string]interface{}{"id": "42", "username": "cadey"},
+			"roles": roles,
+		},
+	}
+
+	var options []map[string]interface{}
+	for k, v := range opts {
+		options = append(options, map[string]interface{}{"name": k, "type": discord.OptionString, "value": v})
+	}
+	data["data"] = map[string]interface{}{
+		"name": "kinq",
+		"options": []map[string]interface{}{
+			{"name": sub, "type": discord.OptionSubCommand, "options": options},
+		},
+	}
+
+	raw, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &discordgo.Event{Type: discord.EventInteractionCreate, RawData: raw}
+}
+
+func TestHandle(t *testing.T) {
+	images := &fakeImages{images: map[string]*database.Image{}}
+	origins := &fakeOrigins{}
+
+	var got *discord.InteractionResponse
+	h := New(Config{
+		Guilds:      []string{"guild", "other"},
+		SiteURL:     "https://kinq.example",
+		TagRoles:    []string{"taggers"},
+		DeleteRoles: []string{"mods"},
+		ImageURL:    func(id string) string { return "https://kinq.example/img/" + id },
+	}, images, origins, func(ctx context.Context, in *discord.Interaction, r *discord.InteractionResponse) error {
+		got = r
+		return nil
+	})
+
+	reset := func() {
+		images.images = map[string]*database.Image{
+			"a": {ID: "a", Tags: []string{"cute"}, Mime: "image/png", Added: time.Now(), Guilds: []string{"guild"}},
+			"b": {ID: "b", Tags: []string{"sad"}, Mime: "image/gif", Added: time.Now(), Guilds: []string{"guild"}},
+			"c": {ID: "c", Tags: []string{"cute"}, Mime: "image/png", Added: time.Now(), Guilds: []string{"other"}},
+			"d": {ID: "d", Tags: []string{"shared"}, Mime: "image/png", Added: time.Now(), Guilds: []string{"guild", "other"}},
+		}
+		origins.origins = []database.Origin{
+			{ImageID: "a", Author: "cadey", GuildID: "guild", ChannelID: "123", Posted: time.Now()},
+			{ImageID: "d", Author: "cadey", GuildID: "guild", ChannelID: "123", Posted: time.Now()},
+			{ImageID: "d", Author: "mara", GuildID: "other", ChannelID: "456", Posted: time.Now()},
+		}
+	}
+
+	cases := []struct {
+		name      string
+		ev        *discordgo.Event
+		ephemeral bool
+		content   string
+		embeds    int
+		check     func(t *testing.T)
+	}{
+		{
+			name:      "search",
+			ev:        event(t, "guild", nil, "search", map[string]string{"query": "cute"}),
+			ephemeral: true,
+			embeds:    1,
+			check: func(t *testing.T) {
+				if u := got.Data.Embeds[0].URL; u != "https://kinq.example/images/id/a" {
+					t.Fatalf("wrong link: %s", u)
+				}
+			},
+		},
+		{
+			name:      "search without results",
+			ev:        event(t, "guild", nil, "search", map[string]string{"query": "happy"}),
+			ephemeral: true,
+			content:   "nothing is tagged",
+		},
+		{
+			name:      "unknown guild",
+			ev:        event(t, "unknown", nil, "search", map[string]string{"query": "cute"}),
+			ephemeral: true,
+			content:   ErrNotInGuild.Error(),
+		},
+		{
+			name:      "search in other guild",
+			ev:        event(t, "other", nil, "search", map[string]string{"query": "cute"}),
+			ephemeral: true,
+			embeds:    1,
+			check: func(t *testing.T) {
+				if id := got.Data.Embeds[0].Title; id != "c" {
+					t.Fatalf("wanted only image c, got: %s", id)
+				}
+			},
+		},
+		{
+			name:      "info from other guild",
+			ev:        event(t, "other", nil, "info", map[string]string{"id": "a"}),
+			ephemeral: true,
+			content:   `no image with id "a"`,
+		},
+		{
+			name:      "tag without role",
+			ev:        event(t, "guild", []string{"mods"}, "tag", map[string]string{"id": "a", "tags": "+happy"}),
+			ephemeral: true,
+			content:   ErrForbidden.Error(),
+		},
+		{
+			name:   "tag",
+			ev:     event(t, "guild", []string{"taggers"}, "tag", map[string]string{"id": "a", "tags": "+happy -cute smol"}),
+			embeds: 1,
+			check: func(t *testing.T) {
+				tags := images.images["a"].Tags
+				if len(tags) != 2 || !contains(tags, "happy") || !contains(tags, "smol") {
+					t.Fatalf("wrong tags: %v", tags)
+				}
+			},
+		},
+		{
+			name:      "tag missing image",
+			ev:        event(t, "guild", []string{"taggers"}, "tag", map[string]string{"id": "zzz", "tags": "+happy"}),
+			ephemeral: true,
+			content:   `no image with id "zzz"`,
+		},
+		{
+			name:      "random",
+			ev:        event(t, "guild", nil, "random", map[string]string{"query": "sad"}),
+			ephemeral: true,
+			embeds:    1,
+		},
+		{
+			name:   "info",
+			ev:     event(t, "guild", nil, "info", map[string]string{"id": "a"}),
+			embeds: 1,
+			check: func(t *testing.T) {
+				fields := got.Data.Embeds[0].Fields
+				if last := fields[len(fields)-1]; last.Name != "posted by cadey" {
+					t.Fatalf("origin not shown: %+v", last)
+				}
+			},
+		},
+		{
+			name:      "delete without role",
+			ev:        event(t, "guild", []string{"taggers"}, "delete", map[string]string{"id": "a"}),
+			ephemeral: true,
+			content:   ErrForbidden.Error(),
+			check: func(t *testing.T) {
+				if images.images["a"].Deleted {
+					t.Fatal("image was deleted")
+				}
+			},
+		},
+		{
+			name:      "delete",
+			ev:        event(t, "guild", []string{"mods"}, "delete", map[string]string{"id": "a"}),
+			ephemeral: true,
+			content:   "deleted a",
+			check: func(t *testing.T) {
+				if !images.images["a"].Deleted {
+					t.Fatal("image was not deleted")
+				}
+			},
+		},
+		{
+			name:      "delete shared image",
+			ev:        event(t, "guild", []string{"mods"}, "delete", map[string]string{"id": "d"}),
+			ephemeral: true,
+			content:   "deleted d from this server",
+			check: func(t *testing.T) {
+				d := images.images["d"]
+				if d.Deleted || d.VisibleTo([]string{"guild"}) || !d.VisibleTo([]string{"other"}) {
+					t.Fatalf("wanted d only taken out of guild, got: %+v", d)
+				}
+				left, _ := origins.ForImage("d")
+				if len(left) != 1 || left[0].GuildID != "other" {
+					t.Fatalf("wanted only the origin in other left, got: %+v", left)
+				}
+			},
+		},
+	}
+
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			reset()
+			got = nil
+
+			in, err := discord.ParseInteraction(cs.ev)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = h.Handle(context.Background(), in)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got == nil || got.Data == nil {
+				t.Fatal("no response was sent")
+			}
+
+			if ephemeral := got.Data.Flags&discord.FlagEphemeral != 0; ephemeral != cs.ephemeral {
+				t.Errorf("wanted ephemeral %v, got: %v", cs.ephemeral, ephemeral)
+			}
+
+			if !strings.Contains(got.Data.Content, cs.content) {
+				t.Errorf("wanted content containing %q, got: %q", cs.content, got.Data.Content)
+			}
+
+			if len(got.Data.Embeds) != cs.embeds {
+				t.Errorf("wanted %d embeds, got: %d", cs.embeds, len(got.Data.Embeds))
+			}
+
+			if cs.check != nil {
+				cs.check(t)
+			}
+		})
+	}
+
+	t.Run("ping", func(t *testing.T) {
+		got = nil
+		err := h.Handle(context.Background(), &discord.Interaction{Type: discord.InteractionPing})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got == nil || got.Type != discord.ResponsePong {
+			t.Fatalf("wanted a pong, got: %+v", got)
+		}
+	})
+}
+
+func TestParseTagChanges(t *testing.T) {
+	add, remove := ParseTagChanges([]string{"+a", "-b", "c", "+", "-"})
+	if strings.Join(add, ",") != "a,c" || strings.Join(remove, ",") != "b" {
+		t.Fatalf("wrong changes: add %v remove %v", add, remove)
+	}
+}
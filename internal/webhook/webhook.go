@@ -0,0 +1,480 @@
+// Package webhook POSTs archive events as signed JSON to URLs registered by
+// admins. Deliveries are stored in the database and retried until they
+// succeed or run out of attempts.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Xe/kinq/internal/events"
+	"github.com/asdine/storm/v2"
+	"github.com/asdine/storm/v2/q"
+	"github.com/celrenheit/sandflake"
+	"within.website/ln"
+	"within.website/ln/opname"
+)
+
+// Hook is a URL events are sent to.
+type Hook struct {
+	ID        string `storm:"id"`
+	URL       string
+	Secret    string
+	Kinds     []events.Kind // if empty, every kind is sent
+	Created   time.Time     `storm:"index"`
+	CreatedBy string
+}
+
+func (h Hook) F() ln.F {
+	return ln.F{
+		"hook_id":  h.ID,
+		"hook_url": h.URL,
+	}
+}
+
+// Wants returns true if events of kind k are sent to h.
+func (h Hook) Wants(k events.Kind) bool {
+	if len(h.Kinds) == 0 {
+		return true
+	}
+
+	for _, kk := range h.Kinds {
+		if kk == k {
+			return true
+		}
+	}
+
+	return false
+}
+
+type Status string
+
+const (
+	StatusPending   Status = "pending"
+	StatusDelivered Status = "delivered"
+	StatusFailed    Status = "failed"
+)
+
+// Delivery is one event being sent to one hook.
+type Delivery struct {
+	ID           string `storm:"id"`
+	HookID       string `storm:"index"`
+	EventID      string
+	Kind         events.Kind
+	Payload      []byte
+	Status       Status `storm:"index"`
+	Attempts     int
+	NextAttempt  time.Time
+	LastError    string
+	ResponseCode int
+	Created      time.Time `storm:"index"`
+	Updated      time.Time
+}
+
+func (d Delivery) F() ln.F {
+	return ln.F{
+		"delivery_id":       d.ID,
+		"delivery_status":   d.Status,
+		"delivery_attempts": d.Attempts,
+		"hook_id":           d.HookID,
+		"event_id":          d.EventID,
+		"event_kind":        d.Kind,
+	}
+}
+
+// Payload is the JSON body of a delivery.
+type Payload struct {
+	ID      string            `json:"id"`
+	Type    events.Kind       `json:"type"`
+	Time    time.Time         `json:"time"`
+	Summary string            `json:"summary"`
+	Data    map[string]string `json:"data"`
+}
+
+// Sign returns the signature of a delivery, sent in the X-Kinq-Signature
+// header. Receivers compute the same over the X-Kinq-Timestamp header and
+// the body and compare.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewSecret returns a random hook secret.
+func NewSecret() (string, error) {
+	buf := make([]byte, 32)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
+
+// Config controls how deliveries are sent.
+type Config struct {
+	MaxAttempts int           // attempts before a delivery fails for good
+	Backoff     time.Duration // wait after the first failed attempt, doubled each time after
+	Timeout     time.Duration // how long a hook has to answer
+	Retention   time.Duration // how long finished deliveries are kept, forever if zero
+
+	// Control is called before connecting to a hook and can refuse the
+	// address, see database.Fetcher.DialControl.
+	Control func(network, address string, c syscall.RawConn) error
+}
+
+// pruneInterval is how often finished deliveries past Retention are removed.
+const pruneInterval = time.Hour
+
+// Dispatcher stores hooks and deliveries and sends the deliveries.
+type Dispatcher struct {
+	db     *storm.DB
+	cfg    Config
+	client *http.Client
+	g      sandflake.Generator
+	wake   chan struct{}
+
+	// busy holds the hooks deliveries are being sent to, so a slow hook
+	// only holds up its own deliveries.
+	lock sync.Mutex
+	busy map[string]bool
+}
+
+func New(db *storm.DB, cfg Config) *Dispatcher {
+	dialer := &net.Dialer{
+		Timeout: cfg.Timeout,
+		Control: cfg.Control,
+	}
+
+	return &Dispatcher{
+		db:  db,
+		cfg: cfg,
+		client: &http.Client{
+			Timeout: cfg.Timeout,
+			Transport: &http.Transport{
+				// no proxy, it would connect to refused addresses for us
+				Proxy:               nil,
+				DialContext:         dialer.DialContext,
+				TLSHandshakeTimeout: cfg.Timeout,
+				MaxIdleConns:        10,
+				IdleConnTimeout:     90 * time.Second,
+			},
+			// hooks answer themselves, redirects count as failures
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		wake: make(chan struct{}, 1),
+		busy: map[string]bool{},
+	}
+}
+
+func (d *Dispatcher) Hooks() ([]Hook, error) {
+	var hooks []Hook
+	err := d.db.AllByIndex("Created", &hooks)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	return hooks, nil
+}
+
+func (d *Dispatcher) Hook(id string) (*Hook, error) {
+	var h Hook
+	err := d.db.One("ID", id, &h)
+	if err != nil {
+		return nil, err
+	}
+
+	return &h, nil
+}
+
+// AddHook registers h, making a secret for it if it has none.
+func (d *Dispatcher) AddHook(h *Hook) error {
+	if h.Secret == "" {
+		secret, err := NewSecret()
+		if err != nil {
+			return err
+		}
+		h.Secret = secret
+	}
+
+	h.ID = d.g.Next().String()
+	h.Created = time.Now()
+
+	return d.db.Save(h)
+}
+
+// DeleteHook removes a hook. Its pending deliveries fail when they come up.
+func (d *Dispatcher) DeleteHook(id string) error {
+	return d.db.DeleteStruct(&Hook{ID: id})
+}
+
+// Deliveries returns the newest deliveries to a hook.
+func (d *Dispatcher) Deliveries(hookID string, limit int) ([]Delivery, error) {
+	var ds []Delivery
+	err := d.db.Select(q.Eq("HookID", hookID)).OrderBy("Created").Reverse().Limit(limit).Find(&ds)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+
+	return ds, nil
+}
+
+// Publish stores a delivery of e for every hook that wants it. It is meant
+// to be subscribed to an events.Bus.
+func (d *Dispatcher) Publish(e events.Event) {
+	ctx := opname.With(context.Background(), "webhook.Dispatcher.Publish")
+
+	hooks, err := d.Hooks()
+	if err != nil {
+		ln.Error(ctx, err, e, ln.Action("listing hooks"))
+		return
+	}
+
+	body, err := json.Marshal(Payload{
+		ID:      e.ID,
+		Type:    e.Kind,
+		Time:    e.Time,
+		Summary: e.Summary,
+		Data:    e.Fields,
+	})
+	if err != nil {
+		ln.Error(ctx, err, e)
+		return
+	}
+
+	now := time.Now()
+	for _, h := range hooks {
+		if !h.Wants(e.Kind) {
+			continue
+		}
+
+		dl := Delivery{
+			ID:          d.g.Next().String(),
+			HookID:      h.ID,
+			EventID:     e.ID,
+			Kind:        e.Kind,
+			Payload:     body,
+			Status:      StatusPending,
+			NextAttempt: now,
+			Created:     now,
+			Updated:     now,
+		}
+
+		err = d.db.Save(&dl)
+		if err != nil {
+			ln.Error(ctx, err, h, dl, ln.Action("storing delivery"))
+		}
+	}
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run sends deliveries as they come due until ctx is cancelled. Every hook
+// gets its deliveries in order, and hooks are sent to concurrently.
+func (d *Dispatcher) Run(ctx context.Context) {
+	ctx = opname.With(ctx, "webhook.Dispatcher.Run")
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+
+	d.prune(ctx)
+	pt := time.NewTicker(pruneInterval)
+	defer pt.Stop()
+
+	for {
+		for hookID, dls := range byHook(d.due(ctx)) {
+			if !d.claim(hookID) {
+				continue
+			}
+
+			wg.Add(1)
+			go func(hookID string, dls []Delivery) {
+				defer wg.Done()
+				defer d.release(hookID)
+
+				for _, dl := range dls {
+					if ctx.Err() != nil {
+						return
+					}
+					d.attempt(ctx, dl)
+				}
+			}(hookID, dls)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.wake:
+		case <-t.C:
+		case <-pt.C:
+			d.prune(ctx)
+		}
+	}
+}
+
+// byHook groups deliveries by their hook, keeping their order.
+func byHook(dls []Delivery) map[string][]Delivery {
+	result := map[string][]Delivery{}
+	for _, dl := range dls {
+		result[dl.HookID] = append(result[dl.HookID], dl)
+	}
+
+	return result
+}
+
+// claim marks a hook as being sent to, returning false if it already is.
+func (d *Dispatcher) claim(hookID string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.busy[hookID] {
+		return false
+	}
+	d.busy[hookID] = true
+
+	return true
+}
+
+func (d *Dispatcher) release(hookID string) {
+	d.lock.Lock()
+	delete(d.busy, hookID)
+	d.lock.Unlock()
+
+	// deliveries to the hook may have come due while it was busy
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// prune removes finished deliveries older than Retention.
+func (d *Dispatcher) prune(ctx context.Context) {
+	if d.cfg.Retention <= 0 {
+		return
+	}
+
+	cutoff := time.Now().Add(-d.cfg.Retention)
+	err := d.db.Select(
+		q.In("Status", []Status{StatusDelivered, StatusFailed}),
+		q.Lt("Created", cutoff),
+	).Delete(new(Delivery))
+	if err != nil && err != storm.ErrNotFound {
+		ln.Error(ctx, err, ln.Action("pruning webhook deliveries"))
+	}
+}
+
+func (d *Dispatcher) due(ctx context.Context) []Delivery {
+	var pending []Delivery
+	err := d.db.Select(q.Eq("Status", StatusPending), q.Lte("NextAttempt", time.Now())).OrderBy("Created").Find(&pending)
+	if err != nil && err != storm.ErrNotFound {
+		ln.Error(ctx, err, ln.Action("finding due deliveries"))
+	}
+
+	return pending
+}
+
+func (d *Dispatcher) attempt(ctx context.Context, dl Delivery) {
+	h, err := d.Hook(dl.HookID)
+	if err == storm.ErrNotFound {
+		err = fmt.Errorf("webhook: hook %s was deleted", dl.HookID)
+		dl.Attempts = d.cfg.MaxAttempts
+	} else if err == nil {
+		dl.Attempts++
+		dl.ResponseCode, err = d.send(ctx, h, dl)
+	}
+
+	dl.Updated = time.Now()
+	switch {
+	case err == nil:
+		dl.Status = StatusDelivered
+		dl.LastError = ""
+	case dl.Attempts >= d.cfg.MaxAttempts:
+		dl.Status = StatusFailed
+		dl.LastError = err.Error()
+	default:
+		dl.LastError = err.Error()
+		dl.NextAttempt = dl.Updated.Add(backoff(d.cfg.Backoff, dl.Attempts))
+	}
+
+	if serr := d.db.Save(&dl); serr != nil {
+		ln.Error(ctx, serr, dl, ln.Action("saving delivery"))
+	}
+
+	switch dl.Status {
+	case StatusDelivered:
+		ln.Log(ctx, dl, ln.Action("delivered webhook"))
+	case StatusFailed:
+		ln.Error(ctx, err, dl, ln.Action("giving up on webhook delivery"))
+	default:
+		ln.Error(ctx, err, dl, ln.Action("will retry webhook delivery"), ln.F{"next_attempt": dl.NextAttempt})
+	}
+}
+
+// send POSTs a delivery to its hook, returning the response status code.
+// Anything but a 2xx response is an error.
+func (d *Dispatcher) send(ctx context.Context, h *Hook, dl Delivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, h.URL, bytes.NewReader(dl.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+
+	ts := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "kinq-webhook")
+	req.Header.Set("X-Kinq-Event", string(dl.Kind))
+	req.Header.Set("X-Kinq-Delivery", dl.ID)
+	req.Header.Set("X-Kinq-Timestamp", strconv.FormatInt(ts, 10))
+	req.Header.Set("X-Kinq-Signature", Sign(h.Secret, ts, dl.Payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode, fmt.Errorf("webhook: %s answered %s", h.URL, resp.Status)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// backoff returns how long to wait before retrying a delivery that has
+// failed attempts times.
+func backoff(base time.Duration, attempts int) time.Duration {
+	const max = 6 * time.Hour
+
+	d := base
+	for i := 1; i < attempts; i++ {
+		d *= 2
+		if d >= max {
+			return max
+		}
+	}
+
+	return d
+}
@@ -0,0 +1,253 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Xe/kinq/internal/events"
+	"github.com/asdine/storm/v2"
+)
+
+func TestSend(t *testing.T) {
+	const secret = "hunter2"
+	body := []byte(`{"id":"1","type":"image.created"}`)
+
+	var status int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ := ioutil.ReadAll(r.Body)
+		ts, _ := strconv.ParseInt(r.Header.Get("X-Kinq-Timestamp"), 10, 64)
+
+		if r.Header.Get("X-Kinq-Signature") != Sign(secret, ts, got) {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get("X-Kinq-Event") != "image.created" {
+			http.Error(w, "wrong event", http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	d := New(nil, Config{Timeout: time.Second})
+	h := &Hook{URL: srv.URL, Secret: secret}
+	dl := Delivery{ID: "d", Kind: events.ImageCreated, Payload: body}
+
+	status = http.StatusNoContent
+	code, err := d.send(context.Background(), h, dl)
+	if err != nil || code != http.StatusNoContent {
+		t.Fatalf("wanted a delivery, got %d: %v", code, err)
+	}
+
+	status = http.StatusInternalServerError
+	code, err = d.send(context.Background(), h, dl)
+	if err == nil || code != http.StatusInternalServerError {
+		t.Fatalf("wanted an error for a 500, got %d: %v", code, err)
+	}
+
+	h.Secret = "wrong"
+	code, err = d.send(context.Background(), h, dl)
+	if err == nil || code != http.StatusUnauthorized {
+		t.Fatalf("wanted the signature to be rejected, got %d: %v", code, err)
+	}
+}
+
+func TestWants(t *testing.T) {
+	all := Hook{}
+	some := Hook{Kinds: []events.Kind{events.ImageDeleted}}
+
+	if !all.Wants(events.ImageCreated) {
+		t.Error("hook without kinds should want everything")
+	}
+	if some.Wants(events.ImageCreated) || !some.Wants(events.ImageDeleted) {
+		t.Error("hook with kinds wants the wrong ones")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	if d := backoff(time.Minute, 3); d != 4*time.Minute {
+		t.Errorf("wrong backoff: %v", d)
+	}
+	if d := backoff(time.Minute, 100); d != 6*time.Hour {
+		t.Errorf("backoff not capped: %v", d)
+	}
+}
+
+func openTestDB(t *testing.T) *storm.DB {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "kinq-webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := storm.Open(filepath.Join(dir, "kinq.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		db.Close()
+		os.RemoveAll(dir)
+	})
+
+	return db
+}
+
+func TestAttempt(t *testing.T) {
+	ctx := context.Background()
+
+	fail := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			http.Error(w, "down", http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	db := openTestDB(t)
+	d := New(db, Config{MaxAttempts: 3, Backoff: time.Minute, Timeout: time.Second})
+
+	h := &Hook{URL: srv.URL}
+	if err := d.AddHook(h); err != nil {
+		t.Fatal(err)
+	}
+
+	d.Publish(events.Event{ID: "e1", Kind: events.ImageCreated, Time: time.Now()})
+
+	due := d.due(ctx)
+	if len(due) != 1 {
+		t.Fatalf("%d deliveries due, want 1", len(due))
+	}
+	dl := due[0]
+
+	load := func() Delivery {
+		t.Helper()
+
+		var got Delivery
+		if err := db.One("ID", dl.ID, &got); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	// a failed attempt is retried after the backoff
+	d.attempt(ctx, dl)
+	got := load()
+	if got.Status != StatusPending || got.Attempts != 1 || got.ResponseCode != http.StatusBadGateway || got.LastError == "" {
+		t.Errorf("after a failed attempt: %+v", got)
+	}
+	if wait := got.NextAttempt.Sub(got.Updated); wait != time.Minute {
+		t.Errorf("retry in %v, want %v", wait, time.Minute)
+	}
+	if len(d.due(ctx)) != 0 {
+		t.Error("delivery is due again before its backoff")
+	}
+
+	// and gives up after MaxAttempts
+	d.attempt(ctx, got)
+	got = load()
+	if wait := got.NextAttempt.Sub(got.Updated); got.Attempts != 2 || wait != 2*time.Minute {
+		t.Errorf("second retry after %d attempts in %v, want 2 in %v", got.Attempts, wait, 2*time.Minute)
+	}
+	d.attempt(ctx, got)
+	got = load()
+	if got.Status != StatusFailed || got.Attempts != 3 {
+		t.Errorf("after %d attempts: status %s, want %s", got.Attempts, got.Status, StatusFailed)
+	}
+
+	// a hook that answers is delivered to
+	fail = false
+	d.Publish(events.Event{ID: "e2", Kind: events.ImageCreated, Time: time.Now()})
+	due = d.due(ctx)
+	if len(due) != 1 {
+		t.Fatalf("%d deliveries due, want 1", len(due))
+	}
+	dl = due[0]
+	d.attempt(ctx, dl)
+	if got = load(); got.Status != StatusDelivered || got.LastError != "" || got.ResponseCode != http.StatusOK {
+		t.Errorf("after a good attempt: %+v", got)
+	}
+
+	// deliveries to deleted hooks fail without being sent
+	d.Publish(events.Event{ID: "e3", Kind: events.ImageCreated, Time: time.Now()})
+	if err := d.DeleteHook(h.ID); err != nil {
+		t.Fatal(err)
+	}
+	due = d.due(ctx)
+	if len(due) != 1 {
+		t.Fatalf("%d deliveries due, want 1", len(due))
+	}
+	dl = due[0]
+	d.attempt(ctx, dl)
+	if got = load(); got.Status != StatusFailed || got.ResponseCode != 0 {
+		t.Errorf("delivery to a deleted hook: %+v", got)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	db := openTestDB(t)
+	d := New(db, Config{Retention: time.Hour})
+
+	old := time.Now().Add(-2 * time.Hour)
+	for _, dl := range []Delivery{
+		{ID: "old-delivered", Status: StatusDelivered, Created: old},
+		{ID: "old-failed", Status: StatusFailed, Created: old},
+		{ID: "old-pending", Status: StatusPending, Created: old},
+		{ID: "new-delivered", Status: StatusDelivered, Created: time.Now()},
+	} {
+		dl := dl
+		if err := db.Save(&dl); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d.prune(context.Background())
+
+	var left []Delivery
+	if err := db.All(&left); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, dl := range left {
+		ids = append(ids, dl.ID)
+	}
+	sort.Strings(ids)
+	if want := []string{"new-delivered", "old-pending"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("kept %v, want %v", ids, want)
+	}
+}
+
+func TestControl(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	refuse := errors.New("refused")
+	d := New(nil, Config{
+		Timeout: time.Second,
+		Control: func(network, address string, c syscall.RawConn) error { return refuse },
+	})
+
+	_, err := d.send(context.Background(), &Hook{URL: srv.URL}, Delivery{})
+	if err == nil || !strings.Contains(err.Error(), refuse.Error()) {
+		t.Errorf("sent to a refused address: %v", err)
+	}
+}